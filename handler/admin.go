@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/hawell/logger"
+	"github.com/miekg/dns"
+)
+
+// authorized checks request's bearer token against admin_token, admin endpoints are disabled without a token
+func (h *DnsRequestHandler) authorized(r *http.Request) bool {
+	if h.Config.AdminToken == "" {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(h.Config.AdminToken)) == 1
+}
+
+// ServeCacheFlush flushes cached zones and locations, only those of zone query parameter if given
+func (h *DnsRequestHandler) ServeCacheFlush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	h.FlushCache(r.URL.Query().Get("zone"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// FlushCache drops cached zones and locations so they are read again from backend on next request,
+// only entries of zone are dropped if zone is not empty
+func (h *DnsRequestHandler) FlushCache(zone string) {
+	if zone == "" {
+		logger.Default.Info("flushing all caches")
+		h.ZoneCache.Clear()
+		h.RecordCache.Clear()
+		return
+	}
+	zone = dns.Fqdn(strings.ToLower(zone))
+	logger.Default.Infof("flushing cache of zone %s", zone)
+	// locations removed from backend are still in cached zone
+	var locations []string
+	if cachedZone, found := h.ZoneCache.Get(zone); found && cachedZone != nil {
+		for location := range cachedZone.(*Zone).Locations {
+			locations = append(locations, location)
+		}
+	}
+	if keys, err := h.Backend.GetHKeys("redins:zones:" + zone); err == nil {
+		locations = append(locations, keys...)
+	} else {
+		logger.Default.Errorf("cannot load zone %s locations : %s", zone, err)
+	}
+	h.ZoneCache.Del(zone)
+	h.RecordCache.Del(zone + "." + zone)
+	for _, location := range locations {
+		h.RecordCache.Del(location + "." + zone)
+	}
+}
+
+// ServeReady answers 200 once zones are loaded and 503 before that, it needs no token
+func (h *DnsRequestHandler) ServeReady(w http.ResponseWriter, r *http.Request) {
+	if !h.Ready() {
+		http.Error(w, "zones not loaded", http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"arvancloud/redins/test"
+	"fmt"
+	"github.com/hawell/logger"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCacheFlush(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := NewMemoryBackend()
+	_ = backend.SAdd("redins:zones", "flush.com.")
+	_ = backend.SAdd("redins:zones", "other.com.")
+	_ = backend.HSet("redins:zones:flush.com.", "www", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`)
+	_ = backend.HSet("redins:zones:other.com.", "www", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`)
+	cfg := defaultConfig
+	cfg.CacheTimeout = 3600
+	cfg.AdminToken = "secret"
+	h := NewHandlerWithBackend(&cfg, backend)
+
+	query := func(qname string) string {
+		tc := test.Case{Qname: qname, Qtype: dns.TypeA}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, tc.Msg()))
+		h.RecordCache.Wait()
+		h.ZoneCache.Wait()
+		if len(w.Msg.Answer) != 1 {
+			return ""
+		}
+		return w.Msg.Answer[0].(*dns.A).A.String()
+	}
+	flush := func(url string, token string) int {
+		req, _ := http.NewRequest(http.MethodPost, url, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeCacheFlush(w, req)
+		return w.Code
+	}
+
+	query("www.flush.com.")
+	query("www.other.com.")
+	_ = backend.HSet("redins:zones:flush.com.", "www", `{"a":{"ttl":300, "records":[{"ip":"5.6.7.8"}]}}`)
+	_ = backend.HSet("redins:zones:other.com.", "www", `{"a":{"ttl":300, "records":[{"ip":"5.6.7.8"}]}}`)
+	if ip := query("www.flush.com."); ip != "1.2.3.4" {
+		fmt.Println("location should be served from cache : ", ip)
+		t.Fail()
+	}
+
+	if code := flush("/cache/flush", ""); code != http.StatusUnauthorized {
+		fmt.Println("flush without token should be rejected : ", code)
+		t.Fail()
+	}
+	if code := flush("/cache/flush", "wrong"); code != http.StatusUnauthorized {
+		fmt.Println("flush with wrong token should be rejected : ", code)
+		t.Fail()
+	}
+	req, _ := http.NewRequest(http.MethodGet, "/cache/flush", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	h.ServeCacheFlush(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		fmt.Println("flush should only accept POST : ", w.Code)
+		t.Fail()
+	}
+	if ip := query("www.flush.com."); ip != "1.2.3.4" {
+		fmt.Println("rejected flush should not drop cache : ", ip)
+		t.Fail()
+	}
+
+	if code := flush("/cache/flush?zone=flush.com", "secret"); code != http.StatusNoContent {
+		fmt.Println("zone flush failed : ", code)
+		t.Fail()
+	}
+	if ip := query("www.flush.com."); ip != "5.6.7.8" {
+		fmt.Println("flushed location should be read from backend : ", ip)
+		t.Fail()
+	}
+	if ip := query("www.other.com."); ip != "1.2.3.4" {
+		fmt.Println("zone flush should not drop other zones : ", ip)
+		t.Fail()
+	}
+
+	if code := flush("/cache/flush", "secret"); code != http.StatusNoContent {
+		fmt.Println("flush failed : ", code)
+		t.Fail()
+	}
+	if ip := query("www.other.com."); ip != "5.6.7.8" {
+		fmt.Println("flush should drop all zones : ", ip)
+		t.Fail()
+	}
+
+	cfg.AdminToken = ""
+	if code := flush("/cache/flush", ""); code != http.StatusUnauthorized {
+		fmt.Println("flush should be disabled without admin token : ", code)
+		t.Fail()
+	}
+}
@@ -0,0 +1,311 @@
+package handler
+
+import (
+	"errors"
+	"github.com/json-iterator/go"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Backend is the storage handler reads zones and records from, *RedisBackend is the default implementation
+type Backend interface {
+	Get(key string) (string, error)
+	Set(key string, value string) error
+	Del(pattern string) error
+	GetKeys(pattern string) ([]string, error)
+	HGet(key string, hkey string) (string, error)
+	HSet(key string, hkey string, value string) error
+	GetHKeys(key string) ([]string, error)
+	SAdd(set string, member string) error
+	SRem(set string, member string) error
+	SMembers(set string) ([]string, error)
+	SubscribeEvent(pattern string, onStart func(), onMessage func(channel string, data string), onError func(err error), quit chan *sync.WaitGroup)
+}
+
+// Incrementer is implemented by backends with atomic counters, needed by "shared" serial format
+type Incrementer interface {
+	// IncrIfChanged increments counter at key and saves marker at markerKey in one atomic step, unless
+	// markerKey already holds marker. it returns counter's value
+	IncrIfChanged(key string, markerKey string, marker string) (int64, error)
+}
+
+var errIncrNotSupported = errors.New("backend does not support incr")
+
+// Locker is implemented by backends with expiring locks, needed by zsk rollover on a backend shared by instances
+type Locker interface {
+	// Lock sets key to token if key is not already locked, lock expires after ttl. returns true if lock is acquired
+	Lock(key string, token string, ttl time.Duration) (bool, error)
+	// Unlock releases key if it is still locked by token
+	Unlock(key string, token string) error
+}
+
+var errLockNotSupported = errors.New("backend does not support lock")
+
+// MemoryBackend is an in-memory Backend, mostly useful for testing
+type MemoryBackend struct {
+	lock        sync.RWMutex
+	values      map[string]string
+	hashes      map[string]map[string]string
+	sets        map[string]map[string]struct{}
+	subscribers map[int]memorySubscriber
+	nextId      int
+	locks       map[string]memoryLock
+}
+
+type MemoryBackendConfig struct {
+	ZonesFile string                      `json:"zones_file"`
+	Zones     map[string]MemoryZoneConfig `json:"zones,omitempty"`
+}
+
+type MemoryZoneConfig struct {
+	Config    jsoniter.RawMessage            `json:"config,omitempty"`
+	Locations map[string]jsoniter.RawMessage `json:"locations"`
+}
+
+type memoryLock struct {
+	token  string
+	expire time.Time
+}
+
+type memorySubscriber struct {
+	pattern   string
+	onMessage func(channel string, data string)
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		values:      make(map[string]string),
+		hashes:      make(map[string]map[string]string),
+		sets:        make(map[string]map[string]struct{}),
+		subscribers: make(map[int]memorySubscriber),
+		locks:       make(map[string]memoryLock),
+	}
+}
+
+// NewMemoryBackendFromConfig creates a MemoryBackend holding zones from config.Zones and config.ZonesFile
+func NewMemoryBackendFromConfig(config *MemoryBackendConfig) (*MemoryBackend, error) {
+	m := NewMemoryBackend()
+	if err := m.LoadZones(config.Zones); err != nil {
+		return nil, err
+	}
+	if config.ZonesFile != "" {
+		data, err := ioutil.ReadFile(config.ZonesFile)
+		if err != nil {
+			return nil, err
+		}
+		var zones map[string]MemoryZoneConfig
+		if err := jsoniter.Unmarshal(data, &zones); err != nil {
+			return nil, err
+		}
+		if err := m.LoadZones(zones); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// LoadZones stores zones with the same key layout used in redis
+func (m *MemoryBackend) LoadZones(zones map[string]MemoryZoneConfig) error {
+	for name, zone := range zones {
+		if err := m.SAdd("redins:zones", name); err != nil {
+			return err
+		}
+		for label, location := range zone.Locations {
+			if err := m.HSet("redins:zones:"+name, label, string(location)); err != nil {
+				return err
+			}
+		}
+		if err := m.Set("redins:zones:"+name+":config", string(zone.Config)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MemoryBackend) Get(key string) (string, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.values[key], nil
+}
+
+func (m *MemoryBackend) Set(key string, value string) error {
+	m.lock.Lock()
+	m.values[key] = value
+	m.lock.Unlock()
+	m.notify(key, "set")
+	return nil
+}
+
+func (m *MemoryBackend) IncrIfChanged(key string, markerKey string, marker string) (int64, error) {
+	m.lock.Lock()
+	if m.values[markerKey] == marker && m.values[key] != "" {
+		value, err := strconv.ParseInt(m.values[key], 10, 64)
+		m.lock.Unlock()
+		return value, err
+	}
+	value := int64(0)
+	if m.values[key] != "" {
+		var err error
+		if value, err = strconv.ParseInt(m.values[key], 10, 64); err != nil {
+			m.lock.Unlock()
+			return 0, err
+		}
+	}
+	value++
+	m.values[key] = strconv.FormatInt(value, 10)
+	m.values[markerKey] = marker
+	m.lock.Unlock()
+	m.notify(key, "incrby")
+	m.notify(markerKey, "set")
+	return value, nil
+}
+
+func (m *MemoryBackend) Lock(key string, token string, ttl time.Duration) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	if lock, ok := m.locks[key]; ok && now.Before(lock.expire) {
+		return false, nil
+	}
+	m.locks[key] = memoryLock{token: token, expire: now.Add(ttl)}
+	return true, nil
+}
+
+func (m *MemoryBackend) Unlock(key string, token string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.locks[key].token == token {
+		delete(m.locks, key)
+	}
+	return nil
+}
+
+func (m *MemoryBackend) Del(pattern string) error {
+	keys, _ := m.GetKeys(pattern)
+	m.lock.Lock()
+	for _, key := range keys {
+		delete(m.values, key)
+		delete(m.hashes, key)
+		delete(m.sets, key)
+	}
+	m.lock.Unlock()
+	for _, key := range keys {
+		m.notify(key, "del")
+	}
+	return nil
+}
+
+func (m *MemoryBackend) GetKeys(pattern string) ([]string, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var keys []string
+	add := func(key string) {
+		if match, _ := path.Match(pattern, key); match {
+			keys = append(keys, key)
+		}
+	}
+	for key := range m.values {
+		add(key)
+	}
+	for key := range m.hashes {
+		add(key)
+	}
+	for key := range m.sets {
+		add(key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (m *MemoryBackend) HGet(key string, hkey string) (string, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.hashes[key][hkey], nil
+}
+
+func (m *MemoryBackend) HSet(key string, hkey string, value string) error {
+	m.lock.Lock()
+	if _, ok := m.hashes[key]; !ok {
+		m.hashes[key] = make(map[string]string)
+	}
+	m.hashes[key][hkey] = value
+	m.lock.Unlock()
+	m.notify(key, "hset")
+	return nil
+}
+
+func (m *MemoryBackend) GetHKeys(key string) ([]string, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var hkeys []string
+	for hkey := range m.hashes[key] {
+		hkeys = append(hkeys, hkey)
+	}
+	sort.Strings(hkeys)
+	return hkeys, nil
+}
+
+func (m *MemoryBackend) SAdd(set string, member string) error {
+	m.lock.Lock()
+	if _, ok := m.sets[set]; !ok {
+		m.sets[set] = make(map[string]struct{})
+	}
+	m.sets[set][member] = struct{}{}
+	m.lock.Unlock()
+	m.notify(set, "sadd")
+	return nil
+}
+
+func (m *MemoryBackend) SRem(set string, member string) error {
+	m.lock.Lock()
+	delete(m.sets[set], member)
+	m.lock.Unlock()
+	m.notify(set, "srem")
+	return nil
+}
+
+func (m *MemoryBackend) SMembers(set string) ([]string, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var members []string
+	for member := range m.sets[set] {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+// SubscribeEvent calls onMessage for every change on keys matching pattern until quit is signaled
+func (m *MemoryBackend) SubscribeEvent(pattern string, onStart func(), onMessage func(channel string, data string), onError func(err error), quit chan *sync.WaitGroup) {
+	m.lock.Lock()
+	id := m.nextId
+	m.nextId++
+	m.subscribers[id] = memorySubscriber{pattern: pattern, onMessage: onMessage}
+	m.lock.Unlock()
+
+	onStart()
+	wg := <-quit
+
+	m.lock.Lock()
+	delete(m.subscribers, id)
+	m.lock.Unlock()
+	wg.Done()
+}
+
+func (m *MemoryBackend) notify(key string, event string) {
+	m.lock.RLock()
+	var matched []func(channel string, data string)
+	for _, s := range m.subscribers {
+		if match, _ := path.Match(s.pattern, key); match {
+			matched = append(matched, s.onMessage)
+		}
+	}
+	m.lock.RUnlock()
+	for _, onMessage := range matched {
+		onMessage(key, event)
+	}
+}
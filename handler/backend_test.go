@@ -0,0 +1,529 @@
+package handler
+
+import (
+	"arvancloud/redins/test"
+	"errors"
+	"fmt"
+	"github.com/hawell/logger"
+	"github.com/json-iterator/go"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryBackend(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+
+	zonesFile, err := ioutil.TempFile("", "redins_zones")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(zonesFile.Name())
+	_, _ = zonesFile.WriteString(`{
+		"memoryfile.com.": {
+			"locations": {
+				"www": {"aaaa":{"ttl":300, "records":[{"ip":"::1"}]}}
+			}
+		}
+	}`)
+	_ = zonesFile.Close()
+
+	config := defaultConfig
+	config.Backend = "memory"
+	config.Memory = MemoryBackendConfig{
+		ZonesFile: zonesFile.Name(),
+		Zones: map[string]MemoryZoneConfig{
+			"memory.com.": {
+				Config: jsoniter.RawMessage(`{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.memory.com.","ns":"ns1.memory.com.","refresh":44,"retry":55,"expire":66}}`),
+				Locations: map[string]jsoniter.RawMessage{
+					"www": jsoniter.RawMessage(`{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`),
+					"mx":  jsoniter.RawMessage(`{"mx":{"ttl":300, "records":[{"host":"mx.memory.com.", "preference":10}]}}`),
+				},
+			},
+		},
+	}
+	h := NewHandler(&config)
+
+	backend, ok := h.Backend.(*MemoryBackend)
+	if !ok {
+		fmt.Println("memory backend not used")
+		t.FailNow()
+	}
+	keys, _ := backend.GetKeys("redins:zones:*")
+	if len(keys) != 4 {
+		fmt.Println("unexpected keys : ", keys)
+		t.Fail()
+	}
+	hkeys, _ := backend.GetHKeys("redins:zones:memory.com.")
+	if len(hkeys) != 2 || hkeys[0] != "mx" || hkeys[1] != "www" {
+		fmt.Println("unexpected hkeys : ", hkeys)
+		t.Fail()
+	}
+
+	testCase := &TestCase{
+		TestCases: []test.Case{
+			{
+				Qname: "www.memory.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("www.memory.com. 300 IN A 1.2.3.4"),
+				},
+			},
+			{
+				Qname: "mx.memory.com.", Qtype: dns.TypeMX,
+				Answer: []dns.RR{
+					test.MX("mx.memory.com. 300 IN MX 10 mx.memory.com."),
+				},
+			},
+			{
+				Qname: "www.memoryfile.com.", Qtype: dns.TypeAAAA,
+				Answer: []dns.RR{
+					test.AAAA("www.memoryfile.com. 300 IN AAAA ::1"),
+				},
+			},
+		},
+	}
+	defaultApplyAndVerify(testCase, h, t)
+}
+
+type failingBackend struct {
+	*MemoryBackend
+	fail bool
+}
+
+func (b *failingBackend) Get(key string) (string, error) {
+	if b.fail {
+		return "", errors.New("connection refused")
+	}
+	return b.MemoryBackend.Get(key)
+}
+
+func (b *failingBackend) HGet(key string, hkey string) (string, error) {
+	if b.fail {
+		return "", errors.New("connection refused")
+	}
+	return b.MemoryBackend.HGet(key, hkey)
+}
+
+func (b *failingBackend) GetHKeys(key string) ([]string, error) {
+	if b.fail {
+		return nil, errors.New("connection refused")
+	}
+	return b.MemoryBackend.GetHKeys(key)
+}
+
+func (b *failingBackend) SMembers(key string) ([]string, error) {
+	if b.fail {
+		return nil, errors.New("connection refused")
+	}
+	return b.MemoryBackend.SMembers(key)
+}
+
+func TestBackendErrors(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := &failingBackend{MemoryBackend: NewMemoryBackend()}
+	_ = backend.SAdd("redins:zones", "failing.com.")
+	_ = backend.SAdd("redins:zones", "failing2.com.")
+	_ = backend.HSet("redins:zones:failing.com.", "www", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`)
+	_ = backend.HSet("redins:zones:failing.com.", "www2", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`)
+	_ = backend.HSet("redins:zones:failing2.com.", "www", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`)
+	h := NewHandlerWithBackend(&defaultConfig, backend)
+
+	query := func(qname string, qtype uint16) *dns.Msg {
+		tc := test.Case{Qname: qname, Qtype: qtype}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, tc.Msg()))
+		return w.Msg
+	}
+
+	// absent keys
+	if resp := query("www.failing.com.", dns.TypeA); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		fmt.Println("unexpected response : ", resp)
+		t.Fail()
+	}
+	if resp := query("absent.failing.com.", dns.TypeA); resp.Rcode != dns.RcodeNameError {
+		fmt.Println("absent location should be NXDOMAIN : ", resp)
+		t.Fail()
+	}
+	if resp := query("www.failing.com.", dns.TypeMX); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+		fmt.Println("absent record type should be NODATA : ", resp)
+		t.Fail()
+	}
+
+	// backend errors
+	backend.fail = true
+	if resp := query("www2.failing.com.", dns.TypeA); resp.Rcode != dns.RcodeServerFailure {
+		fmt.Println("location load error should be SERVFAIL : ", resp)
+		t.Fail()
+	}
+	if resp := query("www.failing2.com.", dns.TypeA); resp.Rcode != dns.RcodeServerFailure {
+		fmt.Println("zone load error should be SERVFAIL : ", resp)
+		t.Fail()
+	}
+}
+
+func TestLocationParseError(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := NewMemoryBackend()
+	_ = backend.SAdd("redins:zones", "corrupt.com.")
+	_ = backend.HSet("redins:zones:corrupt.com.", "www", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]`)
+
+	query := func(h *DnsRequestHandler) *dns.Msg {
+		tc := test.Case{Qname: "www.corrupt.com.", Qtype: dns.TypeA}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, tc.Msg()))
+		return w.Msg
+	}
+
+	config := defaultConfig
+	if resp := query(NewHandlerWithBackend(&config, backend)); resp.Rcode != dns.RcodeServerFailure {
+		fmt.Println("corrupt location should be SERVFAIL by default : ", resp)
+		t.Fail()
+	}
+	config.ParseErrorRcode = "nxdomain"
+	if resp := query(NewHandlerWithBackend(&config, backend)); resp.Rcode != dns.RcodeNameError {
+		fmt.Println("corrupt location should be NXDOMAIN with parse_error_rcode nxdomain : ", resp)
+		t.Fail()
+	}
+}
+
+type countingBackend struct {
+	*MemoryBackend
+	lock  sync.Mutex
+	reads map[string]int
+}
+
+func (b *countingBackend) HGet(key string, hkey string) (string, error) {
+	b.lock.Lock()
+	b.reads[key+" "+hkey]++
+	b.lock.Unlock()
+	// keep the load in flight long enough for all concurrent requests to join it
+	time.Sleep(200 * time.Millisecond)
+	return b.MemoryBackend.HGet(key, hkey)
+}
+
+func TestLocationLoadCoalescing(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := &countingBackend{MemoryBackend: NewMemoryBackend(), reads: make(map[string]int)}
+	_ = backend.SAdd("redins:zones", "coalesce.com.")
+	_ = backend.HSet("redins:zones:coalesce.com.", "www", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`)
+	h := NewHandlerWithBackend(&defaultConfig, backend)
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			tc := test.Case{Qname: "www.coalesce.com.", Qtype: dns.TypeA}
+			w := test.NewRecorder(&test.ResponseWriter{})
+			h.HandleRequest(NewRequestContext(w, tc.Msg()))
+			if w.Msg.Rcode != dns.RcodeSuccess || len(w.Msg.Answer) != 1 {
+				fmt.Println("unexpected response : ", w.Msg)
+				t.Fail()
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if reads := backend.reads["redins:zones:coalesce.com. www"]; reads != 1 {
+		fmt.Println("concurrent loads not coalesced, backend reads : ", reads)
+		t.Fail()
+	}
+}
+
+type slowBackend struct {
+	*MemoryBackend
+	delay time.Duration
+}
+
+func (b *slowBackend) SMembers(key string) ([]string, error) {
+	time.Sleep(b.delay)
+	return b.MemoryBackend.SMembers(key)
+}
+
+func (b *slowBackend) GetHKeys(key string) ([]string, error) {
+	time.Sleep(b.delay)
+	return b.MemoryBackend.GetHKeys(key)
+}
+
+func TestZoneReload(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := &slowBackend{MemoryBackend: NewMemoryBackend()}
+	_ = backend.SAdd("redins:zones", "reload.com.")
+	_ = backend.HSet("redins:zones:reload.com.", "www", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`)
+	config := defaultConfig
+	config.CacheTimeout = 1
+	h := NewHandlerWithBackend(&config, backend)
+
+	query := func(qname string) *dns.Msg {
+		tc := test.Case{Qname: qname, Qtype: dns.TypeA}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, tc.Msg()))
+		return w.Msg
+	}
+	if resp := query("www.reload.com."); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		fmt.Println("unexpected response : ", resp)
+		t.FailNow()
+	}
+
+	// let cached zone expire, then reload zone list and zone data while serving
+	time.Sleep(2100 * time.Millisecond)
+	_ = backend.SAdd("redins:zones", "reload2.com.")
+	_ = backend.HSet("redins:zones:reload2.com.", "www", `{"a":{"ttl":300, "records":[{"ip":"5.6.7.8"}]}}`)
+	backend.delay = 500 * time.Millisecond
+	reloaded := make(chan struct{})
+	go func() {
+		h.LoadZones()
+		close(reloaded)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			resp := query("www.reload.com.")
+			if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+				fmt.Println("query blocked by reload : ", elapsed)
+				t.Fail()
+			}
+			if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "1.2.3.4" {
+				fmt.Println("unexpected response during reload : ", resp)
+				t.Fail()
+			}
+		}()
+	}
+	wg.Wait()
+
+	<-reloaded
+	if resp := query("www.reload2.com."); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "5.6.7.8" {
+		fmt.Println("reloaded zone not served : ", resp)
+		t.Fail()
+	}
+}
+
+func TestBackendErrorText(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := &failingBackend{MemoryBackend: NewMemoryBackend()}
+	_ = backend.SAdd("redins:zones", "outage.com.")
+	_ = backend.HSet("redins:zones:outage.com.", "www", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`)
+	h := NewHandlerWithBackend(&defaultConfig, backend)
+	backend.fail = true
+
+	query := func(edns bool) *dns.Msg {
+		tc := test.Case{Qname: "www.outage.com.", Qtype: dns.TypeA}
+		r := tc.Msg()
+		if edns {
+			r.SetEdns0(4096, false)
+		}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, r))
+		return w.Msg
+	}
+
+	resp := query(true)
+	if resp.Rcode != dns.RcodeServerFailure {
+		fmt.Println("backend outage should be SERVFAIL : ", resp)
+		t.FailNow()
+	}
+	var ede *dns.EDNS0_EDE
+	if opt := resp.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if e, ok := o.(*dns.EDNS0_EDE); ok {
+				ede = e
+			}
+		}
+	}
+	if ede == nil || ede.InfoCode != dns.ExtendedErrorCodeOther || ede.ExtraText != "cannot load zone outage.com." {
+		fmt.Println("expected extended error text : ", resp)
+		t.Fail()
+	}
+
+	if resp := query(false); resp.Rcode != dns.RcodeServerFailure || resp.IsEdns0() != nil {
+		fmt.Println("non-edns client should get plain SERVFAIL : ", resp)
+		t.Fail()
+	}
+}
+
+// readCountingBackend counts reads of each key without delaying them
+type readCountingBackend struct {
+	*MemoryBackend
+	lock  sync.Mutex
+	reads map[string]int
+}
+
+func (b *readCountingBackend) count(key string) {
+	b.lock.Lock()
+	b.reads[key]++
+	b.lock.Unlock()
+}
+
+func (b *readCountingBackend) Get(key string) (string, error) {
+	b.count(key)
+	return b.MemoryBackend.Get(key)
+}
+
+func (b *readCountingBackend) HGet(key string, hkey string) (string, error) {
+	b.count(key + " " + hkey)
+	return b.MemoryBackend.HGet(key, hkey)
+}
+
+func TestNoDataSoa(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := &readCountingBackend{MemoryBackend: NewMemoryBackend(), reads: make(map[string]int)}
+	_ = backend.SAdd("redins:zones", "nodata.com.")
+	_ = backend.Set("redins:zones:nodata.com.:config", `{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.nodata.com.","ns":"ns1.nodata.com.","refresh":44,"retry":55,"expire":66,"serial":1}}`)
+	_ = backend.HSet("redins:zones:nodata.com.", "@", `{"ns":{"ttl":300, "records":[{"host":"ns1.nodata.com."}]}}`)
+	_ = backend.HSet("redins:zones:nodata.com.", "www", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`)
+	h := NewHandlerWithBackend(&defaultConfig, backend)
+
+	for i := 0; i < 10; i++ {
+		tc := test.Case{Qname: "www.nodata.com.", Qtype: dns.TypeMX}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, tc.Msg()))
+		resp := w.Msg
+		if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 || len(resp.Ns) != 1 || resp.Ns[0].Header().Rrtype != dns.TypeSOA {
+			fmt.Println("unexpected nodata response : ", resp)
+			t.FailNow()
+		}
+		// cache writes are asynchronous
+		h.ZoneCache.Wait()
+		h.RecordCache.Wait()
+	}
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	if n := backend.reads["redins:zones:nodata.com. @"]; n != 0 {
+		fmt.Println("nodata should not load apex location : ", n)
+		t.Fail()
+	}
+	if n := backend.reads["redins:zones:nodata.com.:config"]; n != 1 {
+		fmt.Println("apex soa should be read once per zone load : ", n)
+		t.Fail()
+	}
+}
+
+func TestDelegationProbe(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := &readCountingBackend{MemoryBackend: NewMemoryBackend(), reads: make(map[string]int)}
+	_ = backend.SAdd("redins:zones", "cut.com.")
+	_ = backend.Set("redins:zones:cut.com.:config", `{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.cut.com.","ns":"ns1.cut.com.","refresh":44,"retry":55,"expire":66,"serial":1}}`)
+	_ = backend.HSet("redins:zones:cut.com.", "a.b.c", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`)
+	_ = backend.HSet("redins:zones:cut.com.", "d", `{"ns":{"ttl":300, "records":[{"host":"ns1.other.com."}]}}`)
+	_ = backend.HSet("redins:zones:cut.com.", "x.d", `{"a":{"ttl":300, "records":[{"ip":"5.6.7.8"}]}}`)
+	config := defaultConfig
+	config.LocationLookup = "probe"
+	h := NewHandlerWithBackend(&config, backend)
+
+	for i := 0; i < 10; i++ {
+		tc := test.Case{Qname: "a.b.c.cut.com.", Qtype: dns.TypeA}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, tc.Msg()))
+		if resp := w.Msg; resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+			fmt.Println("unexpected response : ", resp)
+			t.FailNow()
+		}
+		tc = test.Case{Qname: "x.d.cut.com.", Qtype: dns.TypeA}
+		w = test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, tc.Msg()))
+		if resp := w.Msg; resp.Authoritative || len(resp.Ns) != 1 || resp.Ns[0].Header().Rrtype != dns.TypeNS {
+			fmt.Println("expected referral : ", resp)
+			t.FailNow()
+		}
+		tc = test.Case{Qname: "missing.d.cut.com.", Qtype: dns.TypeA}
+		w = test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, tc.Msg()))
+		if resp := w.Msg; resp.Rcode != dns.RcodeSuccess || resp.Authoritative || len(resp.Ns) != 1 || resp.Ns[0].Header().Rrtype != dns.TypeNS {
+			fmt.Println("expected referral for name missing below delegation : ", resp)
+			t.FailNow()
+		}
+		h.ZoneCache.Wait()
+		h.RecordCache.Wait()
+	}
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	for _, label := range []string{"c", "b.c"} {
+		if n := backend.reads["redins:zones:cut.com. "+label]; n != 1 {
+			fmt.Println("ancestor should be probed once per zone load : ", label, n)
+			t.Fail()
+		}
+	}
+}
+
+func TestNotReady(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := &failingBackend{MemoryBackend: NewMemoryBackend(), fail: true}
+	_ = backend.SAdd("redins:zones", "ready.com.")
+	_ = backend.HSet("redins:zones:ready.com.", "www", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`)
+	cfg := defaultConfig
+	cfg.NotReadyAction = "servfail"
+	h := NewHandlerWithBackend(&cfg, backend)
+
+	query := func() *dns.Msg {
+		tc := test.Case{Qname: "www.ready.com.", Qtype: dns.TypeA}
+		r := tc.Msg()
+		r.SetEdns0(4096, false)
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, r))
+		return w.Msg
+	}
+	readyz := func() int {
+		w := httptest.NewRecorder()
+		h.ServeReady(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return w.Code
+	}
+
+	if h.Ready() || readyz() != http.StatusServiceUnavailable {
+		fmt.Println("handler should not be ready before zones are loaded")
+		t.Fail()
+	}
+	resp := query()
+	if resp == nil || resp.Rcode != dns.RcodeServerFailure {
+		fmt.Println("queries before zones are loaded should be SERVFAIL : ", resp)
+		t.FailNow()
+	}
+	var ede *dns.EDNS0_EDE
+	if opt := resp.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if e, ok := o.(*dns.EDNS0_EDE); ok {
+				ede = e
+			}
+		}
+	}
+	if ede == nil || ede.InfoCode != dns.ExtendedErrorCodeNotReady {
+		fmt.Println("expected not ready extended error : ", resp)
+		t.Fail()
+	}
+
+	cfg.NotReadyAction = "drop"
+	if resp := query(); resp != nil {
+		fmt.Println("queries before zones are loaded should be dropped : ", resp)
+		t.Fail()
+	}
+
+	backend.fail = false
+	h.LoadZones()
+	if !h.Ready() || readyz() != http.StatusOK {
+		fmt.Println("handler should be ready after zones are loaded")
+		t.Fail()
+	}
+	if resp := query(); resp == nil || resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "1.2.3.4" {
+		fmt.Println("unexpected response after zones are loaded : ", resp)
+		t.Fail()
+	}
+
+	// later backend failures keep serving loaded zones
+	backend.fail = true
+	h.LoadZones()
+	if !h.Ready() {
+		fmt.Println("failed reload should not make handler unready")
+		t.Fail()
+	}
+}
@@ -2,6 +2,7 @@ package handler
 
 import (
 	"arvancloud/redins/test"
+	"fmt"
 	"github.com/hawell/logger"
 	"github.com/miekg/dns"
 	"log"
@@ -33,14 +34,14 @@ func TestMain(m *testing.M) {
 	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
 
 	benchTestHandler = NewHandler(&defaultConfig)
-	err := benchTestHandler.Redis.Del("*")
+	err := benchTestHandler.Backend.Del("*")
 	log.Println(err)
-	err = benchTestHandler.Redis.SAdd("redins:zones", benchZone)
+	err = benchTestHandler.Backend.SAdd("redins:zones", benchZone)
 	log.Println(err)
-	err = benchTestHandler.Redis.Set("redins:zones:"+benchZone+":config", "{\"cname_flattening\": false}")
+	err = benchTestHandler.Backend.Set("redins:zones:"+benchZone+":config", "{\"cname_flattening\": false}")
 	log.Println(err)
 	for _, cmd := range benchEntries {
-		err := benchTestHandler.Redis.HSet("redins:zones:"+benchZone, cmd[0], cmd[1])
+		err := benchTestHandler.Backend.HSet("redins:zones:"+benchZone, cmd[0], cmd[1])
 		if err != nil {
 			log.Printf("[ERROR] cannot connect to redis: %s", err)
 			return
@@ -132,3 +133,74 @@ func BenchmarkNotAuth(b *testing.B) {
 	}
 	response = *resp
 }
+
+func benchmarkLocationLookup(b *testing.B, lookup string) {
+	backend := NewMemoryBackend()
+	_ = backend.SAdd("redins:zones", "large.zon.")
+	for i := 0; i < 100000; i++ {
+		_ = backend.HSet("redins:zones:large.zon.", fmt.Sprintf("www%d", i), `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`)
+	}
+	config := defaultConfig
+	config.LocationLookup = lookup
+	h := NewHandlerWithBackend(&config, backend)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.ZoneCache.Del("large.zon.")
+		z := h.LoadZone("large.zon.")
+		if _, match := z.FindLocation("www500.large.zon."); match != ExactMatch {
+			b.Fatal("location not found")
+		}
+	}
+}
+
+func BenchmarkLocationLookupFull(b *testing.B) {
+	benchmarkLocationLookup(b, "full")
+}
+
+func BenchmarkLocationLookupProbe(b *testing.B) {
+	benchmarkLocationLookup(b, "probe")
+}
+
+func BenchmarkLargeZoneNXDomain(b *testing.B) {
+	locations := make([]string, 0, 100000)
+	for i := 0; i < 100000; i++ {
+		locations = append(locations, fmt.Sprintf("www%d.sub", i))
+	}
+	z := NewZone("large.zon.", locations, "")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, match := z.FindLocation(fmt.Sprintf("x.random%d.large.zon.", i)); match != NoMatch {
+			b.Fatal("random name found")
+		}
+	}
+}
+
+func benchmarkGeoFilter(b *testing.B, cacheTtl int) {
+	backend := NewMemoryBackend()
+	_ = backend.SAdd("redins:zones", "geo.zon.")
+	_ = backend.HSet("redins:zones:geo.zon.", "www", `{"a":{"ttl":300, "filter":{"count":"single","order":"none","geo_filter":"location"}, "records":[{"ip":"212.83.32.45"},{"ip":"80.67.163.250"},{"ip":"154.11.253.242"}]}}`)
+	config := defaultConfig
+	config.GeoIp = GeoIpConfig{Enable: true, CountryDB: "../geoCity.mmdb", CacheTtl: cacheTtl}
+	h := NewHandlerWithBackend(&config, backend)
+	geoip := &countingGeoIp{GeoIpProvider: h.geoip}
+	h.geoip = geoip
+
+	tc := test.Case{Qname: "www.geo.zon.", Qtype: dns.TypeA}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, tc.Msg()))
+		response = *w.Msg
+	}
+	b.ReportMetric(float64(geoip.calls)/float64(b.N), "geo-calls/op")
+}
+
+func BenchmarkGeoFilter(b *testing.B) {
+	benchmarkGeoFilter(b, 0)
+}
+
+func BenchmarkGeoFilterCached(b *testing.B) {
+	benchmarkGeoFilter(b, 10)
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/hashicorp/go-immutable-radix"
+	"github.com/hawell/logger"
+	"github.com/miekg/dns"
+)
+
+const blocklistKey = "redins:blocklist"
+
+type BlocklistConfig struct {
+	Enable       bool   `json:"enable"`
+	File         string `json:"file"`
+	Action       string `json:"action"` // "nxdomain", "refuse", "sinkhole"
+	SinkholeA    string `json:"sinkhole_a"`
+	SinkholeAAAA string `json:"sinkhole_aaaa"`
+	Ttl          uint32 `json:"ttl"`
+	Reload       int    `json:"reload"`
+}
+
+// Blocklist matches query names against listed domains and all their subdomains
+type Blocklist struct {
+	config       *BlocklistConfig
+	backend      Backend
+	sinkholeA    net.IP
+	sinkholeAAAA net.IP
+	names        atomic.Value // *iradix.Tree of reversed names, swapped as a whole on reload
+}
+
+func NewBlocklist(config *BlocklistConfig, backend Backend) *Blocklist {
+	b := &Blocklist{
+		config:       config,
+		backend:      backend,
+		sinkholeA:    net.ParseIP(config.SinkholeA).To4(),
+		sinkholeAAAA: net.ParseIP(config.SinkholeAAAA),
+	}
+	b.names.Store(iradix.New())
+	b.Load()
+	return b
+}
+
+// Load reads blocked domains from backend's redins:blocklist set and blocklist file, one domain per line
+func (b *Blocklist) Load() {
+	names, err := b.backend.SMembers(blocklistKey)
+	if err != nil {
+		logger.Default.Errorf("cannot load blocklist from %s : %s", blocklistKey, err)
+	}
+	if b.config.File != "" {
+		file, err := os.Open(b.config.File)
+		if err != nil {
+			logger.Default.Errorf("cannot open blocklist file %s : %s", b.config.File, err)
+		} else {
+			scanner := bufio.NewScanner(file)
+			for scanner.Scan() {
+				names = append(names, scanner.Text())
+			}
+			if err := scanner.Err(); err != nil {
+				logger.Default.Errorf("cannot read blocklist file %s : %s", b.config.File, err)
+			}
+			_ = file.Close()
+		}
+	}
+	txn := iradix.New().Txn()
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" || strings.HasPrefix(name, "#") {
+			continue
+		}
+		name = dns.Fqdn(strings.ToLower(name))
+		txn.Insert(reverseZone(name), name)
+	}
+	b.names.Store(txn.Commit())
+}
+
+// Match returns the blocked domain qname is equal to or a subdomain of
+func (b *Blocklist) Match(qname string) (string, bool) {
+	if _, name, ok := b.names.Load().(*iradix.Tree).Root().LongestPrefix(reverseZone(qname)); ok {
+		return name.(string), true
+	}
+	return "", false
+}
+
+// Answer fills context's response for a blocked query and returns its rcode
+func (b *Blocklist) Answer(context *RequestContext) int {
+	context.ErrorCode = dns.ExtendedErrorCodeBlocked
+	switch b.config.Action {
+	case "refuse":
+		return dns.RcodeRefused
+	case "sinkhole":
+		hdr := dns.RR_Header{Name: context.RawName(), Rrtype: context.QType(), Class: dns.ClassINET, Ttl: b.config.Ttl}
+		switch {
+		case context.QType() == dns.TypeA && b.sinkholeA != nil:
+			context.Answer = []dns.RR{&dns.A{Hdr: hdr, A: b.sinkholeA}}
+		case context.QType() == dns.TypeAAAA && b.sinkholeAAAA != nil:
+			context.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: b.sinkholeAAAA}}
+		}
+		return dns.RcodeSuccess
+	default:
+		return dns.RcodeNameError
+	}
+}
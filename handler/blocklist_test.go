@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"arvancloud/redins/test"
+	"fmt"
+	"github.com/hawell/logger"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestBlocklist(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := NewMemoryBackend()
+	_ = backend.SAdd("redins:zones", "blocklist.com.")
+	_ = backend.HSet("redins:zones:blocklist.com.", "www", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`)
+	_ = backend.SAdd("redins:blocklist", "Malware.com")
+	_ = backend.SAdd("redins:blocklist", "bad.blocklist.com.")
+	file, err := ioutil.TempFile("", "redins_blocklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	_, _ = file.WriteString("# phishing\nphishing.net\n\n")
+	_ = file.Close()
+
+	config := defaultConfig
+	config.Blocklist = BlocklistConfig{Enable: true, File: file.Name(), Action: "nxdomain"}
+	h := NewHandlerWithBackend(&config, backend)
+
+	query := func(qname string, qtype uint16) *dns.Msg {
+		tc := test.Case{Qname: qname, Qtype: qtype}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, tc.Msg()))
+		return w.Msg
+	}
+
+	for _, qname := range []string{"malware.com.", "x.y.malware.com.", "bad.blocklist.com.", "www.bad.blocklist.com.", "phishing.net."} {
+		if resp := query(qname, dns.TypeA); resp.Rcode != dns.RcodeNameError || len(resp.Answer) != 0 {
+			fmt.Println("blocked name should get nxdomain : ", qname, resp)
+			t.Fail()
+		}
+	}
+	for _, qname := range []string{"notmalware.com.", "www.blocklist.com."} {
+		resp := query(qname, dns.TypeA)
+		if resp.Rcode == dns.RcodeNameError {
+			fmt.Println("name should not be blocked : ", qname, resp)
+			t.Fail()
+		}
+	}
+	if resp := query("www.blocklist.com.", dns.TypeA); len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "1.2.3.4" {
+		fmt.Println("unexpected answer for unblocked name : ", resp)
+		t.Fail()
+	}
+
+	config.Blocklist = BlocklistConfig{Enable: true, Action: "sinkhole", SinkholeA: "10.0.0.1", SinkholeAAAA: "fd00::1", Ttl: 60}
+	h = NewHandlerWithBackend(&config, backend)
+	resp := query("c2.malware.com.", dns.TypeA)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "10.0.0.1" || resp.Answer[0].Header().Ttl != 60 {
+		fmt.Println("subdomain of blocked name should be sinkholed : ", resp)
+		t.Fail()
+	}
+	resp = query("malware.com.", dns.TypeAAAA)
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.AAAA).AAAA.String() != "fd00::1" {
+		fmt.Println("unexpected aaaa sinkhole : ", resp)
+		t.Fail()
+	}
+	if resp = query("malware.com.", dns.TypeMX); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+		fmt.Println("other types of sinkholed names should get nodata : ", resp)
+		t.Fail()
+	}
+	// file is not configured anymore
+	if resp = query("phishing.net.", dns.TypeA); resp.Rcode != dns.RcodeNotAuth {
+		fmt.Println("unexpected response for unlisted name : ", resp)
+		t.Fail()
+	}
+}
@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"net"
+	"sort"
+
+	"github.com/hawell/logger"
+)
+
+// Classifier tags requests based on client characteristics, tags are logged and select tagged record sets
+type Classifier interface {
+	Classify(context *RequestContext) []string
+}
+
+type subnetTag struct {
+	tag     string
+	subnets []*net.IPNet
+}
+
+// SubnetClassifier tags requests whose source ip is in one of tag's subnets
+type SubnetClassifier struct {
+	tags []subnetTag
+}
+
+// NewSubnetClassifier creates a classifier from tag -> subnets, invalid subnets are skipped
+func NewSubnetClassifier(tags map[string][]string) *SubnetClassifier {
+	c := &SubnetClassifier{}
+	for tag, subnets := range tags {
+		st := subnetTag{tag: tag}
+		for _, subnet := range subnets {
+			_, ipNet, err := net.ParseCIDR(subnet)
+			if err != nil {
+				logger.Default.Errorf("invalid subnet for tag %s : %s", tag, err)
+				continue
+			}
+			st.subnets = append(st.subnets, ipNet)
+		}
+		c.tags = append(c.tags, st)
+	}
+	sort.Slice(c.tags, func(i, j int) bool { return c.tags[i].tag < c.tags[j].tag })
+	return c
+}
+
+func (c *SubnetClassifier) Classify(context *RequestContext) []string {
+	var tags []string
+	for _, st := range c.tags {
+		for _, subnet := range st.subnets {
+			if subnet.Contains(context.SourceIp) {
+				tags = append(tags, st.tag)
+				break
+			}
+		}
+	}
+	return tags
+}
+
+// taggedRecord returns record sets of r selected by first of tags, or r itself if none is defined
+func taggedRecord(r *Record, tags []string) *Record {
+	if r == nil || len(r.tagged) == 0 {
+		return r
+	}
+	for _, tag := range tags {
+		if tr, found := r.tagged[tag]; found {
+			return tr
+		}
+	}
+	return r
+}
@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"arvancloud/redins/test"
+	"fmt"
+	"github.com/hawell/logger"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubnetClassifier(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	logFile, err := ioutil.TempFile("", "redins_query_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = logFile.Close()
+	defer os.Remove(logFile.Name())
+
+	backend := NewMemoryBackend()
+	_ = backend.SAdd("redins:zones", "tags.com.")
+	_ = backend.HSet("redins:zones:tags.com.", "www", `{
+		"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]},
+		"tagged":{"mobile":{"a":{"ttl":300, "records":[{"ip":"5.6.7.8"}]}}}
+	}`)
+	config := defaultConfig
+	config.QueryTags = map[string][]string{
+		"mobile": {"10.1.0.0/16", "invalid"},
+		"bot":    {"10.2.0.0/16"},
+	}
+	config.Log = logger.LogConfig{Enable: true, Target: "file", Level: "info", Path: logFile.Name(), Format: "json"}
+	h := NewHandlerWithBackend(&config, backend)
+
+	query := func(sourceIp string) *dns.Msg {
+		tc := test.Case{Qname: "www.tags.com.", Qtype: dns.TypeA}
+		r := tc.Msg()
+		r.Extra = append(r.Extra, &dns.OPT{
+			Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT, Class: dns.ClassANY},
+			Option: []dns.EDNS0{
+				&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 32, Address: net.ParseIP(sourceIp)},
+			},
+		})
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, r))
+		return w.Msg
+	}
+
+	for _, tc := range []struct {
+		sourceIp string
+		ip       string
+	}{
+		{"10.1.2.3", "5.6.7.8"},
+		{"10.2.2.3", "1.2.3.4"},
+		{"10.3.2.3", "1.2.3.4"},
+	} {
+		resp := query(tc.sourceIp)
+		if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != tc.ip {
+			fmt.Println("unexpected answer for ", tc.sourceIp, " : ", resp)
+			t.Fail()
+		}
+	}
+
+	time.Sleep(time.Millisecond * 100)
+	content, _ := ioutil.ReadFile(logFile.Name())
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 3 {
+		fmt.Println("unexpected query log : ", string(content))
+		t.FailNow()
+	}
+	expected := []string{"mobile", "bot", ""}
+	for i, line := range lines {
+		entry := struct {
+			Tags []string `json:"tags"`
+		}{}
+		_ = jsoniter.Unmarshal([]byte(line), &entry)
+		if strings.Join(entry.Tags, ",") != expected[i] {
+			fmt.Println("unexpected tags in log : ", line)
+			t.Fail()
+		}
+	}
+}
+
+type deviceClassifier struct{}
+
+func (deviceClassifier) Classify(context *RequestContext) []string {
+	if device, found := context.EdnsOptions[65001]; found {
+		return []string{string(device)}
+	}
+	return nil
+}
+
+func TestEdnsOptions(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := NewMemoryBackend()
+	_ = backend.SAdd("redins:zones", "device.com.")
+	_ = backend.HSet("redins:zones:device.com.", "www", `{
+		"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]},
+		"tagged":{"mobile":{"a":{"ttl":300, "records":[{"ip":"5.6.7.8"}]}}}
+	}`)
+	config := defaultConfig
+	config.EdnsOptions = []uint16{65001}
+	config.EchoEdnsOptions = true
+	h := NewHandlerWithBackend(&config, backend)
+	h.Classifier = deviceClassifier{}
+
+	query := func(options ...dns.EDNS0) *dns.Msg {
+		tc := test.Case{Qname: "www.device.com.", Qtype: dns.TypeA}
+		r := tc.Msg()
+		r.SetEdns0(4096, false)
+		opt := r.IsEdns0()
+		opt.Option = append(opt.Option, options...)
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, r))
+		return w.Msg
+	}
+
+	resp := query(&dns.EDNS0_LOCAL{Code: 65001, Data: []byte("mobile")}, &dns.EDNS0_LOCAL{Code: 65002, Data: []byte("other")})
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "5.6.7.8" {
+		fmt.Println("classifier should select tagged records by edns option : ", resp)
+		t.Fail()
+	}
+	var echoed []*dns.EDNS0_LOCAL
+	if opt := resp.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if local, ok := o.(*dns.EDNS0_LOCAL); ok {
+				echoed = append(echoed, local)
+			}
+		}
+	}
+	if len(echoed) != 1 || echoed[0].Code != 65001 || string(echoed[0].Data) != "mobile" {
+		fmt.Println("only configured edns options should be echoed : ", resp)
+		t.Fail()
+	}
+
+	resp = query()
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "1.2.3.4" {
+		fmt.Println("unexpected answer without edns option : ", resp)
+		t.Fail()
+	}
+}
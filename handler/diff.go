@@ -0,0 +1,124 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	DiffAdded   = "added"   // only in live zone
+	DiffRemoved = "removed" // only in reference zone
+	DiffChanged = "changed" // in both with different ttl
+)
+
+type ZoneDiff struct {
+	Change    string
+	RR        dns.RR // live record, nil if removed
+	Reference dns.RR // reference record, nil if added
+}
+
+// ExportZone builds all records of zoneName as served from backend, address records are not filtered
+func (h *DnsRequestHandler) ExportZone(zoneName string) ([]dns.RR, error) {
+	zoneName = dns.Fqdn(zoneName)
+	if h.FindZone(zoneName) != zoneName {
+		return nil, errors.New("zone not found : " + zoneName)
+	}
+	zone := h.LoadZone(zoneName)
+	if zone == nil {
+		return nil, errors.New("cannot load zone : " + zoneName)
+	}
+	labels, err := h.Backend.GetHKeys("redins:zones:" + zone.Name)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(labels)
+
+	rrs := []dns.RR{zone.Config.SOA.Data}
+	for _, label := range labels {
+		location, name := label, label+"."+zone.Name
+		if label == "@" {
+			location, name = zone.Name, zone.Name
+		}
+		record := h.LoadLocation(location, zone)
+		if record == nil {
+			return nil, errors.New("cannot load location : " + name)
+		}
+		rrs = append(rrs, h.locationRRs(name, record)...)
+	}
+	return rrs, nil
+}
+
+// ParseZoneFile reads all records of a master file with origin zoneName
+func ParseZoneFile(r io.Reader, zoneName string, fileName string) ([]dns.RR, error) {
+	var rrs []dns.RR
+	zp := dns.NewZoneParser(r, dns.Fqdn(zoneName), fileName)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	return rrs, nil
+}
+
+// diffKey identifies a record regardless of ttl and case, SOA serial is ignored since it is generated
+func diffKey(rr dns.RR) string {
+	rr = dns.Copy(rr)
+	rr.Header().Ttl = 0
+	rr.Header().Name = strings.ToLower(rr.Header().Name)
+	if soa, ok := rr.(*dns.SOA); ok {
+		soa.Serial = 0
+	}
+	return rr.String()
+}
+
+// DiffZone compares live records against reference records, result is sorted by owner name and type
+func DiffZone(live []dns.RR, reference []dns.RR) []ZoneDiff {
+	liveRRs := make(map[string]dns.RR)
+	for _, rr := range live {
+		liveRRs[diffKey(rr)] = rr
+	}
+	referenceRRs := make(map[string]dns.RR)
+	for _, rr := range reference {
+		referenceRRs[diffKey(rr)] = rr
+	}
+
+	var diffs []ZoneDiff
+	for key, rr := range liveRRs {
+		ref, found := referenceRRs[key]
+		switch {
+		case !found:
+			diffs = append(diffs, ZoneDiff{Change: DiffAdded, RR: rr})
+		case rr.Header().Ttl != ref.Header().Ttl:
+			diffs = append(diffs, ZoneDiff{Change: DiffChanged, RR: rr, Reference: ref})
+		}
+	}
+	for key, ref := range referenceRRs {
+		if _, found := liveRRs[key]; !found {
+			diffs = append(diffs, ZoneDiff{Change: DiffRemoved, Reference: ref})
+		}
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		a, b := diffs[i].record(), diffs[j].record()
+		if an, bn := strings.ToLower(a.Header().Name), strings.ToLower(b.Header().Name); an != bn {
+			return an < bn
+		}
+		if a.Header().Rrtype != b.Header().Rrtype {
+			return a.Header().Rrtype < b.Header().Rrtype
+		}
+		return diffKey(a) < diffKey(b)
+	})
+	return diffs
+}
+
+func (d ZoneDiff) record() dns.RR {
+	if d.RR != nil {
+		return d.RR
+	}
+	return d.Reference
+}
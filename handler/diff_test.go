@@ -0,0 +1,87 @@
+package handler
+
+import (
+	"fmt"
+	"github.com/hawell/logger"
+	"github.com/miekg/dns"
+	"strings"
+	"testing"
+)
+
+const diffZoneFile = `$ORIGIN diff.com.
+$TTL 300
+@     IN SOA   ns1.diff.com. hostmaster.diff.com. 1 44 55 66 100
+@     IN NS    ns1.diff.com.
+www   IN A     1.2.3.4
+www   IN A     5.6.7.8
+mail  IN MX    10 mx.diff.com.
+txt   IN TXT   "foo"
+`
+
+func TestDiffZone(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := NewMemoryBackend()
+	_ = backend.SAdd("redins:zones", "diff.com.")
+	_ = backend.Set("redins:zones:diff.com.:config", `{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.diff.com.","ns":"ns1.diff.com.","refresh":44,"retry":55,"expire":66}}`)
+	_ = backend.HSet("redins:zones:diff.com.", "@", `{"ns":{"ttl":300, "records":[{"host":"ns1.diff.com."}]}}`)
+	_ = backend.HSet("redins:zones:diff.com.", "www", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"},{"ip":"5.6.7.8"}]}}`)
+	_ = backend.HSet("redins:zones:diff.com.", "mail", `{"mx":{"ttl":300, "records":[{"host":"mx.diff.com.", "preference":10}]}}`)
+	_ = backend.HSet("redins:zones:diff.com.", "txt", `{"txt":{"ttl":300, "records":[{"text":"foo"}]}}`)
+	h := NewHandlerWithBackend(&defaultConfig, backend)
+
+	reference, err := ParseZoneFile(strings.NewReader(diffZoneFile), "diff.com", "diff.zone")
+	if err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+	live, err := h.ExportZone("diff.com")
+	if err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+	// soa serial is generated and not compared
+	if diffs := DiffZone(live, reference); len(diffs) != 0 {
+		fmt.Println("identical zones reported as different : ", diffs)
+		t.Fail()
+	}
+
+	_ = backend.HSet("redins:zones:diff.com.", "www", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"},{"ip":"9.9.9.9"}]}}`)
+	_ = backend.HSet("redins:zones:diff.com.", "txt", `{"txt":{"ttl":100, "records":[{"text":"foo"}]}}`)
+	_ = backend.HSet("redins:zones:diff.com.", "new", `{"aaaa":{"ttl":300, "records":[{"ip":"::1"}]}}`)
+	h = NewHandlerWithBackend(&defaultConfig, backend)
+	live, err = h.ExportZone("diff.com.")
+	if err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+	diffs := DiffZone(live, reference)
+	expected := []struct {
+		change string
+		rrtype uint16
+		name   string
+	}{
+		{DiffAdded, dns.TypeAAAA, "new.diff.com."},
+		{DiffChanged, dns.TypeTXT, "txt.diff.com."},
+		{DiffRemoved, dns.TypeA, "www.diff.com."},
+		{DiffAdded, dns.TypeA, "www.diff.com."},
+	}
+	if len(diffs) != len(expected) {
+		fmt.Println("unexpected diffs : ", diffs)
+		t.FailNow()
+	}
+	for i, e := range expected {
+		rr := diffs[i].record()
+		if diffs[i].Change != e.change || rr.Header().Rrtype != e.rrtype || rr.Header().Name != e.name {
+			fmt.Println("unexpected diff ", i, " : ", diffs[i].Change, rr)
+			t.Fail()
+		}
+	}
+	if diffs[2].Reference.(*dns.A).A.String() != "5.6.7.8" || diffs[3].RR.(*dns.A).A.String() != "9.9.9.9" {
+		fmt.Println("unexpected address changes : ", diffs[2].Reference, diffs[3].RR)
+		t.Fail()
+	}
+	if diffs[1].RR.Header().Ttl != 100 || diffs[1].Reference.Header().Ttl != 300 {
+		fmt.Println("unexpected ttl change : ", diffs[1].RR, diffs[1].Reference)
+		t.Fail()
+	}
+}
@@ -6,27 +6,125 @@ import (
 	"github.com/miekg/dns"
 	"github.com/pkg/errors"
 	"net"
+	"time"
 )
 
 type RRSets struct {
-	A     IP_RRSet      `json:"a,omitempty"`
-	AAAA  IP_RRSet      `json:"aaaa,omitempty"`
-	TXT   TXT_RRSet     `json:"txt,omitempty"`
-	CNAME *CNAME_RRSet  `json:"cname,omitempty"`
-	NS    NS_RRSet      `json:"ns,omitempty"`
-	MX    MX_RRSet      `json:"mx,omitempty"`
-	SRV   SRV_RRSet     `json:"srv,omitempty"`
-	CAA   CAA_RRSet     `json:"caa,omitempty"`
-	PTR   *PTR_RRSet    `json:"ptr,omitempty"`
-	TLSA  TLSA_RRSet    `json:"tlsa,omitempty"`
-	ANAME *ANAME_Record `json:"aname,omitempty"`
+	A          IP_RRSet         `json:"a,omitempty"`
+	AAAA       IP_RRSet         `json:"aaaa,omitempty"`
+	TXT        TXT_RRSet        `json:"txt,omitempty"`
+	CNAME      *CNAME_RRSet     `json:"cname,omitempty"`
+	NS         NS_RRSet         `json:"ns,omitempty"`
+	MX         MX_RRSet         `json:"mx,omitempty"`
+	SRV        SRV_RRSet        `json:"srv,omitempty"`
+	CAA        CAA_RRSet        `json:"caa,omitempty"`
+	PTR        *PTR_RRSet       `json:"ptr,omitempty"`
+	TLSA       TLSA_RRSet       `json:"tlsa,omitempty"`
+	ANAME      *ANAME_Record    `json:"aname,omitempty"`
+	NID        NID_RRSet        `json:"nid,omitempty"`
+	L32        L32_RRSet        `json:"l32,omitempty"`
+	L64        L64_RRSet        `json:"l64,omitempty"`
+	LP         LP_RRSet         `json:"lp,omitempty"`
+	URI        URI_RRSet        `json:"uri,omitempty"`
+	OPENPGPKEY OPENPGPKEY_RRSet `json:"openpgpkey,omitempty"`
+	SMIMEA     SMIMEA_RRSet     `json:"smimea,omitempty"`
+}
+
+// normalize makes all stored host names fully qualified so lookups and output don't depend on trailing dots
+func (rs *RRSets) normalize() {
+	fqdn := func(s string) string {
+		if s == "" {
+			return s
+		}
+		return dns.Fqdn(s)
+	}
+	if rs.CNAME != nil {
+		rs.CNAME.Host = fqdn(rs.CNAME.Host)
+	}
+	if rs.PTR != nil {
+		rs.PTR.Domain = fqdn(rs.PTR.Domain)
+	}
+	if rs.ANAME != nil {
+		rs.ANAME.Location = fqdn(rs.ANAME.Location)
+	}
+	for i := range rs.NS.Data {
+		rs.NS.Data[i].Host = fqdn(rs.NS.Data[i].Host)
+	}
+	for i := range rs.MX.Data {
+		rs.MX.Data[i].Host = fqdn(rs.MX.Data[i].Host)
+	}
+	for i := range rs.SRV.Data {
+		rs.SRV.Data[i].Target = fqdn(rs.SRV.Data[i].Target)
+	}
+	for i := range rs.LP.Data {
+		rs.LP.Data[i].Fqdn = fqdn(rs.LP.Data[i].Fqdn)
+	}
+}
+
+// defaultOrder sets order of a and aaaa rrsets which have none
+func (rs *RRSets) defaultOrder(order string) {
+	if rs.A.FilterConfig.Order == "" {
+		rs.A.FilterConfig.Order = order
+	}
+	if rs.AAAA.FilterConfig.Order == "" {
+		rs.AAAA.FilterConfig.Order = order
+	}
 }
 
 type Record struct {
 	RRSets
-	Zone         *Zone  `json:"-"`
-	Name         string `json:"-"`
-	CacheTimeout int64  `json:"-"`
+	Schedule       *Schedule         `json:"schedule,omitempty"`
+	BlockCountries []string          `json:"block_countries,omitempty"`
+	Tagged         map[string]RRSets `json:"tagged,omitempty"`
+	Meta           map[string]string `json:"meta,omitempty"`
+	Zone           *Zone             `json:"-"`
+	Name           string            `json:"-"`
+	CacheTimeout   int64             `json:"-"`
+
+	tagged map[string]*Record
+}
+
+// Schedule replaces record sets of a location with Records during a daily time window
+type Schedule struct {
+	Start    string `json:"start"`              // "02:00"
+	End      string `json:"end"`                // "04:00"
+	Timezone string `json:"timezone,omitempty"` // "UTC"
+	Records  RRSets `json:"records"`
+
+	start    int
+	end      int
+	location *time.Location
+	record   *Record
+}
+
+func (s *Schedule) parse() error {
+	start, err := time.Parse("15:04", s.Start)
+	if err != nil {
+		return err
+	}
+	end, err := time.Parse("15:04", s.End)
+	if err != nil {
+		return err
+	}
+	s.start = start.Hour()*60 + start.Minute()
+	s.end = end.Hour()*60 + end.Minute()
+	s.location = time.UTC
+	if s.Timezone != "" {
+		if s.location, err = time.LoadLocation(s.Timezone); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Contains checks if t is inside schedule window, windows with start after end span midnight
+func (s *Schedule) Contains(t time.Time) bool {
+	t = t.In(s.location)
+	minute := t.Hour()*60 + t.Minute()
+	if s.start <= s.end {
+		return minute >= s.start && minute < s.end
+	}
+	return minute >= s.start || minute < s.end
 }
 
 type ZoneKey struct {
@@ -48,13 +146,28 @@ type IP_RR struct {
 	Ip      net.IP   `json:"ip"`
 	Country []string `json:"country,omitempty"`
 	ASN     []uint   `json:"asn,omitempty"`
+	Region  string   `json:"region,omitempty"`
+	// Tier is ip's failover pool, lowest tier with a healthy ip is served and higher tiers are backups
+	Tier int `json:"tier,omitempty"`
+	// HealthCheck enables healthcheck for this ip, overriding rrset's health check parameters
+	HealthCheck *IpRecordHealthCheck `json:"health_check,omitempty"`
+}
+
+type IpRecordHealthCheck struct {
+	Protocol string `json:"protocol,omitempty"`
+	Uri      string `json:"uri,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	Target   string `json:"target,omitempty"` // "ip:port" or "ip" checked instead of served ip
 }
 
 type _IP_RR struct {
-	Country interface{} `json:"country,omitempty"`
-	ASN     interface{} `json:"asn,omitempty"`
-	Weight  int         `json:"weight,omitempty"`
-	Ip      net.IP      `json:"ip"`
+	Country     interface{}          `json:"country,omitempty"`
+	ASN         interface{}          `json:"asn,omitempty"`
+	Weight      int                  `json:"weight,omitempty"`
+	Ip          net.IP               `json:"ip"`
+	Region      string               `json:"region,omitempty"`
+	Tier        int                  `json:"tier,omitempty"`
+	HealthCheck *IpRecordHealthCheck `json:"health_check,omitempty"`
 }
 
 func (iprr *IP_RR) UnmarshalJSON(data []byte) error {
@@ -65,6 +178,9 @@ func (iprr *IP_RR) UnmarshalJSON(data []byte) error {
 
 	iprr.Ip = _ip_rr.Ip
 	iprr.Weight = _ip_rr.Weight
+	iprr.Region = _ip_rr.Region
+	iprr.Tier = _ip_rr.Tier
+	iprr.HealthCheck = _ip_rr.HealthCheck
 
 	switch v := _ip_rr.Country.(type) {
 	case nil:
@@ -110,12 +226,13 @@ type IpHealthCheckConfig struct {
 	UpCount   int    `json:"up_count,omitempty"`
 	DownCount int    `json:"down_count,omitempty"`
 	Enable    bool   `json:"enable,omitempty"`
+	Group     string `json:"group,omitempty"`
 }
 
 type IpFilterConfig struct {
 	Count     string `json:"count,omitempty"`      // "multi", "single"
-	Order     string `json:"order,omitmpty"`       // "weighted", "rr", "none"
-	GeoFilter string `json:"geo_filter,omitempty"` // "country", "location", "asn", "asn+country", "none"
+	Order     string `json:"order,omitmpty"`       // "weighted", "rr", "sticky", "none"
+	GeoFilter string `json:"geo_filter,omitempty"` // "country", "location", "asn", "asn+country", "region", "none"
 }
 
 type CNAME_RRSet struct {
@@ -191,6 +308,78 @@ type TLSA_RR struct {
 	Certificate  string `json:"certificate"`
 }
 
+type NID_RRSet struct {
+	Ttl  uint32   `json:"ttl,omitempty"`
+	Data []NID_RR `json:"records,omitempty"`
+}
+
+type NID_RR struct {
+	Preference uint16 `json:"preference"`
+	NodeID     string `json:"node_id"` // "0014:4fff:ff20:ee64"
+}
+
+type L32_RRSet struct {
+	Ttl  uint32   `json:"ttl,omitempty"`
+	Data []L32_RR `json:"records,omitempty"`
+}
+
+type L32_RR struct {
+	Preference uint16 `json:"preference"`
+	Locator32  string `json:"locator32"` // "10.1.2.0"
+}
+
+type L64_RRSet struct {
+	Ttl  uint32   `json:"ttl,omitempty"`
+	Data []L64_RR `json:"records,omitempty"`
+}
+
+type L64_RR struct {
+	Preference uint16 `json:"preference"`
+	Locator64  string `json:"locator64"` // "2001:0db8:1140:1000"
+}
+
+type LP_RRSet struct {
+	Ttl  uint32  `json:"ttl,omitempty"`
+	Data []LP_RR `json:"records,omitempty"`
+}
+
+type LP_RR struct {
+	Preference uint16 `json:"preference"`
+	Fqdn       string `json:"fqdn"`
+}
+
+type URI_RRSet struct {
+	Ttl  uint32   `json:"ttl,omitempty"`
+	Data []URI_RR `json:"records,omitempty"`
+}
+
+type URI_RR struct {
+	Priority uint16 `json:"priority"`
+	Weight   uint16 `json:"weight"`
+	Target   string `json:"target"`
+}
+
+type OPENPGPKEY_RRSet struct {
+	Ttl  uint32          `json:"ttl,omitempty"`
+	Data []OPENPGPKEY_RR `json:"records,omitempty"`
+}
+
+type OPENPGPKEY_RR struct {
+	PublicKey string `json:"public_key"` // base64
+}
+
+type SMIMEA_RRSet struct {
+	Ttl  uint32      `json:"ttl,omitempty"`
+	Data []SMIMEA_RR `json:"records,omitempty"`
+}
+
+type SMIMEA_RR struct {
+	Usage        uint8  `json:"usage"`
+	Selector     uint8  `json:"selector"`
+	MatchingType uint8  `json:"matching_type"`
+	Certificate  string `json:"certificate"` // hex
+}
+
 type SOA_RRSet struct {
 	Ns      string   `json:"ns"`
 	MBox    string   `json:"MBox"`
@@ -3,14 +3,17 @@ package handler
 import (
 	"crypto/ecdsa"
 	"crypto/rsa"
+	"encoding/base32"
 	"errors"
+	"strings"
 
 	"github.com/hawell/logger"
 	"github.com/miekg/dns"
 )
 
 var (
-	NSecTypes = []uint16{dns.TypeRRSIG, dns.TypeNSEC}
+	NSecTypes  = []uint16{dns.TypeRRSIG, dns.TypeNSEC}
+	NSec3Types = []uint16{dns.TypeRRSIG}
 )
 
 type rrset struct {
@@ -53,6 +56,11 @@ func Sign(rrs []dns.RR, qname string, z *Zone) []dns.RR {
 			continue
 		case dns.TypeDNSKEY:
 			res = append(res, z.DnsKeySig)
+		case dns.TypeCDS, dns.TypeCDNSKEY:
+			// parent only trusts keys referenced by current DS, i.e. KSK
+			if rrsig, err := sign(set, qname, z.KSK, set[0].Header().Ttl); err == nil {
+				res = append(res, rrsig)
+			}
 		default:
 			if rrsig, err := sign(set, qname, z.ZSK, set[0].Header().Ttl); err == nil {
 				res = append(res, rrsig)
@@ -100,3 +108,65 @@ func NSec(name string, zone *Zone) dns.RR {
 
 	return nsec
 }
+
+// NSec3 returns an nsec3 record matching hashed name and covering nothing else, proving name has no data
+func NSec3(name string, zone *Zone) dns.RR {
+	params := zone.Config.Nsec3
+	hash := dns.HashName(name, dns.SHA1, params.Iterations, params.Salt)
+	next, _ := base32.HexEncoding.DecodeString(hash)
+	// next hashed owner is the immediate successor of hash
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return &dns.NSEC3{
+		Hdr:        dns.RR_Header{Name: strings.ToLower(hash) + "." + zone.Name, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: zone.Config.SOA.MinTtl},
+		Hash:       dns.SHA1,
+		Flags:      0,
+		Iterations: params.Iterations,
+		SaltLength: uint8(len(params.Salt) / 2),
+		Salt:       params.Salt,
+		HashLength: uint8(len(next)),
+		NextDomain: base32.HexEncoding.EncodeToString(next),
+		TypeBitMap: NSec3Types,
+	}
+}
+
+// NSec3Param returns zone's apex NSEC3PARAM record
+func NSec3Param(zone *Zone) dns.RR {
+	params := zone.Config.Nsec3
+	return &dns.NSEC3PARAM{
+		Hdr:        dns.RR_Header{Name: zone.Name, Rrtype: dns.TypeNSEC3PARAM, Class: dns.ClassINET, Ttl: 0},
+		Hash:       dns.SHA1,
+		Flags:      0,
+		Iterations: params.Iterations,
+		SaltLength: uint8(len(params.Salt) / 2),
+		Salt:       params.Salt,
+	}
+}
+
+// CDS is DS of zone's active KSK for parent side automation (RFC 7344)
+func CDS(zone *Zone) dns.RR {
+	ds := zone.KSK.DnsKey.ToDS(dns.SHA256)
+	if ds == nil {
+		return nil
+	}
+	return ds.ToCDS()
+}
+
+// CDNSKEY is zone's active KSK for parent side automation (RFC 7344)
+func CDNSKEY(zone *Zone) dns.RR {
+	return zone.KSK.DnsKey.ToCDNSKEY()
+}
+
+// CSYNC asks parent to sync apex NS and glue with current SOA serial (RFC 7477)
+func CSYNC(zone *Zone) dns.RR {
+	return &dns.CSYNC{
+		Hdr:        dns.RR_Header{Name: zone.Name, Rrtype: dns.TypeCSYNC, Class: dns.ClassINET, Ttl: zone.Config.SOA.Data.Hdr.Ttl},
+		Serial:     zone.Config.SOA.Data.Serial,
+		Flags:      1, // immediate
+		TypeBitMap: []uint16{dns.TypeA, dns.TypeNS, dns.TypeAAAA},
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"log"
 	"sort"
 	"testing"
+	"time"
 )
 
 var dnssecZone = "dnssec_test.com."
@@ -311,32 +312,32 @@ func TestDNSSEC(t *testing.T) {
 
 	h := NewHandler(&dnssecTestConfig)
 
-	if err := h.Redis.Del(dnssecZone); err != nil {
+	if err := h.Backend.Del(dnssecZone); err != nil {
 		fmt.Println(err)
 	}
 	for _, cmd := range dnssecEntries {
-		err := h.Redis.HSet("redins:zones:"+dnssecZone, cmd[0], cmd[1])
+		err := h.Backend.HSet("redins:zones:"+dnssecZone, cmd[0], cmd[1])
 		if err != nil {
 			log.Printf("[ERROR] cannot connect to redis: %s", err)
 			t.Fail()
 		}
 	}
-	if err := h.Redis.Set("redins:zones:"+dnssecZone+":config", dnssecConfig); err != nil {
+	if err := h.Backend.Set("redins:zones:"+dnssecZone+":config", dnssecConfig); err != nil {
 		fmt.Println(err)
 	}
-	if err := h.Redis.Set("redins:zones:"+dnssecZone+":zsk:pub", zskPub); err != nil {
+	if err := h.Backend.Set("redins:zones:"+dnssecZone+":zsk:pub", zskPub); err != nil {
 		fmt.Println(err)
 	}
-	if err := h.Redis.Set("redins:zones:"+dnssecZone+":zsk:priv", zskPriv); err != nil {
+	if err := h.Backend.Set("redins:zones:"+dnssecZone+":zsk:priv", zskPriv); err != nil {
 		fmt.Println(err)
 	}
-	if err := h.Redis.Set("redins:zones:"+dnssecZone+":ksk:pub", kskPub); err != nil {
+	if err := h.Backend.Set("redins:zones:"+dnssecZone+":ksk:pub", kskPub); err != nil {
 		fmt.Println(err)
 	}
-	if err := h.Redis.Set("redins:zones:"+dnssecZone+":ksk:priv", kskPriv); err != nil {
+	if err := h.Backend.Set("redins:zones:"+dnssecZone+":ksk:priv", kskPriv); err != nil {
 		fmt.Println(err)
 	}
-	if err := h.Redis.SAdd("redins:zones", dnssecZone); err != nil {
+	if err := h.Backend.SAdd("redins:zones", dnssecZone); err != nil {
 		fmt.Println(err)
 	}
 	h.LoadZones()
@@ -423,3 +424,466 @@ func TestDNSSEC(t *testing.T) {
 	}
 
 }
+
+func TestNSEC3(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := NewMemoryBackend()
+	_ = backend.SAdd("redins:zones", dnssecZone)
+	for _, cmd := range dnssecEntries {
+		_ = backend.HSet("redins:zones:"+dnssecZone, cmd[0], cmd[1])
+	}
+	_ = backend.Set("redins:zones:"+dnssecZone+":config", `{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.dnssec_test.com.","ns":"ns1.dnssec_test.com.","refresh":44,"retry":55,"expire":66},"dnssec": true, "nsec3":{"iterations":5, "salt":"aabbccdd"}}`)
+	_ = backend.Set("redins:zones:"+dnssecZone+":zsk:pub", zskPub)
+	_ = backend.Set("redins:zones:"+dnssecZone+":zsk:priv", zskPriv)
+	_ = backend.Set("redins:zones:"+dnssecZone+":ksk:pub", kskPub)
+	_ = backend.Set("redins:zones:"+dnssecZone+":ksk:priv", kskPriv)
+	h := NewHandlerWithBackend(&dnssecTestConfig, backend)
+
+	query := func(qname string, qtype uint16) *dns.Msg {
+		tc := test.Case{Qname: qname, Qtype: qtype, Do: true}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, tc.Msg()))
+		return w.Msg
+	}
+
+	resp := query(dnssecZone, dns.TypeNSEC3PARAM)
+	var param *dns.NSEC3PARAM
+	for _, rr := range resp.Answer {
+		if p, ok := rr.(*dns.NSEC3PARAM); ok {
+			param = p
+		}
+	}
+	if param == nil || param.Iterations != 5 || param.Salt != "AABBCCDD" && param.Salt != "aabbccdd" || param.SaltLength != 4 || param.Hash != dns.SHA1 {
+		fmt.Println("unexpected NSEC3PARAM : ", resp)
+		t.Fail()
+	}
+
+	resp = query("nxdomain.x.dnssec_test.com.", dns.TypeAAAA)
+	var nsec3 *dns.NSEC3
+	for _, rr := range resp.Ns {
+		if _, ok := rr.(*dns.NSEC); ok {
+			fmt.Println("NSEC used in NSEC3 zone : ", resp)
+			t.Fail()
+		}
+		if n, ok := rr.(*dns.NSEC3); ok {
+			nsec3 = n
+		}
+	}
+	if nsec3 == nil || !nsec3.Match("nxdomain.x.dnssec_test.com.") || nsec3.Iterations != 5 || nsec3.Cover("other.dnssec_test.com.") {
+		fmt.Println("unexpected NSEC3 : ", resp)
+		t.Fail()
+	}
+}
+
+func TestEmptyNonTerminal(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := NewMemoryBackend()
+	_ = backend.SAdd("redins:zones", dnssecZone)
+	for _, cmd := range dnssecEntries {
+		_ = backend.HSet("redins:zones:"+dnssecZone, cmd[0], cmd[1])
+	}
+	_ = backend.HSet("redins:zones:"+dnssecZone, "host.ent", `{"a":{"ttl":300,"records":[{"ip":"129.0.2.1"}]}}`)
+	_ = backend.Set("redins:zones:"+dnssecZone+":config", dnssecConfig)
+	_ = backend.Set("redins:zones:"+dnssecZone+":zsk:pub", zskPub)
+	_ = backend.Set("redins:zones:"+dnssecZone+":zsk:priv", zskPriv)
+	_ = backend.Set("redins:zones:"+dnssecZone+":ksk:pub", kskPub)
+	_ = backend.Set("redins:zones:"+dnssecZone+":ksk:priv", kskPriv)
+	h := NewHandlerWithBackend(&dnssecTestConfig, backend)
+
+	query := func(do bool) *dns.Msg {
+		tc := test.Case{Qname: "ent.dnssec_test.com.", Qtype: dns.TypeTXT, Do: do}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, tc.Msg()))
+		return w.Msg
+	}
+
+	// ent is not covered by the zone's wildcard
+	resp := query(false)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 || len(resp.Ns) != 1 || resp.Ns[0].Header().Rrtype != dns.TypeSOA {
+		fmt.Println("empty non-terminal should be NODATA : ", resp)
+		t.Fail()
+	}
+
+	resp = query(true)
+	var nsec *dns.NSEC
+	soa, sigs := false, 0
+	for _, rr := range resp.Ns {
+		switch v := rr.(type) {
+		case *dns.NSEC:
+			nsec = v
+		case *dns.SOA:
+			soa = true
+		case *dns.RRSIG:
+			sigs++
+		}
+	}
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 || !soa || sigs != 2 || nsec == nil {
+		fmt.Println("signed empty non-terminal should be NODATA : ", resp)
+		t.FailNow()
+	}
+	// nsec proves ent exists with no types while not covering names below it
+	if nsec.Header().Name != "ent.dnssec_test.com." || len(nsec.TypeBitMap) != 2 || nsec.TypeBitMap[0] != dns.TypeRRSIG || nsec.TypeBitMap[1] != dns.TypeNSEC {
+		fmt.Println("unexpected nsec : ", nsec)
+		t.Fail()
+	}
+	if nsec.NextDomain != "\\000.ent.dnssec_test.com." {
+		fmt.Println("nsec covers existing name : ", nsec)
+		t.Fail()
+	}
+}
+
+func TestZskRollover(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := NewMemoryBackend()
+	_ = backend.SAdd("redins:zones", dnssecZone)
+	for _, cmd := range dnssecEntries {
+		_ = backend.HSet("redins:zones:"+dnssecZone, cmd[0], cmd[1])
+	}
+	_ = backend.Set("redins:zones:"+dnssecZone+":config", `{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.dnssec_test.com.","ns":"ns1.dnssec_test.com.","refresh":44,"retry":55,"expire":66},"dnssec": true, "zsk_rollover":{"lifetime":100, "pre_publish":20, "retire":30}}`)
+	_ = backend.Set("redins:zones:"+dnssecZone+":zsk:pub", zskPub)
+	_ = backend.Set("redins:zones:"+dnssecZone+":zsk:priv", zskPriv)
+	_ = backend.Set("redins:zones:"+dnssecZone+":ksk:pub", kskPub)
+	_ = backend.Set("redins:zones:"+dnssecZone+":ksk:priv", kskPriv)
+	h := NewHandlerWithBackend(&dnssecTestConfig, backend)
+	clock := time.Now()
+	h.now = func() time.Time { return clock }
+
+	ksk, _ := dns.NewRR(kskPub)
+	oldZsk, _ := dns.NewRR(zskPub)
+	oldTag := oldZsk.(*dns.DNSKEY).KeyTag()
+	// returns key tags of published zsks and signer of A records
+	query := func() ([]uint16, uint16) {
+		h.ZoneCache.Wait()
+		tc := test.Case{Qname: dnssecZone, Qtype: dns.TypeDNSKEY, Do: true}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, tc.Msg()))
+		var zsks []uint16
+		var keys []dns.RR
+		var sig *dns.RRSIG
+		for _, rr := range w.Msg.Answer {
+			switch v := rr.(type) {
+			case *dns.DNSKEY:
+				keys = append(keys, v)
+				if v.Flags == 256 {
+					zsks = append(zsks, v.KeyTag())
+				}
+			case *dns.RRSIG:
+				sig = v
+			}
+		}
+		if sig == nil || sig.Verify(ksk.(*dns.DNSKEY), keys) != nil {
+			fmt.Println("invalid DNSKEY signature : ", w.Msg)
+			t.Fail()
+		}
+
+		tc = test.Case{Qname: "x." + dnssecZone, Qtype: dns.TypeAAAA, Do: true}
+		w = test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, tc.Msg()))
+		var signer uint16
+		for _, rr := range w.Msg.Answer {
+			if rrsig, ok := rr.(*dns.RRSIG); ok {
+				signer = rrsig.KeyTag
+			}
+		}
+		return zsks, signer
+	}
+	rollover := func(changed bool) {
+		if c, err := h.RolloverZSK(dnssecZone); err != nil || c != changed {
+			fmt.Println("unexpected rollover result : ", c, err)
+			t.Fail()
+		}
+	}
+
+	rollover(false)
+	if zsks, signer := query(); len(zsks) != 1 || zsks[0] != oldTag || signer != oldTag {
+		fmt.Println("unexpected keys before rollover : ", zsks, signer)
+		t.Fail()
+	}
+
+	// pre-publish : new zsk is published, old one still signs
+	clock = clock.Add(85 * time.Second)
+	rollover(true)
+	zsks, signer := query()
+	if len(zsks) != 2 || zsks[0] != oldTag || signer != oldTag {
+		fmt.Println("unexpected keys in pre-publish window : ", zsks, signer)
+		t.FailNow()
+	}
+	newTag := zsks[1]
+	clock = clock.Add(10 * time.Second)
+	rollover(false)
+
+	// rollover : new zsk signs, old one is still published
+	clock = clock.Add(10 * time.Second)
+	rollover(true)
+	if zsks, signer := query(); len(zsks) != 2 || zsks[0] != newTag || zsks[1] != oldTag || signer != newTag {
+		fmt.Println("unexpected keys after rollover : ", zsks, signer)
+		t.Fail()
+	}
+
+	// retire
+	clock = clock.Add(30 * time.Second)
+	rollover(true)
+	if zsks, signer := query(); len(zsks) != 1 || zsks[0] != newTag || signer != newTag {
+		fmt.Println("unexpected keys after retire : ", zsks, signer)
+		t.Fail()
+	}
+
+	// another instance sharing the backend
+	h2 := NewHandlerWithBackend(&dnssecTestConfig, backend)
+	h2.now = h.now
+	if c, err := h2.RolloverZSK(dnssecZone); err != nil || c {
+		fmt.Println("unexpected rollover result of second instance : ", c, err)
+		t.Fail()
+	}
+
+	// no rollover while zone is locked by another instance
+	clock = clock.Add(55 * time.Second)
+	if locked, _ := backend.Lock(zskKey(dnssecZone, "lock"), "other", time.Minute); !locked {
+		fmt.Println("cannot lock zone")
+		t.FailNow()
+	}
+	rollover(false)
+	if next, _ := backend.Get(zskKey(dnssecZone, "next:pub")); next != "" {
+		fmt.Println("zsk published without lock")
+		t.Fail()
+	}
+	_ = backend.Unlock(zskKey(dnssecZone, "lock"), "other")
+
+	// keys published by second instance are reloaded by first one
+	if c, err := h2.RolloverZSK(dnssecZone); err != nil || !c {
+		fmt.Println("unexpected rollover result of second instance : ", c, err)
+		t.Fail()
+	}
+	rollover(true)
+	if zsks, signer := query(); len(zsks) != 2 || zsks[0] != newTag || signer != newTag {
+		fmt.Println("keys of second instance are not loaded : ", zsks, signer)
+		t.Fail()
+	}
+	rollover(false)
+}
+
+func TestCDS(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := NewMemoryBackend()
+	_ = backend.SAdd("redins:zones", dnssecZone)
+	for _, cmd := range dnssecEntries {
+		_ = backend.HSet("redins:zones:"+dnssecZone, cmd[0], cmd[1])
+	}
+	_ = backend.Set("redins:zones:"+dnssecZone+":config", dnssecConfig)
+	_ = backend.Set("redins:zones:"+dnssecZone+":zsk:pub", zskPub)
+	_ = backend.Set("redins:zones:"+dnssecZone+":zsk:priv", zskPriv)
+	_ = backend.Set("redins:zones:"+dnssecZone+":ksk:pub", kskPub)
+	_ = backend.Set("redins:zones:"+dnssecZone+":ksk:priv", kskPriv)
+	h := NewHandlerWithBackend(&dnssecTestConfig, backend)
+	ksk, _ := dns.NewRR(kskPub)
+
+	query := func(qname string, qtype uint16) *dns.Msg {
+		tc := test.Case{Qname: qname, Qtype: qtype, Do: true}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, tc.Msg()))
+		return w.Msg
+	}
+
+	resp := query(dnssecZone, dns.TypeCDS)
+	ds := ksk.(*dns.DNSKEY).ToDS(dns.SHA256)
+	var cds *dns.CDS
+	var sig *dns.RRSIG
+	for _, rr := range resp.Answer {
+		switch v := rr.(type) {
+		case *dns.CDS:
+			cds = v
+		case *dns.RRSIG:
+			sig = v
+		}
+	}
+	if cds == nil || cds.KeyTag != ds.KeyTag || cds.Algorithm != ds.Algorithm || cds.DigestType != ds.DigestType || cds.Digest != ds.Digest {
+		fmt.Println("cds does not match ksk : ", resp)
+		t.FailNow()
+	}
+	if sig == nil || sig.Verify(ksk.(*dns.DNSKEY), []dns.RR{cds}) != nil {
+		fmt.Println("cds should be signed by ksk : ", resp)
+		t.Fail()
+	}
+
+	resp = query(dnssecZone, dns.TypeCDNSKEY)
+	if len(resp.Answer) == 0 {
+		fmt.Println("missing cdnskey : ", resp)
+		t.FailNow()
+	}
+	if cdnskey, ok := resp.Answer[0].(*dns.CDNSKEY); !ok || cdnskey.PublicKey != ksk.(*dns.DNSKEY).PublicKey || cdnskey.Flags != 257 {
+		fmt.Println("cdnskey does not match ksk : ", resp)
+		t.Fail()
+	}
+
+	resp = query(dnssecZone, dns.TypeCSYNC)
+	if len(resp.Answer) == 0 {
+		fmt.Println("missing csync : ", resp)
+		t.FailNow()
+	}
+	if csync, ok := resp.Answer[0].(*dns.CSYNC); !ok || csync.Serial != h.LoadZone(dnssecZone).Config.SOA.Data.Serial {
+		fmt.Println("csync serial does not match soa : ", resp)
+		t.Fail()
+	}
+
+	// only apex publishes parent side records
+	resp = query("x."+dnssecZone, dns.TypeCDS)
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == dns.TypeCDS {
+			fmt.Println("cds served below apex : ", resp)
+			t.Fail()
+		}
+	}
+}
+
+func TestDnssecFlags(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := NewMemoryBackend()
+	_ = backend.SAdd("redins:zones", dnssecZone)
+	for _, cmd := range dnssecEntries {
+		_ = backend.HSet("redins:zones:"+dnssecZone, cmd[0], cmd[1])
+	}
+	_ = backend.Set("redins:zones:"+dnssecZone+":config", dnssecConfig)
+	_ = backend.Set("redins:zones:"+dnssecZone+":zsk:pub", zskPub)
+	_ = backend.Set("redins:zones:"+dnssecZone+":zsk:priv", zskPriv)
+	_ = backend.Set("redins:zones:"+dnssecZone+":ksk:pub", kskPub)
+	_ = backend.Set("redins:zones:"+dnssecZone+":ksk:priv", kskPriv)
+	h := NewHandlerWithBackend(&dnssecTestConfig, backend)
+
+	for _, tc := range []struct {
+		cd, do, ad bool
+	}{
+		{false, false, false},
+		{true, false, false},
+		{false, true, false},
+		{true, true, false},
+		{true, true, true},
+	} {
+		r := test.Case{Qname: "x." + dnssecZone, Qtype: dns.TypeAAAA, Do: tc.do}.Msg()
+		r.CheckingDisabled = tc.cd
+		r.AuthenticatedData = tc.ad
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, r))
+		resp := w.Msg
+
+		if resp.CheckingDisabled != tc.cd {
+			fmt.Println("cd bit should be copied from query : ", tc, resp)
+			t.Fail()
+		}
+		// authoritative data is not validated, ad is never set
+		if resp.AuthenticatedData || !resp.Authoritative {
+			fmt.Println("unexpected ad or aa bit : ", tc, resp)
+			t.Fail()
+		}
+		if opt := resp.IsEdns0(); (opt != nil && opt.Do()) != tc.do {
+			fmt.Println("do bit should be copied from query : ", tc, resp)
+			t.Fail()
+		}
+		signed := false
+		for _, rr := range resp.Answer {
+			if rr.Header().Rrtype == dns.TypeRRSIG {
+				signed = true
+			}
+		}
+		if len(resp.Answer) == 0 || signed != tc.do {
+			fmt.Println("signatures should depend on do bit only : ", tc, resp)
+			t.Fail()
+		}
+	}
+
+	// signed negative answers and referrals are not validated either (rfc4035 section 3.1.6)
+	for _, q := range []struct {
+		qname string
+		qtype uint16
+	}{
+		{"x." + dnssecZone, dns.TypeCAA},
+		{"nonexistent.x." + dnssecZone, dns.TypeA},
+		{"y." + dnssecZone, dns.TypeA},
+	} {
+		r := test.Case{Qname: q.qname, Qtype: q.qtype, Do: true}.Msg()
+		r.AuthenticatedData = true
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, r))
+		resp := w.Msg
+		if resp.AuthenticatedData || len(resp.Ns) == 0 {
+			fmt.Println("ad bit should not be set on signed authority answers : ", q.qname, resp)
+			t.Fail()
+		}
+	}
+}
+
+func TestSignRoundRobin(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := NewMemoryBackend()
+	_ = backend.SAdd("redins:zones", dnssecZone)
+	for _, cmd := range dnssecEntries {
+		_ = backend.HSet("redins:zones:"+dnssecZone, cmd[0], cmd[1])
+	}
+	_ = backend.HSet("redins:zones:"+dnssecZone, "rr", `{"a":{"ttl":300, "filter":{"count":"multi","order":"rr","geo_filter":"none"}, "records":[{"ip":"1.1.1.1"},{"ip":"2.2.2.2"},{"ip":"3.3.3.3"},{"ip":"4.4.4.4"}]}}`)
+	_ = backend.Set("redins:zones:"+dnssecZone+":config", dnssecConfig)
+	_ = backend.Set("redins:zones:"+dnssecZone+":zsk:pub", zskPub)
+	_ = backend.Set("redins:zones:"+dnssecZone+":zsk:priv", zskPriv)
+	_ = backend.Set("redins:zones:"+dnssecZone+":ksk:pub", kskPub)
+	_ = backend.Set("redins:zones:"+dnssecZone+":ksk:priv", kskPriv)
+	h := NewHandlerWithBackend(&dnssecTestConfig, backend)
+	zsk, _ := dns.NewRR(zskPub)
+
+	orders := make(map[string]struct{})
+	for i := 0; i < 50; i++ {
+		tc := test.Case{Qname: "rr." + dnssecZone, Qtype: dns.TypeA, Do: true}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, tc.Msg()))
+		var set []dns.RR
+		var sig *dns.RRSIG
+		order := ""
+		for _, rr := range w.Msg.Answer {
+			switch v := rr.(type) {
+			case *dns.A:
+				set = append(set, v)
+				order += v.A.String() + " "
+			case *dns.RRSIG:
+				sig = v
+			}
+		}
+		orders[order] = struct{}{}
+		if len(set) != 4 || sig == nil || sig.Verify(zsk.(*dns.DNSKEY), set) != nil {
+			fmt.Println("invalid signature for served order : ", w.Msg)
+			t.Fail()
+		}
+	}
+	if len(orders) < 2 {
+		fmt.Println("round robin order expected : ", orders)
+		t.Fail()
+	}
+}
+
+func TestSignedRewrite(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := NewMemoryBackend()
+	_ = backend.SAdd("redins:zones", dnssecZone)
+	for _, cmd := range dnssecEntries {
+		_ = backend.HSet("redins:zones:"+dnssecZone, cmd[0], cmd[1])
+	}
+	_ = backend.Set("redins:zones:"+dnssecZone+":config", dnssecConfig)
+	_ = backend.Set("redins:zones:"+dnssecZone+":zsk:pub", zskPub)
+	_ = backend.Set("redins:zones:"+dnssecZone+":zsk:priv", zskPriv)
+	_ = backend.Set("redins:zones:"+dnssecZone+":ksk:pub", kskPub)
+	_ = backend.Set("redins:zones:"+dnssecZone+":ksk:priv", kskPriv)
+	config := dnssecTestConfig
+	config.Rewrite = map[string]string{"old.example.com": "x.dnssec_test.com"}
+	h := NewHandlerWithBackend(&config, backend)
+
+	tc := test.Case{Qname: "old.example.com.", Qtype: dns.TypeAAAA, Do: true}
+	w := test.NewRecorder(&test.ResponseWriter{})
+	h.HandleRequest(NewRequestContext(w, tc.Msg()))
+	resp := w.Msg
+	covered := make(map[uint16]bool)
+	for _, rr := range resp.Answer {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			covered[sig.TypeCovered] = true
+		}
+	}
+	if len(resp.Answer) != 4 || resp.Answer[0].Header().Rrtype != dns.TypeCNAME || !covered[dns.TypeCNAME] || !covered[dns.TypeAAAA] {
+		fmt.Println("rewrite cname should be signed with target's records : ", resp)
+		t.Fail()
+	}
+}
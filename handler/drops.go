@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"sync/atomic"
+
+	"github.com/hawell/logger"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	DropMalformed = "malformed" // rejected by ValidateRequest
+	DropRateLimit = "ratelimit" // over client's rate limit
+	DropDenied    = "denied"    // client is blacklisted
+)
+
+var droppedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "redins",
+	Subsystem: "server",
+	Name:      "dropped_requests_total",
+	Help:      "number of requests rejected before handling",
+}, []string{"reason"})
+
+func init() {
+	prometheus.MustRegister(droppedRequests)
+}
+
+type DropLogConfig struct {
+	SampleRate int `json:"sample_rate"`
+}
+
+// DropMonitor counts rejected requests by reason and logs one of every SampleRate of them
+type DropMonitor struct {
+	SampleRate uint64
+	counts     map[string]*uint64
+}
+
+func NewDropMonitor(config *DropLogConfig) *DropMonitor {
+	d := &DropMonitor{counts: make(map[string]*uint64)}
+	if config.SampleRate > 0 {
+		d.SampleRate = uint64(config.SampleRate)
+	}
+	for _, reason := range []string{DropMalformed, DropRateLimit, DropDenied} {
+		d.counts[reason] = new(uint64)
+	}
+	return d
+}
+
+// Drop records a request rejected for reason, it returns true if the request is logged
+func (d *DropMonitor) Drop(reason string, source string, r *dns.Msg) bool {
+	droppedRequests.WithLabelValues(reason).Inc()
+	count, ok := d.counts[reason]
+	if !ok || d.SampleRate == 0 {
+		return false
+	}
+	if (atomic.AddUint64(count, 1)-1)%d.SampleRate != 0 {
+		return false
+	}
+	question := ""
+	if len(r.Question) > 0 {
+		question = r.Question[0].String()
+	}
+	logger.Default.Debugf("dropped %s request from %s : id %d, opcode %s, %d questions %s", reason, source, r.Id, dns.OpcodeToString[r.Opcode], len(r.Question), question)
+	return true
+}
+
+// RejectInvalid answers requests failing ValidateRequest with their rcode, returns true if r is rejected
+func (d *DropMonitor) RejectInvalid(w dns.ResponseWriter, r *dns.Msg) bool {
+	rcode := ValidateRequest(r)
+	if rcode == dns.RcodeSuccess {
+		return false
+	}
+	d.Drop(DropMalformed, w.RemoteAddr().String(), r)
+	m := new(dns.Msg)
+	m.SetRcode(r, rcode)
+	_ = w.WriteMsg(m)
+	return true
+}
@@ -0,0 +1,51 @@
+package handler
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"net"
+	"time"
+)
+
+// geoCacheKey identifies geo selection of rrset for clients in sourceIp's /24 or /48,
+// rrset content and health mask are part of key so record and health changes miss the cache
+func geoCacheKey(sourceIp net.IP, rrset *IP_RRSet, mask []int) uint64 {
+	hash := fnv.New64a()
+	if v4 := sourceIp.To4(); v4 != nil {
+		hash.Write(v4.Mask(net.CIDRMask(24, 32)))
+	} else {
+		hash.Write(sourceIp.Mask(net.CIDRMask(48, 128)))
+	}
+	hash.Write([]byte(rrset.FilterConfig.GeoFilter))
+	buf := make([]byte, 8)
+	for i := range rrset.Data {
+		binary.BigEndian.PutUint64(buf, uint64(mask[i]))
+		hash.Write(buf)
+		hash.Write(rrset.Data[i].Ip)
+		hash.Write([]byte(rrset.Data[i].Region))
+		for _, country := range rrset.Data[i].Country {
+			hash.Write([]byte(country))
+		}
+		for _, asn := range rrset.Data[i].ASN {
+			binary.BigEndian.PutUint64(buf, uint64(asn))
+			hash.Write(buf)
+		}
+		hash.Write([]byte{0})
+	}
+	return hash.Sum64()
+}
+
+// cachedFilterGeoIp is FilterGeoIp with results shared by clients of the same subnet for geoip cache_ttl
+func (h *DnsRequestHandler) cachedFilterGeoIp(sourceIp net.IP, rrset *IP_RRSet, mask []int) []int {
+	if h.geoCache == nil || rrset.FilterConfig.GeoFilter == "" || rrset.FilterConfig.GeoFilter == "none" {
+		return h.FilterGeoIp(sourceIp, rrset, mask)
+	}
+	key := geoCacheKey(normalizeIp(sourceIp), rrset, mask)
+	if val, found := h.geoCache.Get(key); found {
+		// cached mask is shared, later filters modify mask in place
+		return append(mask[:0], val.([]int)...)
+	}
+	mask = h.FilterGeoIp(sourceIp, rrset, mask)
+	h.geoCache.SetWithTTL(key, append([]int(nil), mask...), 1, time.Duration(h.Config.GeoIp.CacheTtl)*time.Second)
+	return mask
+}
@@ -1,46 +1,224 @@
 package handler
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"math"
 	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/hawell/logger"
+	"github.com/json-iterator/go"
 	"github.com/oschwald/maxminddb-golang"
 )
 
 type GeoIp struct {
-	Enable    bool
-	CountryDB *maxminddb.Reader
-	ASNDB     *maxminddb.Reader
+	Enable          bool
+	CountryDB       *maxminddb.Reader
+	ASNDB           *maxminddb.Reader
+	DefaultLocation *GeoLocation
+	CountryRegions  map[string][]string
+	// Distances holds effective distances in km from client countries to candidate ips
+	Distances map[string]map[string]float64
+	// Strategy is the ordered list of steps of "strategy" geo filter
+	Strategy []string
+	dbLock   sync.RWMutex // guards databases swapped by refresh
+	quit     chan struct{}
+}
+
+type GeoIpProvider interface {
+	GetSameCountry(sourceIp net.IP, ips []IP_RR, mask []int) []int
+	GetSameASN(sourceIp net.IP, ips []IP_RR, mask []int) []int
+	GetMinimumDistance(sourceIp net.IP, ips []IP_RR, mask []int) []int
+	GetSameRegion(sourceIp net.IP, ips []IP_RR, mask []int) []int
+	GetByStrategy(sourceIp net.IP, ips []IP_RR, mask []int) []int
+	GetCountry(ip net.IP) (string, error)
+	GetCoordinates(ip net.IP) (float64, float64, error)
+	GetASN(ip net.IP) (uint, error)
 }
 
 type GeoIpConfig struct {
-	Enable    bool   `json:"enable"`
-	CountryDB string `json:"country_db"`
-	ASNDB     string `json:"asn_db"`
+	Enable          bool                `json:"enable"`
+	CountryDB       string              `json:"country_db"`
+	ASNDB           string              `json:"asn_db"`
+	CountryDBSha256 string              `json:"country_db_sha256,omitempty"`
+	ASNDBSha256     string              `json:"asn_db_sha256,omitempty"`
+	DefaultLocation *GeoLocation        `json:"default_location,omitempty"`
+	Regions         map[string][]string `json:"regions,omitempty"`
+	HealthTieBreak  bool                `json:"health_tie_break"`
+	DistanceFile    string              `json:"distance_file,omitempty"`
+	Strategy        []string            `json:"strategy,omitempty"`
+	CacheTtl        int                 `json:"cache_ttl,omitempty"`
+	RefreshInterval int                 `json:"refresh_interval,omitempty"` // seconds between downloads of url databases
 }
 
+type GeoLocation struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+var errGeoIpNotFound = errors.New("address not found in geoip database")
+
+var defaultGeoIpStrategy = []string{"country", "continent", "distance", "all"}
+
 func NewGeoIp(config *GeoIpConfig) *GeoIp {
 	g := &GeoIp{
-		Enable: config.Enable,
+		Enable:          config.Enable,
+		DefaultLocation: config.DefaultLocation,
+		CountryRegions:  make(map[string][]string),
+		Strategy:        config.Strategy,
+	}
+	if len(g.Strategy) == 0 {
+		g.Strategy = defaultGeoIpStrategy
+	}
+	for region, countries := range config.Regions {
+		for _, country := range countries {
+			g.CountryRegions[country] = append(g.CountryRegions[country], region)
+		}
 	}
 	var err error
+	if config.DistanceFile != "" {
+		if g.Distances, err = loadDistances(config.DistanceFile); err != nil {
+			logger.Default.Errorf("cannot load distance file %s: %s", config.DistanceFile, err)
+		}
+	}
 	if g.Enable {
-		g.CountryDB, err = maxminddb.Open(config.CountryDB)
+		g.CountryDB, err = OpenGeoIpDB(config.CountryDB, config.CountryDBSha256)
 		if err != nil {
 			logger.Default.Errorf("cannot open maxminddb file %s: %s", config.CountryDB, err)
 		}
-		g.ASNDB, err = maxminddb.Open(config.ASNDB)
+		g.ASNDB, err = OpenGeoIpDB(config.ASNDB, config.ASNDBSha256)
 		if err != nil {
 			logger.Default.Errorf("cannot open maxminddb file %s: %s", config.ASNDB, err)
 		}
+		// each db is used independently, filters depending on a missing db leave records unfiltered
+		if g.CountryDB == nil && g.ASNDB != nil {
+			logger.Default.Warning("country db not loaded, only asn based geo filters are applied")
+		} else if g.CountryDB != nil && g.ASNDB == nil {
+			logger.Default.Warning("asn db not loaded, only country and location based geo filters are applied")
+		}
+		if config.RefreshInterval > 0 && (isRemoteDB(config.CountryDB) || isRemoteDB(config.ASNDB)) {
+			g.quit = make(chan struct{})
+			go g.refresh(*config, time.Duration(config.RefreshInterval)*time.Second)
+		}
 	}
 	// defer g.db.Close()
 	return g
 }
 
+// ShutDown stops refreshing databases
+func (g *GeoIp) ShutDown() {
+	if g.quit != nil {
+		close(g.quit)
+	}
+}
+
+func (g *GeoIp) countryDB() *maxminddb.Reader {
+	g.dbLock.RLock()
+	defer g.dbLock.RUnlock()
+	return g.CountryDB
+}
+
+func (g *GeoIp) asnDB() *maxminddb.Reader {
+	g.dbLock.RLock()
+	defer g.dbLock.RUnlock()
+	return g.ASNDB
+}
+
+// refresh downloads url databases every interval and swaps loaded ones, a database failing download or
+// checksum verification is kept
+func (g *GeoIp) refresh(config GeoIpConfig, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.quit:
+			return
+		case <-ticker.C:
+			g.refreshDB(config.CountryDB, config.CountryDBSha256, &g.CountryDB)
+			g.refreshDB(config.ASNDB, config.ASNDBSha256, &g.ASNDB)
+		}
+	}
+}
+
+func (g *GeoIp) refreshDB(location string, checksum string, target **maxminddb.Reader) {
+	if !isRemoteDB(location) {
+		return
+	}
+	db, err := OpenGeoIpDB(location, checksum)
+	if err != nil {
+		logger.Default.Errorf("cannot refresh maxminddb %s: %s", location, err)
+		return
+	}
+	// readers of downloaded databases are memory backed, old one is left to gc as requests may still use it
+	g.dbLock.Lock()
+	*target = db
+	g.dbLock.Unlock()
+}
+
+// loadDistances reads a json file of effective distances : {"<client country>": {"<candidate ip>": <km>}}
+func loadDistances(path string) (map[string]map[string]float64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	distances := make(map[string]map[string]float64)
+	if err := jsoniter.Unmarshal(data, &distances); err != nil {
+		return nil, err
+	}
+	return distances, nil
+}
+
+// OpenGeoIpDB opens a maxminddb from a local path or downloads it from an http(s) url, verifying its sha256 checksum if given
+func OpenGeoIpDB(location string, checksum string) (*maxminddb.Reader, error) {
+	remote := isRemoteDB(location)
+	if !remote && checksum == "" {
+		return maxminddb.Open(location)
+	}
+	var data []byte
+	var err error
+	if remote {
+		data, err = downloadDB(location)
+	} else {
+		data, err = ioutil.ReadFile(location)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if checksum != "" {
+		sum := sha256.Sum256(data)
+		if !strings.EqualFold(hex.EncodeToString(sum[:]), checksum) {
+			return nil, errors.New("checksum mismatch")
+		}
+	}
+	return maxminddb.FromBytes(data)
+}
+
+func isRemoteDB(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+func downloadDB(url string) ([]byte, error) {
+	client := &http.Client{Timeout: 60 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download failed : %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
 func (g *GeoIp) GetSameCountry(sourceIp net.IP, ips []IP_RR, mask []int) []int {
-	if !g.Enable || g.CountryDB == nil {
+	if !g.Enable || g.countryDB() == nil {
 		return mask
 	}
 	sourceCountry, err := g.GetCountry(sourceIp)
@@ -90,7 +268,7 @@ func (g *GeoIp) GetSameCountry(sourceIp net.IP, ips []IP_RR, mask []int) []int {
 }
 
 func (g *GeoIp) GetSameASN(sourceIp net.IP, ips []IP_RR, mask []int) []int {
-	if !g.Enable || g.ASNDB == nil {
+	if !g.Enable || g.asnDB() == nil {
 		return mask
 	}
 	sourceASN, err := g.GetASN(sourceIp)
@@ -139,30 +317,149 @@ func (g *GeoIp) GetSameASN(sourceIp net.IP, ips []IP_RR, mask []int) []int {
 	return mask
 }
 
+// GetSameRegion keeps records whose region contains client's country, falls back to minimum distance otherwise
+func (g *GeoIp) GetSameRegion(sourceIp net.IP, ips []IP_RR, mask []int) []int {
+	if !g.Enable || g.countryDB() == nil {
+		return mask
+	}
+	sourceCountry, err := g.GetCountry(sourceIp)
+	if err != nil {
+		logger.Default.Error("getSameRegion failed")
+		return g.GetMinimumDistance(sourceIp, ips, mask)
+	}
+
+	regions := g.CountryRegions[sourceCountry]
+	passed := 0
+	if len(regions) > 0 {
+	outer:
+		for i, x := range mask {
+			if x == IpMaskWhite {
+				for _, region := range regions {
+					if ips[i].Region == region {
+						passed++
+						continue outer
+					}
+				}
+				mask[i] = IpMaskGrey
+			} else {
+				mask[i] = IpMaskBlack
+			}
+		}
+	}
+	if passed > 0 {
+		return mask
+	}
+
+	for i := range mask {
+		if mask[i] == IpMaskGrey {
+			mask[i] = IpMaskWhite
+		}
+	}
+	return g.GetMinimumDistance(sourceIp, ips, mask)
+}
+
+// GetByStrategy applies strategy steps in order, first step keeping any record wins :
+// "country" - same country, "continent" - same continent, "distance" - nearest destination, "all" - all records
+func (g *GeoIp) GetByStrategy(sourceIp net.IP, ips []IP_RR, mask []int) []int {
+	if !g.Enable || g.countryDB() == nil {
+		return mask
+	}
+	for _, step := range g.Strategy {
+		var match func(i int) bool
+		switch step {
+		case "country":
+			sourceCountry, _ := g.GetCountry(sourceIp)
+			if sourceCountry == "" {
+				continue
+			}
+			match = func(i int) bool {
+				for _, country := range ips[i].Country {
+					if country == sourceCountry {
+						return true
+					}
+				}
+				return false
+			}
+		case "continent":
+			sourceContinent, _ := g.GetContinent(sourceIp)
+			if sourceContinent == "" {
+				continue
+			}
+			match = func(i int) bool {
+				continent, _ := g.GetContinent(ips[i].Ip)
+				return continent == sourceContinent
+			}
+		case "distance":
+			return g.GetMinimumDistance(sourceIp, ips, mask)
+		case "all":
+			return mask
+		default:
+			logger.Default.Errorf("invalid geoip strategy step : %s", step)
+			continue
+		}
+
+		passed := 0
+		for i, x := range mask {
+			if x == IpMaskWhite && match(i) {
+				passed++
+			}
+		}
+		if passed == 0 {
+			continue
+		}
+		for i, x := range mask {
+			if x != IpMaskWhite {
+				mask[i] = IpMaskBlack
+			} else if !match(i) {
+				mask[i] = IpMaskGrey
+			}
+		}
+		return mask
+	}
+	return mask
+}
+
+const earthRadius = 6371.0
+
 // TODO: add a margin for minimum distance
 func (g *GeoIp) GetMinimumDistance(sourceIp net.IP, ips []IP_RR, mask []int) []int {
-	if !g.Enable || g.CountryDB == nil {
+	if !g.Enable || g.countryDB() == nil {
 		return mask
 	}
 	minDistance := 1000.0
-	dists := make([]float64, 0, len(mask))
+	// indexed like mask, only white entries are set
+	dists := make([]float64, len(mask))
 	slat, slong, err := g.GetCoordinates(sourceIp)
 	if err != nil {
-		logger.Default.Error("getMinimumDistance failed")
-		return mask
+		// client cannot be located, either measure from the configured default location
+		// or keep all candidates
+		if g.DefaultLocation == nil {
+			return mask
+		}
+		slat, slong = g.DefaultLocation.Latitude, g.DefaultLocation.Longitude
+	}
+	var overrides map[string]float64
+	if len(g.Distances) > 0 {
+		sourceCountry, _ := g.GetCountry(sourceIp)
+		overrides = g.Distances[sourceCountry]
 	}
 	for i, x := range mask {
 		if x == IpMaskWhite {
 			destinationIp := ips[i].Ip
-			dlat, dlong, _ := g.GetCoordinates(destinationIp)
-			d, err := g.getDistance(slat, slong, dlat, dlong)
-			if err != nil {
-				d = 1000.0
+			var d float64
+			if km, ok := overrides[destinationIp.String()]; ok {
+				// overrides are in km, geodesic distances are central angles
+				d = km / earthRadius
+			} else {
+				dlat, dlong, _ := g.GetCoordinates(destinationIp)
+				if d, err = g.getDistance(slat, slong, dlat, dlong); err != nil {
+					d = 1000.0
+				}
 			}
 			if d < minDistance {
 				minDistance = d
 			}
-			dists = append(dists, d)
+			dists[i] = d
 		}
 	}
 
@@ -205,10 +502,20 @@ func (g *GeoIp) getDistance(slat, slong, dlat, dlong float64) (float64, error) {
 	return c, nil
 }
 
+// normalizeIp converts IPv4-mapped IPv6 addresses to their IPv4 form
+func normalizeIp(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip
+}
+
 func (g *GeoIp) GetCoordinates(ip net.IP) (latitude float64, longitude float64, err error) {
-	if !g.Enable || g.CountryDB == nil {
+	db := g.countryDB()
+	if !g.Enable || db == nil {
 		return
 	}
+	ip = normalizeIp(ip)
 	var record struct {
 		Location struct {
 			Latitude        float64 `maxminddb:"latitude"`
@@ -216,17 +523,26 @@ func (g *GeoIp) GetCoordinates(ip net.IP) (latitude float64, longitude float64,
 		} `maxminddb:"location"`
 	}
 
-	if err := g.CountryDB.Lookup(ip, &record); err != nil {
+	offset, err := db.LookupOffset(ip)
+	if err != nil {
+		logger.Default.Errorf("lookup failed : %s", err)
+		return 0, 0, err
+	}
+	if offset == maxminddb.NotFound {
+		return 0, 0, errGeoIpNotFound
+	}
+	if err := db.Decode(offset, &record); err != nil {
 		logger.Default.Errorf("lookup failed : %s", err)
 		return 0, 0, err
 	}
-	_ = g.CountryDB.Decode(record.Location.LongitudeOffset, &longitude)
+	_ = db.Decode(record.Location.LongitudeOffset, &longitude)
 	// logger.Default.Debug("lat = ", record.Location.Latitude, " lang = ", longitude)
 	return record.Location.Latitude, longitude, nil
 }
 
 func (g *GeoIp) GetCountry(ip net.IP) (country string, err error) {
-	if !g.Enable || g.CountryDB == nil {
+	db := g.countryDB()
+	if !g.Enable || db == nil {
 		return
 	}
 	var record struct {
@@ -235,7 +551,7 @@ func (g *GeoIp) GetCountry(ip net.IP) (country string, err error) {
 		} `maxminddb:"country"`
 	}
 	// logger.Default.Debugf("ip : %s", ip)
-	if err := g.CountryDB.Lookup(ip, &record); err != nil {
+	if err := db.Lookup(normalizeIp(ip), &record); err != nil {
 		logger.Default.Errorf("lookup failed : %s", err)
 		return "", err
 	}
@@ -243,11 +559,32 @@ func (g *GeoIp) GetCountry(ip net.IP) (country string, err error) {
 	return record.Country.ISOCode, nil
 }
 
+func (g *GeoIp) GetContinent(ip net.IP) (continent string, err error) {
+	db := g.countryDB()
+	if !g.Enable || db == nil {
+		return
+	}
+	var record struct {
+		Continent struct {
+			Code string `maxminddb:"code"`
+		} `maxminddb:"continent"`
+	}
+	if err := db.Lookup(normalizeIp(ip), &record); err != nil {
+		logger.Default.Errorf("lookup failed : %s", err)
+		return "", err
+	}
+	return record.Continent.Code, nil
+}
+
 func (g *GeoIp) GetASN(ip net.IP) (uint, error) {
+	db := g.asnDB()
+	if !g.Enable || db == nil {
+		return 0, nil
+	}
 	var record struct {
 		AutonomousSystemNumber uint `maxminddb:"autonomous_system_number"`
 	}
-	err := g.ASNDB.Lookup(ip, &record)
+	err := db.Lookup(normalizeIp(ip), &record)
 	if err != nil {
 		logger.Default.Errorf("lookup failed : %s", err)
 		return 0, err
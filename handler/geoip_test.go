@@ -1,12 +1,22 @@
 package handler
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"arvancloud/redins/test"
 	"fmt"
 	"github.com/hawell/logger"
+	"github.com/miekg/dns"
 	"strconv"
 )
 
@@ -132,6 +142,47 @@ func TestGetSameCountry(t *testing.T) {
 
 }
 
+func TestGetSameRegion(t *testing.T) {
+	sip := [][]string{
+		{"212.83.32.45", "213.95.10.76"},   // DE: eu-west
+		{"80.67.163.250", "213.95.10.76"},  // FR: eu-west
+		{"206.108.0.43", "154.11.253.242"}, // CA: no region, nearest
+	}
+
+	cfg := GeoIpConfig{
+		Enable:    true,
+		CountryDB: "../geoCity.mmdb",
+		Regions: map[string][]string{
+			"eu-west": {"FR", "DE"},
+			"us-east": {"US"},
+		},
+	}
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+
+	g := NewGeoIp(&cfg)
+
+	for i := range sip {
+		var dest IP_RRSet
+		dest.Data = []IP_RR{
+			{Ip: net.ParseIP("213.95.10.76"), Region: "eu-west"},
+			{Ip: net.ParseIP("192.30.252.225"), Region: "us-east"},
+			{Ip: net.ParseIP("154.11.253.242")},
+		}
+		mask := make([]int, len(dest.Data))
+		mask = g.GetSameRegion(net.ParseIP(sip[i][0]), dest.Data, mask)
+		var result []string
+		for j, x := range mask {
+			if x == IpMaskWhite {
+				result = append(result, dest.Data[j].Ip.String())
+			}
+		}
+		if len(result) != 1 || result[0] != sip[i][1] {
+			fmt.Println(sip[i][0], "expected", sip[i][1], "got", result)
+			t.Fail()
+		}
+	}
+}
+
 func TestGetSameASN(t *testing.T) {
 	sip := []string{
 		"212.83.32.45",
@@ -182,6 +233,247 @@ func TestGetSameASN(t *testing.T) {
 
 }
 
+func TestGeoIpPartialDB(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	rrset := &IP_RRSet{
+		FilterConfig: IpFilterConfig{GeoFilter: "asn+country"},
+		Data: []IP_RR{
+			{Ip: net.ParseIP("1.2.3.4"), Country: []string{"DE"}, ASN: []uint{20766}},
+			{Ip: net.ParseIP("2.3.4.5"), Country: []string{"FR"}, ASN: []uint{47447}},
+		},
+	}
+	white := func(mask []int) []string {
+		var ips []string
+		for i, x := range mask {
+			if x == IpMaskWhite {
+				ips = append(ips, rrset.Data[i].Ip.String())
+			}
+		}
+		return ips
+	}
+
+	// asn db is missing, 212.83.32.45 (DE, AS47447) should be routed by country
+	g := NewGeoIp(&GeoIpConfig{
+		Enable:    true,
+		CountryDB: "../geoCity.mmdb",
+		ASNDB:     "../missing.mmdb",
+	})
+	h := &DnsRequestHandler{geoip: g}
+	if g.CountryDB == nil || g.ASNDB != nil {
+		fmt.Println("country db should be loaded without asn db")
+		t.Fail()
+	}
+	if asn, err := h.geoip.GetASN(net.ParseIP("212.83.32.45")); asn != 0 || err != nil {
+		fmt.Println("asn lookup without asn db should be empty : ", asn, err)
+		t.Fail()
+	}
+	if ips := white(h.FilterGeoIp(net.ParseIP("212.83.32.45"), rrset, make([]int, len(rrset.Data)))); len(ips) != 1 || ips[0] != "1.2.3.4" {
+		fmt.Println("country filter should be applied without asn db : ", ips)
+		t.Fail()
+	}
+
+	// country db is missing, same client should be routed by asn
+	g = NewGeoIp(&GeoIpConfig{
+		Enable:    true,
+		CountryDB: "../missing.mmdb",
+		ASNDB:     "../geoIsp.mmdb",
+	})
+	h = &DnsRequestHandler{geoip: g}
+	if cc, err := h.geoip.GetCountry(net.ParseIP("212.83.32.45")); cc != "" || err != nil {
+		fmt.Println("country lookup without country db should be empty : ", cc, err)
+		t.Fail()
+	}
+	if ips := white(h.FilterGeoIp(net.ParseIP("212.83.32.45"), rrset, make([]int, len(rrset.Data)))); len(ips) != 1 || ips[0] != "2.3.4.5" {
+		fmt.Println("asn filter should be applied without country db : ", ips)
+		t.Fail()
+	}
+}
+
+func TestGeoIpMappedAddress(t *testing.T) {
+	cfg := GeoIpConfig{
+		Enable:    true,
+		CountryDB: "../geoCity.mmdb",
+	}
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+
+	g := NewGeoIp(&cfg)
+
+	mapped := net.ParseIP("::ffff:212.83.32.45")
+	if cc, err := g.GetCountry(mapped); err != nil || cc != "DE" {
+		fmt.Println("country of mapped address is", cc, err, "expected DE")
+		t.Fail()
+	}
+	lat, long, err := g.GetCoordinates(mapped)
+	lat4, long4, _ := g.GetCoordinates(net.ParseIP("212.83.32.45").To4())
+	if err != nil || lat != lat4 || long != long4 {
+		fmt.Println("coordinates of mapped address are", lat, long, err, "expected", lat4, long4)
+		t.Fail()
+	}
+
+	dest := []IP_RR{
+		{Ip: net.ParseIP("::ffff:192.30.252.225")},
+		{Ip: net.ParseIP("::ffff:213.95.10.76")},
+	}
+	mask := g.GetMinimumDistance(mapped, dest, make([]int, len(dest)))
+	if mask[0] == IpMaskWhite || mask[1] != IpMaskWhite {
+		fmt.Println("nearest mapped candidate not selected :", mask)
+		t.Fail()
+	}
+}
+
+func TestGeoIpLookupFailure(t *testing.T) {
+	cfg := GeoIpConfig{
+		Enable:    true,
+		CountryDB: "../geoCity.mmdb",
+	}
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+
+	ips := []IP_RR{
+		{Ip: net.ParseIP("213.95.10.76")},   // DE
+		{Ip: net.ParseIP("154.11.253.242")}, // CA
+		{Ip: net.ParseIP("14.1.44.230")},    // NZ
+	}
+
+	// not in db, all records
+	g := NewGeoIp(&cfg)
+	mask := make([]int, len(ips))
+	mask = g.GetMinimumDistance(net.ParseIP("10.10.10.10"), ips, mask)
+	for i, x := range mask {
+		if x != IpMaskWhite {
+			fmt.Println(ips[i].Ip.String(), " filtered out")
+			t.Fail()
+		}
+	}
+
+	// not in db, default location : Berlin
+	cfg.DefaultLocation = &GeoLocation{Latitude: 52.52, Longitude: 13.40}
+	g = NewGeoIp(&cfg)
+	mask = make([]int, len(ips))
+	mask = g.GetMinimumDistance(net.ParseIP("10.10.10.10"), ips, mask)
+	if mask[0] != IpMaskWhite || mask[1] == IpMaskWhite || mask[2] == IpMaskWhite {
+		fmt.Println("default location not used : ", mask)
+		t.Fail()
+	}
+}
+
+func TestGeoIpStrategy(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	cfg := GeoIpConfig{
+		Enable:    true,
+		CountryDB: "../geoCity.mmdb",
+	}
+	g := NewGeoIp(&cfg)
+	// client in DE
+	sourceIp := net.ParseIP("212.83.32.45")
+	rr := func(ip string, countries ...string) IP_RR {
+		return IP_RR{Ip: net.ParseIP(ip), Country: countries}
+	}
+
+	for i, tc := range []struct {
+		strategy []string
+		ips      []IP_RR
+		expected []string
+	}{
+		// country
+		{nil, []IP_RR{rr("213.95.10.76", "DE"), rr("62.240.228.4", "FR"), rr("192.30.252.225", "US")}, []string{"213.95.10.76"}},
+		// continent : FR is in EU
+		{nil, []IP_RR{rr("62.240.228.4", "FR"), rr("192.30.252.225", "US")}, []string{"62.240.228.4"}},
+		// distance : US is nearer than AU
+		{nil, []IP_RR{rr("192.30.252.225", "US"), rr("175.45.73.66", "AU")}, []string{"192.30.252.225"}},
+		// all
+		{[]string{"country", "continent", "all"}, []IP_RR{rr("192.30.252.225", "US"), rr("175.45.73.66", "AU")}, []string{"192.30.252.225", "175.45.73.66"}},
+		// order of steps
+		{[]string{"continent", "country"}, []IP_RR{rr("213.95.10.76", "DE"), rr("62.240.228.4", "FR")}, []string{"213.95.10.76", "62.240.228.4"}},
+	} {
+		g.Strategy = tc.strategy
+		if len(g.Strategy) == 0 {
+			g.Strategy = defaultGeoIpStrategy
+		}
+		mask := g.GetByStrategy(sourceIp, tc.ips, make([]int, len(tc.ips)))
+		var ips []string
+		for j, x := range mask {
+			if x == IpMaskWhite {
+				ips = append(ips, tc.ips[j].Ip.String())
+			}
+		}
+		if fmt.Sprint(ips) != fmt.Sprint(tc.expected) {
+			fmt.Println(i, "strategy selected ", ips, " expected ", tc.expected)
+			t.Fail()
+		}
+	}
+}
+
+type countingGeoIp struct {
+	GeoIpProvider
+	calls int
+}
+
+func (g *countingGeoIp) GetSameCountry(sourceIp net.IP, ips []IP_RR, mask []int) []int {
+	g.calls++
+	return g.GeoIpProvider.GetSameCountry(sourceIp, ips, mask)
+}
+
+func (g *countingGeoIp) GetSameASN(sourceIp net.IP, ips []IP_RR, mask []int) []int {
+	g.calls++
+	return g.GeoIpProvider.GetSameASN(sourceIp, ips, mask)
+}
+
+func (g *countingGeoIp) GetMinimumDistance(sourceIp net.IP, ips []IP_RR, mask []int) []int {
+	g.calls++
+	return g.GeoIpProvider.GetMinimumDistance(sourceIp, ips, mask)
+}
+
+func (g *countingGeoIp) GetCountry(ip net.IP) (string, error) {
+	g.calls++
+	return g.GeoIpProvider.GetCountry(ip)
+}
+
+func (g *countingGeoIp) GetASN(ip net.IP) (uint, error) {
+	g.calls++
+	return g.GeoIpProvider.GetASN(ip)
+}
+
+func TestGeoIpNonAddressQuery(t *testing.T) {
+	tc := &TestCase{
+		Config:      defaultConfig,
+		Zones:       []string{"geoqtype.com."},
+		ZoneConfigs: []string{""},
+		Entries: [][][]string{
+			{
+				{"www",
+					`{
+						"a":{"ttl":300, "records":[{"ip":"1.2.3.4"},{"ip":"5.6.7.8"}], "filter":{"count":"multi","order":"none","geo_filter":"location"}},
+						"mx":{"ttl":300, "records":[{"host":"mx1.geoqtype.com.", "preference":10}]}
+					}`,
+				},
+			},
+		},
+	}
+	h, err := defaultInitialize(tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &countingGeoIp{GeoIpProvider: h.geoip}
+	h.geoip = g
+
+	query := func(qtype uint16) {
+		r := test.Case{Qname: "www.geoqtype.com.", Qtype: qtype}.Msg()
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, r))
+	}
+
+	query(dns.TypeMX)
+	if g.calls != 0 {
+		fmt.Println("geo lookups for MX query : ", g.calls)
+		t.Fail()
+	}
+	query(dns.TypeA)
+	if g.calls == 0 {
+		fmt.Println("no geo lookup for A query")
+		t.Fail()
+	}
+}
+
 /*
 82.220.3.51 9044 CH
 192.30.252.225 36459 US
@@ -271,3 +563,260 @@ func printCountryASN() {
 		fmt.Println(ip, asn, c)
 	}
 }
+
+func TestGeoIpHealthTieBreak(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	cfg := defaultConfig
+	cfg.GeoIp.HealthTieBreak = true
+	cfg.HealthCheck = config
+	h := newTestHandler(&cfg)
+
+	h.healthcheck.redisStatusServer.Del("*")
+	defer h.healthcheck.redisStatusServer.Del("*")
+	h.healthcheck.redisStatusServer.Set("redins:healthcheck:www.tiebreak.com.:82.220.3.51", `{"enable":true,"protocol":"http","uri":"/","port":80, "status":0}`)
+	h.healthcheck.redisStatusServer.Set("redins:healthcheck:www.tiebreak.com.:82.220.3.52", `{"enable":true,"protocol":"http","uri":"/","port":80, "status":1}`)
+
+	rrset := &IP_RRSet{
+		FilterConfig: IpFilterConfig{
+			Count:     "multi",
+			Order:     "none",
+			GeoFilter: "location",
+		},
+		HealthCheckConfig: IpHealthCheckConfig{
+			Enable:    true,
+			UpCount:   3,
+			DownCount: -3,
+		},
+		Data: []IP_RR{
+			{Ip: net.ParseIP("82.220.3.51")},
+			{Ip: net.ParseIP("82.220.3.52")},
+		},
+	}
+	ips := h.Filter("www.tiebreak.com.", dns.TypeA, net.ParseIP("62.220.128.73"), rrset)
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("82.220.3.52")) {
+		fmt.Println("healthier record should win the tie : ", ips)
+		t.Fail()
+	}
+
+	cfg.GeoIp.HealthTieBreak = false
+	ips = h.Filter("www.tiebreak.com.", dns.TypeA, net.ParseIP("62.220.128.73"), rrset)
+	if len(ips) != 2 {
+		fmt.Println("all equidistant records expected without tie break : ", ips)
+		t.Fail()
+	}
+}
+
+func TestNeverEmpty(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	cfg := defaultConfig
+	cfg.NeverEmpty = true
+	cfg.HealthCheck = config
+	h := newTestHandler(&cfg)
+
+	h.healthcheck.redisStatusServer.Del("*")
+	defer h.healthcheck.redisStatusServer.Del("*")
+	h.healthcheck.redisStatusServer.Set("redins:healthcheck:www.nonempty.com.:1.1.1.1", `{"enable":true,"protocol":"http","uri":"/","port":80, "status":-3}`)
+	h.healthcheck.redisStatusServer.Set("redins:healthcheck:www.nonempty.com.:2.2.2.2", `{"enable":true,"protocol":"http","uri":"/","port":80, "status":3}`)
+	h.healthcheck.redisStatusServer.Set("redins:healthcheck:www.nonempty.com.:3.3.3.3", `{"enable":true,"protocol":"http","uri":"/","port":80, "status":3}`)
+
+	rrset := &IP_RRSet{
+		FilterConfig: IpFilterConfig{
+			Count:     "multi",
+			Order:     "none",
+			GeoFilter: "country",
+		},
+		HealthCheckConfig: IpHealthCheckConfig{
+			Enable:    true,
+			UpCount:   3,
+			DownCount: -3,
+		},
+		Data: []IP_RR{
+			{Ip: net.ParseIP("1.1.1.1"), Country: []string{"FR"}, Weight: 10},
+			{Ip: net.ParseIP("2.2.2.2"), Country: []string{"US"}, Weight: 1},
+			{Ip: net.ParseIP("3.3.3.3"), Country: []string{"GB"}, Weight: 5},
+		},
+	}
+	// client is in DE, healthcheck removes 1.1.1.1 and country filter removes the rest
+	ips := h.Filter("www.nonempty.com.", dns.TypeA, net.ParseIP("212.83.32.45"), rrset)
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("3.3.3.3")) {
+		fmt.Println("healthy record with highest weight should survive filters : ", ips)
+		t.Fail()
+	}
+
+	cfg.NeverEmpty = false
+	ips = h.Filter("www.nonempty.com.", dns.TypeA, net.ParseIP("212.83.32.45"), rrset)
+	if len(ips) != 0 {
+		fmt.Println("filters should empty the set without never_empty : ", ips)
+		t.Fail()
+	}
+}
+
+func TestGeoIpRemoteDB(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	data, err := ioutil.ReadFile("../geoCity.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(data)
+	}))
+	defer server.Close()
+
+	g := NewGeoIp(&GeoIpConfig{
+		Enable:          true,
+		CountryDB:       server.URL + "/geoCity.mmdb",
+		CountryDBSha256: hex.EncodeToString(sum[:]),
+	})
+	if g.CountryDB == nil {
+		fmt.Println("remote database not loaded")
+		t.FailNow()
+	}
+	if country, _ := g.GetCountry(net.ParseIP("82.220.3.51")); country != "CH" {
+		fmt.Println("unexpected country : ", country)
+		t.Fail()
+	}
+
+	g = NewGeoIp(&GeoIpConfig{
+		Enable:          true,
+		CountryDB:       server.URL + "/geoCity.mmdb",
+		CountryDBSha256: "0000",
+	})
+	if g.CountryDB != nil {
+		fmt.Println("database with wrong checksum loaded")
+		t.Fail()
+	}
+}
+
+func TestGeoIpRefresh(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	data, err := ioutil.ReadFile("../geoCity.mmdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var downloads int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+		_, _ = w.Write(data)
+	}))
+	defer server.Close()
+
+	g := NewGeoIp(&GeoIpConfig{
+		Enable:          true,
+		CountryDB:       server.URL + "/geoCity.mmdb",
+		RefreshInterval: 1,
+	})
+	defer g.ShutDown()
+	first := g.countryDB()
+	if first == nil {
+		fmt.Println("remote database not loaded")
+		t.FailNow()
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for g.countryDB() == first && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&downloads); n < 2 || g.countryDB() == first {
+		fmt.Println("database should be downloaded again and swapped : ", n)
+		t.Fail()
+	}
+	if country, _ := g.GetCountry(net.ParseIP("82.220.3.51")); country != "CH" {
+		fmt.Println("unexpected country after refresh : ", country)
+		t.Fail()
+	}
+}
+
+func TestGeoIpDistanceOverride(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	distanceFile, err := ioutil.TempFile("", "redins_distances")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(distanceFile.Name())
+	_, _ = distanceFile.WriteString(`{"CH": {"82.220.3.51": 900, "213.95.10.76": 100}}`)
+	_ = distanceFile.Close()
+
+	ips := []IP_RR{
+		{Ip: net.ParseIP("82.220.3.51")},
+		{Ip: net.ParseIP("213.95.10.76")},
+	}
+	source := net.ParseIP("62.220.128.73")
+
+	g := NewGeoIp(&GeoIpConfig{Enable: true, CountryDB: "../geoCity.mmdb"})
+	mask := g.GetMinimumDistance(source, ips, make([]int, len(ips)))
+	if mask[0] != IpMaskWhite || mask[1] == IpMaskWhite {
+		fmt.Println("nearest by geo should be selected without override : ", mask)
+		t.Fail()
+	}
+
+	g = NewGeoIp(&GeoIpConfig{Enable: true, CountryDB: "../geoCity.mmdb", DistanceFile: distanceFile.Name()})
+	mask = g.GetMinimumDistance(source, ips, make([]int, len(ips)))
+	if mask[0] == IpMaskWhite || mask[1] != IpMaskWhite {
+		fmt.Println("override should flip nearest choice : ", mask)
+		t.Fail()
+	}
+
+	// clients from countries without overrides use geodesic distance
+	mask = g.GetMinimumDistance(net.ParseIP("212.83.32.45"), ips, make([]int, len(ips)))
+	if mask[0] == IpMaskWhite || mask[1] != IpMaskWhite {
+		fmt.Println("DE client should get DE candidate : ", mask)
+		t.Fail()
+	}
+}
+
+func TestGeoIpMinimumDistanceMask(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	distanceFile, err := ioutil.TempFile("", "redins_distances")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(distanceFile.Name())
+	_, _ = distanceFile.WriteString(`{"CH": {"2001:db8::1": 10, "2001:db8::2": 900, "2001:db8::3": 100}}`)
+	_ = distanceFile.Close()
+
+	ips := []IP_RR{
+		{Ip: net.ParseIP("2001:db8::1")},
+		{Ip: net.ParseIP("2001:db8::2")},
+		{Ip: net.ParseIP("2001:db8::3")},
+	}
+	g := NewGeoIp(&GeoIpConfig{Enable: true, CountryDB: "../geoCity.mmdb", DistanceFile: distanceFile.Name()})
+
+	// nearest candidate is already filtered (e.g. unhealthy), distances must still match their ips
+	mask := g.GetMinimumDistance(net.ParseIP("62.220.128.73"), ips, []int{IpMaskGrey, IpMaskWhite, IpMaskWhite})
+	if mask[0] == IpMaskWhite || mask[1] == IpMaskWhite || mask[2] != IpMaskWhite {
+		fmt.Println("nearest remaining aaaa candidate should be selected : ", mask)
+		t.Fail()
+	}
+}
+
+func TestGeoCacheKey(t *testing.T) {
+	rrset := &IP_RRSet{
+		FilterConfig: IpFilterConfig{GeoFilter: "location"},
+		Data: []IP_RR{
+			{Ip: net.ParseIP("1.2.3.4")},
+			{Ip: net.ParseIP("5.6.7.8")},
+		},
+	}
+	key := geoCacheKey(net.ParseIP("10.1.2.3").To4(), rrset, []int{IpMaskWhite, IpMaskWhite})
+	if geoCacheKey(net.ParseIP("10.1.2.200").To4(), rrset, []int{IpMaskWhite, IpMaskWhite}) != key {
+		fmt.Println("clients of same /24 should share geo cache")
+		t.Fail()
+	}
+	if geoCacheKey(net.ParseIP("2001:db8:1:2::1"), rrset, []int{IpMaskWhite, IpMaskWhite}) != geoCacheKey(net.ParseIP("2001:db8:1:3::1"), rrset, []int{IpMaskWhite, IpMaskWhite}) {
+		fmt.Println("clients of same /48 should share geo cache")
+		t.Fail()
+	}
+	if geoCacheKey(net.ParseIP("10.1.3.3").To4(), rrset, []int{IpMaskWhite, IpMaskWhite}) == key {
+		fmt.Println("clients of different subnets should not share geo cache")
+		t.Fail()
+	}
+	if geoCacheKey(net.ParseIP("10.1.2.3").To4(), rrset, []int{IpMaskWhite, IpMaskBlack}) == key {
+		fmt.Println("health change should invalidate geo cache")
+		t.Fail()
+	}
+	rrset.Data[1].Ip = net.ParseIP("5.6.7.9")
+	if geoCacheKey(net.ParseIP("10.1.2.3").To4(), rrset, []int{IpMaskWhite, IpMaskWhite}) == key {
+		fmt.Println("record change should invalidate geo cache")
+		t.Fail()
+	}
+}
@@ -2,15 +2,20 @@ package handler
 
 import (
 	"arvancloud/redins/handler/logformat"
+	"bytes"
 	"errors"
 	"fmt"
 	"github.com/dgraph-io/ristretto"
 	"github.com/json-iterator/go"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/singleflight"
+	"hash/fnv"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/go-immutable-radix"
@@ -21,20 +26,38 @@ import (
 
 type DnsRequestHandler struct {
 	Config         *DnsRequestHandlerConfig
-	Zones          *iradix.Tree
 	LastZoneUpdate time.Time
-	Redis          *uperdis.Redis
+	Backend        Backend
+	Classifier     Classifier
 	Logger         *logger.EventLogger
 	RecordCache    *ristretto.Cache
 	RecordInflight *singleflight.Group
 	ZoneCache      *ristretto.Cache
 	ZoneInflight   *singleflight.Group
-	geoip          *GeoIp
+	geoip          GeoIpProvider
 	healthcheck    *Healthcheck
 	upstream       *Upstream
 	quit           chan struct{}
+	zones          atomic.Value // *iradix.Tree, swapped as a whole on reload
 	quitWG         sync.WaitGroup
 	logQueue       chan map[string]interface{}
+	queryStream    *QueryStream
+	now            func() time.Time
+	serials        map[string]zoneSerial
+	serialsLock    sync.Mutex
+	zskStates      map[string]string // last seen zsk rollover state of zones
+	zskStatesLock  sync.Mutex
+	udpZoneLimiter *ByteRateLimiter
+	rewrites       map[string]string
+	nsHints        map[string][]net.IP
+	blocklist      *Blocklist
+	geoCache       *ristretto.Cache
+	ready          int32 // set after first successful zone load
+}
+
+type zoneSerial struct {
+	serial uint32
+	hash   uint32
 }
 
 type DnsRequestHandlerConfig struct {
@@ -45,18 +68,88 @@ type DnsRequestHandlerConfig struct {
 	CacheTimeout      int                 `json:"cache_timeout"`
 	ZoneReload        int                 `json:"zone_reload"`
 	LogSourceLocation bool                `json:"log_source_location"`
+	LogZones          []string            `json:"log_zones"`
+	PreloadZones      bool                `json:"preload_zones"`
+	PreloadWorkers    int                 `json:"preload_workers"`
+	StableOrder       bool                `json:"stable_order"`
+	MaxCnameChain     int                 `json:"max_cname_chain"`
+	UdpPartialAnswers bool                `json:"udp_partial_answers"`
+	MaxZoneLocations  int                 `json:"max_locations_per_zone"`
+	LocationLookup    string              `json:"location_lookup"`
+	MultiWildcard     bool                `json:"multi_level_wildcard"`
+	ResponseDelay     int                 `json:"response_delay"`
+	BackendMetrics    bool                `json:"backend_metrics"`
+	MaxAnswers        int                 `json:"max_answers"`
+	MaxTypeAnswers    map[string]int      `json:"max_answers_per_type"`
+	SpecialNames      bool                `json:"handle_special_names"`
+	AnyUdpTruncate    bool                `json:"any_udp_truncate"`
+	UdpZoneByteRate   int                 `json:"udp_byte_rate_per_zone"`
+	QueryTags         map[string][]string `json:"query_tags"`
+	MaxTxtRecords     int                 `json:"max_txt_records"`
+	MaxTxtSize        int                 `json:"max_txt_size"`
+	TxtLimitAction    string              `json:"txt_limit_action"`
+	DuplicateRecords  string              `json:"duplicate_records"` // "merge", "keep"
+	MetaLabel         string              `json:"meta_label"`
+	ParseErrorRcode   string              `json:"parse_error_rcode"`
+	NxDomainRcode     string              `json:"nxdomain_rcode"`
+	NoDataRcode       string              `json:"nodata_rcode"`
+	EdnsOptions       []uint16            `json:"edns_options"`
+	EchoEdnsOptions   bool                `json:"echo_edns_options"`
+	HealthManagedTtl  int                 `json:"health_managed_ttl"`
+	ZskRolloverCheck  int                 `json:"zsk_rollover_check"`
+	Rewrite           map[string]string   `json:"rewrite"`
+	NsHints           map[string][]string `json:"ns_hints"`
+	AddressHints      bool                `json:"address_family_hints"`
+	NeverEmpty        bool                `json:"never_empty"`
+	NotReadyAction    string              `json:"not_ready_action"` // "servfail", "drop"
+	Blocklist         BlocklistConfig     `json:"blocklist"`
+	SoaSerialPublic   uint32              `json:"soa_serial_public"`
+	SerialFormat      string              `json:"serial_format"` // "unix", "datecounter", "content-hash"
+	SoaSerial         string              `json:"soa_serial"`    // "unixtime" or "datecounter", overrides serial_format
+	Backend           string              `json:"backend"`       // "redis", "memory"
 	Redis             uperdis.RedisConfig `json:"redis"`
+	Memory            MemoryBackendConfig `json:"memory"`
+	Debug             DebugConfig         `json:"debug"`
+	VersionInfo       VersionInfoConfig   `json:"version_info"`
+	AdminToken        string              `json:"admin_token"`
 	Log               logger.LogConfig    `json:"log"`
 }
 
+type DebugConfig struct {
+	Enable      bool   `json:"enable"`
+	CountryName string `json:"country_name"`
+}
+
 const (
-	RecordCacheSize = 1000000
-	ZoneCacheSize   = 10000
+	RecordCacheSize      = 1000000
+	ZoneCacheSize        = 10000
+	GeoCacheSize         = 100000
+	DefaultMaxCnameChain = 8
 )
 
 func NewHandler(config *DnsRequestHandlerConfig) *DnsRequestHandler {
+	if config.Backend == "memory" {
+		backend, err := NewMemoryBackendFromConfig(&config.Memory)
+		if err != nil {
+			logger.Default.Errorf("cannot load memory backend : %s", err)
+			backend = NewMemoryBackend()
+		}
+		return NewHandlerWithBackend(config, backend)
+	}
+	return NewHandlerWithBackend(config, NewRedisBackend(&config.Redis))
+}
+
+// NewHandlerWithBackend creates a handler reading zones from backend instead of configured redis
+func NewHandlerWithBackend(config *DnsRequestHandlerConfig, backend Backend) *DnsRequestHandler {
+	if config.BackendMetrics {
+		backend = NewMeteredBackend(backend)
+	}
 	h := &DnsRequestHandler{
-		Config: config,
+		Config:    config,
+		Backend:   backend,
+		now:       time.Now,
+		serials:   make(map[string]zoneSerial),
+		zskStates: make(map[string]string),
 	}
 
 	getFormatter := func(name string) logrus.Formatter {
@@ -73,8 +166,10 @@ func NewHandler(config *DnsRequestHandlerConfig) *DnsRequestHandler {
 	}
 
 	h.logQueue = make(chan map[string]interface{}, 1000)
+	h.quit = make(chan struct{})
+	h.quitWG.Add(1)
+	h.queryStream = NewQueryStream()
 	go func() {
-		h.quitWG.Add(1)
 		for {
 			select {
 			case <-h.quit:
@@ -85,13 +180,40 @@ func NewHandler(config *DnsRequestHandlerConfig) *DnsRequestHandler {
 			}
 		}
 	}()
-	h.Redis = uperdis.NewRedis(&config.Redis)
 	h.Logger = logger.NewLogger(&config.Log, getFormatter)
 	h.geoip = NewGeoIp(&config.GeoIp)
-	h.healthcheck = NewHealthcheck(&config.HealthCheck, h.Redis)
+	h.healthcheck = NewHealthcheck(&config.HealthCheck, h.Backend)
 	h.upstream = NewUpstream(config.Upstream)
-	h.Zones = iradix.New()
-	h.quit = make(chan struct{})
+	if len(config.QueryTags) != 0 {
+		h.Classifier = NewSubnetClassifier(config.QueryTags)
+	}
+	if config.UdpZoneByteRate > 0 {
+		h.udpZoneLimiter = NewByteRateLimiter(config.UdpZoneByteRate)
+	}
+	if len(config.Rewrite) != 0 {
+		h.rewrites = make(map[string]string)
+		for name, target := range config.Rewrite {
+			h.rewrites[dns.Fqdn(strings.ToLower(name))] = dns.Fqdn(strings.ToLower(target))
+		}
+	}
+	if len(config.NsHints) != 0 {
+		h.nsHints = make(map[string][]net.IP)
+		for host, addrs := range config.NsHints {
+			host = dns.Fqdn(strings.ToLower(host))
+			for _, addr := range addrs {
+				ip := net.ParseIP(addr)
+				if ip == nil {
+					logger.Default.Errorf("invalid ns hint address %s for %s", addr, host)
+					continue
+				}
+				h.nsHints[host] = append(h.nsHints[host], ip)
+			}
+		}
+	}
+	h.zones.Store(iradix.New())
+	if config.Blocklist.Enable {
+		h.blocklist = NewBlocklist(&config.Blocklist, h.Backend)
+	}
 
 	h.LoadZones()
 
@@ -109,15 +231,64 @@ func NewHandler(config *DnsRequestHandlerConfig) *DnsRequestHandler {
 		Metrics:     false,
 	})
 	h.ZoneInflight = new(singleflight.Group)
+	if h.Config.GeoIp.CacheTtl > 0 {
+		h.geoCache, _ = ristretto.NewCache(&ristretto.Config{
+			NumCounters: GeoCacheSize * 10,
+			MaxCost:     GeoCacheSize,
+			BufferItems: 64,
+			Metrics:     false,
+		})
+	}
+
+	for _, conflict := range h.Config.ProbeConflicts() {
+		logger.Default.Warning(conflict)
+	}
+	if h.Config.PreloadZones {
+		h.PreloadZones()
+	}
 
 	go h.healthcheck.Start()
 
+	if h.Config.ZskRolloverCheck > 0 {
+		h.quitWG.Add(1)
+		go func() {
+			ticker := time.NewTicker(time.Duration(h.Config.ZskRolloverCheck) * time.Second)
+			for {
+				select {
+				case <-h.quit:
+					ticker.Stop()
+					h.quitWG.Done()
+					return
+				case <-ticker.C:
+					h.RolloverZSKs()
+				}
+			}
+		}()
+	}
+
+	if h.blocklist != nil && h.Config.Blocklist.Reload > 0 {
+		h.quitWG.Add(1)
+		go func() {
+			ticker := time.NewTicker(time.Duration(h.Config.Blocklist.Reload) * time.Second)
+			for {
+				select {
+				case <-h.quit:
+					ticker.Stop()
+					h.quitWG.Done()
+					return
+				case <-ticker.C:
+					h.blocklist.Load()
+				}
+			}
+		}()
+	}
+
 	go func() {
 		// logger.Default.Debug("zone updater")
 		h.quitWG.Add(1)
 		quit := make(chan *sync.WaitGroup, 1)
 		modified := false
-		go h.Redis.SubscribeEvent("redins:zones", func() {
+		go h.Backend.SubscribeEvent("redins:zones", func() {
 			modified = true
 		}, func(channel string, data string) {
 			modified = true
@@ -136,7 +307,7 @@ func NewHandler(config *DnsRequestHandlerConfig) *DnsRequestHandler {
 				quit <- &h.quitWG
 				return
 			case <-reloadTicker.C:
-				if modified {
+				if modified || !h.Ready() {
 					// logger.Default.Debug("loading zones")
 					h.LoadZones()
 					modified = false
@@ -153,6 +324,9 @@ func NewHandler(config *DnsRequestHandlerConfig) *DnsRequestHandler {
 func (h *DnsRequestHandler) ShutDown() {
 	// logger.Default.Debug("handler : stopping")
 	h.healthcheck.ShutDown()
+	if g, ok := h.geoip.(*GeoIp); ok {
+		g.ShutDown()
+	}
 	close(h.logQueue)
 	close(h.quit)
 	h.quitWG.Wait()
@@ -161,7 +335,25 @@ func (h *DnsRequestHandler) ShutDown() {
 
 func (h *DnsRequestHandler) Response(context *RequestContext, res int) {
 	h.LogRequest(context, res)
+	context.PartialAnswers = h.Config.UdpPartialAnswers
+	delay := context.responseDelay
+	if delay == 0 {
+		delay = time.Duration(h.Config.ResponseDelay) * time.Millisecond
+	}
+	if delay > 0 {
+		// only this request's goroutine waits, other queries are not affected
+		<-time.After(delay)
+	}
+	throttled := h.udpZoneLimiter != nil && context.zone != "" && context.Proto() == "udp"
+	if throttled && h.udpZoneLimiter.Exceeded(context.zone) {
+		// zone is over its udp byte rate, only send TC so legitimate clients retry over tcp
+		context.Answer, context.Authority, context.Additional = nil, nil, nil
+		context.Truncate = true
+	}
 	context.Response(res)
+	if throttled {
+		h.udpZoneLimiter.Add(context.zone, context.responseSize)
+	}
 }
 
 func (h *DnsRequestHandler) HandleRequest(context *RequestContext) {
@@ -174,8 +366,64 @@ func (h *DnsRequestHandler) HandleRequest(context *RequestContext) {
 		context.LogData["source_asn"] = sourceASN
 	}
 
+	if len(h.Config.EdnsOptions) != 0 {
+		context.EdnsOptions = context.ednsOptions(h.Config.EdnsOptions)
+		context.EchoEdnsOptions = h.Config.EchoEdnsOptions
+	}
+
+	if h.Classifier != nil {
+		context.Tags = h.Classifier.Classify(context)
+		if len(context.Tags) != 0 {
+			context.LogData["tags"] = context.Tags
+		}
+	}
+
+	if h.Config.Debug.Enable && context.RawName() == dns.Fqdn(strings.ToLower(h.Config.Debug.CountryName)) {
+		if context.QType() == dns.TypeTXT {
+			context.Answer = h.DebugCountry(context)
+		}
+		h.Response(context, dns.RcodeSuccess)
+		return
+	}
+
+	if h.Config.VersionInfo.Enable && context.RawName() == dns.Fqdn(strings.ToLower(h.Config.VersionInfo.Name)) {
+		if context.QType() == dns.TypeTXT {
+			context.Answer = h.VersionInfo(context)
+		}
+		h.Response(context, dns.RcodeSuccess)
+		return
+	}
+
+	if h.blocklist != nil {
+		if name, blocked := h.blocklist.Match(context.RawName()); blocked {
+			context.LogData["blocklist"] = name
+			h.Response(context, h.blocklist.Answer(context))
+			return
+		}
+	}
+
+	if !h.Ready() {
+		// an empty zone list would give misleading NXDOMAIN or REFUSED answers
+		if h.Config.NotReadyAction == "drop" {
+			return
+		}
+		context.ErrorCode = dns.ExtendedErrorCodeNotReady
+		h.Response(context, dns.RcodeServerFailure)
+		return
+	}
+
+	if target, found := h.rewrites[context.RawName()]; found {
+		if !h.rewrite(context, target) {
+			h.Response(context, dns.RcodeSuccess)
+			return
+		}
+	}
+
 	zoneName := h.FindZone(context.RawName())
 	if zoneName == "" {
+		if h.Config.SpecialNames && h.HandleSpecialName(context) {
+			return
+		}
 		h.Response(context, dns.RcodeNotAuth)
 		return
 	}
@@ -183,24 +431,37 @@ func (h *DnsRequestHandler) HandleRequest(context *RequestContext) {
 
 	zone := h.LoadZone(zoneName)
 	if zone == nil {
+		context.ErrorText = "cannot load zone " + zoneName
 		h.Response(context, dns.RcodeServerFailure)
 		return
 	}
 	context.LogData["domain_uuid"] = zone.Config.DomainId
+	context.zone = zoneName
+	context.responseDelay = time.Duration(zone.Config.ResponseDelay) * time.Millisecond
+	context.skipLog = !h.sampleLog(zone)
+	if h.blocked(context, zone.Config.BlockCountries) {
+		h.Response(context, dns.RcodeRefused)
+		return
+	}
 
-	loopCount := 0
+	maxChain := h.Config.MaxCnameChain
+	if maxChain < 1 {
+		maxChain = DefaultMaxCnameChain
+	}
+	chain := 0
+	visited := make(map[string]struct{})
 	currentQName := context.RawName()
 	currentRecord := &Record{}
 	res := dns.RcodeSuccess
 loop:
 	for {
-		if loopCount > 10 {
+		if _, found := visited[currentQName]; found {
 			logger.Default.Errorf("CNAME loop in request %s->%s", context.RawName(), context.Type())
 			context.Answer = []dns.RR{}
 			res = dns.RcodeServerFailure
 			break loop
 		}
-		loopCount++
+		visited[currentQName] = struct{}{}
 
 		if h.FindZone(currentQName) != zoneName {
 			// logger.Default.Debugf("[%d] out of zone - qname : %s, zone : %s", context.Req.Id, currentQName, zoneName)
@@ -209,11 +470,33 @@ loop:
 		}
 
 		location, match := zone.FindLocation(currentQName)
+		// names below a delegation point belong to child zone, whether stored here or not
+		if cut, cutRecord := h.findDelegation(currentQName, zone); cutRecord != nil {
+			h.referral(context, cut, cutRecord, zone)
+			break loop
+		}
+		if match != ExactMatch {
+			if metaRecord := h.metaRecord(currentQName, zone); metaRecord != nil {
+				if context.QType() == dns.TypeTXT {
+					context.Answer = append(context.Answer, h.TXT(currentQName, metaRecord)...)
+				} else {
+					context.Authority = []dns.RR{zone.Config.SOA.Data}
+				}
+				res = dns.RcodeSuccess
+				break loop
+			}
+		}
 		switch match {
 		case NoMatch:
 			// logger.Default.Debugf("[%d] no location matched for %s in %s", context.Req.Id, currentQName, zoneName)
-			context.Authority = []dns.RR{zone.Config.SOA.Data}
-			res = dns.RcodeNameError
+			res = h.negativeRcode(zone.Config.NxDomainRcode, h.Config.NxDomainRcode, dns.RcodeNameError)
+			context.Authority = negativeAuthority(zone, res)
+			break loop
+
+		case EmptyNonTerminalMatch:
+			// name exists with no records, NODATA
+			res = h.negativeRcode(zone.Config.NoDataRcode, h.Config.NoDataRcode, dns.RcodeSuccess)
+			context.Authority = negativeAuthority(zone, res)
 			break loop
 
 		case WildCardMatch:
@@ -221,13 +504,41 @@ loop:
 
 		case ExactMatch:
 			// logger.Default.Debugf("[%d] loading location %s", context.Req.Id, location)
-			currentRecord = h.LoadLocation(location, zone)
+			var err error
+			currentRecord, err = h.loadLocation(location, zone)
+			if currentRecord == nil && err == errLocationParse {
+				res = h.negativeRcode(zone.Config.ParseErrorRcode, h.Config.ParseErrorRcode, dns.RcodeServerFailure)
+				if res != dns.RcodeServerFailure {
+					context.Authority = negativeAuthority(zone, res)
+					break loop
+				}
+			}
 			if currentRecord == nil {
+				context.ErrorText = "cannot load location " + currentQName
 				res = dns.RcodeServerFailure
 				break loop
 			}
-			if currentRecord.CNAME != nil && context.QType() != dns.TypeCNAME {
+			currentRecord = taggedRecord(currentRecord, context.Tags)
+			if match == WildCardMatch && zone.Config.WildcardTemplate {
+				currentRecord = templateRecord(currentRecord, wildcardLabel(currentQName, location, zone))
+			}
+			if h.blocked(context, currentRecord.BlockCountries) {
+				context.Answer = []dns.RR{}
+				res = dns.RcodeRefused
+				break loop
+			}
+			// apex SOA, NS and keys belong to zone itself and are never taken from a (flattened) cname target
+			apexData := currentQName == zone.Name && (context.QType() == dns.TypeSOA || context.QType() == dns.TypeNS ||
+				context.QType() == dns.TypeDNSKEY || context.QType() == dns.TypeNSEC3PARAM ||
+				context.QType() == dns.TypeCDS || context.QType() == dns.TypeCDNSKEY || context.QType() == dns.TypeCSYNC)
+			if currentRecord.CNAME != nil && context.QType() != dns.TypeCNAME && !apexData {
 				// logger.Default.Debugf("[%d] cname chain %s -> %s", context.Req.Id, currentQName, currentRecord.CNAME.Host)
+				if chain >= maxChain {
+					logger.Default.Errorf("CNAME chain longer than %d in request %s->%s", maxChain, context.RawName(), context.Type())
+					res = dns.RcodeSuccess
+					break loop
+				}
+				chain++
 				if !zone.Config.CnameFlattening {
 					context.Answer = append(context.Answer, h.CNAME(currentQName, currentRecord)...)
 				} else if h.FindZone(currentRecord.CNAME.Host) != zoneName {
@@ -237,22 +548,9 @@ loop:
 				currentQName = dns.Fqdn(currentRecord.CNAME.Host)
 				continue
 			}
+			// delegation point data other than NS belongs to child zone
 			if len(currentRecord.NS.Data) > 0 && currentQName != zone.Name {
-				// logger.Default.Debugf("[%d] delegation", context.Req.Id)
-				context.Authority = append(context.Authority, h.NS(currentQName, currentRecord)...)
-				for _, ns := range currentRecord.NS.Data {
-					glueLocation, match := zone.FindLocation(ns.Host)
-					if match != NoMatch {
-						glueRecord := h.LoadLocation(glueLocation, zone)
-						// XXX : should we return with RcodeServerFailure?
-						if glueRecord != nil {
-							ips := h.Filter(glueRecord.Name, context.SourceIp, &glueRecord.A)
-							context.Additional = append(context.Additional, h.A(ns.Host, glueRecord, ips)...)
-							ips = h.Filter(glueRecord.Name, context.SourceIp, &glueRecord.AAAA)
-							context.Additional = append(context.Additional, h.AAAA(ns.Host, glueRecord, ips)...)
-						}
-					}
-				}
+				h.referral(context, currentQName, currentRecord, zone)
 				break loop
 			}
 
@@ -269,9 +567,13 @@ loop:
 					ips, res, ttl = h.FindANAME(context, currentRecord.ANAME.Location, dns.TypeA)
 					currentRecord.A.Ttl = ttl
 				} else {
-					ips = h.Filter(currentRecord.Name, context.SourceIp, &currentRecord.A)
+					ips = h.FilterRequest(context, currentRecord, dns.TypeA, &currentRecord.A)
 				}
 				answer = h.A(currentQName, currentRecord, ips)
+				if h.Config.AddressHints && len(answer) > 0 && len(currentRecord.AAAA.Data) > 0 {
+					ips = h.FilterRequest(context, currentRecord, dns.TypeAAAA, &currentRecord.AAAA)
+					context.Additional = append(context.Additional, h.AAAA(currentQName, currentRecord, ips)...)
+				}
 			case dns.TypeAAAA:
 				var ips []net.IP
 				var ttl uint32
@@ -279,9 +581,13 @@ loop:
 					ips, res, ttl = h.FindANAME(context, currentRecord.ANAME.Location, dns.TypeAAAA)
 					currentRecord.AAAA.Ttl = ttl
 				} else {
-					ips = h.Filter(currentRecord.Name, context.SourceIp, &currentRecord.AAAA)
+					ips = h.FilterRequest(context, currentRecord, dns.TypeAAAA, &currentRecord.AAAA)
 				}
 				answer = h.AAAA(currentQName, currentRecord, ips)
+				if h.Config.AddressHints && len(answer) > 0 && len(currentRecord.A.Data) > 0 {
+					ips = h.FilterRequest(context, currentRecord, dns.TypeA, &currentRecord.A)
+					context.Additional = append(context.Additional, h.A(currentQName, currentRecord, ips)...)
+				}
 			case dns.TypeCNAME:
 				answer = h.CNAME(currentQName, currentRecord)
 			case dns.TypeTXT:
@@ -302,21 +608,65 @@ loop:
 				answer = h.PTR(currentQName, currentRecord)
 			case dns.TypeTLSA:
 				answer = h.TLSA(currentQName, currentRecord)
+			case dns.TypeNID:
+				answer = h.NID(currentQName, currentRecord)
+			case dns.TypeL32:
+				answer = h.L32(currentQName, currentRecord)
+			case dns.TypeL64:
+				answer = h.L64(currentQName, currentRecord)
+			case dns.TypeLP:
+				answer = h.LP(currentQName, currentRecord)
+			case dns.TypeURI:
+				answer = h.URI(currentQName, currentRecord)
+			case dns.TypeOPENPGPKEY:
+				answer = h.OPENPGPKEY(currentQName, currentRecord)
+			case dns.TypeSMIMEA:
+				answer = h.SMIMEA(currentQName, currentRecord)
 			case dns.TypeSOA:
 				answer = []dns.RR{zone.Config.SOA.Data}
 			case dns.TypeDNSKEY:
 				if zone.Config.DnsSec {
-					answer = []dns.RR{zone.ZSK.DnsKey, zone.KSK.DnsKey}
+					answer = zone.DnsKeys()
+				}
+			case dns.TypeNSEC3PARAM:
+				if zone.Config.DnsSec && zone.Config.Nsec3 != nil && currentQName == zone.Name {
+					answer = []dns.RR{NSec3Param(zone)}
+				}
+			case dns.TypeCDS:
+				if zone.Config.DnsSec && currentQName == zone.Name {
+					if cds := CDS(zone); cds != nil {
+						answer = []dns.RR{cds}
+					}
 				}
+			case dns.TypeCDNSKEY:
+				if zone.Config.DnsSec && currentQName == zone.Name {
+					answer = []dns.RR{CDNSKEY(zone)}
+				}
+			case dns.TypeCSYNC:
+				if zone.Config.DnsSec && currentQName == zone.Name {
+					answer = []dns.RR{CSYNC(zone)}
+				}
+			case dns.TypeANY:
+				if h.Config.AnyUdpTruncate && context.Proto() == "udp" {
+					// no answer over udp, clients have to retry over tcp
+					context.Truncate = true
+					break loop
+				}
+				answer = h.ANY(context, currentQName, currentRecord)
 			default:
 				context.Answer = []dns.RR{}
 				context.Authority = []dns.RR{zone.Config.SOA.Data}
 				res = dns.RcodeNotImplemented
 				break loop
 			}
+			if h.Config.DuplicateRecords != "keep" && len(answer) > 1 {
+				answer = dns.Dedup(answer, nil)
+			}
+			answer = h.limitAnswers(context.QType(), answer)
 			context.Answer = append(context.Answer, answer...)
 			if len(answer) == 0 && res == dns.RcodeSuccess {
-				context.Authority = []dns.RR{zone.Config.SOA.Data}
+				res = h.negativeRcode(zone.Config.NoDataRcode, h.Config.NoDataRcode, dns.RcodeSuccess)
+				context.Authority = negativeAuthority(zone, res)
 			}
 			break loop
 		}
@@ -326,10 +676,10 @@ loop:
 		switch res {
 		case dns.RcodeSuccess:
 			if len(context.Answer) == 0 {
-				context.Authority = append(context.Authority, NSec(context.RawName(), zone))
+				context.Authority = append(context.Authority, h.denial(context.RawName(), zone))
 			}
 		case dns.RcodeNameError:
-			context.Authority = append(context.Authority, NSec(context.RawName(), zone))
+			context.Authority = append(context.Authority, h.denial(context.RawName(), zone))
 			res = dns.RcodeSuccess
 		}
 		context.Answer = Sign(context.Answer, context.RawName(), zone)
@@ -341,15 +691,194 @@ loop:
 	// logger.Default.Debugf("[%d] end handle request - name : %s, type : %s", context.Req.Id, context.RawName(), context.Type())
 }
 
+// negativeRcode returns rcode named by zone's setting, falling back to handler's setting and then to def
+func (h *DnsRequestHandler) negativeRcode(zoneRcode string, handlerRcode string, def int) int {
+	for _, name := range []string{zoneRcode, handlerRcode} {
+		if rcode, ok := dns.StringToRcode[strings.ToUpper(name)]; ok {
+			return rcode
+		}
+	}
+	return def
+}
+
+// negativeAuthority returns zone's soa for negative answers, other rcodes are errors and carry no soa
+func negativeAuthority(zone *Zone, rcode int) []dns.RR {
+	if rcode == dns.RcodeSuccess || rcode == dns.RcodeNameError {
+		return []dns.RR{zone.Config.SOA.Data}
+	}
+	return nil
+}
+
+// wildcardLabel returns the part of qname covered by '*' of wildcard location
+func wildcardLabel(qname string, location string, zone *Zone) string {
+	return strings.TrimSuffix(qname, strings.TrimPrefix(location, "*")+"."+zone.Name)
+}
+
+// templateRecord returns a copy of r with "%s" in cname host and txt texts replaced by label
+func templateRecord(r *Record, label string) *Record {
+	t := *r
+	if r.CNAME != nil {
+		cname := *r.CNAME
+		cname.Host = strings.ReplaceAll(cname.Host, "%s", label)
+		t.CNAME = &cname
+	}
+	if len(r.TXT.Data) > 0 {
+		t.TXT.Data = make([]TXT_RR, len(r.TXT.Data))
+		for i := range r.TXT.Data {
+			t.TXT.Data[i].Text = strings.ReplaceAll(r.TXT.Data[i].Text, "%s", label)
+		}
+	}
+	return &t
+}
+
+// denial returns zone's nsec or nsec3 record proving name has no data
+func (h *DnsRequestHandler) denial(name string, zone *Zone) dns.RR {
+	if zone.Config.Nsec3 != nil {
+		return NSec3(name, zone)
+	}
+	return NSec(name, zone)
+}
+
+// ANY returns all records of location
+func (h *DnsRequestHandler) ANY(context *RequestContext, name string, record *Record) []dns.RR {
+	var answer []dns.RR
+	answer = append(answer, h.A(name, record, h.FilterRequest(context, record, dns.TypeA, &record.A))...)
+	answer = append(answer, h.AAAA(name, record, h.FilterRequest(context, record, dns.TypeAAAA, &record.AAAA))...)
+	answer = append(answer, h.TXT(name, record)...)
+	answer = append(answer, h.NS(name, record)...)
+	answer = append(answer, h.MX(name, record)...)
+	answer = append(answer, h.SRV(name, record)...)
+	answer = append(answer, h.CAA(name, record)...)
+	answer = append(answer, h.PTR(name, record)...)
+	answer = append(answer, h.TLSA(name, record)...)
+	answer = append(answer, h.NID(name, record)...)
+	answer = append(answer, h.L32(name, record)...)
+	answer = append(answer, h.L64(name, record)...)
+	answer = append(answer, h.LP(name, record)...)
+	answer = append(answer, h.URI(name, record)...)
+	answer = append(answer, h.OPENPGPKEY(name, record)...)
+	answer = append(answer, h.SMIMEA(name, record)...)
+	if name == record.Zone.Name {
+		answer = append(answer, record.Zone.Config.SOA.Data)
+	}
+	return answer
+}
+
+// limitAnswers truncates answer to qtype's limit in max_answers_per_type, falling back to max_answers
+func (h *DnsRequestHandler) limitAnswers(qtype uint16, answer []dns.RR) []dns.RR {
+	limit, ok := h.Config.MaxTypeAnswers[strings.ToLower(dns.TypeToString[qtype])]
+	if !ok {
+		limit = h.Config.MaxAnswers
+	}
+	if limit > 0 && len(answer) > limit {
+		return answer[:limit]
+	}
+	return answer
+}
+
 const (
 	IpMaskWhite = iota
 	IpMaskGrey
 	IpMaskBlack
 )
 
-func (h *DnsRequestHandler) Filter(name string, sourceIp net.IP, rrset *IP_RRSet) []net.IP {
+func (h *DnsRequestHandler) Filter(name string, qtype uint16, sourceIp net.IP, rrset *IP_RRSet) []net.IP {
+	return h.filter(nil, name, qtype, sourceIp, rrset)
+}
+
+// filter is Filter with geoip and healthcheck skipped if disabled by zone's config
+func (h *DnsRequestHandler) filter(zone *Zone, name string, qtype uint16, sourceIp net.IP, rrset *IP_RRSet) []net.IP {
+	geoip := zone == nil || !zone.Config.DisableGeoIp
+	health := zone == nil || !zone.Config.DisableHealth
 	mask := make([]int, len(rrset.Data))
-	mask = h.healthcheck.FilterHealthcheck(name, rrset, mask)
+	if health {
+		var allDown bool
+		mask, allDown = h.healthcheck.filterHealthcheck(name, rrset, mask)
+		if allDown && h.healthcheck.answersAllDown() {
+			// never_empty doesn't bring back down ips
+			return h.healthcheck.allDownIps(qtype)
+		}
+	}
+	var healthMask []int
+	if h.Config.NeverEmpty {
+		// geo filters modify mask in place
+		healthMask = append(healthMask, mask...)
+	}
+	// geo selection only makes sense for address records
+	if geoip && (qtype == dns.TypeA || qtype == dns.TypeAAAA) {
+		mask = h.cachedFilterGeoIp(sourceIp, rrset, mask)
+		// candidates left by location filter are equidistant, prefer the healthier ones
+		if health && rrset.FilterConfig.GeoFilter == "location" && h.Config.GeoIp.HealthTieBreak {
+			mask = h.healthcheck.FilterHealthiest(name, rrset, mask)
+		}
+	}
+	if h.Config.NeverEmpty {
+		mask = keepBest(rrset, healthMask, mask)
+	}
+
+	var ips []net.IP
+	if rrset.FilterConfig.Order == "sticky" {
+		ips = orderFrom(rrset, mask, stickyIndex(normalizeIp(sourceIp), rrset, mask))
+	} else {
+		ips = OrderIps(rrset, mask)
+	}
+	// round robin and sticky order take precedence over stable order
+	if h.Config.StableOrder && rrset.FilterConfig.Order != "rr" && rrset.FilterConfig.Order != "sticky" {
+		sort.Slice(ips, func(i, j int) bool {
+			return bytes.Compare(ips[i].To16(), ips[j].To16()) < 0
+		})
+	}
+	return ips
+}
+
+// keepBest restores one record of rrset if filters removed all of them, a healthy one with highest weight is preferred
+func keepBest(rrset *IP_RRSet, healthMask []int, mask []int) []int {
+	best := -1
+	for i, x := range mask {
+		if x == IpMaskWhite {
+			return mask
+		}
+		if best == -1 || (healthMask[i] == IpMaskWhite && healthMask[best] != IpMaskWhite) ||
+			(healthMask[i] == healthMask[best] && rrset.Data[i].Weight > rrset.Data[best].Weight) {
+			best = i
+		}
+	}
+	if best != -1 {
+		mask[best] = IpMaskWhite
+	}
+	return mask
+}
+
+// blocked checks whether client is geolocated to one of countries
+func (h *DnsRequestHandler) blocked(context *RequestContext, countries []string) bool {
+	if len(countries) == 0 {
+		return false
+	}
+	context.LocationDependent = true
+	country, _ := h.geoip.GetCountry(context.SourceIp)
+	if country == "" {
+		return false
+	}
+	for _, c := range countries {
+		if strings.EqualFold(c, country) {
+			context.ErrorCode = dns.ExtendedErrorCodeBlocked
+			return true
+		}
+	}
+	return false
+}
+
+// FilterRequest filters rrset of record for context's client and marks context if the result depends on client location
+func (h *DnsRequestHandler) FilterRequest(context *RequestContext, record *Record, qtype uint16, rrset *IP_RRSet) []net.IP {
+	geoip := record.Zone == nil || !record.Zone.Config.DisableGeoIp
+	if geoip && (qtype == dns.TypeA || qtype == dns.TypeAAAA) && rrset.FilterConfig.GeoFilter != "" && rrset.FilterConfig.GeoFilter != "none" {
+		context.LocationDependent = true
+	}
+	return h.filter(record.Zone, record.Name, qtype, context.SourceIp, rrset)
+}
+
+func (h *DnsRequestHandler) FilterGeoIp(sourceIp net.IP, rrset *IP_RRSet, mask []int) []int {
+	sourceIp = normalizeIp(sourceIp)
 	switch rrset.FilterConfig.GeoFilter {
 	case "asn":
 		mask = h.geoip.GetSameASN(sourceIp, rrset.Data, mask)
@@ -360,16 +889,38 @@ func (h *DnsRequestHandler) Filter(name string, sourceIp net.IP, rrset *IP_RRSet
 		mask = h.geoip.GetSameCountry(sourceIp, rrset.Data, mask)
 	case "location":
 		mask = h.geoip.GetMinimumDistance(sourceIp, rrset.Data, mask)
+	case "region":
+		mask = h.geoip.GetSameRegion(sourceIp, rrset.Data, mask)
+	case "strategy":
+		mask = h.geoip.GetByStrategy(sourceIp, rrset.Data, mask)
 	default:
 	}
+	return mask
+}
 
-	return OrderIps(rrset, mask)
+// DebugCountry returns a TXT record describing client's geoip location
+func (h *DnsRequestHandler) DebugCountry(context *RequestContext) []dns.RR {
+	sourceIp := normalizeIp(context.SourceIp)
+	country, _ := h.geoip.GetCountry(sourceIp)
+	lat, long, _ := h.geoip.GetCoordinates(sourceIp)
+	r := new(dns.TXT)
+	r.Hdr = dns.RR_Header{Name: context.RawName(), Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0}
+	r.Txt = []string{
+		"ip=" + sourceIp.String(),
+		"country=" + country,
+		fmt.Sprintf("location=%f,%f", lat, long),
+	}
+	return []dns.RR{r}
 }
 
 func (h *DnsRequestHandler) LogRequest(state *RequestContext, responseCode int) {
 	state.LogData["process_time"] = time.Since(state.StartTime).Nanoseconds() / 1000000
 	state.LogData["response_code"] = responseCode
 	state.LogData["log_type"] = "request"
+	h.queryStream.Publish(state.LogData)
+	if state.skipLog || !h.logZone(state.Name()) {
+		return
+	}
 	select {
 	case h.logQueue <- state.LogData:
 	default:
@@ -377,6 +928,27 @@ func (h *DnsRequestHandler) LogRequest(state *RequestContext, responseCode int)
 	}
 }
 
+// sampleLog returns true for one of every log_sampling requests of zone, counting restarts when zone is reloaded
+func (h *DnsRequestHandler) sampleLog(zone *Zone) bool {
+	if zone.Config.LogSampling <= 1 {
+		return true
+	}
+	return (atomic.AddUint64(&zone.logCount, 1)-1)%zone.Config.LogSampling == 0
+}
+
+// logZone checks whether requests for qname should be logged, an empty log_zones list logs all zones
+func (h *DnsRequestHandler) logZone(qname string) bool {
+	if len(h.Config.LogZones) == 0 {
+		return true
+	}
+	for _, zone := range h.Config.LogZones {
+		if dns.IsSubDomain(dns.Fqdn(zone), qname) {
+			return true
+		}
+	}
+	return false
+}
+
 func reverseZone(zone string) []byte {
 	runes := []rune("." + zone)
 	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
@@ -387,7 +959,7 @@ func reverseZone(zone string) []byte {
 
 func (h *DnsRequestHandler) LoadZones() {
 	h.LastZoneUpdate = time.Now()
-	zones, err := h.Redis.SMembers("redins:zones")
+	zones, err := h.Backend.SMembers("redins:zones")
 	if err != nil {
 		logger.Default.Error("cannot load zones : ", err)
 		return
@@ -396,7 +968,85 @@ func (h *DnsRequestHandler) LoadZones() {
 	for _, zone := range zones {
 		newZones, _, _ = newZones.Insert(reverseZone(zone), zone)
 	}
-	h.Zones = newZones
+	h.zones.Store(newZones)
+	atomic.StoreInt32(&h.ready, 1)
+}
+
+// Ready reports whether zones are loaded, queries are not answered authoritatively before that
+func (h *DnsRequestHandler) Ready() bool {
+	return atomic.LoadInt32(&h.ready) == 1
+}
+
+// zoneTree returns current zone tree, it is never modified in place so readers see either old or new zones
+func (h *DnsRequestHandler) zoneTree() *iradix.Tree {
+	return h.zones.Load().(*iradix.Tree)
+}
+
+// ProbeConflicts lists settings which have no effect with probe location lookup, since zone's location
+// names are never loaded
+func (c *DnsRequestHandlerConfig) ProbeConflicts() []string {
+	if c.LocationLookup != "probe" {
+		return nil
+	}
+	conflicts := []string{"probe location lookup does not detect empty non-terminals, they are answered as non-existent"}
+	if c.MaxZoneLocations > 0 {
+		conflicts = append(conflicts, "max_locations_per_zone is not enforced with probe location lookup")
+	}
+	if c.PreloadZones {
+		conflicts = append(conflicts, "preload_zones only preloads zones and not their locations with probe location lookup")
+	}
+	if c.SerialFormat == "datecounter" || c.SerialFormat == "content-hash" || c.SerialFormat == "shared" {
+		conflicts = append(conflicts, "zone serials cannot hash location records with probe location lookup, only config and version are hashed")
+	}
+	return conflicts
+}
+
+// ApplySoaSerial sets serial_format from soa_serial, which only names "unixtime" and "datecounter" modes
+func (c *DnsRequestHandlerConfig) ApplySoaSerial() error {
+	switch c.SoaSerial {
+	case "":
+	case "unixtime":
+		c.SerialFormat = "unix"
+	case "datecounter":
+		c.SerialFormat = "datecounter"
+	default:
+		return fmt.Errorf("invalid soa_serial %s", c.SoaSerial)
+	}
+	return nil
+}
+
+// PreloadZones loads all zones and their locations into cache
+func (h *DnsRequestHandler) PreloadZones() {
+	workers := h.Config.PreloadWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	h.zoneTree().Root().Walk(func(k []byte, v interface{}) bool {
+		zoneName := v.(string)
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			zone := h.LoadZone(zoneName)
+			if zone == nil {
+				return
+			}
+			for label := range zone.Locations {
+				location := label
+				if label == "@" {
+					location = zone.Name
+				}
+				h.LoadLocation(location, zone)
+			}
+		}()
+		return false
+	})
+	wg.Wait()
 }
 
 func (h *DnsRequestHandler) A(name string, record *Record, ips []net.IP) (answers []dns.RR) {
@@ -406,7 +1056,7 @@ func (h *DnsRequestHandler) A(name string, record *Record, ips []net.IP) (answer
 		}
 		r := new(dns.A)
 		r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeA,
-			Class: dns.ClassINET, Ttl: h.getTtl(record.A.Ttl)}
+			Class: dns.ClassINET, Ttl: h.addressTtl(record.Zone, &record.A)}
 		r.A = ip
 		answers = append(answers, r)
 	}
@@ -420,20 +1070,33 @@ func (h *DnsRequestHandler) AAAA(name string, record *Record, ips []net.IP) (ans
 		}
 		r := new(dns.AAAA)
 		r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA,
-			Class: dns.ClassINET, Ttl: h.getTtl(record.AAAA.Ttl)}
+			Class: dns.ClassINET, Ttl: h.addressTtl(record.Zone, &record.AAAA)}
 		r.AAAA = ip
 		answers = append(answers, r)
 	}
 	return
 }
 
+// addressTtl is ttl of an address record set, capped to health_managed_ttl if set is health checked
+// so clients re-query soon after an ip is removed
+func (h *DnsRequestHandler) addressTtl(zone *Zone, rrset *IP_RRSet) uint32 {
+	ttl := h.getTtl(zone, rrset.Ttl)
+	if h.Config.HealthManagedTtl <= 0 || ttl <= uint32(h.Config.HealthManagedTtl) || (zone != nil && zone.Config.DisableHealth) {
+		return ttl
+	}
+	if healthChecked(rrset) {
+		return uint32(h.Config.HealthManagedTtl)
+	}
+	return ttl
+}
+
 func (h *DnsRequestHandler) CNAME(name string, record *Record) (answers []dns.RR) {
 	if record.CNAME == nil {
 		return
 	}
 	r := new(dns.CNAME)
 	r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME,
-		Class: dns.ClassINET, Ttl: h.getTtl(record.CNAME.Ttl)}
+		Class: dns.ClassINET, Ttl: h.getTtl(record.Zone, record.CNAME.Ttl)}
 	r.Target = dns.Fqdn(record.CNAME.Host)
 	answers = append(answers, r)
 	return
@@ -446,7 +1109,7 @@ func (h *DnsRequestHandler) TXT(name string, record *Record) (answers []dns.RR)
 		}
 		r := new(dns.TXT)
 		r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeTXT,
-			Class: dns.ClassINET, Ttl: h.getTtl(record.TXT.Ttl)}
+			Class: dns.ClassINET, Ttl: h.getTtl(record.Zone, record.TXT.Ttl)}
 		r.Txt = split255(txt.Text)
 		answers = append(answers, r)
 	}
@@ -460,7 +1123,7 @@ func (h *DnsRequestHandler) NS(name string, record *Record) (answers []dns.RR) {
 		}
 		r := new(dns.NS)
 		r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeNS,
-			Class: dns.ClassINET, Ttl: h.getTtl(record.NS.Ttl)}
+			Class: dns.ClassINET, Ttl: h.getTtl(record.Zone, record.NS.Ttl)}
 		r.Ns = dns.Fqdn(ns.Host)
 		answers = append(answers, r)
 	}
@@ -474,7 +1137,7 @@ func (h *DnsRequestHandler) MX(name string, record *Record) (answers []dns.RR) {
 		}
 		r := new(dns.MX)
 		r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeMX,
-			Class: dns.ClassINET, Ttl: h.getTtl(record.MX.Ttl)}
+			Class: dns.ClassINET, Ttl: h.getTtl(record.Zone, record.MX.Ttl)}
 		r.Mx = dns.Fqdn(mx.Host)
 		r.Preference = mx.Preference
 		answers = append(answers, r)
@@ -489,7 +1152,7 @@ func (h *DnsRequestHandler) SRV(name string, record *Record) (answers []dns.RR)
 		}
 		r := new(dns.SRV)
 		r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeSRV,
-			Class: dns.ClassINET, Ttl: h.getTtl(record.SRV.Ttl)}
+			Class: dns.ClassINET, Ttl: h.getTtl(record.Zone, record.SRV.Ttl)}
 		r.Target = dns.Fqdn(srv.Target)
 		r.Weight = srv.Weight
 		r.Port = srv.Port
@@ -503,7 +1166,7 @@ func (h *DnsRequestHandler) CAA(name string, record *Record) (answers []dns.RR)
 	for _, caa := range record.CAA.Data {
 		r := new(dns.CAA)
 		r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeCAA,
-			Class: dns.ClassINET, Ttl: h.getTtl(record.CAA.Ttl)}
+			Class: dns.ClassINET, Ttl: h.getTtl(record.Zone, record.CAA.Ttl)}
 		r.Value = caa.Value
 		r.Flag = caa.Flag
 		r.Tag = caa.Tag
@@ -518,7 +1181,7 @@ func (h *DnsRequestHandler) PTR(name string, record *Record) (answers []dns.RR)
 	}
 	r := new(dns.PTR)
 	r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypePTR,
-		Class: dns.ClassINET, Ttl: h.getTtl(record.PTR.Ttl)}
+		Class: dns.ClassINET, Ttl: h.getTtl(record.Zone, record.PTR.Ttl)}
 	r.Ptr = dns.Fqdn(record.PTR.Domain)
 	answers = append(answers, r)
 	return
@@ -528,7 +1191,7 @@ func (h *DnsRequestHandler) TLSA(name string, record *Record) (answers []dns.RR)
 	for _, tlsa := range record.TLSA.Data {
 		r := new(dns.TLSA)
 		r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeTLSA,
-			Class: dns.ClassNONE, Ttl: h.getTtl(record.TLSA.Ttl)}
+			Class: dns.ClassNONE, Ttl: h.getTtl(record.Zone, record.TLSA.Ttl)}
 		r.Usage = tlsa.Usage
 		r.Selector = tlsa.Selector
 		r.MatchingType = tlsa.MatchingType
@@ -538,10 +1201,149 @@ func (h *DnsRequestHandler) TLSA(name string, record *Record) (answers []dns.RR)
 	return
 }
 
-func (h *DnsRequestHandler) getTtl(ttl uint32) uint32 {
+func (h *DnsRequestHandler) NID(name string, record *Record) (answers []dns.RR) {
+	for _, nid := range record.NID.Data {
+		nodeId, err := parseIlnp64(nid.NodeID)
+		if err != nil {
+			continue
+		}
+		r := new(dns.NID)
+		r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeNID,
+			Class: dns.ClassINET, Ttl: h.getTtl(record.Zone, record.NID.Ttl)}
+		r.Preference = nid.Preference
+		r.NodeID = nodeId
+		answers = append(answers, r)
+	}
+	return
+}
+
+func (h *DnsRequestHandler) L32(name string, record *Record) (answers []dns.RR) {
+	for _, l32 := range record.L32.Data {
+		locator := net.ParseIP(l32.Locator32).To4()
+		if locator == nil {
+			continue
+		}
+		r := new(dns.L32)
+		r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeL32,
+			Class: dns.ClassINET, Ttl: h.getTtl(record.Zone, record.L32.Ttl)}
+		r.Preference = l32.Preference
+		r.Locator32 = locator
+		answers = append(answers, r)
+	}
+	return
+}
+
+func (h *DnsRequestHandler) L64(name string, record *Record) (answers []dns.RR) {
+	for _, l64 := range record.L64.Data {
+		locator, err := parseIlnp64(l64.Locator64)
+		if err != nil {
+			continue
+		}
+		r := new(dns.L64)
+		r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeL64,
+			Class: dns.ClassINET, Ttl: h.getTtl(record.Zone, record.L64.Ttl)}
+		r.Preference = l64.Preference
+		r.Locator64 = locator
+		answers = append(answers, r)
+	}
+	return
+}
+
+func (h *DnsRequestHandler) LP(name string, record *Record) (answers []dns.RR) {
+	for _, lp := range record.LP.Data {
+		if len(lp.Fqdn) == 0 {
+			continue
+		}
+		r := new(dns.LP)
+		r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeLP,
+			Class: dns.ClassINET, Ttl: h.getTtl(record.Zone, record.LP.Ttl)}
+		r.Preference = lp.Preference
+		r.Fqdn = dns.Fqdn(lp.Fqdn)
+		answers = append(answers, r)
+	}
+	return
+}
+
+func (h *DnsRequestHandler) URI(name string, record *Record) (answers []dns.RR) {
+	for _, uri := range record.URI.Data {
+		if len(uri.Target) == 0 {
+			continue
+		}
+		r := new(dns.URI)
+		r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeURI,
+			Class: dns.ClassINET, Ttl: h.getTtl(record.Zone, record.URI.Ttl)}
+		r.Priority = uri.Priority
+		r.Weight = uri.Weight
+		r.Target = uri.Target
+		answers = append(answers, r)
+	}
+	return
+}
+
+func (h *DnsRequestHandler) OPENPGPKEY(name string, record *Record) (answers []dns.RR) {
+	for _, key := range record.OPENPGPKEY.Data {
+		if len(key.PublicKey) == 0 {
+			continue
+		}
+		r := new(dns.OPENPGPKEY)
+		r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeOPENPGPKEY,
+			Class: dns.ClassINET, Ttl: h.getTtl(record.Zone, record.OPENPGPKEY.Ttl)}
+		r.PublicKey = key.PublicKey
+		answers = append(answers, r)
+	}
+	return
+}
+
+func (h *DnsRequestHandler) SMIMEA(name string, record *Record) (answers []dns.RR) {
+	for _, smimea := range record.SMIMEA.Data {
+		if len(smimea.Certificate) == 0 {
+			continue
+		}
+		r := new(dns.SMIMEA)
+		r.Hdr = dns.RR_Header{Name: name, Rrtype: dns.TypeSMIMEA,
+			Class: dns.ClassINET, Ttl: h.getTtl(record.Zone, record.SMIMEA.Ttl)}
+		r.Usage = smimea.Usage
+		r.Selector = smimea.Selector
+		r.MatchingType = smimea.MatchingType
+		r.Certificate = smimea.Certificate
+		answers = append(answers, r)
+	}
+	return
+}
+
+// parseIlnp64 parses 64 bit ILNP values written as four colon separated 16 bit hex groups
+func parseIlnp64(s string) (uint64, error) {
+	groups := strings.Split(s, ":")
+	if len(groups) != 4 {
+		return 0, errors.New("invalid ilnp 64 bit value: " + s)
+	}
+	var value uint64
+	for _, group := range groups {
+		if len(group) == 0 || len(group) > 4 {
+			return 0, errors.New("invalid ilnp 64 bit value: " + s)
+		}
+		x, err := strconv.ParseUint(group, 16, 16)
+		if err != nil {
+			return 0, err
+		}
+		value = value<<16 | x
+	}
+	return value, nil
+}
+
+func (h *DnsRequestHandler) getTtl(zone *Zone, ttl uint32) uint32 {
 	maxTtl := uint32(h.Config.MaxTtl)
 	if ttl == 0 {
-		return maxTtl
+		// records without ttl inherit zone's default_ttl or SOA minttl, which is never 0 after setDefaults
+		switch {
+		case zone == nil:
+			// names out of our zones, i.e. external rewrite targets, have no zone defaults
+			return maxTtl
+		case zone.Config.DefaultTtl != 0:
+			ttl = zone.Config.DefaultTtl
+		default:
+			ttl = zone.Config.SOA.MinTtl
+		}
 	}
 	if maxTtl == 0 {
 		return ttl
@@ -574,19 +1376,19 @@ func split255(s string) []string {
 
 func (h *DnsRequestHandler) FindZone(qname string) string {
 	rname := reverseZone(qname)
-	if _, zname, ok := h.Zones.Root().LongestPrefix(rname); ok {
+	if _, zname, ok := h.zoneTree().Root().LongestPrefix(rname); ok {
 		return zname.(string)
 	}
 	return ""
 }
 
 func (h *DnsRequestHandler) loadKey(pub string, priv string) *ZoneKey {
-	pubStr, _ := h.Redis.Get(pub)
+	pubStr, _ := h.Backend.Get(pub)
 	if pubStr == "" {
 		logger.Default.Errorf("key is not set : %s", pub)
 		return nil
 	}
-	privStr, _ := h.Redis.Get(priv)
+	privStr, _ := h.Backend.Get(priv)
 	if privStr == "" {
 		logger.Default.Errorf("key is not set : %s", priv)
 		return nil
@@ -621,30 +1423,208 @@ func (h *DnsRequestHandler) LoadZone(zone string) *Zone {
 		}
 	}
 
-	answer, _, _ := h.ZoneInflight.Do(zone, func() (interface{}, error) {
-		locations, err := h.Redis.GetHKeys("redins:zones:" + zone)
-		if err != nil {
-			logger.Default.Errorf("cannot load zone %s locations : %s", zone, err)
-			return nil, err
+	load := func() (interface{}, error) {
+		var locations []string
+		if h.Config.LocationLookup != "probe" {
+			var err error
+			locations, err = h.Backend.GetHKeys("redins:zones:" + zone)
+			if err != nil {
+				logger.Default.Errorf("cannot load zone %s locations : %s", zone, err)
+				return nil, err
+			}
+			if h.Config.MaxZoneLocations > 0 && len(locations) > h.Config.MaxZoneLocations {
+				err := fmt.Errorf("zone %s has %d locations, more than max_locations_per_zone (%d)", zone, len(locations), h.Config.MaxZoneLocations)
+				logger.Default.Error(err)
+				return nil, err
+			}
 		}
-		config, err := h.Redis.Get("redins:zones:" + zone + ":config")
+		config, err := h.Backend.Get("redins:zones:" + zone + ":config")
 		if err != nil {
 			logger.Default.Errorf("cannot load zone %s config : %s", zone, err)
 		}
 
 		z := NewZone(zone, locations, config)
+		if h.Config.LocationLookup == "probe" {
+			z.probe = h.locationProbe(zone)
+		}
+		z.deepWildcard = h.Config.MultiWildcard
+		if z.Config.SOA.Serial == 0 {
+			z.Config.SOA.Serial = h.ZoneSerial(zone, h.zoneHash(zone, locations, config))
+			z.Config.SOA.Data.Serial = z.Config.SOA.Serial
+		}
+		if h.Config.SoaSerialPublic != 0 {
+			// only emitted serial is fixed, zone's real serial keeps tracking changes
+			z.Config.SOA.Data.Serial = h.Config.SoaSerialPublic
+		}
 		h.LoadZoneKeys(z)
 		z.CacheTimeout = time.Now().Unix() + int64(h.Config.CacheTimeout)
 
 		h.ZoneCache.Set(zone, z, 1)
 		return z, nil
-	})
+	}
+	if z != nil {
+		// serve expired zone while a fresh copy is loaded in background
+		h.ZoneInflight.DoChan(zone, load)
+		return z
+	}
+	answer, _, _ := h.ZoneInflight.Do(zone, load)
 	if answer != nil {
 		return answer.(*Zone)
 	}
 	return z
 }
 
+// locationProbe checks existence of zone's locations directly in backend instead of loading all location keys
+func (h *DnsRequestHandler) locationProbe(zone string) func(label string) bool {
+	key := "redins:zones:" + zone
+	return func(label string) bool {
+		val, err := h.Backend.HGet(key, label)
+		if err != nil {
+			logger.Default.Errorf("cannot probe location %s in %s : %s", label, zone, err)
+			return false
+		}
+		return val != ""
+	}
+}
+
+// zoneHash returns a hash of zone's config, version key and locations, only needed by serial formats depending on content
+func (h *DnsRequestHandler) zoneHash(zone string, locations []string, config string) uint32 {
+	if h.Config.SerialFormat != "datecounter" && h.Config.SerialFormat != "content-hash" && h.Config.SerialFormat != "shared" {
+		return 0
+	}
+	sorted := append([]string{}, locations...)
+	sort.Strings(sorted)
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(config))
+	version, err := h.Backend.Get("redins:zones:" + zone + ":version")
+	if err != nil {
+		logger.Default.Errorf("cannot load version of %s : %s", zone, err)
+	}
+	_, _ = hash.Write([]byte(version))
+	for _, location := range sorted {
+		_, _ = hash.Write([]byte(location))
+		// one backend read per location, zone reloads cost grows with zone size
+		val, err := h.Backend.HGet("redins:zones:"+zone, location)
+		if err != nil {
+			logger.Default.Errorf("cannot load location %s of %s : %s", location, zone, err)
+		}
+		_, _ = hash.Write([]byte(val))
+	}
+	return hash.Sum32()
+}
+
+// ZoneSerial generates SOA serial for zone with content hash according to serial format
+func (h *DnsRequestHandler) ZoneSerial(zone string, hash uint32) uint32 {
+	now := h.now()
+	switch h.Config.SerialFormat {
+	case "content-hash":
+		if hash == 0 {
+			return 1
+		}
+		return hash
+	case "datecounter":
+		h.serialsLock.Lock()
+		defer h.serialsLock.Unlock()
+		base := uint32(now.UTC().Year()*1000000 + int(now.UTC().Month())*10000 + now.UTC().Day()*100)
+		prev, ok := h.serials[zone]
+		if !ok {
+			// continue from serial of previous run so restarts don't reset the counter
+			prev, ok = h.storedSerial(zone)
+		}
+		serial := base
+		if ok {
+			if prev.hash == hash {
+				h.serials[zone] = prev
+				return prev.serial
+			}
+			// same day changes increment the counter, serial should never decrease
+			if prev.serial >= base {
+				serial = prev.serial + 1
+			}
+		}
+		h.serials[zone] = zoneSerial{serial: serial, hash: hash}
+		h.storeSerial(zone, h.serials[zone])
+		return serial
+	case "shared":
+		h.serialsLock.Lock()
+		defer h.serialsLock.Unlock()
+		serial, err := h.sharedSerial(zone, hash)
+		if err != nil {
+			// unix time would be far ahead of shared counter, keep last serial instead
+			logger.Default.Errorf("cannot get shared serial of %s : %s", zone, err)
+			if prev, ok := h.serials[zone]; ok {
+				return prev.serial
+			}
+			return 1
+		}
+		h.serials[zone] = zoneSerial{serial: serial, hash: hash}
+		return serial
+	default:
+		return uint32(now.Unix())
+	}
+}
+
+// storedSerial returns zone's serial and hash saved in backend by storeSerial
+func (h *DnsRequestHandler) storedSerial(zone string) (zoneSerial, bool) {
+	key := "redins:zones:" + zone + ":datecounter"
+	value, err := h.Backend.Get(key)
+	if err != nil || value == "" {
+		return zoneSerial{}, false
+	}
+	hashStr, err := h.Backend.Get(key + "_hash")
+	if err != nil {
+		return zoneSerial{}, false
+	}
+	serial, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return zoneSerial{}, false
+	}
+	hash, _ := strconv.ParseUint(hashStr, 10, 32)
+	return zoneSerial{serial: uint32(serial), hash: uint32(hash)}, true
+}
+
+// storeSerial saves zone's datecounter serial and hash in backend, apart from shared serials so instances
+// running different serial formats on one backend don't overwrite each other's counters
+func (h *DnsRequestHandler) storeSerial(zone string, s zoneSerial) {
+	key := "redins:zones:" + zone + ":datecounter"
+	if err := h.Backend.Set(key, strconv.FormatUint(uint64(s.serial), 10)); err != nil {
+		logger.Default.Errorf("cannot store serial of %s : %s", zone, err)
+		return
+	}
+	if err := h.Backend.Set(key+"_hash", strconv.FormatUint(uint64(s.hash), 10)); err != nil {
+		logger.Default.Errorf("cannot store serial of %s : %s", zone, err)
+	}
+}
+
+// sharedSerial returns zone's serial stored in backend so all instances agree on it,
+// first instance seeing a new zone hash increments it atomically
+func (h *DnsRequestHandler) sharedSerial(zone string, hash uint32) (uint32, error) {
+	incrementer, ok := h.Backend.(Incrementer)
+	if !ok {
+		return 0, errIncrNotSupported
+	}
+	key := "redins:zones:" + zone + ":serial"
+	serial, err := incrementer.IncrIfChanged(key, key+"_hash", strconv.FormatUint(uint64(hash), 10))
+	if err != nil {
+		return 0, err
+	}
+	return uint32(serial), nil
+}
+
+// CheckSerialFormat returns an error if backend cannot provide serials of serial format
+func CheckSerialFormat(format string, backend Backend) error {
+	if format != "shared" {
+		return nil
+	}
+	if metered, ok := backend.(*MeteredBackend); ok {
+		backend = metered.Backend
+	}
+	if _, ok := backend.(Incrementer); !ok {
+		return fmt.Errorf("serial_format shared : %s", errIncrNotSupported)
+	}
+	return nil
+}
+
 func (h *DnsRequestHandler) LoadZoneKeys(z *Zone) {
 	if z.Config.DnsSec {
 		z.ZSK = h.loadKey("redins:zones:"+z.Name+":zsk:pub", "redins:zones:"+z.Name+":zsk:priv")
@@ -664,7 +1644,8 @@ func (h *DnsRequestHandler) LoadZoneKeys(z *Zone) {
 			z.ZSK.DnsKey.Hdr.Ttl = z.KSK.DnsKey.Hdr.Ttl
 		}
 
-		if rrsig, err := sign([]dns.RR{z.ZSK.DnsKey, z.KSK.DnsKey}, z.Name, z.KSK, z.KSK.DnsKey.Hdr.Ttl); err == nil {
+		h.loadPublishedKeys(z)
+		if rrsig, err := sign(z.DnsKeys(), z.Name, z.KSK, z.KSK.DnsKey.Hdr.Ttl); err == nil {
 			z.DnsKeySig = rrsig
 		} else {
 			logger.Default.Errorf("cannot create RRSIG for DNSKEY : %s", err)
@@ -674,18 +1655,26 @@ func (h *DnsRequestHandler) LoadZoneKeys(z *Zone) {
 	}
 }
 
+// errLocationParse is returned when location's json in backend is corrupt
+var errLocationParse = errors.New("cannot parse location")
+
 func (h *DnsRequestHandler) LoadLocation(location string, z *Zone) *Record {
+	r, _ := h.loadLocation(location, z)
+	return r
+}
+
+func (h *DnsRequestHandler) loadLocation(location string, z *Zone) (*Record, error) {
 	key := location + "." + z.Name
 	var r *Record = nil
 	cachedRecord, found := h.RecordCache.Get(key)
 	if found && cachedRecord != nil {
 		r = cachedRecord.(*Record)
 		if time.Now().Unix() <= r.CacheTimeout {
-			return r
+			return h.scheduledRecord(r), nil
 		}
 	}
 
-	answer, _, _ := h.RecordInflight.Do(key, func() (interface{}, error) {
+	answer, err, _ := h.RecordInflight.Do(key, func() (interface{}, error) {
 		var label, name string
 		if location == z.Name {
 			name = z.Name
@@ -694,11 +1683,15 @@ func (h *DnsRequestHandler) LoadLocation(location string, z *Zone) *Record {
 			name = location + "." + z.Name
 			label = location
 		}
+		order := z.Config.IpOrder
+		if order == "" {
+			order = "none"
+		}
 		r := new(Record)
 		r.A = IP_RRSet{
 			FilterConfig: IpFilterConfig{
 				Count:     "multi",
-				Order:     "none",
+				Order:     order,
 				GeoFilter: "none",
 			},
 			HealthCheckConfig: IpHealthCheckConfig{
@@ -709,7 +1702,7 @@ func (h *DnsRequestHandler) LoadLocation(location string, z *Zone) *Record {
 		r.Zone = z
 		r.Name = name
 
-		if _, ok := z.Locations[label]; !ok {
+		if !z.keyExists(label) {
 			// implicit root location
 			if label == "@" {
 				h.RecordCache.Set(key, r, 1)
@@ -720,7 +1713,7 @@ func (h *DnsRequestHandler) LoadLocation(location string, z *Zone) *Record {
 			return nil, err
 		}
 
-		val, err := h.Redis.HGet("redins:zones:"+z.Name, label)
+		val, err := h.Backend.HGet("redins:zones:"+z.Name, label)
 		if err != nil {
 			logger.Default.Error(err, " : ", label, " ", z.Name)
 			return nil, err
@@ -729,18 +1722,69 @@ func (h *DnsRequestHandler) LoadLocation(location string, z *Zone) *Record {
 			err := jsoniter.Unmarshal([]byte(val), r)
 			if err != nil {
 				logger.Default.Errorf("cannot parse json : zone -> %s, location -> %s, \"%s\" -> %s", z.Name, location, val, err)
-				return nil, err
+				return nil, errLocationParse
 			}
 		}
+		r.normalize()
+		h.checkTxtLimits(&r.RRSets, name)
 		r.CacheTimeout = time.Now().Unix() + int64(h.Config.CacheTimeout)
+		if r.Schedule != nil {
+			r.Schedule.Records.normalize()
+			r.Schedule.Records.defaultOrder(order)
+			h.checkTxtLimits(&r.Schedule.Records, name)
+			if err := r.Schedule.parse(); err != nil {
+				logger.Default.Errorf("invalid schedule : zone -> %s, location -> %s : %s", z.Name, location, err)
+				r.Schedule = nil
+			} else {
+				r.Schedule.record = &Record{RRSets: r.Schedule.Records, BlockCountries: r.BlockCountries, Zone: r.Zone, Name: r.Name, CacheTimeout: r.CacheTimeout}
+			}
+		}
+		if len(r.Tagged) != 0 {
+			r.tagged = make(map[string]*Record, len(r.Tagged))
+			for tag, rrsets := range r.Tagged {
+				rrsets.normalize()
+				rrsets.defaultOrder(order)
+				h.checkTxtLimits(&rrsets, name)
+				r.tagged[tag] = &Record{RRSets: rrsets, BlockCountries: r.BlockCountries, Zone: r.Zone, Name: r.Name, CacheTimeout: r.CacheTimeout}
+			}
+		}
 		h.RecordCache.Set(key, r, 1)
 		return r, nil
 	})
 
 	if answer != nil {
-		return answer.(*Record)
+		return h.scheduledRecord(answer.(*Record)), nil
 	}
-	return r
+	if r != nil {
+		return h.scheduledRecord(r), nil
+	}
+	return nil, err
+}
+
+// checkTxtLimits reports txt record sets exceeding max_txt_records or max_txt_size, blocked sets are dropped
+func (h *DnsRequestHandler) checkTxtLimits(rrsets *RRSets, name string) {
+	size := 0
+	for _, txt := range rrsets.TXT.Data {
+		size += len(txt.Text)
+	}
+	count := len(rrsets.TXT.Data)
+	if (h.Config.MaxTxtRecords <= 0 || count <= h.Config.MaxTxtRecords) && (h.Config.MaxTxtSize <= 0 || size <= h.Config.MaxTxtSize) {
+		return
+	}
+	if h.Config.TxtLimitAction == "block" {
+		logger.Default.Errorf("txt records of %s exceed limits (%d records, %d bytes), dropped", name, count, size)
+		rrsets.TXT.Data = nil
+		return
+	}
+	logger.Default.Warningf("txt records of %s exceed limits (%d records, %d bytes)", name, count, size)
+}
+
+// scheduledRecord returns record sets of r's schedule if we are inside its window
+func (h *DnsRequestHandler) scheduledRecord(r *Record) *Record {
+	if r == nil || r.Schedule == nil || !r.Schedule.Contains(h.now()) {
+		return r
+	}
+	return r.Schedule.record
 }
 
 func (h *DnsRequestHandler) SetLocation(location string, z *Zone, val *Record) {
@@ -755,7 +1799,7 @@ func (h *DnsRequestHandler) SetLocation(location string, z *Zone, val *Record) {
 	} else {
 		label = location
 	}
-	if err = h.Redis.HSet(z.Name, label, string(jsonValue)); err != nil {
+	if err = h.Backend.HSet("redins:zones:"+z.Name, label, string(jsonValue)); err != nil {
 		logger.Default.Error("redis error : ", err)
 	}
 }
@@ -773,13 +1817,23 @@ func OrderIps(rrset *IP_RRSet, mask []int) []net.IP {
 	if count == 0 {
 		return result
 	}
+	if rrset.FilterConfig.Order == "weighted" && sum > 0 {
+		// ips with 0 weight are never selected, not even after the others in multi answers
+		weighted := make([]int, len(mask))
+		copy(weighted, mask)
+		for i, x := range weighted {
+			if x == IpMaskWhite && rrset.Data[i].Weight == 0 {
+				weighted[i] = IpMaskBlack
+			}
+		}
+		mask = weighted
+	}
 
 	index := -1
 	if rrset.FilterConfig.Order == "weighted" && sum > 0 {
 		s := time.Now().Nanosecond() % sum
 		for i, x := range mask {
 			if x == IpMaskWhite {
-				// skip Ips with 0 weight
 				s -= rrset.Data[i].Weight
 				if s < 0 {
 					index = i
@@ -807,6 +1861,56 @@ func OrderIps(rrset *IP_RRSet, mask []int) []net.IP {
 		}
 	}
 
+	if rrset.FilterConfig.Order == "weighted" && sum > 0 {
+		return orderByWeight(rrset, mask, index)
+	}
+	return orderFrom(rrset, mask, index)
+}
+
+// orderByWeight returns white ips starting at index followed by the rest in decreasing weight, so
+// answers trimmed to fit client's buffer or answer limits drop the lowest weight ips first
+func orderByWeight(rrset *IP_RRSet, mask []int, index int) []net.IP {
+	result := orderFrom(rrset, mask, index)
+	if len(result) < 2 {
+		return result
+	}
+	rest := make([]int, 0, len(result)-1)
+	for i, x := range mask {
+		if x == IpMaskWhite && i != index {
+			rest = append(rest, i)
+		}
+	}
+	sort.SliceStable(rest, func(i, j int) bool {
+		return rrset.Data[rest[i]].Weight > rrset.Data[rest[j]].Weight
+	})
+	for i, r := range rest {
+		result[i+1] = rrset.Data[r].Ip
+	}
+	return result
+}
+
+// stickyIndex picks a white ip by rendezvous hashing of client ip, so a client keeps its answer
+// as long as that ip stays white and only clients of a removed ip are moved
+func stickyIndex(sourceIp net.IP, rrset *IP_RRSet, mask []int) int {
+	index := -1
+	var max uint64
+	for i, x := range mask {
+		if x != IpMaskWhite {
+			continue
+		}
+		hash := fnv.New64a()
+		_, _ = hash.Write(sourceIp.To16())
+		_, _ = hash.Write(rrset.Data[i].Ip.To16())
+		if sum := hash.Sum64(); index == -1 || sum > max {
+			index, max = i, sum
+		}
+	}
+	return index
+}
+
+// orderFrom returns white ips starting at index, or only ip at index for single count
+func orderFrom(rrset *IP_RRSet, mask []int, index int) []net.IP {
+	result := []net.IP{}
 	if index == -1 {
 		return result
 	}
@@ -847,6 +1951,11 @@ func (h *DnsRequestHandler) FindCAA(record *Record) *Record {
 		if match == NoMatch {
 			return nil
 		}
+		if match == EmptyNonTerminalMatch {
+			// nothing to load, keep climbing
+			currentRecord = &Record{}
+			continue
+		}
 		currentRecord = h.LoadLocation(currentLocation, zone)
 		if currentRecord == nil {
 			return nil
@@ -925,10 +2034,10 @@ func (h *DnsRequestHandler) FindANAME(context *RequestContext, aname string, qty
 
 		if qtype == dns.TypeA && len(currentRecord.A.Data) > 0 {
 			// logger.Default.Debug("found a")
-			return h.Filter(currentRecord.Name, context.SourceIp, &currentRecord.A), dns.RcodeSuccess, currentRecord.A.Ttl
+			return h.FilterRequest(context, currentRecord, qtype, &currentRecord.A), dns.RcodeSuccess, currentRecord.A.Ttl
 		} else if qtype == dns.TypeAAAA && len(currentRecord.AAAA.Data) > 0 {
 			// logger.Default.Debug("found aaaa")
-			return h.Filter(currentRecord.Name, context.SourceIp, &currentRecord.AAAA), dns.RcodeSuccess, currentRecord.AAAA.Ttl
+			return h.FilterRequest(context, currentRecord, qtype, &currentRecord.AAAA), dns.RcodeSuccess, currentRecord.AAAA.Ttl
 		}
 
 		if currentRecord.ANAME != nil {
@@ -940,3 +2049,93 @@ func (h *DnsRequestHandler) FindANAME(context *RequestContext, aname string, qty
 		return []net.IP{}, dns.RcodeSuccess, 0
 	}
 }
+
+// findDelegation returns the topmost delegation point above qname, names below it belong to child zone.
+// ancestors are checked once per zone load, so in probe mode they are not probed on every query
+func (h *DnsRequestHandler) findDelegation(qname string, zone *Zone) (string, *Record) {
+	if qname == zone.Name {
+		return "", nil
+	}
+	labels := dns.SplitDomainName(strings.TrimSuffix(qname, "."+zone.Name))
+	for i := len(labels) - 1; i > 0; i-- {
+		location := strings.Join(labels[i:], ".")
+		cut := zone.isDelegation(location, func() bool {
+			if !zone.keyExists(location) {
+				return false
+			}
+			record := h.LoadLocation(location, zone)
+			return record != nil && len(record.NS.Data) > 0
+		})
+		if !cut {
+			continue
+		}
+		if record := h.LoadLocation(location, zone); record != nil && len(record.NS.Data) > 0 {
+			return location + "." + zone.Name, record
+		}
+	}
+	return "", nil
+}
+
+// referral answers with delegation NS of name and in-zone glue of its name servers only
+func (h *DnsRequestHandler) referral(context *RequestContext, name string, record *Record, zone *Zone) {
+	// logger.Default.Debugf("[%d] delegation", context.Req.Id)
+	// referrals are not authoritative unless we already answered with in-zone cnames
+	if len(context.Answer) == 0 {
+		context.Auth = false
+	}
+	context.Authority = append(context.Authority, h.NS(name, record)...)
+	for _, ns := range record.NS.Data {
+		if !dns.IsSubDomain(zone.Name, ns.Host) {
+			// out of zone name servers have no glue, only configured hints are added
+			context.Additional = append(context.Additional, h.nsHint(ns.Host, record)...)
+			continue
+		}
+		glueLocation, match := zone.FindLocation(ns.Host)
+		if match == ExactMatch || match == WildCardMatch {
+			glueRecord := h.LoadLocation(glueLocation, zone)
+			// XXX : should we return with RcodeServerFailure?
+			if glueRecord != nil {
+				ips := h.FilterRequest(context, glueRecord, dns.TypeA, &glueRecord.A)
+				context.Additional = append(context.Additional, h.A(ns.Host, glueRecord, ips)...)
+				ips = h.FilterRequest(context, glueRecord, dns.TypeAAAA, &glueRecord.AAAA)
+				context.Additional = append(context.Additional, h.AAAA(ns.Host, glueRecord, ips)...)
+			}
+		}
+	}
+}
+
+// nsHint returns configured addresses of an out of zone name server with delegation's ttl
+func (h *DnsRequestHandler) nsHint(host string, record *Record) (answers []dns.RR) {
+	host = dns.Fqdn(strings.ToLower(host))
+	for _, ip := range h.nsHints[host] {
+		hdr := dns.RR_Header{Name: host, Class: dns.ClassINET, Ttl: h.getTtl(record.Zone, record.NS.Ttl)}
+		if ip.To4() != nil {
+			hdr.Rrtype = dns.TypeA
+			answers = append(answers, &dns.A{Hdr: hdr, A: ip.To4()})
+		} else {
+			hdr.Rrtype = dns.TypeAAAA
+			answers = append(answers, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return
+}
+
+// rewrite answers with a CNAME from qname to target, returns true if target should be resolved in place of qname
+func (h *DnsRequestHandler) rewrite(context *RequestContext, target string) bool {
+	context.LogData["rewrite"] = context.RawName()
+	var zone *Zone
+	if zoneName := h.FindZone(target); zoneName != "" {
+		zone = h.LoadZone(zoneName)
+	}
+	// cname goes in answer before target's records so it is signed and limited like them
+	context.Answer = append(context.Answer, &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: context.RawName(), Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: h.getTtl(zone, 0)},
+		Target: target,
+	})
+	if zone == nil || context.QType() == dns.TypeCNAME {
+		return false
+	}
+	// target is in one of our zones, rest of the request is handled for target
+	context.name = target
+	return true
+}
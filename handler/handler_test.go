@@ -7,8 +7,11 @@ import (
 	"github.com/hawell/logger"
 	"github.com/hawell/uperdis"
 	"github.com/miekg/dns"
+	"io/ioutil"
 	"net"
+	"os"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -24,26 +27,29 @@ type TestCase struct {
 	ZoneConfigs    []string
 	Entries        [][][]string
 	TestCases      []test.Case
+	RedisOnly      bool
 }
 
+var newTestHandler = NewHandler
+
 func defaultInitialize(testCase *TestCase) (*DnsRequestHandler, error) {
 	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
 
-	h := NewHandler(&testCase.Config)
-	if err := h.Redis.Del("*"); err != nil {
+	h := newTestHandler(&testCase.Config)
+	if err := h.Backend.Del("*"); err != nil {
 		return nil, err
 	}
 	for i, zone := range testCase.Zones {
-		if err := h.Redis.SAdd("redins:zones", zone); err != nil {
+		if err := h.Backend.SAdd("redins:zones", zone); err != nil {
 			return nil, err
 		}
 		for _, cmd := range testCase.Entries[i] {
-			err := h.Redis.HSet("redins:zones:"+zone, cmd[0], cmd[1])
+			err := h.Backend.HSet("redins:zones:"+zone, cmd[0], cmd[1])
 			if err != nil {
 				return nil, errors.New(fmt.Sprintf("[ERROR] cannot connect to redis: %s", err))
 			}
 		}
-		if err := h.Redis.Set("redins:zones:"+zone+":config", testCase.ZoneConfigs[i]); err != nil {
+		if err := h.Backend.Set("redins:zones:"+zone+":config", testCase.ZoneConfigs[i]); err != nil {
 			return nil, err
 		}
 	}
@@ -354,9 +360,9 @@ var testCases = []*TestCase{
 			},
 			{
 				Qname: "host.subdel.example.net.", Qtype: dns.TypeA,
-				Rcode: dns.RcodeNameError,
 				Ns: []dns.RR{
-					test.SOA("example.net. 300 IN SOA ns1.example.net. hostmaster.example.net. 1460498836 44 55 66 100"),
+					test.NS("subdel.example.net. 300 IN NS ns1.subdel.example.net."),
+					test.NS("subdel.example.net. 300 IN NS ns2.subdel.example.net."),
 				},
 			},
 			{
@@ -1305,6 +1311,9 @@ var testCases = []*TestCase{
 				Qname: "ww3.filtergeo.com.", Qtype: dns.TypeA,
 				Answer: []dns.RR{
 					test.A("ww3.filtergeo.com. 300 IN A 192.168.0.1"),
+					test.A("ww3.filtergeo.com. 300 IN A 192.30.252.225"),
+					test.A("ww3.filtergeo.com. 300 IN A 84.88.14.229"),
+					test.A("ww3.filtergeo.com. 300 IN A 94.76.229.204"),
 				},
 			},
 			{
@@ -1997,6 +2006,14 @@ var testCases = []*TestCase{
 					test.NS("noglue.delegation.zon. 300 IN NS ns2.delegated.zon."),
 				},
 			},
+			{
+				Qname: "x.noglue.delegation.zon.",
+				Qtype: dns.TypeA,
+				Ns: []dns.RR{
+					test.NS("noglue.delegation.zon. 300 IN NS ns1.delegated.zon."),
+					test.NS("noglue.delegation.zon. 300 IN NS ns2.delegated.zon."),
+				},
+			},
 			{
 				Qname: "cname.delegation.zon.",
 				Qtype: dns.TypeA,
@@ -2295,6 +2312,7 @@ var testCases = []*TestCase{
 		Name:        "cache stale",
 		Description: "use stale data from cache when redis is not available",
 		Enabled:     true,
+		RedisOnly:   true,
 		Config:      defaultConfig,
 		Initialize: func(testCase *TestCase) (handler *DnsRequestHandler, e error) {
 			testCase.Config.Redis.Connection.WaitForConnection = false
@@ -2316,7 +2334,7 @@ var testCases = []*TestCase{
 			}
 
 			for i := 0; i < testCase.Config.Redis.Connection.MaxActiveConnections; i++ {
-				handler.Redis.Pool.Get()
+				handler.Backend.(*RedisBackend).Pool.Get()
 			}
 			time.Sleep(time.Duration(1200) * time.Millisecond)
 
@@ -2357,22 +2375,24 @@ var testCases = []*TestCase{
 		Initialize: func(testCase *TestCase) (handler *DnsRequestHandler, e error) {
 			logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
 			testCase.Config.ZoneReload = 1
-			h := NewHandler(&testCase.Config)
-			_ = h.Redis.SetConfig("notify-keyspace-events", "AKE")
-			if err := h.Redis.Del("*"); err != nil {
+			h := newTestHandler(&testCase.Config)
+			if redis, ok := h.Backend.(*RedisBackend); ok {
+				_ = redis.SetConfig("notify-keyspace-events", "AKE")
+			}
+			if err := h.Backend.Del("*"); err != nil {
 				return nil, err
 			}
 			for i, zone := range testCase.Zones {
-				if err := h.Redis.SAdd("redins:zones", zone); err != nil {
+				if err := h.Backend.SAdd("redins:zones", zone); err != nil {
 					return nil, err
 				}
 				for _, cmd := range testCase.Entries[i] {
-					err := h.Redis.HSet("redins:zones:"+zone, cmd[0], cmd[1])
+					err := h.Backend.HSet("redins:zones:"+zone, cmd[0], cmd[1])
 					if err != nil {
 						return nil, errors.New(fmt.Sprintf("[ERROR] cannot connect to redis: %s", err))
 					}
 				}
-				if err := h.Redis.Set("redins:zones:"+zone+":config", testCase.ZoneConfigs[i]); err != nil {
+				if err := h.Backend.Set("redins:zones:"+zone+":config", testCase.ZoneConfigs[i]); err != nil {
 					return nil, err
 				}
 			}
@@ -2382,7 +2402,7 @@ var testCases = []*TestCase{
 		},
 		ApplyAndVerify: func(testCase *TestCase, handler *DnsRequestHandler, t *testing.T) {
 			{
-				_ = handler.Redis.SRem("redins:zones", testCase.Zones[0])
+				_ = handler.Backend.SRem("redins:zones", testCase.Zones[0])
 				time.Sleep(time.Millisecond * 1200)
 
 				tc := testCase.TestCases[0]
@@ -2400,7 +2420,7 @@ var testCases = []*TestCase{
 			}
 
 			{
-				_ = handler.Redis.SAdd("redins:zones", testCase.Zones[0])
+				_ = handler.Backend.SAdd("redins:zones", testCase.Zones[0])
 				time.Sleep(time.Millisecond * 1200)
 
 				tc := testCase.TestCases[1]
@@ -2507,26 +2527,2398 @@ var testCases = []*TestCase{
 			},
 		},
 	},
-}
-
-func center(s string, w int) string {
-	return fmt.Sprintf("%[1]*s", -w, fmt.Sprintf("%[1]*s", (w+len(s))/2, s))
-}
+	{
+		Name:           "ttl inheritance",
+		Description:    "test records without ttl inherit zone's soa minttl",
+		Enabled:        true,
+		Config:         defaultConfig,
+		Initialize:     defaultInitialize,
+		ApplyAndVerify: defaultApplyAndVerify,
+		Zones:          []string{"ttl1.com.", "ttl2.com."},
+		ZoneConfigs: []string{
+			`{"soa":{"ttl":300, "minttl":120, "mbox":"hostmaster.ttl1.com.","ns":"ns1.ttl1.com.","refresh":44,"retry":55,"expire":66}}`,
+			`{"soa":{"ttl":300, "minttl":0, "mbox":"hostmaster.ttl2.com.","ns":"ns1.ttl2.com.","refresh":44,"retry":55,"expire":66}}`,
+		},
+		Entries: [][][]string{
+			{
+				{"www",
+					`{"a":{"records":[{"ip":"1.2.3.4"}]}, "txt":{"ttl":200, "records":[{"text":"foo"}]}}`,
+				},
+			},
+			{
+				{"www",
+					`{"a":{"records":[{"ip":"1.2.3.4"}]}}`,
+				},
+			},
+		},
+		TestCases: []test.Case{
+			{
+				Qname: "www.ttl1.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("www.ttl1.com. 120 IN A 1.2.3.4"),
+				},
+			},
+			{
+				Qname: "www.ttl1.com.", Qtype: dns.TypeTXT,
+				Answer: []dns.RR{
+					test.TXT("www.ttl1.com. 200 IN TXT \"foo\""),
+				},
+			},
+			{
+				Qname: "www.ttl2.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("www.ttl2.com. 300 IN A 1.2.3.4"),
+				},
+			},
+		},
+	},
+	{
+		Name:        "preload zones",
+		Description: "test zones are served from cache after preloading",
+		Enabled:     true,
+		Config:      defaultConfig,
+		Initialize: func(testCase *TestCase) (*DnsRequestHandler, error) {
+			h, err := defaultInitialize(testCase)
+			if err != nil {
+				return nil, err
+			}
+			h.ShutDown()
+			testCase.Config.PreloadZones = true
+			testCase.Config.PreloadWorkers = 2
+			return newTestHandler(&testCase.Config), nil
+		},
+		ApplyAndVerify: func(testCase *TestCase, handler *DnsRequestHandler, t *testing.T) {
+			// preloading is done when handler is created, only cache writes may be pending
+			handler.ZoneCache.Wait()
+			handler.RecordCache.Wait()
+			if err := handler.Backend.Del("*"); err != nil {
+				fmt.Println(err)
+				t.Fail()
+			}
+			defaultApplyAndVerify(testCase, handler, t)
+		},
+		Zones:       []string{"preload1.com.", "preload2.com.", "preload3.com."},
+		ZoneConfigs: []string{"", "", ""},
+		Entries: [][][]string{
+			{
+				{"@",
+					`{"a":{"ttl":300, "records":[{"ip":"1.1.1.1"}]}}`,
+				},
+				{"www",
+					`{"a":{"ttl":300, "records":[{"ip":"1.1.1.2"}]}}`,
+				},
+			},
+			{
+				{"www",
+					`{"a":{"ttl":300, "records":[{"ip":"2.2.2.2"}]}}`,
+				},
+			},
+			{
+				{"www",
+					`{"a":{"ttl":300, "records":[{"ip":"3.3.3.3"}]}}`,
+				},
+			},
+		},
+		TestCases: []test.Case{
+			{
+				Qname: "preload1.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("preload1.com. 300 IN A 1.1.1.1"),
+				},
+			},
+			{
+				Qname: "www.preload1.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("www.preload1.com. 300 IN A 1.1.1.2"),
+				},
+			},
+			{
+				Qname: "www.preload2.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("www.preload2.com. 300 IN A 2.2.2.2"),
+				},
+			},
+			{
+				Qname: "www.preload3.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("www.preload3.com. 300 IN A 3.3.3.3"),
+				},
+			},
+		},
+	},
+	{
+		Name:           "ilnp records",
+		Description:    "test NID, L32, L64 and LP records",
+		Enabled:        true,
+		Config:         defaultConfig,
+		Initialize:     defaultInitialize,
+		ApplyAndVerify: defaultApplyAndVerify,
+		Zones:          []string{"ilnp.com."},
+		ZoneConfigs: []string{
+			`{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.ilnp.com.","ns":"ns1.ilnp.com.","refresh":44,"retry":55,"expire":66}}`,
+		},
+		Entries: [][][]string{
+			{
+				{"host",
+					`{
+						"nid":{"ttl":300, "records":[{"preference":10, "node_id":"0014:4fff:ff20:ee64"}, {"preference":20}, {"preference":30, "node_id":"0014:4fff"}]},
+						"l32":{"ttl":300, "records":[{"preference":10, "locator32":"10.1.2.0"}, {"preference":20}, {"preference":30, "locator32":"10.1.2"}, {"preference":40, "locator32":"2001:db8::1"}]},
+						"l64":{"ttl":300, "records":[{"preference":10, "locator64":"2001:0db8:1140:1000"}, {"preference":20, "locator64":""}]},
+						"lp":{"ttl":300, "records":[{"preference":10, "fqdn":"l64-subnet1.ilnp.com."}, {"preference":20, "fqdn":""}]}
+					}`,
+				},
+			},
+		},
+		TestCases: []test.Case{
+			{
+				Qname: "host.ilnp.com.", Qtype: dns.TypeNID,
+				Answer: []dns.RR{
+					test.NID("host.ilnp.com. 300 IN NID 10 0014:4fff:ff20:ee64"),
+				},
+			},
+			{
+				Qname: "host.ilnp.com.", Qtype: dns.TypeL32,
+				Answer: []dns.RR{
+					test.L32("host.ilnp.com. 300 IN L32 10 10.1.2.0"),
+				},
+			},
+			{
+				Qname: "host.ilnp.com.", Qtype: dns.TypeL64,
+				Answer: []dns.RR{
+					test.L64("host.ilnp.com. 300 IN L64 10 2001:0db8:1140:1000"),
+				},
+			},
+			{
+				Qname: "host.ilnp.com.", Qtype: dns.TypeLP,
+				Answer: []dns.RR{
+					test.LP("host.ilnp.com. 300 IN LP 10 l64-subnet1.ilnp.com."),
+				},
+			},
+		},
+	},
+	{
+		Name:        "stable order",
+		Description: "test address answers are sorted by ip when stable order is enabled",
+		Enabled:     true,
+		Config:      defaultConfig,
+		Initialize: func(testCase *TestCase) (*DnsRequestHandler, error) {
+			testCase.Config.StableOrder = true
+			return defaultInitialize(testCase)
+		},
+		ApplyAndVerify: func(testCase *TestCase, handler *DnsRequestHandler, t *testing.T) {
+			for i, tc := range testCase.TestCases {
+				r := tc.Msg()
+				w := test.NewRecorder(&test.ResponseWriter{})
+				state := NewRequestContext(w, r)
+				handler.HandleRequest(state)
 
-func TestAll(t *testing.T) {
-	for _, testCase := range testCases {
-		if !testCase.Enabled {
-			continue
-		}
-		fmt.Println(">>> ", center(testCase.Name, 70), " <<<")
-		fmt.Println(testCase.Description)
-		fmt.Println(strings.Repeat("-", 80))
-		h, err := testCase.Initialize(testCase)
-		if err != nil {
-			fmt.Println("initialization failed : ", err)
-			t.Fail()
-		}
-		testCase.ApplyAndVerify(testCase, h, t)
-		fmt.Println(strings.Repeat("-", 80))
+				resp := w.Msg
+				// compare without sorting, order is what we are testing
+				if err := test.Header(tc, resp); err != nil {
+					fmt.Println(i, err, tc.Qname, tc.Answer, resp.Answer)
+					t.Fail()
+					continue
+				}
+				for j := range resp.Answer {
+					if resp.Answer[j].String() != tc.Answer[j].String() {
+						fmt.Println(i, "unexpected order", tc.Qname, tc.Answer, resp.Answer)
+						t.Fail()
+						break
+					}
+				}
+			}
+		},
+		Zones:       []string{"stableorder.com."},
+		ZoneConfigs: []string{""},
+		Entries: [][][]string{
+			{
+				{"www",
+					`{
+						"a":{"ttl":300, "records":[{"ip":"10.0.0.3"}, {"ip":"10.0.0.1"}, {"ip":"9.0.0.2"}, {"ip":"10.0.0.2"}]},
+						"aaaa":{"ttl":300, "records":[{"ip":"::3"}, {"ip":"::1"}, {"ip":"::2"}]}
+					}`,
+				},
+			},
+		},
+		TestCases: []test.Case{
+			{
+				Qname: "www.stableorder.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("www.stableorder.com. 300 IN A 9.0.0.2"),
+					test.A("www.stableorder.com. 300 IN A 10.0.0.1"),
+					test.A("www.stableorder.com. 300 IN A 10.0.0.2"),
+					test.A("www.stableorder.com. 300 IN A 10.0.0.3"),
+				},
+			},
+			{
+				Qname: "www.stableorder.com.", Qtype: dns.TypeAAAA,
+				Answer: []dns.RR{
+					test.AAAA("www.stableorder.com. 300 IN AAAA ::1"),
+					test.AAAA("www.stableorder.com. 300 IN AAAA ::2"),
+					test.AAAA("www.stableorder.com. 300 IN AAAA ::3"),
+				},
+			},
+		},
+	},
+	{
+		Name:        "scheduled records",
+		Description: "test locations resolve to scheduled record sets inside schedule window",
+		Enabled:     true,
+		Config:      defaultConfig,
+		Initialize:  defaultInitialize,
+		ApplyAndVerify: func(testCase *TestCase, handler *DnsRequestHandler, t *testing.T) {
+			clocks := []time.Time{
+				time.Date(2020, 1, 1, 2, 30, 0, 0, time.UTC),  // 03:30 Berlin
+				time.Date(2020, 1, 1, 23, 30, 0, 0, time.UTC), // 00:30 Berlin
+				time.Date(2020, 1, 1, 4, 0, 0, 0, time.UTC),   // 05:00 Berlin
+			}
+			for i, clock := range clocks {
+				clock := clock
+				handler.now = func() time.Time { return clock }
+				tc := *testCase
+				tc.TestCases = testCase.TestCases[i*2 : i*2+2]
+				defaultApplyAndVerify(&tc, handler, t)
+			}
+		},
+		Zones:       []string{"schedule.com."},
+		ZoneConfigs: []string{""},
+		Entries: [][][]string{
+			{
+				{"www",
+					`{
+						"a":{"ttl":300, "records":[{"ip":"1.1.1.1"}]},
+						"schedule":{"start":"02:00", "end":"04:00", "timezone":"UTC", "records":{
+							"a":{"ttl":300, "records":[{"ip":"2.2.2.2"}]}
+						}}
+					}`,
+				},
+				{"night",
+					`{
+						"a":{"ttl":300, "records":[{"ip":"1.1.1.1"}]},
+						"schedule":{"start":"23:00", "end":"03:00", "timezone":"Europe/Berlin", "records":{
+							"a":{"ttl":300, "records":[{"ip":"3.3.3.3"}]}
+						}}
+					}`,
+				},
+			},
+		},
+		TestCases: []test.Case{
+			{
+				Qname: "www.schedule.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("www.schedule.com. 300 IN A 2.2.2.2"),
+				},
+			},
+			{
+				Qname: "night.schedule.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("night.schedule.com. 300 IN A 1.1.1.1"),
+				},
+			},
+			{
+				Qname: "www.schedule.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("www.schedule.com. 300 IN A 1.1.1.1"),
+				},
+			},
+			{
+				Qname: "night.schedule.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("night.schedule.com. 300 IN A 3.3.3.3"),
+				},
+			},
+			{
+				Qname: "www.schedule.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("www.schedule.com. 300 IN A 1.1.1.1"),
+				},
+			},
+			{
+				Qname: "night.schedule.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("night.schedule.com. 300 IN A 1.1.1.1"),
+				},
+			},
+		},
+	},
+	{
+		Name:        "cname chain limit",
+		Description: "cname chains longer than max_cname_chain should be truncated",
+		Enabled:     true,
+		Config:      defaultConfig,
+		Initialize: func(testCase *TestCase) (*DnsRequestHandler, error) {
+			testCase.Config.MaxCnameChain = 3
+			return defaultInitialize(testCase)
+		},
+		ApplyAndVerify: defaultApplyAndVerify,
+		Zones:          []string{"chain.cnm."},
+		ZoneConfigs:    []string{""},
+		Entries: [][][]string{
+			{
+				{"c1",
+					`{"cname":{"ttl":300, "host":"c2.chain.cnm."}}`,
+				},
+				{"c2",
+					`{"cname":{"ttl":300, "host":"c3.chain.cnm."}}`,
+				},
+				{"c3",
+					`{"cname":{"ttl":300, "host":"c4.chain.cnm."}}`,
+				},
+				{"c4",
+					`{"cname":{"ttl":300, "host":"c5.chain.cnm."}}`,
+				},
+				{"c5",
+					`{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`,
+				},
+			},
+		},
+		TestCases: []test.Case{
+			{
+				Qname: "c1.chain.cnm.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.CNAME("c1.chain.cnm. 300 IN CNAME c2.chain.cnm."),
+					test.CNAME("c2.chain.cnm. 300 IN CNAME c3.chain.cnm."),
+					test.CNAME("c3.chain.cnm. 300 IN CNAME c4.chain.cnm."),
+				},
+			},
+			{
+				Qname: "c2.chain.cnm.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.CNAME("c2.chain.cnm. 300 IN CNAME c3.chain.cnm."),
+					test.CNAME("c3.chain.cnm. 300 IN CNAME c4.chain.cnm."),
+					test.CNAME("c4.chain.cnm. 300 IN CNAME c5.chain.cnm."),
+					test.A("c5.chain.cnm. 300 IN A 1.2.3.4"),
+				},
+			},
+		},
+	},
+	{
+		Name:        "block countries",
+		Description: "clients from blocked countries should be refused",
+		Enabled:     true,
+		Config:      defaultConfig,
+		Initialize:  defaultInitialize,
+		ApplyAndVerify: func(testCase *TestCase, handler *DnsRequestHandler, t *testing.T) {
+			var sourceIps = []string{
+				"213.95.10.76",  // DE
+				"94.76.229.204", // GB
+				"213.95.10.76",
+				"94.76.229.204",
+			}
+			for i, tc := range testCase.TestCases {
+				r := tc.Msg()
+				r.Extra = append(r.Extra, &dns.OPT{
+					Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT, Class: dns.ClassANY, Rdlength: 0, Ttl: 300},
+					Option: []dns.EDNS0{
+						&dns.EDNS0_SUBNET{
+							Address:       net.ParseIP(sourceIps[i]),
+							Code:          dns.EDNS0SUBNET,
+							Family:        1,
+							SourceNetmask: 32,
+							SourceScope:   0,
+						},
+					},
+				})
+				w := test.NewRecorder(&test.ResponseWriter{})
+				state := NewRequestContext(w, r)
+				handler.HandleRequest(state)
+
+				resp := w.Msg
+				var ede *dns.EDNS0_EDE
+				if opt := resp.IsEdns0(); opt != nil {
+					for _, o := range opt.Option {
+						if e, ok := o.(*dns.EDNS0_EDE); ok {
+							ede = e
+						}
+					}
+				}
+				if blocked := tc.Rcode == dns.RcodeRefused; blocked != (ede != nil && ede.InfoCode == dns.ExtendedErrorCodeBlocked) {
+					fmt.Println(i, "unexpected extended error : ", resp)
+					t.Fail()
+				}
+				resp.Extra = nil
+
+				if err := test.SortAndCheck(resp, tc); err != nil {
+					fmt.Println(i, err)
+					t.Fail()
+				}
+			}
+		},
+		Zones:       []string{"block.com.", "blockzone.com."},
+		ZoneConfigs: []string{"", `{"block_countries":["de"]}`},
+		Entries: [][][]string{
+			{
+				{"www",
+					`{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]},"block_countries":["DE","FR"]}`,
+				},
+			},
+			{
+				{"www",
+					`{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`,
+				},
+			},
+		},
+		TestCases: []test.Case{
+			{
+				Qname: "www.block.com.", Qtype: dns.TypeA,
+				Rcode: dns.RcodeRefused,
+			},
+			{
+				Qname: "www.block.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("www.block.com. 300 IN A 1.2.3.4"),
+				},
+			},
+			{
+				Qname: "www.blockzone.com.", Qtype: dns.TypeA,
+				Rcode: dns.RcodeRefused,
+			},
+			{
+				Qname: "www.blockzone.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("www.blockzone.com. 300 IN A 1.2.3.4"),
+				},
+			},
+		},
+	},
+	{
+		Name:           "soa defaults",
+		Description:    "missing or zero soa fields should be replaced with defaults",
+		Enabled:        true,
+		Config:         defaultConfig,
+		Initialize:     defaultInitialize,
+		ApplyAndVerify: defaultApplyAndVerify,
+		Zones:          []string{"soadefault.com.", "soaempty.com."},
+		ZoneConfigs: []string{
+			`{"soa":{"ttl":300, "minttl":0, "mbox":"", "ns":"ns1.soadefault.com", "refresh":0, "retry":0, "expire":0, "serial":1}}`,
+			`{"soa":null}`,
+		},
+		Entries: [][][]string{
+			{
+				{"@",
+					`{}`,
+				},
+			},
+			{
+				{"@",
+					`{}`,
+				},
+			},
+		},
+		TestCases: []test.Case{
+			{
+				Qname: "soadefault.com.", Qtype: dns.TypeSOA,
+				Answer: []dns.RR{
+					test.SOA("soadefault.com. 300 IN SOA ns1.soadefault.com. hostmaster.soadefault.com. 1 86400 7200 3600 300"),
+				},
+			},
+			{
+				Qname: "soaempty.com.", Qtype: dns.TypeSOA,
+				Answer: []dns.RR{
+					test.SOA("soaempty.com. 300 IN SOA ns1.soaempty.com. hostmaster.soaempty.com. 303 86400 7200 3600 300"),
+				},
+			},
+		},
+	},
+	{
+		Name:           "trailing dots",
+		Description:    "stored host names with or without trailing dot should give the same output",
+		Enabled:        true,
+		Config:         defaultConfig,
+		Initialize:     defaultInitialize,
+		ApplyAndVerify: defaultApplyAndVerify,
+		Zones:          []string{"trail.com."},
+		ZoneConfigs:    []string{""},
+		Entries: [][][]string{
+			{
+				{"www",
+					`{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`,
+				},
+				{"cn",
+					`{"cname":{"ttl":300, "host":"www.trail.com"}}`,
+				},
+				{"mx",
+					`{"mx":{"ttl":300, "records":[{"host":"mx1.trail.com", "preference":10},{"host":"mx2.trail.com.", "preference":20}]}}`,
+				},
+				{"_sip._udp",
+					`{"srv":{"ttl":300, "records":[{"target":"sip1.trail.com", "port":555, "priority":10, "weight":100},{"target":"sip2.trail.com.", "port":555, "priority":10, "weight":100}]}}`,
+				},
+				{"sub",
+					`{"ns":{"ttl":300, "records":[{"host":"ns1.sub.trail.com"},{"host":"ns2.sub.trail.com."}]}}`,
+				},
+				{"ns1.sub",
+					`{"a":{"ttl":300, "records":[{"ip":"1.1.1.1"}]}}`,
+				},
+				{"ns2.sub",
+					`{"a":{"ttl":300, "records":[{"ip":"2.2.2.2"}]}}`,
+				},
+			},
+		},
+		TestCases: []test.Case{
+			{
+				Qname: "cn.trail.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.CNAME("cn.trail.com. 300 IN CNAME www.trail.com."),
+					test.A("www.trail.com. 300 IN A 1.2.3.4"),
+				},
+			},
+			{
+				Qname: "mx.trail.com.", Qtype: dns.TypeMX,
+				Answer: []dns.RR{
+					test.MX("mx.trail.com. 300 IN MX 10 mx1.trail.com."),
+					test.MX("mx.trail.com. 300 IN MX 20 mx2.trail.com."),
+				},
+			},
+			{
+				Qname: "_sip._udp.trail.com.", Qtype: dns.TypeSRV,
+				Answer: []dns.RR{
+					test.SRV("_sip._udp.trail.com. 300 IN SRV 10 100 555 sip1.trail.com."),
+					test.SRV("_sip._udp.trail.com. 300 IN SRV 10 100 555 sip2.trail.com."),
+				},
+			},
+			{
+				Qname: "sub.trail.com.", Qtype: dns.TypeA,
+				Ns: []dns.RR{
+					test.NS("sub.trail.com. 300 IN NS ns1.sub.trail.com."),
+					test.NS("sub.trail.com. 300 IN NS ns2.sub.trail.com."),
+				},
+				Extra: []dns.RR{
+					test.A("ns1.sub.trail.com. 300 IN A 1.1.1.1"),
+					test.A("ns2.sub.trail.com. 300 IN A 2.2.2.2"),
+				},
+			},
+		},
+	},
+	{
+		Name:           "zone default ttl",
+		Description:    "records without ttl should use zone's default_ttl",
+		Enabled:        true,
+		Config:         defaultConfig,
+		Initialize:     defaultInitialize,
+		ApplyAndVerify: defaultApplyAndVerify,
+		Zones:          []string{"ttl1.com.", "ttl2.com.", "ttl3.com."},
+		ZoneConfigs: []string{
+			`{"default_ttl":60}`,
+			`{"default_ttl":120}`,
+			`{"soa":{"minttl":200}}`,
+		},
+		Entries: [][][]string{
+			{
+				{"www",
+					`{"a":{"records":[{"ip":"1.2.3.4"}]}}`,
+				},
+				{"ttl",
+					`{"a":{"ttl":30, "records":[{"ip":"1.2.3.4"}]}}`,
+				},
+			},
+			{
+				{"www",
+					`{"a":{"records":[{"ip":"1.2.3.4"}]}}`,
+				},
+			},
+			{
+				{"www",
+					`{"a":{"records":[{"ip":"1.2.3.4"}]}}`,
+				},
+			},
+		},
+		TestCases: []test.Case{
+			{
+				Qname: "www.ttl1.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("www.ttl1.com. 60 IN A 1.2.3.4"),
+				},
+			},
+			{
+				Qname: "ttl.ttl1.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("ttl.ttl1.com. 30 IN A 1.2.3.4"),
+				},
+			},
+			{
+				Qname: "www.ttl2.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("www.ttl2.com. 120 IN A 1.2.3.4"),
+				},
+			},
+			{
+				Qname: "www.ttl3.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("www.ttl3.com. 200 IN A 1.2.3.4"),
+				},
+			},
+		},
+	},
+	{
+		Name:           "uri records",
+		Description:    "test uri records",
+		Enabled:        true,
+		Config:         defaultConfig,
+		Initialize:     defaultInitialize,
+		ApplyAndVerify: defaultApplyAndVerify,
+		Zones:          []string{"uri.com."},
+		ZoneConfigs:    []string{""},
+		Entries: [][][]string{
+			{
+				{"_ftp._tcp",
+					`{"uri":{"ttl":300, "records":[{"priority":10, "weight":1, "target":"ftp://ftp1.uri.com/public?a=1&b=%20"},{"priority":20, "weight":2, "target":""}]}}`,
+				},
+			},
+		},
+		TestCases: []test.Case{
+			{
+				Qname: "_ftp._tcp.uri.com.", Qtype: dns.TypeURI,
+				Answer: []dns.RR{
+					test.URI(`_ftp._tcp.uri.com. 300 IN URI 10 1 "ftp://ftp1.uri.com/public?a=1&b=%20"`),
+				},
+			},
+		},
+	},
+	{
+		Name:           "openpgpkey and smimea records",
+		Description:    "test openpgpkey and smimea records under hashed owner names",
+		Enabled:        true,
+		Config:         defaultConfig,
+		Initialize:     defaultInitialize,
+		ApplyAndVerify: defaultApplyAndVerify,
+		Zones:          []string{"mail.com."},
+		ZoneConfigs:    []string{""},
+		Entries: [][][]string{
+			{
+				{"c93f1e400f26708f98cb19d936620da35eec8f72e57f9eec01c1afd6._openpgpkey",
+					`{"openpgpkey":{"ttl":300, "records":[{"public_key":"mQENBFVHm5sBCADABFlimdDEUmd9S8sl"},{"public_key":""}]}}`,
+				},
+				{"c93f1e400f26708f98cb19d936620da35eec8f72e57f9eec01c1afd6._smimecert",
+					`{"smimea":{"ttl":300, "records":[{"usage":3, "selector":1, "matching_type":1, "certificate":"1CFC98A706BCF3683015"}]}}`,
+				},
+			},
+		},
+		TestCases: []test.Case{
+			{
+				Qname: "c93f1e400f26708f98cb19d936620da35eec8f72e57f9eec01c1afd6._openpgpkey.mail.com.", Qtype: dns.TypeOPENPGPKEY,
+				Answer: []dns.RR{
+					test.OPENPGPKEY("c93f1e400f26708f98cb19d936620da35eec8f72e57f9eec01c1afd6._openpgpkey.mail.com. 300 IN OPENPGPKEY mQENBFVHm5sBCADABFlimdDEUmd9S8sl"),
+				},
+			},
+			{
+				Qname: "c93f1e400f26708f98cb19d936620da35eec8f72e57f9eec01c1afd6._smimecert.mail.com.", Qtype: dns.TypeSMIMEA,
+				Answer: []dns.RR{
+					test.SMIMEA("c93f1e400f26708f98cb19d936620da35eec8f72e57f9eec01c1afd6._smimecert.mail.com. 300 IN SMIMEA 3 1 1 1CFC98A706BCF3683015"),
+				},
+			},
+		},
+	},
+	{
+		Name:        "max locations per zone",
+		Description: "zones with more locations than max_locations_per_zone should not be served",
+		Enabled:     true,
+		Config:      defaultConfig,
+		Initialize: func(testCase *TestCase) (*DnsRequestHandler, error) {
+			testCase.Config.MaxZoneLocations = 2
+			return defaultInitialize(testCase)
+		},
+		ApplyAndVerify: defaultApplyAndVerify,
+		Zones:          []string{"small.com.", "large.com."},
+		ZoneConfigs:    []string{"", ""},
+		Entries: [][][]string{
+			{
+				{"www1",
+					`{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`,
+				},
+				{"www2",
+					`{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`,
+				},
+			},
+			{
+				{"www1",
+					`{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`,
+				},
+				{"www2",
+					`{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`,
+				},
+				{"www3",
+					`{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`,
+				},
+			},
+		},
+		TestCases: []test.Case{
+			{
+				Qname: "www1.small.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("www1.small.com. 300 IN A 1.2.3.4"),
+				},
+			},
+			{
+				Qname: "www1.large.com.", Qtype: dns.TypeA,
+				Rcode: dns.RcodeServerFailure,
+			},
+		},
+	},
+	{
+		Name:        "probe location lookup",
+		Description: "locations should be found by probing backend when location_lookup is probe",
+		Enabled:     true,
+		Config:      defaultConfig,
+		Initialize: func(testCase *TestCase) (*DnsRequestHandler, error) {
+			testCase.Config.LocationLookup = "probe"
+			return defaultInitialize(testCase)
+		},
+		ApplyAndVerify: defaultApplyAndVerify,
+		Zones:          []string{"probe.com."},
+		ZoneConfigs:    []string{`{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.probe.com.","ns":"ns1.probe.com.","refresh":44,"retry":55,"expire":66, "serial":1}}`},
+		Entries: [][][]string{
+			{
+				{"@",
+					`{"txt":{"ttl":300, "records":[{"text":"apex"}]}}`,
+				},
+				{"www",
+					`{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`,
+				},
+				{"*.sub",
+					`{"a":{"ttl":300, "records":[{"ip":"5.6.7.8"}]}}`,
+				},
+				{"sub",
+					`{"a":{"ttl":300, "records":[{"ip":"9.9.9.9"}]}}`,
+				},
+			},
+		},
+		TestCases: []test.Case{
+			{
+				Qname: "probe.com.", Qtype: dns.TypeTXT,
+				Answer: []dns.RR{
+					test.TXT("probe.com. 300 IN TXT \"apex\""),
+				},
+			},
+			{
+				Qname: "www.probe.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("www.probe.com. 300 IN A 1.2.3.4"),
+				},
+			},
+			{
+				Qname: "a.sub.probe.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("a.sub.probe.com. 300 IN A 5.6.7.8"),
+				},
+			},
+			{
+				Qname: "a.b.sub.probe.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("a.b.sub.probe.com. 300 IN A 5.6.7.8"),
+				},
+			},
+			{
+				Qname: "nx.probe.com.", Qtype: dns.TypeA,
+				Rcode: dns.RcodeNameError,
+				Ns: []dns.RR{
+					test.SOA("probe.com. 300 IN SOA ns1.probe.com. hostmaster.probe.com. 1 44 55 66 100"),
+				},
+			},
+		},
+	},
+	{
+		Name:           "standard wildcard",
+		Description:    "wildcards should not match below existing names by default",
+		Enabled:        true,
+		Config:         defaultConfig,
+		Initialize:     defaultInitialize,
+		ApplyAndVerify: defaultApplyAndVerify,
+		Zones:          []string{"multiwildcard.com."},
+		ZoneConfigs:    []string{`{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.multiwildcard.com.","ns":"ns1.multiwildcard.com.","refresh":44,"retry":55,"expire":66, "serial":1}}`},
+		Entries: [][][]string{
+			{
+				{"*",
+					`{"a":{"ttl":300, "records":[{"ip":"1.1.1.1"}]}}`,
+				},
+				{"c",
+					`{"a":{"ttl":300, "records":[{"ip":"2.2.2.2"}]}}`,
+				},
+				{"*.x",
+					`{"a":{"ttl":300, "records":[{"ip":"3.3.3.3"}]}}`,
+				},
+			},
+		},
+		TestCases: []test.Case{
+			{
+				Qname: "a.b.c.multiwildcard.com.", Qtype: dns.TypeA,
+				Rcode: dns.RcodeNameError,
+				Ns: []dns.RR{
+					test.SOA("multiwildcard.com. 300 IN SOA ns1.multiwildcard.com. hostmaster.multiwildcard.com. 1 44 55 66 100"),
+				},
+			},
+			{
+				Qname: "a.b.d.multiwildcard.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("a.b.d.multiwildcard.com. 300 IN A 1.1.1.1"),
+				},
+			},
+			{
+				Qname: "a.b.x.multiwildcard.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("a.b.x.multiwildcard.com. 300 IN A 3.3.3.3"),
+				},
+			},
+		},
+	},
+	{
+		Name:        "multi level wildcard",
+		Description: "wildcards should match any number of labels when multi_level_wildcard is enabled",
+		Enabled:     true,
+		Config:      defaultConfig,
+		Initialize: func(testCase *TestCase) (*DnsRequestHandler, error) {
+			testCase.Config.MultiWildcard = true
+			return defaultInitialize(testCase)
+		},
+		ApplyAndVerify: defaultApplyAndVerify,
+		Zones:          []string{"multiwildcard.com."},
+		ZoneConfigs:    []string{`{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.multiwildcard.com.","ns":"ns1.multiwildcard.com.","refresh":44,"retry":55,"expire":66, "serial":1}}`},
+		Entries: [][][]string{
+			{
+				{"*",
+					`{"a":{"ttl":300, "records":[{"ip":"1.1.1.1"}]}}`,
+				},
+				{"c",
+					`{"a":{"ttl":300, "records":[{"ip":"2.2.2.2"}]}}`,
+				},
+				{"*.x",
+					`{"a":{"ttl":300, "records":[{"ip":"3.3.3.3"}]}}`,
+				},
+			},
+		},
+		TestCases: []test.Case{
+			{
+				Qname: "a.b.c.multiwildcard.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("a.b.c.multiwildcard.com. 300 IN A 1.1.1.1"),
+				},
+			},
+			{
+				Qname: "a.b.d.multiwildcard.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("a.b.d.multiwildcard.com. 300 IN A 1.1.1.1"),
+				},
+			},
+			{
+				Qname: "a.b.x.multiwildcard.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("a.b.x.multiwildcard.com. 300 IN A 3.3.3.3"),
+				},
+			},
+			{
+				Qname: "c.multiwildcard.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("c.multiwildcard.com. 300 IN A 2.2.2.2"),
+				},
+			},
+		},
+	},
+	{
+		Name:        "answer limits",
+		Description: "answers should be truncated to per type limits with max_answers as fallback",
+		Enabled:     true,
+		Config:      defaultConfig,
+		Initialize: func(testCase *TestCase) (handler *DnsRequestHandler, e error) {
+			testCase.Config.MaxAnswers = 2
+			testCase.Config.MaxTypeAnswers = map[string]int{"a": 1, "txt": 3}
+			return defaultInitialize(testCase)
+		},
+		ApplyAndVerify: defaultApplyAndVerify,
+		Zones:          []string{"limits.com."},
+		ZoneConfigs:    []string{""},
+		Entries: [][][]string{
+			{
+				{"www",
+					`{
+						"a":{"ttl":300, "records":[{"ip":"1.2.3.1"},{"ip":"1.2.3.2"},{"ip":"1.2.3.3"}]},
+						"aaaa":{"ttl":300, "records":[{"ip":"::1"},{"ip":"::2"},{"ip":"::3"}]},
+						"txt":{"ttl":300, "records":[{"text":"t1"},{"text":"t2"},{"text":"t3"},{"text":"t4"}]}
+					}`,
+				},
+			},
+		},
+		TestCases: []test.Case{
+			{
+				Qname: "www.limits.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("www.limits.com. 300 IN A 1.2.3.1"),
+				},
+			},
+			{
+				Qname: "www.limits.com.", Qtype: dns.TypeAAAA,
+				Answer: []dns.RR{
+					test.AAAA("www.limits.com. 300 IN AAAA ::1"),
+					test.AAAA("www.limits.com. 300 IN AAAA ::2"),
+				},
+			},
+			{
+				Qname: "www.limits.com.", Qtype: dns.TypeTXT,
+				Answer: []dns.RR{
+					test.TXT("www.limits.com. 300 IN TXT \"t1\""),
+					test.TXT("www.limits.com. 300 IN TXT \"t2\""),
+					test.TXT("www.limits.com. 300 IN TXT \"t3\""),
+				},
+			},
+		},
+	},
+	{
+		Name:        "special names",
+		Description: "special-use names should be answered locally when handle_special_names is enabled",
+		Enabled:     true,
+		Config:      defaultConfig,
+		Initialize: func(testCase *TestCase) (handler *DnsRequestHandler, e error) {
+			testCase.Config.SpecialNames = true
+			return defaultInitialize(testCase)
+		},
+		ApplyAndVerify: defaultApplyAndVerify,
+		Zones:          []string{"special.com."},
+		ZoneConfigs:    []string{""},
+		Entries: [][][]string{
+			{
+				{"www",
+					`{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`,
+				},
+			},
+		},
+		TestCases: []test.Case{
+			{
+				Qname: "localhost.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("localhost. 300 IN A 127.0.0.1"),
+				},
+			},
+			{
+				Qname: "www.localhost.", Qtype: dns.TypeAAAA,
+				Answer: []dns.RR{
+					test.AAAA("www.localhost. 300 IN AAAA ::1"),
+				},
+			},
+			{
+				Qname: "1.0.0.127.in-addr.arpa.", Qtype: dns.TypePTR,
+				Answer: []dns.RR{
+					test.PTR("1.0.0.127.in-addr.arpa. 300 IN PTR localhost."),
+				},
+			},
+			{
+				Qname: "10.in-addr.arpa.", Qtype: dns.TypePTR,
+				Ns: []dns.RR{
+					test.SOA("10.in-addr.arpa. 300 IN SOA localhost. nobody.invalid. 1 3600 1200 604800 300"),
+				},
+			},
+			{
+				Qname: "4.3.2.10.in-addr.arpa.", Qtype: dns.TypePTR,
+				Rcode: dns.RcodeNameError,
+				Ns: []dns.RR{
+					test.SOA("10.in-addr.arpa. 300 IN SOA localhost. nobody.invalid. 1 3600 1200 604800 300"),
+				},
+			},
+			{
+				Qname: "1.1.168.192.in-addr.arpa.", Qtype: dns.TypePTR,
+				Rcode: dns.RcodeNameError,
+				Ns: []dns.RR{
+					test.SOA("168.192.in-addr.arpa. 300 IN SOA localhost. nobody.invalid. 1 3600 1200 604800 300"),
+				},
+			},
+			{
+				Qname: "www.invalid.", Qtype: dns.TypeA,
+				Rcode: dns.RcodeNameError,
+				Ns: []dns.RR{
+					test.SOA("invalid. 300 IN SOA localhost. nobody.invalid. 1 3600 1200 604800 300"),
+				},
+			},
+			{
+				Qname: "www.special.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("www.special.com. 300 IN A 1.2.3.4"),
+				},
+			},
+		},
+	},
+	{
+		Name:           "soa mbox",
+		Description:    "soa_mbox email should be converted to soa mailbox name",
+		Enabled:        true,
+		Config:         defaultConfig,
+		Initialize:     defaultInitialize,
+		ApplyAndVerify: defaultApplyAndVerify,
+		Zones:          []string{"mbox.com.", "dottedmbox.com."},
+		ZoneConfigs: []string{
+			`{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.mbox.com.","ns":"ns1.mbox.com.","refresh":44,"retry":55,"expire":66,"serial":1}, "soa_mbox":"admin@mbox.com"}`,
+			`{"soa":{"ttl":300, "minttl":100, "ns":"ns1.dottedmbox.com.","refresh":44,"retry":55,"expire":66,"serial":1}, "soa_mbox":"first.last@example.com"}`,
+		},
+		Entries: [][][]string{
+			{
+				{"@",
+					`{}`,
+				},
+			},
+			{
+				{"@",
+					`{}`,
+				},
+			},
+		},
+		TestCases: []test.Case{
+			{
+				Qname: "mbox.com.", Qtype: dns.TypeSOA,
+				Answer: []dns.RR{
+					test.SOA("mbox.com. 300 IN SOA ns1.mbox.com. admin.mbox.com. 1 44 55 66 100"),
+				},
+			},
+			{
+				Qname: "dottedmbox.com.", Qtype: dns.TypeSOA,
+				Answer: []dns.RR{
+					test.SOA(`dottedmbox.com. 300 IN SOA ns1.dottedmbox.com. first\.last.example.com. 1 44 55 66 100`),
+				},
+			},
+		},
+	},
+	{
+		Name:        "txt limits",
+		Description: "txt record sets above max_txt_records or max_txt_size should be blocked",
+		Enabled:     true,
+		Config:      defaultConfig,
+		Initialize: func(testCase *TestCase) (handler *DnsRequestHandler, e error) {
+			testCase.Config.MaxTxtRecords = 3
+			testCase.Config.MaxTxtSize = 12
+			testCase.Config.TxtLimitAction = "block"
+			return defaultInitialize(testCase)
+		},
+		ApplyAndVerify: defaultApplyAndVerify,
+		Zones:          []string{"txtlimits.com."},
+		ZoneConfigs:    []string{`{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.txtlimits.com.","ns":"ns1.txtlimits.com.","refresh":44,"retry":55,"expire":66,"serial":1}}`},
+		Entries: [][][]string{
+			{
+				{"count",
+					`{"txt":{"ttl":300, "records":[{"text":"t1"},{"text":"t2"},{"text":"t3"}]}}`,
+				},
+				{"overcount",
+					`{"txt":{"ttl":300, "records":[{"text":"t1"},{"text":"t2"},{"text":"t3"},{"text":"t4"}]}}`,
+				},
+				{"size",
+					`{"txt":{"ttl":300, "records":[{"text":"aaaaaa"},{"text":"bbbbbb"}]}}`,
+				},
+				{"oversize",
+					`{"txt":{"ttl":300, "records":[{"text":"aaaaaa"},{"text":"bbbbbbb"}]}}`,
+				},
+			},
+		},
+		TestCases: []test.Case{
+			{
+				Qname: "count.txtlimits.com.", Qtype: dns.TypeTXT,
+				Answer: []dns.RR{
+					test.TXT("count.txtlimits.com. 300 IN TXT \"t1\""),
+					test.TXT("count.txtlimits.com. 300 IN TXT \"t2\""),
+					test.TXT("count.txtlimits.com. 300 IN TXT \"t3\""),
+				},
+			},
+			{
+				Qname: "overcount.txtlimits.com.", Qtype: dns.TypeTXT,
+				Ns: []dns.RR{
+					test.SOA("txtlimits.com. 300 IN SOA ns1.txtlimits.com. hostmaster.txtlimits.com. 1 44 55 66 100"),
+				},
+			},
+			{
+				Qname: "size.txtlimits.com.", Qtype: dns.TypeTXT,
+				Answer: []dns.RR{
+					test.TXT("size.txtlimits.com. 300 IN TXT \"aaaaaa\""),
+					test.TXT("size.txtlimits.com. 300 IN TXT \"bbbbbb\""),
+				},
+			},
+			{
+				Qname: "oversize.txtlimits.com.", Qtype: dns.TypeTXT,
+				Ns: []dns.RR{
+					test.SOA("txtlimits.com. 300 IN SOA ns1.txtlimits.com. hostmaster.txtlimits.com. 1 44 55 66 100"),
+				},
+			},
+		},
+	},
+	{
+		Name:        "meta label",
+		Description: "location meta should be served as txt under meta label",
+		Enabled:     true,
+		Config:      defaultConfig,
+		Initialize: func(testCase *TestCase) (handler *DnsRequestHandler, e error) {
+			testCase.Config.MetaLabel = "_meta"
+			return defaultInitialize(testCase)
+		},
+		ApplyAndVerify: defaultApplyAndVerify,
+		Zones:          []string{"meta.com."},
+		ZoneConfigs:    []string{`{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.meta.com.","ns":"ns1.meta.com.","refresh":44,"retry":55,"expire":66,"serial":1}}`},
+		Entries: [][][]string{
+			{
+				{"www",
+					`{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}, "meta":{"owner":"web-team", "changed":"2021-05-01"}}`,
+				},
+				{"nometa",
+					`{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`,
+				},
+			},
+		},
+		TestCases: []test.Case{
+			{
+				Qname: "_meta.www.meta.com.", Qtype: dns.TypeTXT,
+				Answer: []dns.RR{
+					test.TXT("_meta.www.meta.com. 100 IN TXT \"changed=2021-05-01\""),
+					test.TXT("_meta.www.meta.com. 100 IN TXT \"owner=web-team\""),
+				},
+			},
+			{
+				Qname: "_meta.www.meta.com.", Qtype: dns.TypeA,
+				Ns: []dns.RR{
+					test.SOA("meta.com. 300 IN SOA ns1.meta.com. hostmaster.meta.com. 1 44 55 66 100"),
+				},
+			},
+			{
+				Qname: "www.meta.com.", Qtype: dns.TypeTXT,
+				Ns: []dns.RR{
+					test.SOA("meta.com. 300 IN SOA ns1.meta.com. hostmaster.meta.com. 1 44 55 66 100"),
+				},
+			},
+			{
+				Qname: "_meta.nometa.meta.com.", Qtype: dns.TypeTXT,
+				Rcode: dns.RcodeNameError,
+				Ns: []dns.RR{
+					test.SOA("meta.com. 300 IN SOA ns1.meta.com. hostmaster.meta.com. 1 44 55 66 100"),
+				},
+			},
+		},
+	},
+	{
+		Name:        "health managed ttl",
+		Description: "ttl of health checked address records should be capped to health_managed_ttl",
+		Enabled:     true,
+		Config:      defaultConfig,
+		Initialize: func(testCase *TestCase) (handler *DnsRequestHandler, e error) {
+			testCase.Config.HealthManagedTtl = 30
+			return defaultInitialize(testCase)
+		},
+		ApplyAndVerify: defaultApplyAndVerify,
+		Zones:          []string{"healthttl.com."},
+		ZoneConfigs:    []string{`{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.healthttl.com.","ns":"ns1.healthttl.com.","refresh":44,"retry":55,"expire":66,"serial":1}}`},
+		Entries: [][][]string{
+			{
+				{"managed",
+					`{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}], "health_check":{"protocol":"http","uri":"/","port":80,"timeout":1000,"up_count":3,"down_count":-3,"enable":true}}}`,
+				},
+				{"ipmanaged",
+					`{"aaaa":{"ttl":300, "records":[{"ip":"::1", "health_check":{"protocol":"http","uri":"/","port":80}}]}}`,
+				},
+				{"short",
+					`{"a":{"ttl":10, "records":[{"ip":"1.2.3.4"}], "health_check":{"protocol":"http","uri":"/","port":80,"timeout":1000,"up_count":3,"down_count":-3,"enable":true}}}`,
+				},
+				{"stable",
+					`{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`,
+				},
+			},
+		},
+		TestCases: []test.Case{
+			{
+				Qname: "managed.healthttl.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("managed.healthttl.com. 30 IN A 1.2.3.4"),
+				},
+			},
+			{
+				Qname: "ipmanaged.healthttl.com.", Qtype: dns.TypeAAAA,
+				Answer: []dns.RR{
+					test.AAAA("ipmanaged.healthttl.com. 30 IN AAAA ::1"),
+				},
+			},
+			{
+				Qname: "short.healthttl.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("short.healthttl.com. 10 IN A 1.2.3.4"),
+				},
+			},
+			{
+				Qname: "stable.healthttl.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("stable.healthttl.com. 300 IN A 1.2.3.4"),
+				},
+			},
+		},
+	},
+	{
+		Name:           "delegation minimization",
+		Description:    "referrals contain only delegation ns and glue",
+		Enabled:        true,
+		Config:         defaultConfig,
+		Initialize:     defaultInitialize,
+		ApplyAndVerify: defaultApplyAndVerify,
+		Zones:          []string{"minimize.zon."},
+		ZoneConfigs:    []string{""},
+		Entries: [][][]string{
+			{
+				{"child",
+					`{"ns":{"ttl":300, "records":[{"host":"ns1.child.minimize.zon."}]},
+					"a":{"ttl":300, "records":[{"ip":"1.1.1.1"}]},
+					"txt":{"ttl":300, "records":[{"text":"child data"}]},
+					"mx":{"ttl":300, "records":[{"host":"mx.minimize.zon.", "preference":10}]}}`,
+				},
+				{"ns1.child",
+					`{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]},
+					"txt":{"ttl":300, "records":[{"text":"glue data"}]}}`,
+				},
+				{"www.child",
+					`{"a":{"ttl":300, "records":[{"ip":"5.6.7.8"}]}}`,
+				},
+			},
+		},
+		TestCases: []test.Case{
+			{
+				Qname: "child.minimize.zon.",
+				Qtype: dns.TypeA,
+				Ns: []dns.RR{
+					test.NS("child.minimize.zon. 300 IN NS ns1.child.minimize.zon."),
+				},
+				Extra: []dns.RR{
+					test.A("ns1.child.minimize.zon. 300 IN A 1.2.3.4"),
+				},
+			},
+			{
+				Qname: "child.minimize.zon.",
+				Qtype: dns.TypeTXT,
+				Ns: []dns.RR{
+					test.NS("child.minimize.zon. 300 IN NS ns1.child.minimize.zon."),
+				},
+				Extra: []dns.RR{
+					test.A("ns1.child.minimize.zon. 300 IN A 1.2.3.4"),
+				},
+			},
+			{
+				Qname: "www.child.minimize.zon.",
+				Qtype: dns.TypeA,
+				Ns: []dns.RR{
+					test.NS("child.minimize.zon. 300 IN NS ns1.child.minimize.zon."),
+				},
+				Extra: []dns.RR{
+					test.A("ns1.child.minimize.zon. 300 IN A 1.2.3.4"),
+				},
+			},
+			{
+				Qname: "ns1.child.minimize.zon.",
+				Qtype: dns.TypeTXT,
+				Ns: []dns.RR{
+					test.NS("child.minimize.zon. 300 IN NS ns1.child.minimize.zon."),
+				},
+				Extra: []dns.RR{
+					test.A("ns1.child.minimize.zon. 300 IN A 1.2.3.4"),
+				},
+			},
+		},
+	},
+	{
+		Name:        "rewrite",
+		Description: "rewritten names should be answered with a cname to their target",
+		Enabled:     true,
+		Config:      defaultConfig,
+		Initialize: func(testCase *TestCase) (handler *DnsRequestHandler, e error) {
+			testCase.Config.Rewrite = map[string]string{
+				"old.example.com":  "www.rewrite.com",
+				"Ext.Rewrite.com.": "www.example.org.",
+			}
+			return defaultInitialize(testCase)
+		},
+		ApplyAndVerify: defaultApplyAndVerify,
+		Zones:          []string{"rewrite.com."},
+		ZoneConfigs:    []string{`{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.rewrite.com.","ns":"ns1.rewrite.com.","refresh":44,"retry":55,"expire":66,"serial":1}}`},
+		Entries: [][][]string{
+			{
+				{"www",
+					`{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`,
+				},
+				{"ext",
+					`{"a":{"ttl":300, "records":[{"ip":"5.6.7.8"}]}}`,
+				},
+			},
+		},
+		TestCases: []test.Case{
+			{
+				Qname: "old.example.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.CNAME("old.example.com. 100 IN CNAME www.rewrite.com."),
+					test.A("www.rewrite.com. 300 IN A 1.2.3.4"),
+				},
+			},
+			{
+				Qname: "old.example.com.", Qtype: dns.TypeCNAME,
+				Answer: []dns.RR{
+					test.CNAME("old.example.com. 100 IN CNAME www.rewrite.com."),
+				},
+			},
+			{
+				Qname: "ext.rewrite.com.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.CNAME("ext.rewrite.com. 300 IN CNAME www.example.org."),
+				},
+			},
+		},
+	},
+	{
+		Name:        "ns hints",
+		Description: "referrals to out of zone name servers have no glue but configured hints",
+		Enabled:     true,
+		Config:      defaultConfig,
+		Initialize: func(testCase *TestCase) (handler *DnsRequestHandler, e error) {
+			testCase.Config.NsHints = map[string][]string{
+				"NS.Hinted.net": {"192.0.2.53", "2001:db8::53", "invalid"},
+			}
+			return defaultInitialize(testCase)
+		},
+		ApplyAndVerify: defaultApplyAndVerify,
+		Zones:          []string{"hints.zon.", "other.zon."},
+		ZoneConfigs:    []string{"", ""},
+		Entries: [][][]string{
+			{
+				{"child",
+					`{"ns":{"ttl":300, "records":[{"host":"ns1.other.zon."},{"host":"ns.hinted.net."},{"host":"ns1.child.hints.zon."}]}}`,
+				},
+				{"ns1.child",
+					`{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`,
+				},
+			},
+			{
+				{"ns1",
+					`{"a":{"ttl":300, "records":[{"ip":"5.6.7.8"}]}}`,
+				},
+			},
+		},
+		TestCases: []test.Case{
+			{
+				Qname: "child.hints.zon.",
+				Qtype: dns.TypeA,
+				Ns: []dns.RR{
+					test.NS("child.hints.zon. 300 IN NS ns.hinted.net."),
+					test.NS("child.hints.zon. 300 IN NS ns1.child.hints.zon."),
+					test.NS("child.hints.zon. 300 IN NS ns1.other.zon."),
+				},
+				Extra: []dns.RR{
+					test.A("ns.hinted.net. 300 IN A 192.0.2.53"),
+					test.AAAA("ns.hinted.net. 300 IN AAAA 2001:db8::53"),
+					test.A("ns1.child.hints.zon. 300 IN A 1.2.3.4"),
+				},
+			},
+		},
+	},
+	{
+		Name:        "negative rcodes",
+		Description: "zones can override rcodes of negative answers, falling back to handler's rcodes",
+		Enabled:     true,
+		Config:      defaultConfig,
+		Initialize: func(testCase *TestCase) (handler *DnsRequestHandler, e error) {
+			testCase.Config.NxDomainRcode = "refused"
+			return defaultInitialize(testCase)
+		},
+		ApplyAndVerify: defaultApplyAndVerify,
+		Zones:          []string{"strict.zon.", "lenient.zon."},
+		ZoneConfigs: []string{
+			`{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.strict.zon.","ns":"ns1.strict.zon.","refresh":44,"retry":55,"expire":66,"serial":1}, "nxdomain_rcode":"nxdomain", "nodata_rcode":"nxdomain"}`,
+			`{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.lenient.zon.","ns":"ns1.lenient.zon.","refresh":44,"retry":55,"expire":66,"serial":1}, "parse_error_rcode":"nxdomain"}`,
+		},
+		Entries: [][][]string{
+			{
+				{"www",
+					`{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`,
+				},
+			},
+			{
+				{"www",
+					`{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`,
+				},
+				{"corrupt",
+					`{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}`,
+				},
+			},
+		},
+		TestCases: []test.Case{
+			{
+				Qname: "missing.strict.zon.", Qtype: dns.TypeA,
+				Rcode: dns.RcodeNameError,
+				Ns: []dns.RR{
+					test.SOA("strict.zon. 300 IN SOA ns1.strict.zon. hostmaster.strict.zon. 1 44 55 66 100"),
+				},
+			},
+			{
+				Qname: "www.strict.zon.", Qtype: dns.TypeTXT,
+				Rcode: dns.RcodeNameError,
+				Ns: []dns.RR{
+					test.SOA("strict.zon. 300 IN SOA ns1.strict.zon. hostmaster.strict.zon. 1 44 55 66 100"),
+				},
+			},
+			{
+				Qname: "missing.lenient.zon.", Qtype: dns.TypeA,
+				Rcode: dns.RcodeRefused,
+			},
+			{
+				Qname: "www.lenient.zon.", Qtype: dns.TypeTXT,
+				Ns: []dns.RR{
+					test.SOA("lenient.zon. 300 IN SOA ns1.lenient.zon. hostmaster.lenient.zon. 1 44 55 66 100"),
+				},
+			},
+			{
+				Qname: "corrupt.lenient.zon.", Qtype: dns.TypeA,
+				Rcode: dns.RcodeNameError,
+				Ns: []dns.RR{
+					test.SOA("lenient.zon. 300 IN SOA ns1.lenient.zon. hostmaster.lenient.zon. 1 44 55 66 100"),
+				},
+			},
+		},
+	},
+	{
+		Name:        "address family hints",
+		Description: "address answers should include other family in additional section",
+		Enabled:     true,
+		Config:      defaultConfig,
+		Initialize: func(testCase *TestCase) (handler *DnsRequestHandler, e error) {
+			testCase.Config.AddressHints = true
+			return defaultInitialize(testCase)
+		},
+		ApplyAndVerify: defaultApplyAndVerify,
+		Zones:          []string{"hints.zon."},
+		ZoneConfigs:    []string{""},
+		Entries: [][][]string{
+			{
+				{"www",
+					`{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]},
+					"aaaa":{"ttl":300, "records":[{"ip":"2001:db8::1"}]}}`,
+				},
+				{"v4",
+					`{"a":{"ttl":300, "records":[{"ip":"5.6.7.8"}]}}`,
+				},
+			},
+		},
+		TestCases: []test.Case{
+			{
+				Qname: "www.hints.zon.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("www.hints.zon. 300 IN A 1.2.3.4"),
+				},
+				Extra: []dns.RR{
+					test.AAAA("www.hints.zon. 300 IN AAAA 2001:db8::1"),
+				},
+			},
+			{
+				Qname: "www.hints.zon.", Qtype: dns.TypeAAAA,
+				Answer: []dns.RR{
+					test.AAAA("www.hints.zon. 300 IN AAAA 2001:db8::1"),
+				},
+				Extra: []dns.RR{
+					test.A("www.hints.zon. 300 IN A 1.2.3.4"),
+				},
+			},
+			{
+				Qname: "v4.hints.zon.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("v4.hints.zon. 300 IN A 5.6.7.8"),
+				},
+			},
+		},
+	},
+	{
+		Name:           "duplicate records",
+		Description:    "identical records of a location should be answered once",
+		Enabled:        true,
+		Config:         defaultConfig,
+		Initialize:     defaultInitialize,
+		ApplyAndVerify: defaultApplyAndVerify,
+		Zones:          []string{"dup.zon."},
+		ZoneConfigs:    []string{""},
+		Entries: [][][]string{
+			{
+				{"www",
+					`{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"},{"ip":"5.6.7.8"},{"ip":"1.2.3.4"}]},
+					"txt":{"ttl":300, "records":[{"text":"foo"},{"text":"foo"}]}}`,
+				},
+			},
+		},
+		TestCases: []test.Case{
+			{
+				Qname: "www.dup.zon.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("www.dup.zon. 300 IN A 1.2.3.4"),
+					test.A("www.dup.zon. 300 IN A 5.6.7.8"),
+				},
+			},
+			{
+				Qname: "www.dup.zon.", Qtype: dns.TypeTXT,
+				Answer: []dns.RR{
+					test.TXT("www.dup.zon. 300 IN TXT \"foo\""),
+				},
+			},
+		},
+	},
+	{
+		Name:        "keep duplicate records",
+		Description: "identical records of a location should be kept with duplicate_records keep",
+		Enabled:     true,
+		Config:      defaultConfig,
+		Initialize: func(testCase *TestCase) (handler *DnsRequestHandler, e error) {
+			testCase.Config.DuplicateRecords = "keep"
+			return defaultInitialize(testCase)
+		},
+		ApplyAndVerify: defaultApplyAndVerify,
+		Zones:          []string{"dup.zon."},
+		ZoneConfigs:    []string{""},
+		Entries: [][][]string{
+			{
+				{"www",
+					`{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"},{"ip":"5.6.7.8"},{"ip":"1.2.3.4"}]},
+					"txt":{"ttl":300, "records":[{"text":"foo"},{"text":"foo"}]}}`,
+				},
+			},
+		},
+		TestCases: []test.Case{
+			{
+				Qname: "www.dup.zon.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("www.dup.zon. 300 IN A 1.2.3.4"),
+					test.A("www.dup.zon. 300 IN A 1.2.3.4"),
+					test.A("www.dup.zon. 300 IN A 5.6.7.8"),
+				},
+			},
+		},
+	},
+	{
+		Name:           "templated wildcard",
+		Description:    "wildcard records of a zone with wildcard_template should have %s replaced by queried label",
+		Enabled:        true,
+		Config:         defaultConfig,
+		Initialize:     defaultInitialize,
+		ApplyAndVerify: defaultApplyAndVerify,
+		Zones:          []string{"users.example.com.", "plain.example.com."},
+		ZoneConfigs:    []string{`{"wildcard_template": true}`, ""},
+		Entries: [][][]string{
+			{
+				{"*",
+					`{"txt":{"ttl":300, "records":[{"text":"user=%s"}]}}`,
+				},
+				{"*.svc",
+					`{"cname":{"ttl":300, "host":"%s.ingress.example.com."}}`,
+				},
+				{"bob",
+					`{"txt":{"ttl":300, "records":[{"text":"user=%s"}]}}`,
+				},
+			},
+			{
+				{"*",
+					`{"txt":{"ttl":300, "records":[{"text":"user=%s"}]}}`,
+				},
+			},
+		},
+		TestCases: []test.Case{
+			{
+				Qname: "alice.users.example.com.", Qtype: dns.TypeTXT,
+				Answer: []dns.RR{
+					test.TXT("alice.users.example.com. 300 IN TXT \"user=alice\""),
+				},
+			},
+			{
+				Qname: "web.svc.users.example.com.", Qtype: dns.TypeCNAME,
+				Answer: []dns.RR{
+					test.CNAME("web.svc.users.example.com. 300 IN CNAME web.ingress.example.com."),
+				},
+			},
+			{
+				Qname: "bob.users.example.com.", Qtype: dns.TypeTXT,
+				Answer: []dns.RR{
+					test.TXT("bob.users.example.com. 300 IN TXT \"user=%s\""),
+				},
+			},
+			{
+				Qname: "alice.plain.example.com.", Qtype: dns.TypeTXT,
+				Answer: []dns.RR{
+					test.TXT("alice.plain.example.com. 300 IN TXT \"user=%s\""),
+				},
+			},
+		},
+	},
+}
+
+func center(s string, w int) string {
+	return fmt.Sprintf("%[1]*s", -w, fmt.Sprintf("%[1]*s", (w+len(s))/2, s))
+}
+
+func TestAll(t *testing.T) {
+	runTestCases(t, false)
+}
+
+func TestAllMemoryBackend(t *testing.T) {
+	backend := NewMemoryBackend()
+	newTestHandler = func(config *DnsRequestHandlerConfig) *DnsRequestHandler {
+		return NewHandlerWithBackend(config, backend)
+	}
+	defer func() { newTestHandler = NewHandler }()
+	runTestCases(t, true)
+}
+
+func runTestCases(t *testing.T, memoryBackend bool) {
+	for _, testCase := range testCases {
+		if !testCase.Enabled || (memoryBackend && testCase.RedisOnly) {
+			continue
+		}
+		fmt.Println(">>> ", center(testCase.Name, 70), " <<<")
+		fmt.Println(testCase.Description)
+		fmt.Println(strings.Repeat("-", 80))
+		h, err := testCase.Initialize(testCase)
+		if err != nil {
+			fmt.Println("initialization failed : ", err)
+			t.Fail()
+		}
+		testCase.ApplyAndVerify(testCase, h, t)
+		fmt.Println(strings.Repeat("-", 80))
+	}
+}
+
+func TestZoneSerial(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	clock := time.Date(2020, 3, 4, 10, 0, 0, 0, time.UTC)
+
+	var handlers []*DnsRequestHandler
+	defer func() {
+		for _, h := range handlers {
+			h.ShutDown()
+		}
+	}()
+	newSerialHandler := func(format string) *DnsRequestHandler {
+		config := defaultConfig
+		config.SerialFormat = format
+		backend := NewMemoryBackend()
+		_ = backend.SAdd("redins:zones", "serial.com.")
+		_ = backend.HSet("redins:zones:serial.com.", "www", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`)
+		h := NewHandlerWithBackend(&config, backend)
+		h.now = func() time.Time { return clock }
+		handlers = append(handlers, h)
+		return h
+	}
+
+	// unix
+	h := newSerialHandler("unix")
+	if serial := h.LoadZone("serial.com.").Config.SOA.Data.Serial; serial != uint32(clock.Unix()) {
+		fmt.Println("unix serial is", serial, "expected", clock.Unix())
+		t.Fail()
+	}
+
+	// explicit serial in zone config is kept
+	h = newSerialHandler("datecounter")
+	_ = h.Backend.Set("redins:zones:serial.com.:config", `{"soa":{"serial":123}}`)
+	if serial := h.LoadZone("serial.com.").Config.SOA.Data.Serial; serial != 123 {
+		fmt.Println("explicit serial is", serial, "expected 123")
+		t.Fail()
+	}
+
+	// content-hash
+	h = newSerialHandler("content-hash")
+	z := h.LoadZone("serial.com.")
+	if z.Config.SOA.Serial == uint32(clock.Unix()) {
+		fmt.Println("content-hash serial should not be unix time")
+		t.Fail()
+	}
+	if z2 := newSerialHandler("content-hash").LoadZone("serial.com."); z.Config.SOA.Serial != z2.Config.SOA.Serial {
+		fmt.Println("content-hash serials", z.Config.SOA.Serial, z2.Config.SOA.Serial, "of same zone should be equal")
+		t.Fail()
+	}
+	// editing a record is enough, version is not needed
+	h2 := newSerialHandler("content-hash")
+	_ = h2.Backend.HSet("redins:zones:serial.com.", "www", `{"a":{"ttl":300, "records":[{"ip":"5.6.7.8"}]}}`)
+	if z2 := h2.LoadZone("serial.com."); z.Config.SOA.Serial == z2.Config.SOA.Serial {
+		fmt.Println("content-hash serials", z.Config.SOA.Serial, z2.Config.SOA.Serial, "should differ after record edit")
+		t.Fail()
+	}
+	h2 = newSerialHandler("content-hash")
+	_ = h2.Backend.Set("redins:zones:serial.com.:version", "2")
+	if z2 := h2.LoadZone("serial.com."); z.Config.SOA.Serial == z2.Config.SOA.Serial {
+		fmt.Println("content-hash serials", z.Config.SOA.Serial, z2.Config.SOA.Serial, "should differ after version change")
+		t.Fail()
+	}
+	if s := h.ZoneSerial("serial.com.", h.zoneHash("serial.com.", []string{"www"}, "")); s != z.Config.SOA.Serial {
+		fmt.Println("content-hash serial of unchanged zone is", s, "expected", z.Config.SOA.Serial)
+		t.Fail()
+	}
+
+	// datecounter
+	h = newSerialHandler("datecounter")
+	steps := []struct {
+		clock  time.Time
+		hash   uint32
+		serial uint32
+	}{
+		{clock, 1, 2020030400},
+		{clock.Add(time.Hour), 1, 2020030400},
+		{clock.Add(2 * time.Hour), 2, 2020030401},
+		{clock.Add(3 * time.Hour), 3, 2020030402},
+		{clock.Add(24 * time.Hour), 3, 2020030402},
+		{clock.Add(24 * time.Hour), 4, 2020030500},
+	}
+	for i, step := range steps {
+		clock := step.clock
+		h.now = func() time.Time { return clock }
+		if serial := h.ZoneSerial("serial.com.", step.hash); serial != step.serial {
+			fmt.Println(i, "datecounter serial is", serial, "expected", step.serial)
+			t.Fail()
+		}
+	}
+	if serial := newSerialHandler("datecounter").LoadZone("serial.com.").Config.SOA.Data.Serial; serial != 2020030400 {
+		fmt.Println("datecounter serial is", serial, "expected 2020030400")
+		t.Fail()
+	}
+
+	// datecounter serial survives restarts, a new instance on the same backend continues the counter
+	h = newSerialHandler("datecounter")
+	if serial := h.ZoneSerial("serial.com.", 1); serial != 2020030400 {
+		fmt.Println("datecounter serial is", serial, "expected 2020030400")
+		t.Fail()
+	}
+	if serial := h.ZoneSerial("serial.com.", 2); serial != 2020030401 {
+		fmt.Println("datecounter serial is", serial, "expected 2020030401")
+		t.Fail()
+	}
+	restarted := NewHandlerWithBackend(h.Config, h.Backend)
+	restarted.now = h.now
+	handlers = append(handlers, restarted)
+	if serial := restarted.ZoneSerial("serial.com.", 2); serial != 2020030401 {
+		fmt.Println("datecounter serial of unchanged zone after restart is", serial, "expected 2020030401")
+		t.Fail()
+	}
+	if serial := restarted.ZoneSerial("serial.com.", 3); serial != 2020030402 {
+		fmt.Println("datecounter serial of changed zone after restart is", serial, "expected 2020030402")
+		t.Fail()
+	}
+	if value, _ := h.Backend.Get("redins:zones:serial.com.:datecounter"); value != "2020030402" {
+		fmt.Println("stored datecounter serial is", value, "expected 2020030402")
+		t.Fail()
+	}
+	if value, _ := h.Backend.Get("redins:zones:serial.com.:serial"); value != "" {
+		fmt.Println("datecounter should not touch shared serial : ", value)
+		t.Fail()
+	}
+
+	// editing a record without bumping version increments datecounter serial
+	h = newSerialHandler("datecounter")
+	if serial := h.LoadZone("serial.com.").Config.SOA.Serial; serial != 2020030400 {
+		fmt.Println("datecounter serial is", serial, "expected 2020030400")
+		t.Fail()
+	}
+	_ = h.Backend.HSet("redins:zones:serial.com.", "www", `{"a":{"ttl":300, "records":[{"ip":"5.6.7.8"}]}}`)
+	h.ZoneCache.Wait()
+	h.ZoneCache.Del("serial.com.")
+	if serial := h.LoadZone("serial.com.").Config.SOA.Serial; serial != 2020030401 {
+		fmt.Println("datecounter serial after record edit is", serial, "expected 2020030401")
+		t.Fail()
+	}
+
+	// public serial is fixed while internal serial tracks changes
+	h = newSerialHandler("datecounter")
+	h.Config.SoaSerialPublic = 1
+	querySerial := func() uint32 {
+		tc := test.Case{Qname: "serial.com.", Qtype: dns.TypeSOA}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, tc.Msg()))
+		if len(w.Msg.Answer) != 1 {
+			return 0
+		}
+		return w.Msg.Answer[0].(*dns.SOA).Serial
+	}
+	if serial, internal := querySerial(), h.LoadZone("serial.com.").Config.SOA.Serial; serial != 1 || internal != 2020030400 {
+		fmt.Println("public serial is", serial, "internal", internal, "expected 1 and 2020030400")
+		t.Fail()
+	}
+	_ = h.Backend.HSet("redins:zones:serial.com.", "www", `{"a":{"ttl":300, "records":[{"ip":"5.6.7.8"}]}}`)
+	_ = h.Backend.Set("redins:zones:serial.com.:version", "2")
+	h.ZoneCache.Del("serial.com.")
+	if serial, internal := querySerial(), h.LoadZone("serial.com.").Config.SOA.Serial; serial != 1 || internal != 2020030401 {
+		fmt.Println("public serial of changed zone is", serial, "internal", internal, "expected 1 and 2020030401")
+		t.Fail()
+	}
+
+	// shared, instances on the same backend agree on serial
+	config := defaultConfig
+	config.SerialFormat = "shared"
+	redisBackend := NewRedisBackend(&config.Redis)
+	_ = redisBackend.Del("*")
+	for _, backend := range []Backend{NewMemoryBackend(), redisBackend} {
+		if err := CheckSerialFormat(config.SerialFormat, backend); err != nil {
+			fmt.Println(err)
+			t.Fail()
+		}
+		h1 := NewHandlerWithBackend(&config, backend)
+		h2 = NewHandlerWithBackend(&config, backend)
+		handlers = append(handlers, h1, h2)
+		h1.now = func() time.Time { return clock }
+		h2.now = func() time.Time { return clock.Add(time.Hour) }
+		for i, step := range []struct {
+			hash   uint32
+			serial uint32
+		}{
+			{1, 1},
+			{1, 1},
+			{2, 2},
+			{2, 2},
+			{3, 3},
+		} {
+			s1, s2 := h1.ZoneSerial("serial.com.", step.hash), h2.ZoneSerial("serial.com.", step.hash)
+			if s1 != step.serial || s2 != step.serial {
+				fmt.Println(i, "shared serials are", s1, s2, "expected", step.serial)
+				t.Fail()
+			}
+		}
+		if value, _ := backend.Get("redins:zones:serial.com.:serial"); value != "3" {
+			fmt.Println("stored shared serial is", value, "expected 3")
+			t.Fail()
+		}
+		// instances seeing the same change at once increment only once
+		serials := make(chan uint32, 10)
+		for i := 0; i < 10; i++ {
+			go func(h *DnsRequestHandler) {
+				serials <- h.ZoneSerial("serial.com.", 4)
+			}([]*DnsRequestHandler{h1, h2}[i%2])
+		}
+		for i := 0; i < 10; i++ {
+			if serial := <-serials; serial != 4 {
+				fmt.Println("concurrent shared serial is", serial, "expected 4")
+				t.Fail()
+			}
+		}
+		_ = backend.HSet("redins:zones:shared.com.", "www", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`)
+		if s1, s2 := h1.LoadZone("shared.com.").Config.SOA.Data.Serial, h2.LoadZone("shared.com.").Config.SOA.Data.Serial; s1 != 1 || s2 != 1 {
+			fmt.Println("shared serials of loaded zone are", s1, s2, "expected 1")
+			t.Fail()
+		}
+	}
+	if err := CheckSerialFormat(config.SerialFormat, struct{ Backend }{NewMemoryBackend()}); err == nil {
+		fmt.Println("shared serial format should be rejected for backends without atomic counters")
+		t.Fail()
+	}
+	if err := CheckSerialFormat("datecounter", struct{ Backend }{NewMemoryBackend()}); err != nil {
+		fmt.Println(err)
+		t.Fail()
+	}
+}
+
+func TestDebugCountry(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	config := defaultConfig
+	config.Debug = DebugConfig{Enable: true, CountryName: "Country.Redins"}
+	h := NewHandlerWithBackend(&config, NewMemoryBackend())
+
+	tc := test.Case{
+		Qname: "country.redins.", Qtype: dns.TypeTXT,
+	}
+	r := tc.Msg()
+	r.Extra = append(r.Extra, &dns.OPT{
+		Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT, Class: dns.ClassANY, Rdlength: 0, Ttl: 300},
+		Option: []dns.EDNS0{
+			&dns.EDNS0_SUBNET{
+				Address:       net.ParseIP("212.83.32.45"),
+				Code:          dns.EDNS0SUBNET,
+				Family:        1,
+				SourceNetmask: 32,
+				SourceScope:   0,
+			},
+		},
+	})
+	w := test.NewRecorder(&test.ResponseWriter{})
+	h.HandleRequest(NewRequestContext(w, r))
+
+	resp := w.Msg
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		fmt.Println("unexpected response : ", resp)
+		t.FailNow()
+	}
+	txt, ok := resp.Answer[0].(*dns.TXT)
+	if !ok {
+		fmt.Println("expected TXT answer, got ", resp.Answer[0])
+		t.FailNow()
+	}
+	country := ""
+	for _, s := range txt.Txt {
+		if strings.HasPrefix(s, "country=") {
+			country = strings.TrimPrefix(s, "country=")
+		}
+	}
+	if country != "DE" {
+		fmt.Println("country is ", country, " expected DE : ", txt)
+		t.Fail()
+	}
+
+	config.Debug.Enable = false
+	w = test.NewRecorder(&test.ResponseWriter{})
+	h.HandleRequest(NewRequestContext(w, tc.Msg()))
+	if w.Msg.Rcode != dns.RcodeNotAuth {
+		fmt.Println("debug name should not be answered when disabled : ", w.Msg)
+		t.Fail()
+	}
+}
+
+func TestVersionInfo(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	Version, Commit = "1.3.5", "0123abcd"
+	defer func() { Version, Commit = "dev", "unknown" }()
+	config := defaultConfig
+	config.VersionInfo = VersionInfoConfig{Enable: true, Name: "Version.Redins"}
+	h := NewHandlerWithBackend(&config, NewMemoryBackend())
+
+	tc := test.Case{Qname: "version.redins.", Qtype: dns.TypeTXT}
+	w := test.NewRecorder(&test.ResponseWriter{})
+	h.HandleRequest(NewRequestContext(w, tc.Msg()))
+	resp := w.Msg
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		fmt.Println("unexpected response : ", resp)
+		t.FailNow()
+	}
+	txt, ok := resp.Answer[0].(*dns.TXT)
+	if !ok {
+		fmt.Println("expected TXT answer, got ", resp.Answer[0])
+		t.FailNow()
+	}
+	info := make(map[string]string)
+	for _, s := range txt.Txt {
+		if kv := strings.SplitN(s, "=", 2); len(kv) == 2 {
+			info[kv[0]] = kv[1]
+		}
+	}
+	if info["version"] != "1.3.5" || info["commit"] != "0123abcd" || info["go"] == "" {
+		fmt.Println("unexpected version info : ", txt)
+		t.Fail()
+	}
+
+	config.VersionInfo.Enable = false
+	w = test.NewRecorder(&test.ResponseWriter{})
+	h.HandleRequest(NewRequestContext(w, tc.Msg()))
+	if w.Msg.Rcode != dns.RcodeNotAuth {
+		fmt.Println("version info should not be answered when disabled : ", w.Msg)
+		t.Fail()
+	}
+}
+
+func TestSetLocation(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := NewMemoryBackend()
+	_ = backend.SAdd("redins:zones", "setlocation.com.")
+	_ = backend.HSet("redins:zones:setlocation.com.", "_ftp._tcp", `{}`)
+	h := NewHandlerWithBackend(&defaultConfig, backend)
+
+	z := h.LoadZone("setlocation.com.")
+	record := &Record{}
+	record.URI = URI_RRSet{
+		Ttl: 300,
+		Data: []URI_RR{
+			{Priority: 10, Weight: 1, Target: `ftp://ftp1.setlocation.com/public?a=1&b="c d"`},
+		},
+	}
+	record.OPENPGPKEY = OPENPGPKEY_RRSet{
+		Ttl:  300,
+		Data: []OPENPGPKEY_RR{{PublicKey: "mQENBFVHm5sBCADABFlimdDEUmd9S8sl"}},
+	}
+	record.SMIMEA = SMIMEA_RRSet{
+		Ttl:  300,
+		Data: []SMIMEA_RR{{Usage: 3, Selector: 1, MatchingType: 1, Certificate: "1CFC98A706BCF3683015"}},
+	}
+	h.SetLocation("_ftp._tcp", z, record)
+
+	loaded := h.LoadLocation("_ftp._tcp", z)
+	if loaded == nil || len(loaded.URI.Data) != 1 || loaded.URI.Data[0] != record.URI.Data[0] || loaded.URI.Ttl != 300 {
+		fmt.Println("uri record changed after round-trip : ", loaded)
+		t.FailNow()
+	}
+	answers := h.URI("_ftp._tcp.setlocation.com.", loaded)
+	if len(answers) != 1 || answers[0].(*dns.URI).Target != record.URI.Data[0].Target {
+		fmt.Println("unexpected uri answer : ", answers)
+		t.Fail()
+	}
+	if err := verifyRR(answers[0]); err != nil {
+		fmt.Println("uri answer is not valid : ", err)
+		t.Fail()
+	}
+
+	if len(loaded.OPENPGPKEY.Data) != 1 || loaded.OPENPGPKEY.Data[0] != record.OPENPGPKEY.Data[0] {
+		fmt.Println("openpgpkey record changed after round-trip : ", loaded.OPENPGPKEY)
+		t.Fail()
+	}
+	if len(loaded.SMIMEA.Data) != 1 || loaded.SMIMEA.Data[0] != record.SMIMEA.Data[0] {
+		fmt.Println("smimea record changed after round-trip : ", loaded.SMIMEA)
+		t.Fail()
+	}
+	answers = append(h.OPENPGPKEY("_ftp._tcp.setlocation.com.", loaded), h.SMIMEA("_ftp._tcp.setlocation.com.", loaded)...)
+	if len(answers) != 2 {
+		fmt.Println("unexpected answers : ", answers)
+		t.FailNow()
+	}
+	for _, rr := range answers {
+		if err := verifyRR(rr); err != nil {
+			fmt.Println(rr, " is not valid : ", err)
+			t.Fail()
+		}
+	}
+}
+
+func TestResponseDelay(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := NewMemoryBackend()
+	_ = backend.SAdd("redins:zones", "delay.com.")
+	_ = backend.SAdd("redins:zones", "fastdelay.com.")
+	_ = backend.HSet("redins:zones:delay.com.", "www", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`)
+	_ = backend.HSet("redins:zones:fastdelay.com.", "www", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`)
+	_ = backend.Set("redins:zones:fastdelay.com.:config", `{"response_delay":50}`)
+	config := defaultConfig
+	config.ResponseDelay = 300
+	h := NewHandlerWithBackend(&config, backend)
+
+	query := func(qname string) time.Duration {
+		start := time.Now()
+		tc := test.Case{Qname: qname, Qtype: dns.TypeA}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, tc.Msg()))
+		if len(w.Msg.Answer) != 1 {
+			fmt.Println("unexpected response : ", w.Msg)
+			t.Fail()
+		}
+		return time.Since(start)
+	}
+
+	// concurrent queries are delayed independently
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if d := query("www.delay.com."); d < 300*time.Millisecond {
+				fmt.Println("response delay not observed : ", d)
+				t.Fail()
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed > 600*time.Millisecond {
+		fmt.Println("delayed queries were serialized : ", elapsed)
+		t.Fail()
+	}
+
+	// zone's response_delay overrides global value
+	if d := query("www.fastdelay.com."); d < 50*time.Millisecond || d >= 300*time.Millisecond {
+		fmt.Println("zone response delay not observed : ", d)
+		t.Fail()
+	}
+}
+
+func TestQuietRequestPath(t *testing.T) {
+	logFile, err := ioutil.TempFile("", "redins_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = logFile.Close()
+	defer os.Remove(logFile.Name())
+	logger.Default = logger.NewLogger(&logger.LogConfig{Enable: true, Target: "file", Level: "info", Path: logFile.Name(), Format: "text"}, nil)
+	defer func() { logger.Default = logger.NewLogger(&logger.LogConfig{}, nil) }()
+
+	backend := NewMemoryBackend()
+	_ = backend.SAdd("redins:zones", "quiet.com.")
+	_ = backend.HSet("redins:zones:quiet.com.", "www", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`)
+	_ = backend.HSet("redins:zones:quiet.com.", "alias", `{"cname":{"ttl":300, "host":"www.quiet.com."}}`)
+	h := NewHandlerWithBackend(&defaultConfig, backend)
+
+	for _, tc := range []test.Case{
+		{Qname: "www.quiet.com.", Qtype: dns.TypeA},
+		{Qname: "alias.quiet.com.", Qtype: dns.TypeA},
+		{Qname: "www.quiet.com.", Qtype: dns.TypeAAAA},
+	} {
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, tc.Msg()))
+		if w.Msg.Rcode != dns.RcodeSuccess {
+			fmt.Println("unexpected response : ", w.Msg)
+			t.Fail()
+		}
+	}
+
+	content, _ := ioutil.ReadFile(logFile.Name())
+	if len(content) != 0 {
+		fmt.Println("unexpected log output for normal queries : ", string(content))
+		t.Fail()
+	}
+}
+
+func TestNSAuthority(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := NewMemoryBackend()
+	_ = backend.SAdd("redins:zones", "nsauth.com.")
+	_ = backend.HSet("redins:zones:nsauth.com.", "@", `{"ns":{"ttl":300, "records":[{"host":"ns1.nsauth.com."},{"host":"ns2.nsauth.com."}]}}`)
+	_ = backend.HSet("redins:zones:nsauth.com.", "sub", `{"ns":{"ttl":300, "records":[{"host":"ns1.other.com."}]}}`)
+	_ = backend.HSet("redins:zones:nsauth.com.", "alias", `{"cname":{"ttl":300, "host":"sub.nsauth.com."}}`)
+	h := NewHandlerWithBackend(&defaultConfig, backend)
+
+	query := func(qname string) *dns.Msg {
+		tc := test.Case{Qname: qname, Qtype: dns.TypeNS}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, tc.Msg()))
+		return w.Msg
+	}
+
+	// apex NS is an authoritative answer
+	resp := query("nsauth.com.")
+	if !resp.Authoritative || len(resp.Answer) != 2 || len(resp.Ns) != 0 {
+		fmt.Println("apex NS should be an authoritative answer : ", resp)
+		t.Fail()
+	}
+
+	// delegated NS is a referral
+	resp = query("sub.nsauth.com.")
+	if resp.Authoritative || len(resp.Answer) != 0 || len(resp.Ns) != 1 {
+		fmt.Println("delegated NS should be a referral : ", resp)
+		t.Fail()
+	}
+
+	// in-zone cname answer stays authoritative
+	resp = query("alias.nsauth.com.")
+	if !resp.Authoritative || len(resp.Answer) != 1 || len(resp.Ns) != 1 {
+		fmt.Println("cname to delegation should be authoritative for the cname : ", resp)
+		t.Fail()
+	}
+}
+
+func TestAnyUdpTruncate(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := NewMemoryBackend()
+	_ = backend.SAdd("redins:zones", "any.com.")
+	_ = backend.HSet("redins:zones:any.com.", "www", `{
+		"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]},
+		"aaaa":{"ttl":300, "records":[{"ip":"::1"}]},
+		"txt":{"ttl":300, "records":[{"text":"foo"}]},
+		"mx":{"ttl":300, "records":[{"host":"mx.any.com.", "preference":10}]}
+	}`)
+	config := defaultConfig
+	h := NewHandlerWithBackend(&config, backend)
+
+	query := func(tcp bool) *dns.Msg {
+		tc := test.Case{Qname: "www.any.com.", Qtype: dns.TypeANY}
+		w := test.NewRecorder(&test.ResponseWriter{TCP: tcp})
+		h.HandleRequest(NewRequestContext(w, tc.Msg()))
+		return w.Msg
+	}
+
+	for _, truncate := range []bool{false, true} {
+		config.AnyUdpTruncate = truncate
+		resp := query(false)
+		if truncate && (!resp.Truncated || len(resp.Answer) != 0 || resp.Rcode != dns.RcodeSuccess) {
+			fmt.Println("udp ANY should be truncated : ", resp)
+			t.Fail()
+		}
+		if !truncate && (resp.Truncated || len(resp.Answer) != 4) {
+			fmt.Println("udp ANY should get full answer : ", resp)
+			t.Fail()
+		}
+		resp = query(true)
+		if resp.Truncated || len(resp.Answer) != 4 {
+			fmt.Println("tcp ANY should get full answer : ", resp)
+			t.Fail()
+		}
+	}
+}
+
+func TestUdpZoneByteRate(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := NewMemoryBackend()
+	_ = backend.SAdd("redins:zones", "abused.com.")
+	_ = backend.SAdd("redins:zones", "other.com.")
+	_ = backend.HSet("redins:zones:abused.com.", "www", `{"txt":{"ttl":300, "records":[{"text":"aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}]}}`)
+	_ = backend.HSet("redins:zones:other.com.", "www", `{"txt":{"ttl":300, "records":[{"text":"foo"}]}}`)
+	config := defaultConfig
+	config.UdpZoneByteRate = 1000
+	config.Rewrite = map[string]string{"old.example.com": "www.abused.com"}
+	h := NewHandlerWithBackend(&config, backend)
+
+	query := func(qname string, tcp bool) *dns.Msg {
+		tc := test.Case{Qname: qname, Qtype: dns.TypeTXT}
+		w := test.NewRecorder(&test.ResponseWriter{TCP: tcp})
+		h.HandleRequest(NewRequestContext(w, tc.Msg()))
+		return w.Msg
+	}
+
+	// each response is ~150 bytes, so the one second burst allows a few full answers
+	full := 0
+	for i := 0; i < 20; i++ {
+		resp := query("www.abused.com.", false)
+		if resp.Truncated {
+			break
+		}
+		full++
+	}
+	if full == 0 || full > 10 {
+		fmt.Println("unexpected number of full answers before cap : ", full)
+		t.Fail()
+	}
+	for i := 0; i < 5; i++ {
+		if resp := query("www.abused.com.", false); !resp.Truncated || len(resp.Answer) != 0 {
+			fmt.Println("udp response over cap should be truncated : ", resp)
+			t.Fail()
+		}
+	}
+	if resp := query("old.example.com.", false); !resp.Truncated || len(resp.Answer) != 0 {
+		fmt.Println("rewrites to a capped zone should be truncated : ", resp)
+		t.Fail()
+	}
+	if resp := query("www.abused.com.", true); resp.Truncated || len(resp.Answer) != 1 {
+		fmt.Println("tcp response should not be capped : ", resp)
+		t.Fail()
+	}
+	if resp := query("www.other.com.", false); resp.Truncated || len(resp.Answer) != 1 {
+		fmt.Println("other zones should not be capped : ", resp)
+		t.Fail()
+	}
+}
+
+func TestTxtLimitWarn(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := NewMemoryBackend()
+	_ = backend.SAdd("redins:zones", "txtwarn.com.")
+	_ = backend.HSet("redins:zones:txtwarn.com.", "www", `{"txt":{"ttl":300, "records":[{"text":"t1"},{"text":"t2"},{"text":"t3"}]}}`)
+	config := defaultConfig
+	config.MaxTxtRecords = 2
+	config.TxtLimitAction = "warn"
+	config.MaxTypeAnswers = map[string]int{"txt": 2}
+	h := NewHandlerWithBackend(&config, backend)
+
+	tc := test.Case{Qname: "www.txtwarn.com.", Qtype: dns.TypeTXT}
+	w := test.NewRecorder(&test.ResponseWriter{})
+	h.HandleRequest(NewRequestContext(w, tc.Msg()))
+	// records over limit are still served in warn mode, capped by per type answer limit
+	if w.Msg.Rcode != dns.RcodeSuccess || len(w.Msg.Answer) != 2 {
+		fmt.Println("unexpected response : ", w.Msg)
+		t.Fail()
+	}
+}
+
+func TestZoneFilterFlags(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := NewMemoryBackend()
+	location := `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4", "country":"DE"},{"ip":"5.6.7.8", "country":"GB"}], "filter":{"count":"multi","order":"none","geo_filter":"country"}}}`
+	_ = backend.SAdd("redins:zones", "geo.com.")
+	_ = backend.HSet("redins:zones:geo.com.", "www", location)
+	_ = backend.SAdd("redins:zones", "static.com.")
+	_ = backend.HSet("redins:zones:static.com.", "www", location)
+	_ = backend.Set("redins:zones:static.com.:config", `{"disable_geoip":true}`)
+	h := NewHandlerWithBackend(&defaultConfig, backend)
+
+	query := func(qname string) *dns.Msg {
+		tc := test.Case{Qname: qname, Qtype: dns.TypeA}
+		r := tc.Msg()
+		r.SetEdns0(4096, false)
+		r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 32, Address: net.ParseIP("213.95.10.76")})
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, r))
+		return w.Msg
+	}
+	if resp := query("www.geo.com."); len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "1.2.3.4" {
+		fmt.Println("geoip enabled zone should filter by country : ", resp)
+		t.Fail()
+	}
+	if resp := query("www.static.com."); len(resp.Answer) != 2 {
+		fmt.Println("geoip disabled zone should return all records : ", resp)
+		t.Fail()
+	}
+
+	// ips without health data are considered down
+	cfg := config
+	cfg.MissingStatus = "down"
+	h.healthcheck = NewHealthcheck(&cfg, uperdis.NewRedis(&configRedisConf))
+	h.healthcheck.redisStatusServer.Del("*")
+	defer h.healthcheck.redisStatusServer.Del("*")
+	h.healthcheck.redisStatusServer.Set("redins:healthcheck:www.health.com.:1.2.3.4", `{"enable":true,"protocol":"http","uri":"/","port":80, "status":3}`)
+	rrset := &IP_RRSet{
+		Data:              []IP_RR{{Ip: net.ParseIP("1.2.3.4")}, {Ip: net.ParseIP("5.6.7.8")}},
+		HealthCheckConfig: IpHealthCheckConfig{Enable: true, DownCount: -3, UpCount: 3, Timeout: 1000},
+	}
+	for _, disabled := range []bool{false, true} {
+		zone := &Zone{Name: "health.com.", Config: ZoneConfig{DisableHealth: disabled}}
+		ips := h.FilterRequest(NewRequestContext(test.NewRecorder(&test.ResponseWriter{}), new(dns.Msg)), &Record{Zone: zone, Name: "www.health.com."}, dns.TypeA, rrset)
+		if disabled && len(ips) != 2 || !disabled && len(ips) != 1 {
+			fmt.Println("unexpected health filtering, disabled : ", disabled, ips)
+			t.Fail()
+		}
+	}
+}
+
+func TestApexQueries(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := NewMemoryBackend()
+	_ = backend.SAdd("redins:zones", "apex.com.")
+	_ = backend.Set("redins:zones:apex.com.:config", `{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.apex.com.","ns":"ns1.apex.com.","refresh":44,"retry":55,"expire":66,"serial":1}}`)
+	_ = backend.HSet("redins:zones:apex.com.", "@", `{
+		"ns":{"ttl":300, "records":[{"host":"ns1.apex.com."},{"host":"ns2.apex.com."}]},
+		"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]},
+		"aaaa":{"ttl":300, "records":[{"ip":"::1"}]}
+	}`)
+	_ = backend.HSet("redins:zones:apex.com.", "ns1", `{"a":{"ttl":300, "records":[{"ip":"2.2.2.2"}]}}`)
+	_ = backend.SAdd("redins:zones", "flatapex.com.")
+	_ = backend.Set("redins:zones:flatapex.com.:config", `{"soa":{"ttl":300, "minttl":100, "mbox":"hostmaster.flatapex.com.","ns":"ns1.flatapex.com.","refresh":44,"retry":55,"expire":66,"serial":1}, "cname_flattening":true}`)
+	_ = backend.HSet("redins:zones:flatapex.com.", "@", `{
+		"ns":{"ttl":300, "records":[{"host":"ns1.flatapex.com."}]},
+		"cname":{"ttl":300, "host":"www.flatapex.com."}
+	}`)
+	_ = backend.HSet("redins:zones:flatapex.com.", "www", `{"a":{"ttl":300, "records":[{"ip":"5.6.7.8"}]}}`)
+	h := NewHandlerWithBackend(&defaultConfig, backend)
+
+	for _, tc := range []struct {
+		qname string
+		qtype uint16
+		count int
+	}{
+		{"apex.com.", dns.TypeSOA, 1},
+		{"apex.com.", dns.TypeNS, 2},
+		{"apex.com.", dns.TypeA, 1},
+		{"apex.com.", dns.TypeAAAA, 1},
+		{"flatapex.com.", dns.TypeSOA, 1},
+		{"flatapex.com.", dns.TypeNS, 1},
+		{"flatapex.com.", dns.TypeA, 1},
+	} {
+		r := test.Case{Qname: tc.qname, Qtype: tc.qtype}.Msg()
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, r))
+		resp := w.Msg
+		ok := resp.Rcode == dns.RcodeSuccess && resp.Authoritative && len(resp.Answer) == tc.count
+		for _, rr := range resp.Answer {
+			if rr.Header().Rrtype != tc.qtype || rr.Header().Name != tc.qname {
+				ok = false
+			}
+		}
+		if !ok {
+			fmt.Println("incomplete apex answer for ", tc.qname, dns.TypeToString[tc.qtype], " : ", resp)
+			t.Fail()
+		}
+	}
+}
+
+func TestProbeConflicts(t *testing.T) {
+	config := defaultConfig
+	config.MaxZoneLocations = 10
+	config.PreloadZones = true
+	if conflicts := config.ProbeConflicts(); len(conflicts) != 0 {
+		fmt.Println("full location lookup has no conflicts : ", conflicts)
+		t.Fail()
+	}
+	config.LocationLookup = "probe"
+	if conflicts := config.ProbeConflicts(); len(conflicts) != 3 {
+		fmt.Println("expected empty non-terminal, max_locations_per_zone and preload_zones conflicts : ", conflicts)
+		t.Fail()
+	}
+}
+
+func TestApplySoaSerial(t *testing.T) {
+	config := defaultConfig
+	config.SerialFormat = "shared"
+	if err := config.ApplySoaSerial(); err != nil || config.SerialFormat != "shared" {
+		fmt.Println("empty soa_serial should keep serial_format : ", config.SerialFormat, err)
+		t.Fail()
+	}
+	for soaSerial, format := range map[string]string{"unixtime": "unix", "datecounter": "datecounter"} {
+		config.SoaSerial = soaSerial
+		if err := config.ApplySoaSerial(); err != nil || config.SerialFormat != format {
+			fmt.Println("soa_serial", soaSerial, "sets serial_format", config.SerialFormat, err)
+			t.Fail()
+		}
+	}
+	config.SoaSerial = "content-hash"
+	if err := config.ApplySoaSerial(); err == nil {
+		fmt.Println("soa_serial only accepts unixtime and datecounter")
+		t.Fail()
 	}
 }
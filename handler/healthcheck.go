@@ -6,6 +6,7 @@ import (
 	"github.com/json-iterator/go"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -14,6 +15,7 @@ import (
 	"github.com/hawell/logger"
 	"github.com/hawell/uperdis"
 	"github.com/hawell/workerpool"
+	"github.com/miekg/dns"
 	"github.com/patrickmn/go-cache"
 	"github.com/pkg/errors"
 	"golang.org/x/net/icmp"
@@ -42,7 +44,12 @@ type Healthcheck struct {
 	maxPendingRequests int
 	updateInterval     time.Duration
 	checkInterval      time.Duration
-	redisConfigServer  *uperdis.Redis
+	statusTtl          time.Duration
+	missingStatus      string
+	allDownAction      string
+	sinkholeA          net.IP
+	sinkholeAAAA       net.IP
+	redisConfigServer  Backend
 	redisStatusServer  *uperdis.Redis
 	logger             *logger.EventLogger
 	cachedItems        *cache.Cache
@@ -50,6 +57,10 @@ type Healthcheck struct {
 	dispatcher         *workerpool.Dispatcher
 	quit               chan struct{}
 	quitWG             sync.WaitGroup
+	mode               string
+	importUrl          string
+	importInterval     time.Duration
+	importClient       *http.Client
 }
 
 func HandleHealthCheck(h *Healthcheck) workerpool.JobHandler {
@@ -60,8 +71,7 @@ func HandleHealthCheck(h *Healthcheck) workerpool.JobHandler {
 		switch item.Protocol {
 		case "http", "https":
 			timeout := time.Duration(item.Timeout) * time.Millisecond
-			url := item.Protocol + "://" + item.Ip + item.Uri
-			err = httpCheck(url, item.Host, timeout)
+			err = httpCheck(healthcheckUrl(item), item.Host, timeout)
 		case "ping", "icmp":
 			err = pingCheck(item.Ip, time.Duration(item.Timeout)*time.Millisecond)
 			logger.Default.Error("@@@@@@@@@@@@@@ ", item.Ip, " : result : ", err)
@@ -81,6 +91,17 @@ func HandleHealthCheck(h *Healthcheck) workerpool.JobHandler {
 	}
 }
 
+// healthcheckUrl is the url item is probed at, without a port protocol's default port is used
+func healthcheckUrl(item *HealthCheckItem) string {
+	host := item.Ip
+	if item.Port != 0 {
+		host = net.JoinHostPort(item.Ip, strconv.Itoa(item.Port))
+	} else if strings.Contains(item.Ip, ":") {
+		host = "[" + item.Ip + "]"
+	}
+	return item.Protocol + "://" + host + item.Uri
+}
+
 func httpCheck(url string, host string, timeout time.Duration) error {
 	tr := &http.Transport{
 		MaxIdleConnsPerHost: 1024,
@@ -165,17 +186,36 @@ type HealthcheckConfig struct {
 	MaxPendingRequests int                 `json:"max_pending_requests"`
 	UpdateInterval     int                 `json:"update_interval"`
 	CheckInterval      int                 `json:"check_interval"`
+	StatusTtl          int                 `json:"health_status_ttl"`
 	RedisStatusServer  uperdis.RedisConfig `json:"redis"`
 	Log                logger.LogConfig    `json:"log"`
+	MissingStatus      string              `json:"missing_health_status"` // "up", "down", "neutral"
+	AllDownAction      string              `json:"all_down_action"`       // "serve", "nodata", "sinkhole"
+	SinkholeA          string              `json:"all_down_sinkhole_a"`
+	SinkholeAAAA       string              `json:"all_down_sinkhole_aaaa"`
+	Mode               string              `json:"mode"` // "probe", "import"
+	Import             HealthImportConfig  `json:"import"`
 }
 
-func NewHealthcheck(config *HealthcheckConfig, redisConfigServer *uperdis.Redis) *Healthcheck {
+func NewHealthcheck(config *HealthcheckConfig, redisConfigServer Backend) *Healthcheck {
 	h := &Healthcheck{
 		Enable:             config.Enable,
 		maxRequests:        config.MaxRequests,
 		maxPendingRequests: config.MaxPendingRequests,
 		updateInterval:     time.Duration(config.UpdateInterval) * time.Second,
 		checkInterval:      time.Duration(config.CheckInterval) * time.Second,
+		statusTtl:          time.Duration(config.StatusTtl) * time.Second,
+		missingStatus:      config.MissingStatus,
+		allDownAction:      config.AllDownAction,
+		sinkholeA:          net.ParseIP(config.SinkholeA).To4(),
+		sinkholeAAAA:       net.ParseIP(config.SinkholeAAAA),
+		mode:               config.Mode,
+		importUrl:          config.Import.Url,
+		importInterval:     time.Duration(config.Import.Interval) * time.Second,
+		importClient:       &http.Client{Timeout: time.Duration(config.Import.Timeout) * time.Millisecond},
+	}
+	if h.importInterval == 0 {
+		h.importInterval = h.checkInterval
 	}
 
 	if h.Enable {
@@ -207,30 +247,83 @@ func (h *Healthcheck) ShutDown() {
 }
 
 func (h *Healthcheck) getStatus(host string, ip net.IP) int {
+	status, _, _ := h.itemStatus(host, ip)
+	return status
+}
+
+// itemStatus returns status of host:ip and whether there is any healthcheck data for it, err is set if health store is unreachable
+func (h *Healthcheck) itemStatus(host string, ip net.IP) (int, bool, error) {
 	if !h.Enable {
-		return 0
+		return 0, false, nil
 	}
 	key := host + ":" + ip.String()
 	var item *HealthCheckItem
 	val, found := h.cachedItems.Get(key)
 	if !found {
-		item = h.loadItem(key)
-		if item == nil {
-			item = new(HealthCheckItem)
+		var err error
+		item, err = h.fetchItem(key)
+		if err != nil {
+			// not cached, store may be reachable on next request
+			return 0, false, err
 		}
 		h.cachedItems.Set(key, item, h.updateInterval)
 	} else {
 		item = val.(*HealthCheckItem)
 	}
-	return item.Status
+	if item == nil {
+		return 0, false, nil
+	}
+	return item.Status, true, nil
+}
+
+// rrsetStatus returns status of ip in rrset, ips without healthcheck data are treated according to missing_health_status
+func (h *Healthcheck) rrsetStatus(host string, rrset *IP_RRSet, ip net.IP) (int, error) {
+	status, found, err := h.itemStatus(host, ip)
+	if err != nil {
+		return 0, err
+	}
+	if found {
+		return status, nil
+	}
+	up, down := healthThresholds(rrset)
+	switch h.missingStatus {
+	case "up":
+		return up, nil
+	case "down":
+		return down, nil
+	default:
+		return 0, nil
+	}
+}
+
+// maskStatuses returns status of white ips in mask, statuses cannot be trusted if err is set
+func (h *Healthcheck) maskStatuses(host string, rrset *IP_RRSet, mask []int) ([]int, error) {
+	statuses := make([]int, len(mask))
+	for i, x := range mask {
+		if x == IpMaskWhite {
+			ip, _ := healthcheckTarget(&rrset.Data[i])
+			status, err := h.rrsetStatus(host, rrset, ip)
+			if err != nil {
+				return nil, err
+			}
+			statuses[i] = status
+		}
+	}
+	return statuses, nil
 }
 
 func (h *Healthcheck) loadItem(key string) *HealthCheckItem {
+	item, _ := h.fetchItem(key)
+	return item
+}
+
+// fetchItem reads item of key from health store, a nil item without error means there is no data for key
+func (h *Healthcheck) fetchItem(key string) (*HealthCheckItem, error) {
 	splits := strings.SplitAfterN(key, ":", 2)
 	// logger.Default.Error(splits)
 	if len(splits) != 2 {
 		logger.Default.Errorf("invalid key: %s", key)
-		return nil
+		return nil, nil
 	}
 	item := new(HealthCheckItem)
 	item.Host = strings.TrimSuffix(splits[0], ":")
@@ -238,13 +331,16 @@ func (h *Healthcheck) loadItem(key string) *HealthCheckItem {
 	itemStr, err := h.redisStatusServer.Get("redins:healthcheck:" + key)
 	if err != nil {
 		logger.Default.Errorf("cannot load item %s : %s", key, err)
-		return nil
+		return nil, err
+	}
+	if itemStr == "" {
+		return nil, nil
 	}
 	jsoniter.Unmarshal([]byte(itemStr), item)
 	if item.DownCount > 0 {
 		item.DownCount = -item.DownCount
 	}
-	return item
+	return item, nil
 }
 
 func (h *Healthcheck) storeItem(item *HealthCheckItem) {
@@ -256,9 +352,13 @@ func (h *Healthcheck) storeItem(item *HealthCheckItem) {
 	}
 	// logger.Default.Debugf("setting %v in redis : %s", *item, string(itemStr))
 	h.redisStatusServer.Set("redins:healthcheck:"+key, string(itemStr))
+	// status of ips no longer checked expires instead of staying in redis
+	if h.statusTtl > 0 {
+		h.redisStatusServer.Expire("redins:healthcheck:"+key, h.statusTtl)
+	}
 }
 
-func (h *Healthcheck) getDomainId(zone string) string {
+func (h *Healthcheck) getZoneConfig(zone string) ZoneConfig {
 	var cfg ZoneConfig
 	val, err := h.redisConfigServer.Get("redins:zones:" + zone + ":config")
 	if err != nil {
@@ -270,7 +370,7 @@ func (h *Healthcheck) getDomainId(zone string) string {
 			logger.Default.Errorf("cannot parse zone config : %s", err)
 		}
 	}
-	return cfg.DomainId
+	return cfg
 }
 
 func (h *Healthcheck) Start() {
@@ -281,6 +381,11 @@ func (h *Healthcheck) Start() {
 
 	go h.Transfer()
 
+	if h.mode == "import" {
+		h.importStatuses()
+		return
+	}
+
 	ticker := time.NewTicker(h.checkInterval)
 	for {
 		itemKeys, err := h.redisStatusServer.GetKeys("redins:healthcheck:*")
@@ -348,37 +453,259 @@ func statusUp(item *HealthCheckItem) {
 	}
 }
 
+// healthcheckHost returns the host health status of rrset is tracked under, the configured group or the record name
+func healthcheckHost(name string, rrset *IP_RRSet) string {
+	if rrset.HealthCheckConfig.Group != "" {
+		return dns.Fqdn(rrset.HealthCheckConfig.Group)
+	}
+	return name
+}
+
 func (h *Healthcheck) FilterHealthcheck(qname string, rrset *IP_RRSet, mask []int) []int {
+	mask, _ = h.filterHealthcheck(qname, rrset, mask)
+	return mask
+}
+
+// filterHealthcheck is FilterHealthcheck also reporting whether every candidate ip is down, in which case
+// last tier is kept for all_down_action "serve" and all ips are removed otherwise
+func (h *Healthcheck) filterHealthcheck(qname string, rrset *IP_RRSet, mask []int) ([]int, bool) {
 	if !h.Enable {
-		return mask
+		return mask, false
+	}
+	qname = healthcheckHost(qname, rrset)
+	statuses, err := h.maskStatuses(qname, rrset, mask)
+	if err != nil {
+		// health store is unreachable, fail open instead of removing ips based on bogus statuses
+		for i, x := range mask {
+			if x != IpMaskWhite {
+				mask[i] = IpMaskBlack
+			}
+		}
+		return mask, false
 	}
-	min := rrset.HealthCheckConfig.DownCount
+	tier, found := healthyTier(rrset, mask, statuses)
+	allDown := false
+	if !found {
+		tier, allDown = lastTier(rrset, mask)
+		if allDown && h.answersAllDown() {
+			for i := range mask {
+				mask[i] = IpMaskBlack
+			}
+			return mask, true
+		}
+	}
+	for i, x := range mask {
+		if x == IpMaskWhite && rrset.Data[i].Tier != tier {
+			mask[i] = IpMaskBlack
+		}
+	}
+	up, down := healthThresholds(rrset)
+	min := down
 	for i, x := range mask {
 		if x == IpMaskWhite {
-			status := h.getStatus(qname, rrset.Data[i].Ip)
-			if status > min {
-				min = status
+			if statuses[i] > min {
+				min = statuses[i]
 			}
 		}
 	}
 	// logger.Default.Debugf("min = %d", min)
-	if min < rrset.HealthCheckConfig.UpCount-1 && min > rrset.HealthCheckConfig.DownCount {
-		min = rrset.HealthCheckConfig.DownCount + 1
+	if min < up-1 && min > down {
+		min = down + 1
 	}
 	// logger.Default.Debugf("min = %d", min)
 	for i, x := range mask {
 		if x == IpMaskWhite {
-			// logger.Default.Debug("qname: ", rrset.Data[i].Ip.String(), " status: ", h.getStatus(qname, rrset.Data[i].Ip))
-			if h.getStatus(qname, rrset.Data[i].Ip) < min {
+			// logger.Default.Debug("qname: ", rrset.Data[i].Ip.String(), " status: ", statuses[i])
+			if statuses[i] < min {
 				mask[i] = IpMaskBlack
 			}
 		} else {
 			mask[i] = IpMaskBlack
 		}
 	}
+	return mask, allDown
+}
+
+// healthyTier returns lowest tier of white ips with a status above down count, found is false if all of them are down.
+// ips without rrset or embedded health check are never down
+func healthyTier(rrset *IP_RRSet, mask []int, statuses []int) (tier int, found bool) {
+	_, down := healthThresholds(rrset)
+	for i, x := range mask {
+		checked := rrset.HealthCheckConfig.Enable || rrset.Data[i].HealthCheck != nil
+		healthy := !checked || statuses[i] > down
+		if x == IpMaskWhite && healthy && (!found || rrset.Data[i].Tier < tier) {
+			tier = rrset.Data[i].Tier
+			found = true
+		}
+	}
+	return
+}
+
+// lastTier returns highest tier of white ips, found is false if there is none
+func lastTier(rrset *IP_RRSet, mask []int) (tier int, found bool) {
+	for i, x := range mask {
+		if x == IpMaskWhite && (!found || rrset.Data[i].Tier > tier) {
+			tier = rrset.Data[i].Tier
+			found = true
+		}
+	}
+	return
+}
+
+// answersAllDown reports whether rrsets with all ips down are replaced by allDownIps instead of serving their last tier
+func (h *Healthcheck) answersAllDown() bool {
+	return h.allDownAction == "nodata" || h.allDownAction == "sinkhole"
+}
+
+// allDownIps returns sinkhole address of qtype for all_down_action "sinkhole", nil (NODATA) otherwise
+func (h *Healthcheck) allDownIps(qtype uint16) []net.IP {
+	if h.allDownAction != "sinkhole" {
+		return nil
+	}
+	if qtype == dns.TypeA && h.sinkholeA != nil {
+		return []net.IP{h.sinkholeA}
+	}
+	if qtype == dns.TypeAAAA && h.sinkholeAAAA != nil {
+		return []net.IP{h.sinkholeAAAA}
+	}
+	return nil
+}
+
+// FilterHealthiest keeps only candidates with the highest healthcheck status
+func (h *Healthcheck) FilterHealthiest(qname string, rrset *IP_RRSet, mask []int) []int {
+	if !h.Enable {
+		return mask
+	}
+	qname = healthcheckHost(qname, rrset)
+	statuses, err := h.maskStatuses(qname, rrset, mask)
+	if err != nil {
+		return mask
+	}
+	max := 0
+	found := false
+	for i, x := range mask {
+		if x == IpMaskWhite {
+			if !found || statuses[i] > max {
+				max = statuses[i]
+				found = true
+			}
+		}
+	}
+	for i, x := range mask {
+		if x == IpMaskWhite && statuses[i] < max {
+			mask[i] = IpMaskBlack
+		}
+	}
 	return mask
 }
 
+// defaultHealthCheckConfig fills parameters a health check leaves unset
+var defaultHealthCheckConfig = IpHealthCheckConfig{
+	Timeout:   1000,
+	UpCount:   3,
+	DownCount: -3,
+	Protocol:  "http",
+	Uri:       "/",
+	Enable:    false,
+}
+
+// healthChecked reports whether any ip of rrset is health checked, by rrset's config or its own
+func healthChecked(rrset *IP_RRSet) bool {
+	if rrset.HealthCheckConfig.Enable {
+		return true
+	}
+	for i := range rrset.Data {
+		if rrset.Data[i].HealthCheck != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// healthThresholds returns up and down counts of rrset, unset counts of a checked rrset get default values so
+// ips with only embedded health checks can go down
+func healthThresholds(rrset *IP_RRSet) (int, int) {
+	up, down := rrset.HealthCheckConfig.UpCount, rrset.HealthCheckConfig.DownCount
+	if !healthChecked(rrset) {
+		return up, down
+	}
+	if up == 0 {
+		up = defaultHealthCheckConfig.UpCount
+	}
+	if down == 0 {
+		down = defaultHealthCheckConfig.DownCount
+	}
+	return up, down
+}
+
+// healthcheckTarget returns ip and port (0 if not given) health of rr is checked at, its target if set and valid or served ip otherwise
+func healthcheckTarget(rr *IP_RR) (net.IP, int) {
+	if rr.HealthCheck == nil || rr.HealthCheck.Target == "" {
+		return rr.Ip, 0
+	}
+	host, port := rr.HealthCheck.Target, 0
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host = h
+		port, _ = strconv.Atoi(p)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return rr.Ip, 0
+	}
+	return ip, port
+}
+
+// loadItems derives healthcheck items of rrset's ips, from rrset's health check config if enabled and ips' own health check parameters
+func loadItems(host string, rrset *IP_RRSet, domainId string) []*HealthCheckItem {
+	host = healthcheckHost(host, rrset)
+	var items []*HealthCheckItem
+	for i := range rrset.Data {
+		ipCheck := rrset.Data[i].HealthCheck
+		if !rrset.HealthCheckConfig.Enable && ipCheck == nil {
+			continue
+		}
+		ip, port := healthcheckTarget(&rrset.Data[i])
+		up, down := healthThresholds(rrset)
+		item := &HealthCheckItem{
+			Ip:        ip.String(),
+			Port:      rrset.HealthCheckConfig.Port,
+			Host:      host,
+			Enable:    true,
+			DownCount: down,
+			UpCount:   up,
+			Timeout:   rrset.HealthCheckConfig.Timeout,
+			Uri:       rrset.HealthCheckConfig.Uri,
+			Protocol:  rrset.HealthCheckConfig.Protocol,
+			DomainId:  domainId,
+		}
+		if item.Timeout == 0 {
+			item.Timeout = defaultHealthCheckConfig.Timeout
+		}
+		if item.Uri == "" {
+			item.Uri = defaultHealthCheckConfig.Uri
+		}
+		if item.Protocol == "" {
+			item.Protocol = defaultHealthCheckConfig.Protocol
+		}
+		if ipCheck != nil {
+			if ipCheck.Protocol != "" {
+				item.Protocol = ipCheck.Protocol
+			}
+			if ipCheck.Uri != "" {
+				item.Uri = ipCheck.Uri
+			}
+			if ipCheck.Port != 0 {
+				item.Port = ipCheck.Port
+			}
+			if port != 0 {
+				item.Port = port
+			}
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
 func (h *Healthcheck) Transfer() {
 	itemsEqual := func(item1 *HealthCheckItem, item2 *HealthCheckItem) bool {
 		if item1 == nil || item2 == nil {
@@ -399,7 +726,11 @@ func (h *Healthcheck) Transfer() {
 			logger.Default.Errorf("cannot get members of redins:zones : %s", err)
 		}
 		for _, domain := range domains {
-			domainId := h.getDomainId(domain)
+			zoneConfig := h.getZoneConfig(domain)
+			if zoneConfig.DisableHealth {
+				continue
+			}
+			domainId := zoneConfig.DomainId
 			subdomains, err := h.redisConfigServer.GetHKeys("redins:zones:" + domain)
 			if err != nil {
 				logger.Default.Errorf("cannot get keys of %s : %s", domain, err)
@@ -415,15 +746,7 @@ func (h *Healthcheck) Transfer() {
 						logger.Default.Errorf("cannot get record of %s.%s : %s", subdomain, domain, err)
 					}
 					record := new(Record)
-					record.A.HealthCheckConfig = IpHealthCheckConfig{
-						Timeout:   1000,
-						Port:      80,
-						UpCount:   3,
-						DownCount: -3,
-						Protocol:  "http",
-						Uri:       "/",
-						Enable:    false,
-					}
+					record.A.HealthCheckConfig = defaultHealthCheckConfig
 					record.AAAA = record.A
 					err = jsoniter.Unmarshal([]byte(recordStr), record)
 					if err != nil {
@@ -437,23 +760,8 @@ func (h *Healthcheck) Transfer() {
 						host = subdomain + "." + domain
 					}
 					for _, rrset := range []*IP_RRSet{&record.A, &record.AAAA} {
-						if !rrset.HealthCheckConfig.Enable {
-							continue
-						}
-						for i := range rrset.Data {
-							key := host + ":" + rrset.Data[i].Ip.String()
-							newItem := &HealthCheckItem{
-								Ip:        rrset.Data[i].Ip.String(),
-								Port:      rrset.HealthCheckConfig.Port,
-								Host:      host,
-								Enable:    rrset.HealthCheckConfig.Enable,
-								DownCount: rrset.HealthCheckConfig.DownCount,
-								UpCount:   rrset.HealthCheckConfig.UpCount,
-								Timeout:   rrset.HealthCheckConfig.Timeout,
-								Uri:       rrset.HealthCheckConfig.Uri,
-								Protocol:  rrset.HealthCheckConfig.Protocol,
-								DomainId:  domainId,
-							}
+						for _, newItem := range loadItems(host, rrset, domainId) {
+							key := newItem.Host + ":" + newItem.Ip
 							oldItem := h.loadItem(key)
 							if !itemsEqual(oldItem, newItem) {
 								h.storeItem(newItem)
@@ -2,15 +2,20 @@ package handler
 
 import (
 	"fmt"
+	"github.com/json-iterator/go"
 	"log"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/hawell/logger"
 	"github.com/hawell/uperdis"
+	"github.com/miekg/dns"
 )
 
 var healthcheckGetEntries = [][]string{
@@ -511,3 +516,457 @@ func TestExpire(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestHealthcheckGroup(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	configRedis := uperdis.NewRedis(&configRedisConf)
+	h := NewHealthcheck(&config, configRedis)
+
+	h.redisStatusServer.Del("*")
+	defer h.redisStatusServer.Del("*")
+	h.redisStatusServer.Set("redins:healthcheck:web.group.com.:1.2.3.4", `{"enable":true,"protocol":"http","uri":"/","port":80, "status":3}`)
+	h.redisStatusServer.Set("redins:healthcheck:web.group.com.:2.3.4.5", `{"enable":true,"protocol":"http","uri":"/","port":80, "status":-3}`)
+
+	// concrete and wildcard locations bound to the same group
+	records := map[string]string{
+		"www.group.com.": `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"},{"ip":"2.3.4.5"}], "health_check":{"enable":true, "up_count":3, "down_count":-3, "group":"web.group.com"}}}`,
+		"*.group.com.":   `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"},{"ip":"2.3.4.5"}], "health_check":{"enable":true, "up_count":3, "down_count":-3, "group":"web.group.com"}}}`,
+	}
+	for name, recordStr := range records {
+		record := new(Record)
+		if err := jsoniter.Unmarshal([]byte(recordStr), record); err != nil {
+			t.Fatal(err)
+		}
+		mask := h.FilterHealthcheck(name, &record.A, make([]int, len(record.A.Data)))
+		if mask[0] != IpMaskWhite || mask[1] != IpMaskBlack {
+			fmt.Println("group status not used for ", name, " : ", mask)
+			t.Fail()
+		}
+	}
+}
+
+func TestHealthcheckTarget(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	configRedis := uperdis.NewRedis(&configRedisConf)
+	h := NewHealthcheck(&config, configRedis)
+
+	record := new(Record)
+	err := jsoniter.Unmarshal([]byte(`{"a":{"ttl":300, "records":[
+		{"ip":"1.2.3.4", "health_check":{"target":"10.0.0.1:8080"}},
+		{"ip":"2.3.4.5", "health_check":{"target":"10.0.0.2"}}
+	], "health_check":{"enable":true, "protocol":"http", "port":80, "uri":"/", "up_count":3, "down_count":-3, "timeout":1000}}}`), record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items := loadItems("www.target.com.", &record.A, "")
+	if len(items) != 2 || items[0].Ip != "10.0.0.1" || items[0].Port != 8080 || items[1].Ip != "10.0.0.2" || items[1].Port != 80 {
+		fmt.Println("health targets should be checked instead of served ips : ", items)
+		t.Fail()
+	}
+
+	h.redisStatusServer.Del("*")
+	defer h.redisStatusServer.Del("*")
+	// statuses of served ips are the opposite of their targets' and must be ignored
+	h.redisStatusServer.Set("redins:healthcheck:www.target.com.:10.0.0.1", `{"enable":true,"protocol":"http","uri":"/","port":8080, "status":3}`)
+	h.redisStatusServer.Set("redins:healthcheck:www.target.com.:10.0.0.2", `{"enable":true,"protocol":"http","uri":"/","port":80, "status":-3}`)
+	h.redisStatusServer.Set("redins:healthcheck:www.target.com.:1.2.3.4", `{"enable":true,"protocol":"http","uri":"/","port":80, "status":-3}`)
+	h.redisStatusServer.Set("redins:healthcheck:www.target.com.:2.3.4.5", `{"enable":true,"protocol":"http","uri":"/","port":80, "status":3}`)
+	mask := h.FilterHealthcheck("www.target.com.", &record.A, make([]int, len(record.A.Data)))
+	if mask[0] != IpMaskWhite || mask[1] != IpMaskBlack {
+		fmt.Println("served ips should be filtered by status of their health targets : ", mask)
+		t.Fail()
+	}
+
+	// target's port is the one probed, not protocol's default
+	probed := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probed <- r.URL.Path
+	}))
+	defer server.Close()
+	record = new(Record)
+	err = jsoniter.Unmarshal([]byte(`{"a":{"ttl":300, "records":[
+		{"ip":"1.2.3.4", "health_check":{"target":"`+server.Listener.Addr().String()+`"}}
+	], "health_check":{"enable":true, "protocol":"http", "port":80, "uri":"/mgmt", "up_count":3, "down_count":-3, "timeout":1000}}}`), record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items = loadItems("www.target.com.", &record.A, "")
+	HandleHealthCheck(h)(nil, items[0])
+	select {
+	case path := <-probed:
+		if path != "/mgmt" || items[0].Status != 1 {
+			fmt.Println("unexpected probe of health target : ", path, items[0].Status)
+			t.Fail()
+		}
+	default:
+		fmt.Println("health target port not probed : ", items[0].Error)
+		t.Fail()
+	}
+}
+
+func TestHealthcheckTier(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	configRedis := uperdis.NewRedis(&configRedisConf)
+	h := NewHealthcheck(&config, configRedis)
+
+	record := new(Record)
+	err := jsoniter.Unmarshal([]byte(`{"a":{"ttl":300, "records":[
+		{"ip":"1.1.1.1"},
+		{"ip":"1.1.1.2"},
+		{"ip":"2.2.2.1", "tier":1},
+		{"ip":"2.2.2.2", "tier":1}
+	], "health_check":{"enable":true, "up_count":3, "down_count":-3}}}`), record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.A.Data[2].Tier != 1 {
+		fmt.Println("tier not parsed : ", record.A.Data[2])
+		t.Fail()
+	}
+
+	h.redisStatusServer.Del("*")
+	defer h.redisStatusServer.Del("*")
+	setStatus := func(ip string, status int) {
+		h.redisStatusServer.Set("redins:healthcheck:www.tier.com.:"+ip, `{"enable":true,"protocol":"http","uri":"/","port":80, "status":`+strconv.Itoa(status)+`}`)
+	}
+	filter := func() []int {
+		h.cachedItems.Flush()
+		return h.FilterHealthcheck("www.tier.com.", &record.A, make([]int, len(record.A.Data)))
+	}
+
+	// primary tier is served while any of it is healthy, even if backups are healthier
+	setStatus("1.1.1.1", -3)
+	setStatus("1.1.1.2", 1)
+	setStatus("2.2.2.1", 3)
+	setStatus("2.2.2.2", 3)
+	if mask := filter(); mask[0] != IpMaskBlack || mask[1] != IpMaskWhite || mask[2] != IpMaskBlack || mask[3] != IpMaskBlack {
+		fmt.Println("only healthy primary ips should be served : ", mask)
+		t.Fail()
+	}
+
+	// whole primary tier is down, backup tier is served
+	setStatus("1.1.1.2", -3)
+	setStatus("2.2.2.2", -3)
+	if mask := filter(); mask[0] != IpMaskBlack || mask[1] != IpMaskBlack || mask[2] != IpMaskWhite || mask[3] != IpMaskBlack {
+		fmt.Println("backup tier should be served when primary tier is down : ", mask)
+		t.Fail()
+	}
+}
+
+func TestAllDownAction(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	rrset := &IP_RRSet{
+		FilterConfig: IpFilterConfig{
+			Count:     "multi",
+			Order:     "none",
+			GeoFilter: "none",
+		},
+		HealthCheckConfig: IpHealthCheckConfig{
+			Enable:    true,
+			UpCount:   3,
+			DownCount: -3,
+		},
+		Data: []IP_RR{
+			{Ip: net.ParseIP("1.1.1.1")},
+			{Ip: net.ParseIP("2.2.2.2"), Tier: 1},
+			{Ip: net.ParseIP("3.3.3.3"), Tier: 2},
+		},
+	}
+	results := []struct {
+		action string
+		qtype  uint16
+		ips    []string
+	}{
+		{"serve", dns.TypeA, []string{"3.3.3.3"}},
+		{"", dns.TypeA, []string{"3.3.3.3"}},
+		{"nodata", dns.TypeA, nil},
+		{"sinkhole", dns.TypeA, []string{"10.10.10.10"}},
+		// no aaaa sinkhole is configured
+		{"sinkhole", dns.TypeAAAA, nil},
+	}
+	for _, result := range results {
+		cfg := defaultConfig
+		cfg.NeverEmpty = true
+		cfg.HealthCheck = config
+		cfg.HealthCheck.AllDownAction = result.action
+		cfg.HealthCheck.SinkholeA = "10.10.10.10"
+		h := newTestHandler(&cfg)
+		h.healthcheck.redisStatusServer.Del("*")
+		for _, ip := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"} {
+			h.healthcheck.redisStatusServer.Set("redins:healthcheck:www.alldown.com.:"+ip, `{"enable":true,"protocol":"http","uri":"/","port":80, "status":-3}`)
+		}
+
+		ips := h.Filter("www.alldown.com.", result.qtype, net.ParseIP("1.2.3.4"), rrset)
+		var got []string
+		for _, ip := range ips {
+			got = append(got, ip.String())
+		}
+		if strings.Join(got, ",") != strings.Join(result.ips, ",") {
+			fmt.Println("unexpected answer for all_down_action ", result.action, " ", dns.TypeToString[result.qtype], " : ", got)
+			t.Fail()
+		}
+		h.healthcheck.redisStatusServer.Del("*")
+	}
+}
+
+func TestMissingHealthStatus(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	configRedis := uperdis.NewRedis(&configRedisConf)
+
+	rrset := IP_RRSet{
+		Data: []IP_RR{
+			{Ip: net.ParseIP("1.2.3.4")},
+			{Ip: net.ParseIP("9.9.9.9")},
+		},
+		HealthCheckConfig: IpHealthCheckConfig{
+			Enable:    true,
+			DownCount: -3,
+			UpCount:   3,
+			Timeout:   1000,
+		},
+	}
+	results := map[string][]int{
+		"neutral": {IpMaskWhite, IpMaskWhite},
+		"":        {IpMaskWhite, IpMaskWhite},
+		"down":    {IpMaskWhite, IpMaskBlack},
+		"up":      {IpMaskBlack, IpMaskWhite},
+	}
+	for missingStatus, expected := range results {
+		cfg := config
+		cfg.MissingStatus = missingStatus
+		h := NewHealthcheck(&cfg, configRedis)
+		h.redisStatusServer.Del("*")
+		// 9.9.9.9 is not monitored
+		h.redisStatusServer.Set("redins:healthcheck:w.missing.com.:1.2.3.4", `{"enable":true,"protocol":"http","uri":"/","port":80, "status":-1}`)
+
+		mask := h.FilterHealthcheck("w.missing.com.", &rrset, make([]int, len(rrset.Data)))
+		if mask[0] != expected[0] || mask[1] != expected[1] {
+			fmt.Println("unexpected mask for missing_health_status ", missingStatus, " : ", mask)
+			t.Fail()
+		}
+		h.redisStatusServer.Del("*")
+	}
+}
+
+func TestLoadItems(t *testing.T) {
+	record := new(Record)
+	err := jsoniter.Unmarshal([]byte(`{"a":{"ttl":300, "records":[
+		{"ip":"1.2.3.4", "health_check":{"protocol":"https", "port":8443, "uri":"/hc"}},
+		{"ip":"2.3.4.5"}
+	], "health_check":{"enable":false, "protocol":"http", "port":80, "uri":"/", "up_count":3, "down_count":-3, "timeout":1000}}}`), record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only ips with embedded parameters are checked when rrset health check is disabled
+	items := loadItems("www.items.com.", &record.A, "domain-id")
+	if len(items) != 1 {
+		fmt.Println("unexpected items : ", items)
+		t.FailNow()
+	}
+	item := items[0]
+	if item.Host != "www.items.com." || item.Ip != "1.2.3.4" || !item.Enable || item.Protocol != "https" || item.Port != 8443 || item.Uri != "/hc" ||
+		item.UpCount != 3 || item.DownCount != -3 || item.Timeout != 1000 || item.DomainId != "domain-id" {
+		fmt.Println("unexpected item : ", *item)
+		t.Fail()
+	}
+
+	// embedded parameters override rrset's for that ip only
+	record.A.HealthCheckConfig.Enable = true
+	items = loadItems("www.items.com.", &record.A, "domain-id")
+	if len(items) != 2 || items[0].Port != 8443 || items[1].Ip != "2.3.4.5" || items[1].Port != 80 || items[1].Protocol != "http" || items[1].Uri != "/" {
+		fmt.Println("unexpected items : ", items)
+		t.Fail()
+	}
+}
+
+func TestEmbeddedHealthCheck(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	configRedis := uperdis.NewRedis(&configRedisConf)
+	h := NewHealthcheck(&config, configRedis)
+	h.redisStatusServer.Del("*")
+	defer h.redisStatusServer.Del("*")
+
+	var probes []string
+	var probesLock sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probesLock.Lock()
+		probes = append(probes, r.URL.Path)
+		probesLock.Unlock()
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	port := server.Listener.Addr().(*net.TCPAddr).Port
+
+	// rrset has no health check of its own, thresholds and timeout come from defaults
+	record := new(Record)
+	err := jsoniter.Unmarshal([]byte(`{"a":{"ttl":300, "records":[
+		{"ip":"127.0.0.1", "health_check":{"port":`+strconv.Itoa(port)+`, "uri":"/hc"}},
+		{"ip":"127.0.0.2"}
+	]}}`), record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := loadItems("www.embedded.com.", &record.A, "")
+	if len(items) != 1 || items[0].DownCount != -3 || items[0].UpCount != 3 || items[0].Timeout != 1000 {
+		fmt.Println("embedded health check should get default thresholds : ", items)
+		t.FailNow()
+	}
+
+	check := HandleHealthCheck(h)
+	for i := 0; i < 3; i++ {
+		check(nil, items[0])
+	}
+	probesLock.Lock()
+	defer probesLock.Unlock()
+	if len(probes) != 3 || probes[0] != "/hc" {
+		fmt.Println("embedded port and uri should be probed : ", probes)
+		t.Fail()
+	}
+	if items[0].Status != -3 {
+		fmt.Println("ip should be down after failed probes : ", items[0].Status)
+		t.Fail()
+	}
+	mask := h.FilterHealthcheck("www.embedded.com.", &record.A, make([]int, len(record.A.Data)))
+	if mask[0] != IpMaskBlack || mask[1] != IpMaskWhite {
+		fmt.Println("down ip with embedded health check should be removed : ", mask)
+		t.Fail()
+	}
+}
+
+func TestHealthStatusImport(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	configRedis := uperdis.NewRedis(&configRedisConf)
+
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"w.import.com.:1.2.3.4":"down", "W.Import.com:5.6.7.8":"up", "w.import.com.:9.9.9.9":"unknown", "invalid":"up"}`))
+	}))
+	defer source.Close()
+
+	cfg := config
+	cfg.Mode = "import"
+	cfg.Import = HealthImportConfig{Url: source.URL, Timeout: 1000}
+	h := NewHealthcheck(&cfg, configRedis)
+	h.redisStatusServer.Del("*")
+	// thresholds of items transferred from zone data are kept
+	h.redisStatusServer.Set("redins:healthcheck:w.import.com.:5.6.7.8", `{"enable":true,"protocol":"http","uri":"/","port":80,"up_count":5,"down_count":-5}`)
+
+	if err := h.ImportStatus(); err != nil {
+		fmt.Println("import failed : ", err)
+		t.FailNow()
+	}
+	for ip, expected := range map[string]int{"1.2.3.4": -3, "5.6.7.8": 5, "9.9.9.9": 0} {
+		if status := h.getStatus("w.import.com.", net.ParseIP(ip)); status != expected {
+			fmt.Println("unexpected imported status for ", ip, " : ", status)
+			t.Fail()
+		}
+	}
+
+	rrset := IP_RRSet{
+		Data: []IP_RR{
+			{Ip: net.ParseIP("1.2.3.4")},
+			{Ip: net.ParseIP("5.6.7.8")},
+		},
+		HealthCheckConfig: IpHealthCheckConfig{
+			Enable:    true,
+			DownCount: -3,
+			UpCount:   3,
+		},
+	}
+	mask := h.FilterHealthcheck("w.import.com.", &rrset, make([]int, len(rrset.Data)))
+	if mask[0] != IpMaskBlack || mask[1] != IpMaskWhite {
+		fmt.Println("filter should use imported status : ", mask)
+		t.Fail()
+	}
+	h.redisStatusServer.Del("*")
+}
+
+func TestHealthStoreOutage(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	configRedis := uperdis.NewRedis(&configRedisConf)
+
+	rrset := IP_RRSet{
+		Data: []IP_RR{
+			{Ip: net.ParseIP("1.2.3.4")},
+			{Ip: net.ParseIP("5.6.7.8")},
+		},
+		HealthCheckConfig: IpHealthCheckConfig{
+			Enable:    true,
+			DownCount: -3,
+			UpCount:   3,
+		},
+	}
+
+	cfg := config
+	cfg.MissingStatus = "down"
+	h := NewHealthcheck(&cfg, configRedis)
+	h.redisStatusServer.Del("*")
+	h.redisStatusServer.Set("redins:healthcheck:w.outage.com.:1.2.3.4", `{"enable":true,"protocol":"http","uri":"/","port":80, "status":3}`)
+	mask := h.FilterHealthcheck("w.outage.com.", &rrset, make([]int, len(rrset.Data)))
+	if mask[0] != IpMaskWhite || mask[1] != IpMaskBlack {
+		fmt.Println("unexpected mask with reachable health store : ", mask)
+		t.Fail()
+	}
+
+	h.redisStatusServer.Del("*")
+
+	// 1.2.3.4 is cached as up, 5.6.7.8 cannot be loaded during outage and would be treated as missing
+	h = NewHealthcheck(&cfg, configRedis)
+	h.redisStatusServer.Set("redins:healthcheck:w.outage.com.:1.2.3.4", `{"enable":true,"protocol":"http","uri":"/","port":80, "status":3}`)
+	h.redisStatusServer.Set("redins:healthcheck:w.outage.com.:5.6.7.8", `{"enable":true,"protocol":"http","uri":"/","port":80, "status":3}`)
+	h.getStatus("w.outage.com.", net.ParseIP("1.2.3.4"))
+	h.redisStatusServer.Del("*")
+	// nothing listens on port 1
+	unreachable := cfg.RedisStatusServer
+	unreachable.Address = "127.0.0.1:1"
+	h.redisStatusServer = uperdis.NewRedis(&unreachable)
+	for _, filter := range []func(string, *IP_RRSet, []int) []int{h.FilterHealthcheck, h.FilterHealthiest} {
+		mask = filter("w.outage.com.", &rrset, make([]int, len(rrset.Data)))
+		if mask[0] != IpMaskWhite || mask[1] != IpMaskWhite {
+			fmt.Println("health store outage should not filter any ip : ", mask)
+			t.Fail()
+		}
+	}
+}
+
+func TestHealthStatusTtl(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	configRedis := uperdis.NewRedis(&configRedisConf)
+
+	cfg := config
+	cfg.StatusTtl = 1
+	cfg.MissingStatus = "down"
+	h := NewHealthcheck(&cfg, configRedis)
+	h.redisStatusServer.Del("*")
+
+	h.storeItem(&HealthCheckItem{Protocol: "http", Uri: "/", Port: 80, Enable: true, Status: 3, UpCount: 3, DownCount: -3, Host: "w.ttl.com.", Ip: "1.2.3.4"})
+	if val, _ := h.redisStatusServer.Get("redins:healthcheck:w.ttl.com.:1.2.3.4"); val == "" {
+		fmt.Println("status should be stored")
+		t.Fail()
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if val, _ := h.redisStatusServer.Get("redins:healthcheck:w.ttl.com.:1.2.3.4"); val != "" {
+		fmt.Println("status should expire after health_status_ttl : ", val)
+		t.Fail()
+	}
+
+	// 5.6.7.8 is written without ttl
+	h.redisStatusServer.Set("redins:healthcheck:w.ttl.com.:5.6.7.8", `{"enable":true,"protocol":"http","uri":"/","port":80, "status":3}`)
+	rrset := IP_RRSet{
+		Data: []IP_RR{
+			{Ip: net.ParseIP("1.2.3.4")},
+			{Ip: net.ParseIP("5.6.7.8")},
+		},
+		HealthCheckConfig: IpHealthCheckConfig{
+			Enable:    true,
+			DownCount: -3,
+			UpCount:   3,
+		},
+	}
+	if mask := h.FilterHealthcheck("w.ttl.com.", &rrset, make([]int, len(rrset.Data))); mask[0] != IpMaskBlack || mask[1] != IpMaskWhite {
+		fmt.Println("expired status should be treated as missing : ", mask)
+		t.Fail()
+	}
+	h.redisStatusServer.Del("*")
+}
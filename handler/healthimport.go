@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hawell/logger"
+	"github.com/json-iterator/go"
+	"github.com/miekg/dns"
+)
+
+type HealthImportConfig struct {
+	Url      string `json:"url"`
+	Interval int    `json:"interval"`
+	Timeout  int    `json:"timeout"`
+}
+
+// importStatuses replaces probing in import mode, statuses are read from external source every import interval
+func (h *Healthcheck) importStatuses() {
+	ticker := time.NewTicker(h.importInterval)
+	for {
+		if err := h.ImportStatus(); err != nil {
+			logger.Default.Errorf("cannot import health status from %s : %s", h.importUrl, err)
+		}
+		select {
+		case <-h.quit:
+			ticker.Stop()
+			h.quitWG.Done()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ImportStatus reads a json object of "host:ip" -> "up"/"down" from import url and stores it as healthcheck status,
+// up and down are mapped to item's up_count and down_count so filters treat them as fully checked
+func (h *Healthcheck) ImportStatus() error {
+	resp, err := h.importClient.Get(h.importUrl)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("invalid http status code : %d", resp.StatusCode)
+	}
+	statuses := make(map[string]string)
+	if err := jsoniter.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+		return err
+	}
+	for key, status := range statuses {
+		splits := strings.SplitN(key, ":", 2)
+		if len(splits) != 2 || net.ParseIP(splits[1]) == nil {
+			logger.Default.Errorf("invalid imported health status key : %s", key)
+			continue
+		}
+		host, ip := dns.Fqdn(strings.ToLower(splits[0])), net.ParseIP(splits[1]).String()
+		key = host + ":" + ip
+		item := h.loadItem(key)
+		if item == nil {
+			// not transferred from zone data yet, use default thresholds
+			item = &HealthCheckItem{Host: host, Ip: ip, Enable: true, UpCount: 3, DownCount: -3}
+		}
+		switch strings.ToLower(status) {
+		case "up":
+			item.Status = item.UpCount
+		case "down":
+			item.Status = item.DownCount
+		default:
+			logger.Default.Errorf("invalid imported health status for %s : %s", key, status)
+			continue
+		}
+		item.Error = nil
+		item.LastCheck = time.Now()
+		h.storeItem(item)
+		h.cachedItems.Delete(key)
+	}
+	return nil
+}
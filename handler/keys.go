@@ -0,0 +1,237 @@
+package handler
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/hawell/logger"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/miekg/dns"
+)
+
+// ZskRollover enables automatic zsk rollover of a dnssec zone, durations are in seconds
+type ZskRollover struct {
+	Lifetime   int64 `json:"lifetime"`    // how long a zsk signs the zone
+	PrePublish int64 `json:"pre_publish"` // how long a new zsk is published before it signs
+	Retire     int64 `json:"retire"`      // how long an old zsk stays published after it is replaced
+}
+
+// zskState is rollover state of a zone stored in backend
+type zskState struct {
+	Activated  int64 `json:"activated"`
+	RetireAt   int64 `json:"retire_at,omitempty"`
+	Generation int64 `json:"generation,omitempty"` // incremented on every key change so other instances notice it
+}
+
+// zskLockTtl bounds how long a crashed instance can block rollover of a zone
+const zskLockTtl = time.Minute
+
+func zskKey(zone string, name string) string {
+	return "redins:zones:" + zone + ":zsk:" + name
+}
+
+// RolloverZSK advances zone's zsk lifecycle : a new zsk (zsk:next) is published pre_publish seconds before
+// active zsk reaches its lifetime, then it replaces active zsk and the old one (zsk:prev) stays published
+// for retire seconds. only the instance holding zone's rollover lock (zsk:lock) changes keys, others reload
+// zone when they see a new rollover state. returns true if zone keys are changed
+func (h *DnsRequestHandler) RolloverZSK(zone string) (bool, error) {
+	config, err := h.Backend.Get("redins:zones:" + zone + ":config")
+	if err != nil {
+		return false, err
+	}
+	z := NewZone(zone, nil, config)
+	rollover := z.Config.ZskRollover
+	if !z.Config.DnsSec || rollover == nil || rollover.Lifetime <= 0 {
+		return false, nil
+	}
+	locker, ok := h.Backend.(Locker)
+	if !ok {
+		return false, errLockNotSupported
+	}
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return false, err
+	}
+	locked, err := locker.Lock(zskKey(zone, "lock"), hex.EncodeToString(token), zskLockTtl)
+	if err != nil {
+		return false, err
+	}
+	changed := false
+	if locked {
+		changed, err = h.rolloverZSK(zone, rollover)
+		if err := locker.Unlock(zskKey(zone, "lock"), hex.EncodeToString(token)); err != nil {
+			logger.Default.Errorf("cannot release zsk lock of %s : %s", zone, err)
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// keys may also be changed by another instance
+	state, err := h.Backend.Get(zskKey(zone, "state"))
+	if err != nil {
+		return false, err
+	}
+	h.zskStatesLock.Lock()
+	last, seen := h.zskStates[zone]
+	h.zskStates[zone] = state
+	h.zskStatesLock.Unlock()
+	if state != last {
+		// reload keys on next request
+		h.ZoneCache.Del(zone)
+		changed = changed || seen
+	}
+	return changed, nil
+}
+
+// rolloverZSK does one rollover step of zone, caller must hold zone's rollover lock
+func (h *DnsRequestHandler) rolloverZSK(zone string, rollover *ZskRollover) (bool, error) {
+	active := h.loadKey(zskKey(zone, "pub"), zskKey(zone, "priv"))
+	if active == nil {
+		return false, errors.New("cannot load zsk of " + zone)
+	}
+
+	now := h.now().Unix()
+	var state zskState
+	if value, err := h.Backend.Get(zskKey(zone, "state")); err != nil {
+		return false, err
+	} else if value != "" {
+		if err := jsoniter.Unmarshal([]byte(value), &state); err != nil {
+			return false, err
+		}
+	}
+	if state.Activated == 0 {
+		state.Activated = now
+	}
+
+	changed := false
+	if state.RetireAt != 0 && now >= state.RetireAt {
+		if err := h.Backend.Del(zskKey(zone, "prev:*")); err != nil {
+			return false, err
+		}
+		state.RetireAt = 0
+		changed = true
+	}
+	next, err := h.Backend.Get(zskKey(zone, "next:pub"))
+	if err != nil {
+		return false, err
+	}
+	expiration := state.Activated + rollover.Lifetime
+	if next == "" && now >= expiration-rollover.PrePublish {
+		pub, priv, err := newZsk(zone, active)
+		if err != nil {
+			return false, err
+		}
+		if err := h.setKey(zskKey(zone, "next:"), pub, priv); err != nil {
+			return false, err
+		}
+		next = pub
+		changed = true
+	}
+	if next != "" && now >= expiration {
+		activePub, _ := h.Backend.Get(zskKey(zone, "pub"))
+		activePriv, _ := h.Backend.Get(zskKey(zone, "priv"))
+		nextPriv, err := h.Backend.Get(zskKey(zone, "next:priv"))
+		if err != nil {
+			return false, err
+		}
+		if err := h.setKey(zskKey(zone, "prev:"), activePub, activePriv); err != nil {
+			return false, err
+		}
+		if err := h.setKey(zskKey(zone, ""), next, nextPriv); err != nil {
+			return false, err
+		}
+		if err := h.Backend.Del(zskKey(zone, "next:*")); err != nil {
+			return false, err
+		}
+		state.Activated = now
+		state.RetireAt = now + rollover.Retire
+		changed = true
+	}
+
+	if changed {
+		state.Generation++
+	}
+	value, _ := jsoniter.Marshal(state)
+	if err := h.Backend.Set(zskKey(zone, "state"), string(value)); err != nil {
+		return false, err
+	}
+	return changed, nil
+}
+
+// RolloverZSKs runs RolloverZSK for all zones
+func (h *DnsRequestHandler) RolloverZSKs() {
+	h.zoneTree().Root().Walk(func(k []byte, v interface{}) bool {
+		zone := v.(string)
+		if changed, err := h.RolloverZSK(zone); err != nil {
+			logger.Default.Errorf("zsk rollover of %s failed : %s", zone, err)
+		} else if changed {
+			logger.Default.Infof("zsk of %s rolled over", zone)
+		}
+		return false
+	})
+}
+
+func (h *DnsRequestHandler) setKey(prefix string, pub string, priv string) error {
+	if err := h.Backend.Set(prefix+"pub", pub); err != nil {
+		return err
+	}
+	return h.Backend.Set(prefix+"priv", priv)
+}
+
+// newZsk generates a zsk with same algorithm and size as key
+func newZsk(zone string, key *ZoneKey) (string, string, error) {
+	zsk := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: key.DnsKey.Hdr.Ttl},
+		Flags:     256,
+		Protocol:  3,
+		Algorithm: key.DnsKey.Algorithm,
+	}
+	var bits int
+	switch pk := key.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		bits = pk.N.BitLen()
+	case *ecdsa.PrivateKey:
+		bits = pk.Curve.Params().BitSize
+	default:
+		return "", "", errors.New("invalid or not supported algorithm")
+	}
+	pk, err := zsk.Generate(bits)
+	if err != nil {
+		return "", "", err
+	}
+	return zsk.String(), zsk.PrivateKeyString(pk), nil
+}
+
+// loadPublishedKeys loads pre-published and retiring zsks of z, they are only published in DNSKEY set
+func (h *DnsRequestHandler) loadPublishedKeys(z *Zone) {
+	z.ExtraZSKs = nil
+	for _, name := range []string{"next:pub", "prev:pub"} {
+		pub, _ := h.Backend.Get(zskKey(z.Name, name))
+		if pub == "" {
+			continue
+		}
+		rr, err := dns.NewRR(pub)
+		if err != nil {
+			logger.Default.Errorf("cannot parse zone key : %s", err)
+			continue
+		}
+		key := rr.(*dns.DNSKEY)
+		key.Flags = 256
+		key.Hdr.Ttl = z.KSK.DnsKey.Hdr.Ttl
+		z.ExtraZSKs = append(z.ExtraZSKs, key)
+	}
+}
+
+// DnsKeys is zone's DNSKEY set
+func (z *Zone) DnsKeys() []dns.RR {
+	keys := []dns.RR{z.ZSK.DnsKey}
+	for _, key := range z.ExtraZSKs {
+		keys = append(keys, key)
+	}
+	return append(keys, z.KSK.DnsKey)
+}
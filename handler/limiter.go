@@ -48,6 +48,15 @@ type Limiter struct {
 	Mutex      *sync.Mutex
 }
 
+// Denied reports whether key is refused by blacklist
+func (rl *RateLimiter) Denied(key string) bool {
+	if !rl.Config.Enable {
+		return false
+	}
+	_, exist := rl.BlackList[key]
+	return exist
+}
+
 func (rl *RateLimiter) CanHandle(key string) bool {
 	if !rl.Config.Enable {
 		return true
@@ -93,3 +102,64 @@ func (rl *RateLimiter) CanHandle(key string) bool {
 	}
 	return res
 }
+
+// ByteRateLimiter tracks bytes sent per key and reports keys exceeding Rate bytes per second
+type ByteRateLimiter struct {
+	Rate    int
+	Buckets *cache.Cache
+}
+
+type byteBucket struct {
+	Level      float64
+	LastUpdate time.Time
+	Mutex      *sync.Mutex
+}
+
+func NewByteRateLimiter(rate int) *ByteRateLimiter {
+	return &ByteRateLimiter{
+		Rate:    rate,
+		Buckets: cache.New(time.Minute, time.Minute*10),
+	}
+}
+
+func (bl *ByteRateLimiter) bucket(key string) *byteBucket {
+	if value, found := bl.Buckets.Get(key); found {
+		return value.(*byteBucket)
+	}
+	b := &byteBucket{LastUpdate: time.Now(), Mutex: &sync.Mutex{}}
+	if err := bl.Buckets.Add(key, b, time.Minute); err != nil {
+		// another request created it first
+		if value, found := bl.Buckets.Get(key); found {
+			return value.(*byteBucket)
+		}
+	}
+	return b
+}
+
+// drain must be called with b.Mutex held
+func (bl *ByteRateLimiter) drain(b *byteBucket) {
+	b.Level -= time.Since(b.LastUpdate).Seconds() * float64(bl.Rate)
+	b.LastUpdate = time.Now()
+	if b.Level < 0 {
+		b.Level = 0
+	}
+}
+
+// Exceeded returns true if more than Rate bytes per second (with a one second burst) are sent for key
+func (bl *ByteRateLimiter) Exceeded(key string) bool {
+	b := bl.bucket(key)
+	b.Mutex.Lock()
+	defer b.Mutex.Unlock()
+	bl.drain(b)
+	return b.Level > float64(bl.Rate)
+}
+
+// Add accounts size bytes sent for key
+func (bl *ByteRateLimiter) Add(key string, size int) {
+	b := bl.bucket(key)
+	b.Mutex.Lock()
+	bl.drain(b)
+	b.Level += float64(size)
+	b.Mutex.Unlock()
+	bl.Buckets.Set(key, b, time.Minute)
+}
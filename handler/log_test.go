@@ -78,16 +78,16 @@ func TestJsonLog(t *testing.T) {
 
 	logTestConfig.Log.Format = "json"
 	h := NewHandler(&logTestConfig)
-	h.Redis.Del("*")
-	h.Redis.SAdd("redins:zones", logZone)
+	h.Backend.Del("*")
+	h.Backend.SAdd("redins:zones", logZone)
 	for _, cmd := range logZoneEntries {
-		err := h.Redis.HSet("redins:zones:"+logZone, cmd[0], cmd[1])
+		err := h.Backend.HSet("redins:zones:"+logZone, cmd[0], cmd[1])
 		if err != nil {
 			log.Printf("[ERROR] cannot connect to redis: %s", err)
 			t.Fail()
 		}
 	}
-	h.Redis.Set("redins:zones:"+logZone+":config", logZoneConfig)
+	h.Backend.Set("redins:zones:"+logZone+":config", logZoneConfig)
 	h.LoadZones()
 	tc := test.Case{
 		Qname: "www.zone.log",
@@ -128,16 +128,16 @@ func TestCapnpLog(t *testing.T) {
 
 	logTestConfig.Log.Format = "capnp_request"
 	h := NewHandler(&logTestConfig)
-	h.Redis.Del("*")
-	h.Redis.SAdd("redins:zones", logZone)
+	h.Backend.Del("*")
+	h.Backend.SAdd("redins:zones", logZone)
 	for _, cmd := range logZoneEntries {
-		err := h.Redis.HSet("redins:zones:"+logZone, cmd[0], cmd[1])
+		err := h.Backend.HSet("redins:zones:"+logZone, cmd[0], cmd[1])
 		if err != nil {
 			log.Printf("[ERROR] cannot connect to redis: %s", err)
 			t.Fail()
 		}
 	}
-	h.Redis.Set("redins:zones:"+logZone+":config", logZoneConfig)
+	h.Backend.Set("redins:zones:"+logZone+":config", logZoneConfig)
 	h.LoadZones()
 	tc := test.Case{
 		Qname: "www2.zone.log",
@@ -184,7 +184,7 @@ func TestCapnpLogNotAuth(t *testing.T) {
 
 	logTestConfig.Log.Format = "capnp_request"
 	h := NewHandler(&logTestConfig)
-	h.Redis.Del("*")
+	h.Backend.Del("*")
 	h.LoadZones()
 	tc := test.Case{
 		Qname: "www2.zone.log",
@@ -228,10 +228,10 @@ func TestKafkaCapnpLog(t *testing.T) {
 	logTestConfig.Log.Kafka.Enable = true
 	logTestConfig.Log.Kafka.Format = "capnp_request"
 	h := NewHandler(&logTestConfig)
-	h.Redis.Del("*")
-	h.Redis.SAdd("redins:zones", logZone)
+	h.Backend.Del("*")
+	h.Backend.SAdd("redins:zones", logZone)
 	for _, cmd := range logZoneEntries {
-		err := h.Redis.HSet("redins:zones:"+logZone, cmd[0], cmd[1])
+		err := h.Backend.HSet("redins:zones:"+logZone, cmd[0], cmd[1])
 		if err != nil {
 			log.Printf("[ERROR] cannot connect to redis: %s", err)
 			t.Fail()
@@ -249,7 +249,7 @@ func TestKafkaCapnpLog(t *testing.T) {
 			},
 		},
 	}
-	h.Redis.Set("redins:zones:"+logZone+":config", logZoneConfig)
+	h.Backend.Set("redins:zones:"+logZone+":config", logZoneConfig)
 	h.LoadZones()
 	tc := test.Case{
 		Qname: "www2.zone.log",
@@ -313,16 +313,16 @@ func TestUdpCapnpLog(t *testing.T) {
 	logTestConfig.Log.Target = "udp"
 	logTestConfig.Log.Path = "localhost:9090"
 	h := NewHandler(&logTestConfig)
-	h.Redis.Del("*")
-	h.Redis.SAdd("redins:zones", logZone)
+	h.Backend.Del("*")
+	h.Backend.SAdd("redins:zones", logZone)
 	for _, cmd := range logZoneEntries {
-		err := h.Redis.HSet("redins:zones:"+logZone, cmd[0], cmd[1])
+		err := h.Backend.HSet("redins:zones:"+logZone, cmd[0], cmd[1])
 		if err != nil {
 			log.Printf("[ERROR] cannot connect to redis: %s", err)
 			t.Fail()
 		}
 	}
-	h.Redis.Set("redins:zones:"+logZone+":config", logZoneConfig)
+	h.Backend.Set("redins:zones:"+logZone+":config", logZoneConfig)
 	h.LoadZones()
 	tc := test.Case{
 		Qname: "www2.zone.log",
@@ -335,3 +335,95 @@ func TestUdpCapnpLog(t *testing.T) {
 	h.HandleRequest(state)
 	time.Sleep(time.Millisecond * 100)
 }
+
+func TestLogZones(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+
+	for _, c := range []struct {
+		logZones []string
+		logged   bool
+	}{
+		{[]string{"other.log."}, false},
+		{[]string{"other.log.", "zone.log"}, true},
+		{nil, true},
+	} {
+		os.Remove("/tmp/test.log")
+		config := logTestConfig
+		config.Log.Format = "json"
+		config.LogZones = c.logZones
+		h := NewHandler(&config)
+		h.Backend.Del("*")
+		h.Backend.SAdd("redins:zones", logZone)
+		for _, cmd := range logZoneEntries {
+			h.Backend.HSet("redins:zones:"+logZone, cmd[0], cmd[1])
+		}
+		h.Backend.Set("redins:zones:"+logZone+":config", logZoneConfig)
+		h.LoadZones()
+		tc := test.Case{
+			Qname: "www.zone.log",
+			Qtype: dns.TypeA,
+		}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, tc.Msg()))
+		time.Sleep(time.Millisecond * 100)
+		b, _ := ioutil.ReadFile("/tmp/test.log")
+		if logged := len(b) > 0; logged != c.logged {
+			fmt.Println("log_zones ", c.logZones, " logged = ", logged, " expected ", c.logged)
+			t.Fail()
+		}
+	}
+}
+
+func TestLogSampling(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	logFile, err := ioutil.TempFile("", "redins_query_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = logFile.Close()
+	defer os.Remove(logFile.Name())
+
+	backend := NewMemoryBackend()
+	_ = backend.SAdd("redins:zones", "sampled.com.")
+	_ = backend.SAdd("redins:zones", "full.com.")
+	_ = backend.Set("redins:zones:sampled.com.:config", `{"log_sampling":10}`)
+	_ = backend.HSet("redins:zones:sampled.com.", "www", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`)
+	_ = backend.HSet("redins:zones:full.com.", "www", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`)
+	config := defaultConfig
+	config.Log = logger.LogConfig{Enable: true, Target: "file", Level: "info", Path: logFile.Name(), Format: "json"}
+	h := NewHandlerWithBackend(&config, backend)
+
+	query := func(qname string) {
+		tc := test.Case{Qname: qname, Qtype: dns.TypeA}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, tc.Msg()))
+	}
+	// sampling counter lives in cached zone
+	query("www.sampled.com.")
+	h.ZoneCache.Wait()
+	for i := 0; i < 500; i++ {
+		query("www.sampled.com.")
+	}
+	for i := 0; i < 20; i++ {
+		query("www.full.com.")
+	}
+
+	time.Sleep(time.Millisecond * 200)
+	content, _ := ioutil.ReadFile(logFile.Name())
+	counts := make(map[string]int)
+	for _, line := range bytes.Split(bytes.TrimSpace(content), []byte("\n")) {
+		entry := struct {
+			Record string `json:"record"`
+		}{}
+		_ = jsoniter.Unmarshal(line, &entry)
+		counts[entry.Record]++
+	}
+	if counts["www.sampled.com."] < 40 || counts["www.sampled.com."] > 60 {
+		fmt.Println("about one in 10 requests of sampled zone should be logged : ", counts)
+		t.Fail()
+	}
+	if counts["www.full.com."] != 20 {
+		fmt.Println("all requests of zone without sampling should be logged : ", counts)
+		t.Fail()
+	}
+}
@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// metaRecord returns a record holding txt records of owner's meta if qname is meta label under an existing location
+func (h *DnsRequestHandler) metaRecord(qname string, zone *Zone) *Record {
+	if h.Config.MetaLabel == "" {
+		return nil
+	}
+	prefix := strings.ToLower(h.Config.MetaLabel) + "."
+	if !strings.HasPrefix(qname, prefix) {
+		return nil
+	}
+	owner := qname[len(prefix):]
+	if !dns.IsSubDomain(zone.Name, owner) {
+		return nil
+	}
+	location, match := zone.FindLocation(owner)
+	if match != ExactMatch {
+		return nil
+	}
+	record := h.LoadLocation(location, zone)
+	if record == nil || len(record.Meta) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(record.Meta))
+	for key := range record.Meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	meta := &Record{Zone: zone, Name: qname}
+	for _, key := range keys {
+		meta.TXT.Data = append(meta.TXT.Data, TXT_RR{Text: key + "=" + record.Meta[key]})
+	}
+	return meta
+}
@@ -0,0 +1,164 @@
+package handler
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	backendDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "redins",
+		Subsystem: "backend",
+		Name:      "operation_duration_seconds",
+		Help:      "latency of backend operations",
+		Buckets:   []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1},
+	}, []string{"operation"})
+	backendErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "redins",
+		Subsystem: "backend",
+		Name:      "errors_total",
+		Help:      "number of failed backend operations",
+	}, []string{"operation"})
+	backendTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "redins",
+		Subsystem: "backend",
+		Name:      "timeouts_total",
+		Help:      "number of backend operations failed with a timeout",
+	}, []string{"operation"})
+)
+
+func init() {
+	prometheus.MustRegister(backendDuration, backendErrors, backendTimeouts)
+}
+
+// MeteredBackend records latency and errors of every operation of the wrapped Backend
+type MeteredBackend struct {
+	Backend
+}
+
+func NewMeteredBackend(backend Backend) *MeteredBackend {
+	return &MeteredBackend{Backend: backend}
+}
+
+func observe(operation string, start time.Time, err error) {
+	backendDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		backendErrors.WithLabelValues(operation).Inc()
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			backendTimeouts.WithLabelValues(operation).Inc()
+		}
+	}
+}
+
+func (m *MeteredBackend) Get(key string) (string, error) {
+	start := time.Now()
+	value, err := m.Backend.Get(key)
+	observe("get", start, err)
+	return value, err
+}
+
+func (m *MeteredBackend) Set(key string, value string) error {
+	start := time.Now()
+	err := m.Backend.Set(key, value)
+	observe("set", start, err)
+	return err
+}
+
+func (m *MeteredBackend) IncrIfChanged(key string, markerKey string, marker string) (int64, error) {
+	incrementer, ok := m.Backend.(Incrementer)
+	if !ok {
+		return 0, errIncrNotSupported
+	}
+	start := time.Now()
+	value, err := incrementer.IncrIfChanged(key, markerKey, marker)
+	observe("incr", start, err)
+	return value, err
+}
+
+func (m *MeteredBackend) Lock(key string, token string, ttl time.Duration) (bool, error) {
+	locker, ok := m.Backend.(Locker)
+	if !ok {
+		return false, errLockNotSupported
+	}
+	start := time.Now()
+	locked, err := locker.Lock(key, token, ttl)
+	observe("lock", start, err)
+	return locked, err
+}
+
+func (m *MeteredBackend) Unlock(key string, token string) error {
+	locker, ok := m.Backend.(Locker)
+	if !ok {
+		return errLockNotSupported
+	}
+	start := time.Now()
+	err := locker.Unlock(key, token)
+	observe("unlock", start, err)
+	return err
+}
+
+func (m *MeteredBackend) Del(pattern string) error {
+	start := time.Now()
+	err := m.Backend.Del(pattern)
+	observe("del", start, err)
+	return err
+}
+
+func (m *MeteredBackend) GetKeys(pattern string) ([]string, error) {
+	start := time.Now()
+	keys, err := m.Backend.GetKeys(pattern)
+	observe("get_keys", start, err)
+	return keys, err
+}
+
+func (m *MeteredBackend) HGet(key string, hkey string) (string, error) {
+	start := time.Now()
+	value, err := m.Backend.HGet(key, hkey)
+	observe("hget", start, err)
+	return value, err
+}
+
+func (m *MeteredBackend) HSet(key string, hkey string, value string) error {
+	start := time.Now()
+	err := m.Backend.HSet(key, hkey, value)
+	observe("hset", start, err)
+	return err
+}
+
+func (m *MeteredBackend) GetHKeys(key string) ([]string, error) {
+	start := time.Now()
+	keys, err := m.Backend.GetHKeys(key)
+	observe("get_hkeys", start, err)
+	return keys, err
+}
+
+func (m *MeteredBackend) SAdd(set string, member string) error {
+	start := time.Now()
+	err := m.Backend.SAdd(set, member)
+	observe("sadd", start, err)
+	return err
+}
+
+func (m *MeteredBackend) SRem(set string, member string) error {
+	start := time.Now()
+	err := m.Backend.SRem(set, member)
+	observe("srem", start, err)
+	return err
+}
+
+func (m *MeteredBackend) SMembers(set string) ([]string, error) {
+	start := time.Now()
+	members, err := m.Backend.SMembers(set)
+	observe("smembers", start, err)
+	return members, err
+}
+
+func (m *MeteredBackend) SubscribeEvent(pattern string, onStart func(), onMessage func(channel string, data string), onError func(err error), quit chan *sync.WaitGroup) {
+	m.Backend.SubscribeEvent(pattern, onStart, onMessage, func(err error) {
+		backendErrors.WithLabelValues("subscribe").Inc()
+		onError(err)
+	}, quit)
+}
@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"arvancloud/redins/test"
+	"errors"
+	"fmt"
+	"github.com/hawell/logger"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"net"
+	"testing"
+)
+
+func sampleCount(operation string) uint64 {
+	m := &dto.Metric{}
+	_ = backendDuration.WithLabelValues(operation).(prometheus.Histogram).Write(m)
+	return m.GetHistogram().GetSampleCount()
+}
+
+func counterValue(c *prometheus.CounterVec, operation string) float64 {
+	m := &dto.Metric{}
+	_ = c.WithLabelValues(operation).Write(m)
+	return m.GetCounter().GetValue()
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+type erroringBackend struct {
+	*MemoryBackend
+	err error
+}
+
+func (b *erroringBackend) HGet(key string, hkey string) (string, error) {
+	return "", b.err
+}
+
+func TestMeteredBackend(t *testing.T) {
+	backend := NewMeteredBackend(NewMemoryBackend())
+	getCount := sampleCount("get")
+	hsetCount := sampleCount("hset")
+	_ = backend.Set("metrics:key", "value")
+	_, _ = backend.Get("metrics:key")
+	_, _ = backend.Get("metrics:key")
+	_ = backend.HSet("metrics:hash", "a", "value")
+	if sampleCount("get") != getCount+2 || sampleCount("hset") != hsetCount+1 {
+		fmt.Println("observations not recorded : ", sampleCount("get")-getCount, sampleCount("hset")-hsetCount)
+		t.Fail()
+	}
+
+	failing := &erroringBackend{MemoryBackend: NewMemoryBackend(), err: errors.New("connection refused")}
+	backend = NewMeteredBackend(failing)
+	errorCount := counterValue(backendErrors, "hget")
+	timeoutCount := counterValue(backendTimeouts, "hget")
+	_, _ = backend.HGet("metrics:hash", "a")
+	failing.err = timeoutError{}
+	_, _ = backend.HGet("metrics:hash", "a")
+	if counterValue(backendErrors, "hget") != errorCount+2 || counterValue(backendTimeouts, "hget") != timeoutCount+1 {
+		fmt.Println("errors not counted : ", counterValue(backendErrors, "hget")-errorCount, counterValue(backendTimeouts, "hget")-timeoutCount)
+		t.Fail()
+	}
+
+	config := defaultConfig
+	config.BackendMetrics = true
+	h := NewHandlerWithBackend(&config, NewMemoryBackend())
+	if _, ok := h.Backend.(*MeteredBackend); !ok {
+		fmt.Println("backend not metered")
+		t.Fail()
+	}
+}
+
+func TestDropMonitor(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	d := NewDropMonitor(&DropLogConfig{SampleRate: 2})
+
+	malformed := new(dns.Msg)
+	malformed.SetQuestion("www.example.com.", dns.TypeA)
+	malformed.Question = append(malformed.Question, malformed.Question[0])
+	drops := counterValue(droppedRequests, DropMalformed)
+	w := test.NewRecorder(&test.ResponseWriter{})
+	if !d.RejectInvalid(w, malformed) || w.Msg.Rcode != dns.RcodeFormatError {
+		fmt.Println("malformed request not rejected : ", w.Msg)
+		t.Fail()
+	}
+	if counterValue(droppedRequests, DropMalformed) != drops+1 {
+		fmt.Println("drop counter not incremented : ", counterValue(droppedRequests, DropMalformed)-drops)
+		t.Fail()
+	}
+
+	valid := new(dns.Msg)
+	valid.SetQuestion("www.example.com.", dns.TypeA)
+	if d.RejectInvalid(test.NewRecorder(&test.ResponseWriter{}), valid) || counterValue(droppedRequests, DropMalformed) != drops+1 {
+		fmt.Println("valid request rejected")
+		t.Fail()
+	}
+
+	// one of every sample_rate drops is logged
+	logged := 0
+	for i := 0; i < 10; i++ {
+		if d.Drop(DropRateLimit, "10.0.0.1", valid) {
+			logged++
+		}
+	}
+	if logged != 5 {
+		fmt.Println("sampled drops logged : ", logged)
+		t.Fail()
+	}
+}
@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/hawell/uperdis"
+)
+
+// RedisBackend is the default Backend, it adds atomic counters and locks missing from uperdis.Redis
+type RedisBackend struct {
+	*uperdis.Redis
+	config *uperdis.RedisConfig
+}
+
+func NewRedisBackend(config *uperdis.RedisConfig) *RedisBackend {
+	return &RedisBackend{
+		Redis:  uperdis.NewRedis(config),
+		config: config,
+	}
+}
+
+// incrIfChangedScript increments KEYS[1] and saves ARGV[1] in KEYS[2], unless KEYS[2] already holds ARGV[1]
+var incrIfChangedScript = redis.NewScript(2, `
+if redis.call('GET', KEYS[2]) == ARGV[1] then
+	local value = redis.call('GET', KEYS[1])
+	if value then
+		return tonumber(value)
+	end
+end
+redis.call('SET', KEYS[2], ARGV[1])
+return redis.call('INCR', KEYS[1])
+`)
+
+func (r *RedisBackend) IncrIfChanged(key string, markerKey string, marker string) (int64, error) {
+	conn := r.Pool.Get()
+	defer conn.Close()
+	return redis.Int64(incrIfChangedScript.Do(conn, r.key(key), r.key(markerKey), marker))
+}
+
+// unlockScript deletes KEYS[1] if it holds ARGV[1]
+var unlockScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+func (r *RedisBackend) Lock(key string, token string, ttl time.Duration) (bool, error) {
+	conn := r.Pool.Get()
+	defer conn.Close()
+	_, err := redis.String(conn.Do("SET", r.key(key), token, "NX", "PX", ttl.Milliseconds()))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (r *RedisBackend) Unlock(key string, token string) error {
+	conn := r.Pool.Get()
+	defer conn.Close()
+	_, err := unlockScript.Do(conn, r.key(key), token)
+	return err
+}
+
+// key adds configured prefix and suffix like uperdis.Redis does for its own commands
+func (r *RedisBackend) key(key string) string {
+	return r.config.Prefix + key + r.config.Suffix
+}
@@ -4,6 +4,8 @@ import (
 	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -19,8 +21,41 @@ type RequestContext struct {
 
 	SourceIp     net.IP
 	SourceSubnet string
+	// LocationDependent is set when answer is selected based on client location
+	LocationDependent bool
+	// PartialAnswers caps oversized answers for non-edns udp clients instead of setting TC
+	PartialAnswers bool
+	// ErrorText is sent to edns clients as an extended dns error explaining a failure response
+	ErrorText string
+	// ErrorCode is the extended dns error info code, sent even without ErrorText if not ExtendedErrorCodeOther
+	ErrorCode uint16
+	// Tags are set by handler's classifier before processing the request
+	Tags []string
+	// EdnsOptions holds data of configured custom edns options found in request by option code, available to classifiers and filters
+	EdnsOptions map[uint16][]byte
+	// EchoEdnsOptions sends EdnsOptions back in response
+	EchoEdnsOptions bool
+	// Truncate sets TC on the response, forcing udp clients to retry over tcp
+	Truncate      bool
+	responseDelay time.Duration
+	skipLog       bool
+	responseSize  int
 
 	name string
+	zone string
+}
+
+// ValidateRequest returns the rcode a request should be rejected with, or RcodeSuccess if it can be handled
+func ValidateRequest(r *dns.Msg) int {
+	if len(r.Question) != 1 {
+		return dns.RcodeFormatError
+	}
+	switch r.Opcode {
+	case dns.OpcodeQuery, dns.OpcodeNotify:
+		return dns.RcodeSuccess
+	default:
+		return dns.RcodeNotImplemented
+	}
 }
 
 func NewRequestContext(w dns.ResponseWriter, r *dns.Msg) *RequestContext {
@@ -46,15 +81,11 @@ func NewRequestContext(w dns.ResponseWriter, r *dns.Msg) *RequestContext {
 	return context
 }
 
+// sourceIp returns client address of ecs option, or remote address if there is none or
+// its source prefix length is 0 meaning client opted out (rfc7871 7.1.2)
 func (context *RequestContext) sourceIp() net.IP {
-	opt := context.Req.IsEdns0()
-	if opt != nil && len(opt.Option) != 0 {
-		for _, o := range opt.Option {
-			switch v := o.(type) {
-			case *dns.EDNS0_SUBNET:
-				return v.Address
-			}
-		}
+	if subnet := context.clientSubnet(); subnet != nil && subnet.SourceNetmask != 0 && subnet.Address != nil {
+		return subnet.Address
 	}
 	return net.ParseIP(context.IP())
 }
@@ -72,6 +103,90 @@ func (context *RequestContext) sourceSubnet() string {
 	return ""
 }
 
+// clientSubnet returns client subnet option of request, it must be called before SizeAndDo which strips unsupported options
+func (context *RequestContext) clientSubnet() *dns.EDNS0_SUBNET {
+	opt := context.Req.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// setSubnetScope echoes client subnet option with a scope prefix length matching the granularity of the answer
+func (context *RequestContext) setSubnetScope(m *dns.Msg, subnet *dns.EDNS0_SUBNET) {
+	opt := m.IsEdns0()
+	if opt == nil || subnet == nil {
+		return
+	}
+	scope := uint8(0)
+	if context.LocationDependent {
+		scope = subnet.SourceNetmask
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        subnet.Family,
+		SourceNetmask: subnet.SourceNetmask,
+		SourceScope:   scope,
+		Address:       subnet.Address,
+	})
+}
+
+// ednsOptions returns data of request's edns options with one of codes, it must be called before SizeAndDo
+func (context *RequestContext) ednsOptions(codes []uint16) map[uint16][]byte {
+	opt := context.Req.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	var options map[uint16][]byte
+	for _, o := range opt.Option {
+		local, ok := o.(*dns.EDNS0_LOCAL)
+		if !ok {
+			continue
+		}
+		for _, code := range codes {
+			if local.Code == code {
+				if options == nil {
+					options = make(map[uint16][]byte)
+				}
+				options[code] = local.Data
+				break
+			}
+		}
+	}
+	return options
+}
+
+func (context *RequestContext) setEdnsOptions(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil || !context.EchoEdnsOptions || len(context.EdnsOptions) == 0 {
+		return
+	}
+	codes := make([]int, 0, len(context.EdnsOptions))
+	for code := range context.EdnsOptions {
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: uint16(code), Data: context.EdnsOptions[uint16(code)]})
+	}
+}
+
+func (context *RequestContext) setExtendedError(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil || (context.ErrorText == "" && context.ErrorCode == dns.ExtendedErrorCodeOther) {
+		return
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_EDE{
+		InfoCode:  context.ErrorCode,
+		ExtraText: context.ErrorText,
+	})
+}
+
 func (context *RequestContext) RawName() string {
 	if context.name != "" {
 		return context.name
@@ -97,10 +212,91 @@ func (context *RequestContext) Response(rcode int) {
 	m.Ns = append(m.Ns, context.Authority...)
 	m.Extra = append(m.Extra, context.Additional...)
 
+	subnet := context.clientSubnet()
 	context.SizeAndDo(m)
+	context.setSubnetScope(m, subnet)
+	context.setEdnsOptions(m)
+	context.setExtendedError(m)
+	trimAdditional(m, context.Size())
+	if context.PartialAnswers && context.Proto() == "udp" && context.Req.IsEdns0() == nil {
+		trimAnswer(m, context.Size())
+	}
 	m = context.Scrub(m)
+	if context.Truncate {
+		m.Truncated = true
+	}
+	context.responseSize = m.Len()
 	if err := context.W.WriteMsg(m); err != nil {
 		// logger.Default.Error("write error : ", err, " msg : ", m.String())
 		_ = context.W.Close()
 	}
 }
+
+// trimAnswer drops answer records from the end until m fits in size, keeping at least one record
+func trimAnswer(m *dns.Msg, size int) {
+	for len(m.Answer) > 1 && m.Len() > size {
+		m.Answer = m.Answer[:len(m.Answer)-1]
+	}
+}
+
+// trimAdditional drops additional rrsets, along with their signatures, until m fits in size, these records are
+// optional so truncation (and TC) is only left to Scrub if answer section itself overflows
+func trimAdditional(m *dns.Msg, size int) {
+	if m.Len() <= size {
+		return
+	}
+	var opt dns.RR
+	var groups [][]dns.RR
+	index := make(map[string]int)
+	for _, rr := range m.Extra {
+		rrtype := rr.Header().Rrtype
+		if rrtype == dns.TypeOPT {
+			opt = rr
+			continue
+		}
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			rrtype = sig.TypeCovered
+		}
+		key := strings.ToLower(rr.Header().Name) + "/" + strconv.Itoa(int(rrtype))
+		if i, ok := index[key]; ok {
+			groups[i] = append(groups[i], rr)
+		} else {
+			index[key] = len(groups)
+			groups = append(groups, []dns.RR{rr})
+		}
+	}
+	keep := func(n int) {
+		m.Extra = m.Extra[:0]
+		for _, group := range groups[:n] {
+			m.Extra = append(m.Extra, group...)
+		}
+		if opt != nil {
+			m.Extra = append(m.Extra, opt)
+		}
+	}
+
+	// uncompressed lengths are an upper bound, rrsets fitting by them surely fit
+	keep(0)
+	length := m.Len()
+	low := 0
+	for ; low < len(groups); low++ {
+		for _, rr := range groups[low] {
+			length += dns.Len(rr)
+		}
+		if length > size {
+			break
+		}
+	}
+	// compression may leave room for more rrsets
+	high := len(groups)
+	for low < high {
+		mid := (low + high + 1) / 2
+		keep(mid)
+		if m.Len() <= size {
+			low = mid
+		} else {
+			high = mid - 1
+		}
+	}
+	keep(low)
+}
@@ -0,0 +1,143 @@
+package handler
+
+import (
+	"arvancloud/redins/test"
+	"fmt"
+	"github.com/miekg/dns"
+	"log"
+	"testing"
+)
+
+func TestValidateRequest(t *testing.T) {
+	tc := test.Case{
+		Qname: "example.com.", Qtype: dns.TypeA,
+	}
+
+	r := tc.Msg()
+	if rcode := ValidateRequest(r); rcode != dns.RcodeSuccess {
+		log.Printf("valid query rejected with %s\n", dns.RcodeToString[rcode])
+		t.Fail()
+	}
+
+	r = tc.Msg()
+	r.Question = nil
+	if rcode := ValidateRequest(r); rcode != dns.RcodeFormatError {
+		log.Printf("zero question query: rcode = %s should be FORMERR\n", dns.RcodeToString[rcode])
+		t.Fail()
+	}
+
+	r = tc.Msg()
+	r.Question = append(r.Question, dns.Question{Name: "example.net.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	if rcode := ValidateRequest(r); rcode != dns.RcodeFormatError {
+		log.Printf("multi question query: rcode = %s should be FORMERR\n", dns.RcodeToString[rcode])
+		t.Fail()
+	}
+
+	r = tc.Msg()
+	r.Opcode = dns.OpcodeIQuery
+	if rcode := ValidateRequest(r); rcode != dns.RcodeNotImplemented {
+		log.Printf("iquery: rcode = %s should be NOTIMP\n", dns.RcodeToString[rcode])
+		t.Fail()
+	}
+
+	r = tc.Msg()
+	r.Opcode = dns.OpcodeNotify
+	if rcode := ValidateRequest(r); rcode != dns.RcodeSuccess {
+		log.Printf("notify rejected with %s\n", dns.RcodeToString[rcode])
+		t.Fail()
+	}
+}
+
+func TestTrimAdditional(t *testing.T) {
+	tc := test.Case{
+		Qname: "glue.example.com.", Qtype: dns.TypeA,
+	}
+
+	// large glue: additional section is trimmed without setting TC
+	w := test.NewRecorder(&test.ResponseWriter{})
+	context := NewRequestContext(w, tc.Msg())
+	context.Authority = []dns.RR{
+		test.NS("glue.example.com. 300 IN NS ns1.glue.example.com."),
+		test.NS("glue.example.com. 300 IN NS ns2.glue.example.com."),
+	}
+	for i := 0; i < 50; i++ {
+		context.Additional = append(context.Additional, test.A(fmt.Sprintf("ns%d.glue.example.com. 300 IN A 10.0.0.%d", i, i)))
+		context.Additional = append(context.Additional, test.A(fmt.Sprintf("ns%d.glue.example.com. 300 IN A 10.0.1.%d", i, i)))
+		context.Additional = append(context.Additional, test.RRSIG(fmt.Sprintf("ns%d.glue.example.com. 300 IN RRSIG A 8 4 300 20300101000000 20200101000000 1234 glue.example.com. c2lnbmF0dXJl", i)))
+	}
+	context.Response(dns.RcodeSuccess)
+	resp := w.Msg
+	// rrsets are kept whole with their signatures
+	names := make(map[string]int)
+	for _, rr := range resp.Extra {
+		names[rr.Header().Name]++
+	}
+	for name, n := range names {
+		if n != 3 {
+			log.Printf("%s has %d records in additional, 3 expected\n", name, n)
+			t.Fail()
+		}
+	}
+	if resp.Truncated {
+		log.Printf("response with large glue should not be truncated\n")
+		t.Fail()
+	}
+	if len(resp.Ns) != 2 {
+		log.Printf("authority contained %d records, 2 expected\n", len(resp.Ns))
+		t.Fail()
+	}
+	if len(resp.Extra) == 0 || len(resp.Extra) >= 150 {
+		log.Printf("additional contained %d records, expected to be trimmed\n", len(resp.Extra))
+		t.Fail()
+	}
+	if resp.Len() > dns.MinMsgSize {
+		log.Printf("response size %d exceeds %d\n", resp.Len(), dns.MinMsgSize)
+		t.Fail()
+	}
+
+	// answer overflow: TC is set
+	w = test.NewRecorder(&test.ResponseWriter{})
+	context = NewRequestContext(w, tc.Msg())
+	for i := 0; i < 100; i++ {
+		context.Answer = append(context.Answer, test.A(fmt.Sprintf("glue.example.com. 300 IN A 10.0.0.%d", i)))
+	}
+	context.Additional = []dns.RR{test.A("ns1.glue.example.com. 300 IN A 10.0.1.1")}
+	context.Response(dns.RcodeSuccess)
+	resp = w.Msg
+	if !resp.Truncated {
+		log.Printf("response with large answer should be truncated\n")
+		t.Fail()
+	}
+	if len(resp.Extra) != 0 {
+		log.Printf("additional contained %d records, 0 expected\n", len(resp.Extra))
+		t.Fail()
+	}
+}
+
+func TestPartialAnswers(t *testing.T) {
+	tc := test.Case{
+		Qname: "large.example.com.", Qtype: dns.TypeA,
+	}
+	for _, partial := range []bool{false, true} {
+		w := test.NewRecorder(&test.ResponseWriter{})
+		context := NewRequestContext(w, tc.Msg())
+		context.PartialAnswers = partial
+		for i := 0; i < 100; i++ {
+			context.Answer = append(context.Answer, test.A(fmt.Sprintf("large.example.com. 300 IN A 10.0.0.%d", i)))
+		}
+		context.Response(dns.RcodeSuccess)
+		resp := w.Msg
+		if resp.Truncated == partial {
+			log.Printf("partial = %v : truncated = %v\n", partial, resp.Truncated)
+			t.Fail()
+		}
+		if partial && (len(resp.Answer) == 0 || len(resp.Answer) >= 100) {
+			log.Printf("answer contained %d records, expected to be capped\n", len(resp.Answer))
+			t.Fail()
+		}
+		if resp.Len() > dns.MinMsgSize {
+			log.Printf("response size %d exceeds %d\n", resp.Len(), dns.MinMsgSize)
+			t.Fail()
+		}
+	}
+}
@@ -1,11 +1,20 @@
 package handler
 
 import (
+	"context"
+	"net"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"crypto/tls"
 	"crypto/x509"
+	"github.com/hawell/logger"
 	"github.com/miekg/dns"
+	"golang.org/x/sys/unix"
 	"io/ioutil"
 )
 
@@ -17,11 +26,21 @@ type TlsConfig struct {
 }
 
 type ServerConfig struct {
-	Ip       string    `json:"ip"`
-	Port     int       `json:"port"`
-	Protocol string    `json:"protocol"`
-	Count    int       `json:"count"`
-	Tls      TlsConfig `json:"tls"`
+	Ip             string    `json:"ip"`
+	Port           int       `json:"port"`
+	Protocol       string    `json:"protocol"`
+	Count          int       `json:"count"`
+	IdleTimeout    int       `json:"idle_timeout"`
+	MaxConnections int       `json:"max_connections"`
+	Tls            TlsConfig `json:"tls"`
+}
+
+// Server is a dns.Server whose tcp listeners accept a limited number of concurrent connections
+type Server struct {
+	dns.Server
+	maxConnections int64
+	// connections is shared by all listeners of the same address
+	connections *int64
 }
 
 func loadRoots(caPath string) *x509.CertPool {
@@ -53,23 +72,142 @@ func loadTlsConfig(cfg TlsConfig) *tls.Config {
 	return &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: root}
 }
 
-func NewServer(config []ServerConfig) []dns.Server {
-	var servers []dns.Server
+func NewServer(config []ServerConfig) []*Server {
+	var servers []*Server
 	for _, cfg := range config {
 		if cfg.Count < 1 {
 			cfg.Count = 1
 		}
+		connections := new(int64)
 		for i := 0; i < cfg.Count; i++ {
-			server := dns.Server{
-				Addr:      cfg.Ip + ":" + strconv.Itoa(cfg.Port),
-				Net:       cfg.Protocol,
-				ReusePort: true,
+			server := &Server{
+				Server: dns.Server{
+					Addr:      cfg.Ip + ":" + strconv.Itoa(cfg.Port),
+					Net:       cfg.Protocol,
+					ReusePort: true,
+				},
+				connections: connections,
 			}
 			if cfg.Tls.Enable {
 				server.TLSConfig = loadTlsConfig(cfg.Tls)
 			}
+			if cfg.Protocol == "tcp" || cfg.Protocol == "tcp-tls" {
+				idleTimeout := time.Duration(cfg.IdleTimeout) * time.Millisecond
+				if idleTimeout > 0 {
+					server.IdleTimeout = func() time.Duration { return idleTimeout }
+				} else {
+					// same as miekg/dns default
+					idleTimeout = 8 * time.Second
+				}
+				server.Handler = keepaliveHandler(idleTimeout, nil)
+				server.maxConnections = int64(cfg.MaxConnections)
+			}
 			servers = append(servers, server)
 		}
 	}
 	return servers
 }
+
+// ListenAndServe starts server, new tcp connections are closed right after accept while max_connections are open
+func (s *Server) ListenAndServe() error {
+	if s.maxConnections <= 0 {
+		return s.Server.ListenAndServe()
+	}
+	if s.Net == "tcp-tls" && (s.TLSConfig == nil || len(s.TLSConfig.Certificates) == 0) {
+		// let dns.Server report missing certificates
+		return s.Server.ListenAndServe()
+	}
+	lc := net.ListenConfig{Control: reuseportControl}
+	l, err := lc.Listen(context.Background(), strings.TrimSuffix(s.Net, "-tls"), s.Addr)
+	if err != nil {
+		return err
+	}
+	l = &limitListener{Listener: l, max: s.maxConnections, count: s.connections}
+	if s.Net == "tcp-tls" {
+		l = tls.NewListener(l, s.TLSConfig)
+	}
+	s.Listener = l
+	return s.ActivateAndServe()
+}
+
+func reuseportControl(network, address string, c syscall.RawConn) error {
+	var opErr error
+	err := c.Control(func(fd uintptr) {
+		opErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
+
+type limitListener struct {
+	net.Listener
+	max   int64
+	count *int64
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if atomic.AddInt64(l.count, 1) > l.max {
+			atomic.AddInt64(l.count, -1)
+			logger.Default.Debugf("too many connections, closing connection from %s", conn.RemoteAddr())
+			_ = conn.Close()
+			continue
+		}
+		return &limitConn{Conn: conn, count: l.count}, nil
+	}
+}
+
+type limitConn struct {
+	net.Conn
+	count *int64
+	once  sync.Once
+}
+
+func (c *limitConn) Close() error {
+	c.once.Do(func() { atomic.AddInt64(c.count, -1) })
+	return c.Conn.Close()
+}
+
+// keepaliveHandler answers edns tcp keepalive option (rfc7828) with server's idle timeout
+func keepaliveHandler(idleTimeout time.Duration, next dns.Handler) dns.Handler {
+	if next == nil {
+		next = dns.DefaultServeMux
+	}
+	timeout := uint16(idleTimeout / (100 * time.Millisecond))
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		if opt := r.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if o.Option() == dns.EDNS0TCPKEEPALIVE {
+					next.ServeDNS(&keepaliveWriter{ResponseWriter: w, timeout: timeout}, r)
+					return
+				}
+			}
+		}
+		next.ServeDNS(w, r)
+	})
+}
+
+type keepaliveWriter struct {
+	dns.ResponseWriter
+	timeout uint16
+}
+
+func (w *keepaliveWriter) WriteMsg(m *dns.Msg) error {
+	if opt := m.IsEdns0(); opt != nil {
+		keepalive := &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE, Length: 2, Timeout: w.timeout}
+		options := make([]dns.EDNS0, 0, len(opt.Option)+1)
+		for _, o := range opt.Option {
+			if o.Option() != dns.EDNS0TCPKEEPALIVE {
+				options = append(options, o)
+			}
+		}
+		opt.Option = append(options, keepalive)
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
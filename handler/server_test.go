@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"testing"
+	"time"
+)
+
+func TestTcpKeepalive(t *testing.T) {
+	dns.HandleFunc("keepalive.test.", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.SetEdns0(4096, false)
+		m.IsEdns0().Option = r.IsEdns0().Option
+		_ = w.WriteMsg(m)
+	})
+	defer dns.HandleRemove("keepalive.test.")
+
+	servers := NewServer([]ServerConfig{{Ip: "127.0.0.1", Port: 10853, Protocol: "tcp", IdleTimeout: 5000}})
+	started := make(chan struct{})
+	servers[0].NotifyStartedFunc = func() { close(started) }
+	go func() {
+		if err := servers[0].ListenAndServe(); err != nil {
+			fmt.Println(err)
+		}
+	}()
+	<-started
+	defer servers[0].Shutdown()
+
+	r := new(dns.Msg)
+	r.SetQuestion("keepalive.test.", dns.TypeA)
+	r.SetEdns0(4096, false)
+	r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+	c := dns.Client{Net: "tcp"}
+	resp, _, err := c.Exchange(r, "127.0.0.1:10853")
+	if err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+	opt := resp.IsEdns0()
+	if opt == nil {
+		fmt.Println("no edns in response")
+		t.FailNow()
+	}
+	found := false
+	for _, o := range opt.Option {
+		if keepalive, ok := o.(*dns.EDNS0_TCP_KEEPALIVE); ok {
+			found = true
+			if keepalive.Timeout != 50 {
+				fmt.Println("keepalive timeout is ", keepalive.Timeout, " expected 50")
+				t.Fail()
+			}
+		}
+	}
+	if !found {
+		fmt.Println("keepalive option not in response : ", opt)
+		t.Fail()
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	dns.HandleFunc("limit.test.", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		_ = w.WriteMsg(m)
+	})
+	defer dns.HandleRemove("limit.test.")
+
+	servers := NewServer([]ServerConfig{{Ip: "127.0.0.1", Port: 10854, Protocol: "tcp", IdleTimeout: 5000, MaxConnections: 2}})
+	started := make(chan struct{})
+	servers[0].NotifyStartedFunc = func() { close(started) }
+	go func() {
+		if err := servers[0].ListenAndServe(); err != nil {
+			fmt.Println(err)
+		}
+	}()
+	<-started
+	defer servers[0].Shutdown()
+
+	c := dns.Client{Net: "tcp", Timeout: time.Second}
+	query := func(conn *dns.Conn) error {
+		r := new(dns.Msg)
+		r.SetQuestion("limit.test.", dns.TypeA)
+		_, _, err := c.ExchangeWithConn(r, conn)
+		return err
+	}
+	var conns []*dns.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := c.Dial("127.0.0.1:10854")
+		if err != nil {
+			fmt.Println(err)
+			t.FailNow()
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	for i := 0; i < 2; i++ {
+		if err := query(conns[i]); err != nil {
+			fmt.Println("connection ", i, " should be served : ", err)
+			t.Fail()
+		}
+	}
+	if err := query(conns[2]); err == nil {
+		fmt.Println("connection over limit should be closed")
+		t.Fail()
+	}
+
+	// closed connections free their slot
+	_ = conns[0].Close()
+	time.Sleep(100 * time.Millisecond)
+	conn, err := c.Dial("127.0.0.1:10854")
+	if err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+	defer conn.Close()
+	if err := query(conn); err != nil {
+		fmt.Println("new connection should be served after one is closed : ", err)
+		t.Fail()
+	}
+}
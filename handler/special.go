@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// special-use zones answered locally (rfc6761, rfc6303) when no configured zone covers them
+var specialZones = []string{
+	"localhost.",
+	"invalid.",
+	"127.in-addr.arpa.",
+	"10.in-addr.arpa.",
+	"16.172.in-addr.arpa.",
+	"17.172.in-addr.arpa.",
+	"18.172.in-addr.arpa.",
+	"19.172.in-addr.arpa.",
+	"20.172.in-addr.arpa.",
+	"21.172.in-addr.arpa.",
+	"22.172.in-addr.arpa.",
+	"23.172.in-addr.arpa.",
+	"24.172.in-addr.arpa.",
+	"25.172.in-addr.arpa.",
+	"26.172.in-addr.arpa.",
+	"27.172.in-addr.arpa.",
+	"28.172.in-addr.arpa.",
+	"29.172.in-addr.arpa.",
+	"30.172.in-addr.arpa.",
+	"31.172.in-addr.arpa.",
+	"168.192.in-addr.arpa.",
+	"254.169.in-addr.arpa.",
+}
+
+const specialTtl = 300
+
+func findSpecialZone(qname string) string {
+	for _, zone := range specialZones {
+		if dns.IsSubDomain(zone, qname) {
+			return zone
+		}
+	}
+	return ""
+}
+
+func specialSOA(zone string) dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: specialTtl},
+		Ns:      "localhost.",
+		Mbox:    "nobody.invalid.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   1200,
+		Expire:  604800,
+		Minttl:  specialTtl,
+	}
+}
+
+// HandleSpecialName answers queries for special-use names with synthesized responses, returns false if qname is not special
+func (h *DnsRequestHandler) HandleSpecialName(context *RequestContext) bool {
+	qname := context.RawName()
+	zone := findSpecialZone(qname)
+	if zone == "" {
+		return false
+	}
+	hdr := dns.RR_Header{Name: qname, Rrtype: context.QType(), Class: dns.ClassINET, Ttl: specialTtl}
+	res := dns.RcodeSuccess
+	switch {
+	case zone == "invalid.":
+		res = dns.RcodeNameError
+	case zone == "localhost.":
+		// localhost and all its subdomains resolve to loopback
+		switch context.QType() {
+		case dns.TypeA:
+			context.Answer = []dns.RR{&dns.A{Hdr: hdr, A: net.IPv4(127, 0, 0, 1)}}
+		case dns.TypeAAAA:
+			context.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: net.IPv6loopback}}
+		}
+	case qname == "1.0.0.127.in-addr.arpa.":
+		if context.QType() == dns.TypePTR {
+			context.Answer = []dns.RR{&dns.PTR{Hdr: hdr, Ptr: "localhost."}}
+		}
+	case qname != zone:
+		res = dns.RcodeNameError
+	}
+	if qname == zone && res == dns.RcodeSuccess {
+		switch context.QType() {
+		case dns.TypeSOA:
+			context.Answer = []dns.RR{specialSOA(zone)}
+		case dns.TypeNS:
+			context.Answer = []dns.RR{&dns.NS{Hdr: hdr, Ns: "localhost."}}
+		}
+	}
+	if len(context.Answer) == 0 {
+		context.Authority = []dns.RR{specialSOA(zone)}
+	}
+	h.Response(context, res)
+	return true
+}
@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/json-iterator/go"
+	"github.com/miekg/dns"
+)
+
+// QueryStream delivers request logs to live subscribers, slow subscribers miss entries instead of blocking requests
+type QueryStream struct {
+	lock        sync.RWMutex
+	subscribers map[chan map[string]interface{}]struct{}
+}
+
+func NewQueryStream() *QueryStream {
+	return &QueryStream{
+		subscribers: make(map[chan map[string]interface{}]struct{}),
+	}
+}
+
+func (s *QueryStream) Subscribe() chan map[string]interface{} {
+	ch := make(chan map[string]interface{}, 100)
+	s.lock.Lock()
+	s.subscribers[ch] = struct{}{}
+	s.lock.Unlock()
+	return ch
+}
+
+func (s *QueryStream) Unsubscribe(ch chan map[string]interface{}) {
+	s.lock.Lock()
+	delete(s.subscribers, ch)
+	s.lock.Unlock()
+}
+
+// Publish sends a copy of data to subscribers, data itself keeps being used by request log
+func (s *QueryStream) Publish(data map[string]interface{}) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if len(s.subscribers) == 0 {
+		return
+	}
+	entry := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		entry[k] = v
+	}
+	for ch := range s.subscribers {
+		select {
+		case ch <- entry:
+		default:
+		}
+	}
+}
+
+// ServeQueryStream streams request logs as json lines, optionally filtered by qname (including subdomains) and client ip or subnet,
+// it requires admin_token
+func (h *DnsRequestHandler) ServeQueryStream(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	qname := r.URL.Query().Get("qname")
+	if qname != "" {
+		qname = dns.Fqdn(qname)
+	}
+	var client *net.IPNet
+	if c := r.URL.Query().Get("client"); c != "" {
+		var err error
+		if _, client, err = net.ParseCIDR(c); err != nil {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				http.Error(w, "invalid client : "+c, http.StatusBadRequest)
+				return
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			client = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+		}
+	}
+
+	ch := h.queryStream.Subscribe()
+	defer h.queryStream.Unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	encoder := jsoniter.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case data := <-ch:
+			if qname != "" {
+				record, _ := data["record"].(string)
+				if !dns.IsSubDomain(qname, record) {
+					continue
+				}
+			}
+			if client != nil {
+				ip, _ := data["source_ip"].(net.IP)
+				if !client.Contains(ip) {
+					continue
+				}
+			}
+			if err := encoder.Encode(data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"arvancloud/redins/test"
+	"bufio"
+	"fmt"
+	"github.com/hawell/logger"
+	"github.com/json-iterator/go"
+	"github.com/miekg/dns"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestQueryStream(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := NewMemoryBackend()
+	_ = backend.SAdd("redins:zones", "stream.com.")
+	_ = backend.HSet("redins:zones:stream.com.", "www", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`)
+	_ = backend.HSet("redins:zones:stream.com.", "other", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}]}}`)
+	cfg := defaultConfig
+	cfg.AdminToken = "secret"
+	h := NewHandlerWithBackend(&cfg, backend)
+	defer h.ShutDown()
+
+	server := httptest.NewServer(http.HandlerFunc(h.ServeQueryStream))
+	defer server.Close()
+	if resp, err := http.Get(server.URL); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		fmt.Println("stream without token should be rejected : ", resp, err)
+		t.Fail()
+	}
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"?qname=www.stream.com&client=10.240.0.0/16", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Println("unexpected status : ", resp.Status)
+		t.FailNow()
+	}
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	for _, qname := range []string{"other.stream.com.", "www.stream.com.", "www.stream.com."} {
+		tc := test.Case{Qname: qname, Qtype: dns.TypeA}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, tc.Msg()))
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case line := <-lines:
+			data := make(map[string]interface{})
+			if err := jsoniter.Unmarshal([]byte(line), &data); err != nil {
+				fmt.Println(err)
+				t.FailNow()
+			}
+			if data["record"] != "www.stream.com." || data["source_ip"] != "10.240.0.1" || data["response_code"] != float64(dns.RcodeSuccess) {
+				fmt.Println("unexpected log entry : ", line)
+				t.Fail()
+			}
+		case <-time.After(time.Second):
+			fmt.Println("query not streamed")
+			t.FailNow()
+		}
+	}
+	select {
+	case line := <-lines:
+		fmt.Println("unexpected log entry : ", line)
+		t.Fail()
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -2,6 +2,7 @@ package handler
 
 import (
 	"arvancloud/redins/test"
+	"github.com/hawell/logger"
 	"github.com/miekg/dns"
 	"log"
 	"net"
@@ -45,3 +46,85 @@ func TestSubnet(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestSubnetScope(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := NewMemoryBackend()
+	_ = backend.SAdd("redins:zones", "scope.com.")
+	_ = backend.HSet("redins:zones:scope.com.", "geo", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4", "country":["DE"]},{"ip":"5.6.7.8", "country":[""]}], "filter":{"count":"multi","order":"none","geo_filter":"country"}}}`)
+	_ = backend.HSet("redins:zones:scope.com.", "plain", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4"},{"ip":"5.6.7.8"}]}}`)
+	h := NewHandlerWithBackend(&defaultConfig, backend)
+
+	for _, c := range []struct {
+		qname string
+		scope uint8
+	}{
+		{"geo.scope.com.", 24},
+		{"plain.scope.com.", 0},
+	} {
+		tc := test.Case{
+			Qname: c.qname, Qtype: dns.TypeA,
+		}
+		r := tc.Msg()
+		r.Extra = append(r.Extra, &dns.OPT{
+			Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT, Class: dns.ClassANY, Rdlength: 0, Ttl: 300},
+			Option: []dns.EDNS0{
+				&dns.EDNS0_SUBNET{
+					Address:       net.ParseIP("212.83.32.0"),
+					Code:          dns.EDNS0SUBNET,
+					Family:        1,
+					SourceNetmask: 24,
+					SourceScope:   0,
+				},
+			},
+		})
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, r))
+
+		opt := w.Msg.IsEdns0()
+		if opt == nil {
+			log.Printf("%s : no edns in response\n", c.qname)
+			t.Fail()
+			continue
+		}
+		var subnet *dns.EDNS0_SUBNET
+		for _, o := range opt.Option {
+			if s, ok := o.(*dns.EDNS0_SUBNET); ok {
+				subnet = s
+			}
+		}
+		if subnet == nil {
+			log.Printf("%s : no client subnet in response\n", c.qname)
+			t.Fail()
+			continue
+		}
+		if subnet.SourceNetmask != 24 || subnet.SourceScope != c.scope {
+			log.Printf("%s : subnet = %d/%d should be 24/%d\n", c.qname, subnet.SourceNetmask, subnet.SourceScope, c.scope)
+			t.Fail()
+		}
+	}
+}
+
+func TestSubnetFallback(t *testing.T) {
+	remote := "10.240.0.1"
+	for _, subnet := range []*dns.EDNS0_SUBNET{
+		nil,
+		// opted out
+		{Address: net.ParseIP("0.0.0.0"), Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 0, SourceScope: 0},
+	} {
+		tc := test.Case{
+			Qname: "example.com.", Qtype: dns.TypeA,
+		}
+		r := tc.Msg()
+		if subnet != nil {
+			r.SetEdns0(4096, false)
+			r.IsEdns0().Option = append(r.IsEdns0().Option, subnet)
+		}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		state := NewRequestContext(w, r)
+		if state.SourceIp.String() != remote {
+			log.Printf("address = %s should be %s for subnet %v\n", state.SourceIp.String(), remote, subnet)
+			t.Fail()
+		}
+	}
+}
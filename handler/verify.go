@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+type VerifyResult struct {
+	RR  dns.RR
+	Err error
+}
+
+// VerifyLocation builds all records of a location and checks every RR survives a text round-trip and wire packing
+func (h *DnsRequestHandler) VerifyLocation(zoneName string, location string) ([]VerifyResult, error) {
+	zoneName = dns.Fqdn(zoneName)
+	if h.FindZone(zoneName) != zoneName {
+		return nil, errors.New("zone not found : " + zoneName)
+	}
+	zone := h.LoadZone(zoneName)
+	if zone == nil {
+		return nil, errors.New("cannot load zone : " + zoneName)
+	}
+	name := location + "." + zone.Name
+	if location == "@" || location == "" {
+		location = zone.Name
+		name = zone.Name
+	}
+	record := h.LoadLocation(location, zone)
+	if record == nil {
+		return nil, errors.New("cannot load location : " + name)
+	}
+
+	rrs := h.locationRRs(name, record)
+	results := make([]VerifyResult, 0, len(rrs))
+	for _, rr := range rrs {
+		results = append(results, VerifyResult{RR: rr, Err: verifyRR(rr)})
+	}
+	return results, nil
+}
+
+// locationRRs builds all records of a location, address records are not filtered
+func (h *DnsRequestHandler) locationRRs(name string, record *Record) []dns.RR {
+	var rrs []dns.RR
+	rrs = append(rrs, h.A(name, record, rrsetIps(&record.A))...)
+	rrs = append(rrs, h.AAAA(name, record, rrsetIps(&record.AAAA))...)
+	rrs = append(rrs, h.CNAME(name, record)...)
+	rrs = append(rrs, h.TXT(name, record)...)
+	rrs = append(rrs, h.NS(name, record)...)
+	rrs = append(rrs, h.MX(name, record)...)
+	rrs = append(rrs, h.SRV(name, record)...)
+	rrs = append(rrs, h.CAA(name, record)...)
+	rrs = append(rrs, h.PTR(name, record)...)
+	rrs = append(rrs, h.TLSA(name, record)...)
+	rrs = append(rrs, h.NID(name, record)...)
+	rrs = append(rrs, h.L32(name, record)...)
+	rrs = append(rrs, h.L64(name, record)...)
+	rrs = append(rrs, h.LP(name, record)...)
+	rrs = append(rrs, h.URI(name, record)...)
+	rrs = append(rrs, h.OPENPGPKEY(name, record)...)
+	rrs = append(rrs, h.SMIMEA(name, record)...)
+	return rrs
+}
+
+func rrsetIps(rrset *IP_RRSet) []net.IP {
+	ips := make([]net.IP, 0, len(rrset.Data))
+	for _, rr := range rrset.Data {
+		ips = append(ips, rr.Ip)
+	}
+	return ips
+}
+
+func verifyRR(rr dns.RR) error {
+	text := rr.String()
+	parsed, err := dns.NewRR(text)
+	if err != nil {
+		return err
+	}
+	if parsed == nil {
+		return errors.New("empty record")
+	}
+	if parsed.String() != text {
+		return fmt.Errorf("round-trip mismatch : %q", parsed.String())
+	}
+	buf := make([]byte, dns.MaxMsgSize)
+	if _, err := dns.PackRR(rr, buf, 0, nil, false); err != nil {
+		return err
+	}
+	return nil
+}
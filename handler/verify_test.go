@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"fmt"
+	"github.com/hawell/logger"
+	"github.com/miekg/dns"
+	"testing"
+)
+
+func TestVerifyLocation(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+
+	backend := NewMemoryBackend()
+	_ = backend.SAdd("redins:zones", "verify.com.")
+	_ = backend.HSet("redins:zones:verify.com.", "@", `{
+		"ns":{"ttl":300, "records":[{"host":"ns1.verify.com"}]},
+		"mx":{"ttl":300, "records":[{"host":"mx.verify.com", "preference":10}]}
+	}`)
+	_ = backend.HSet("redins:zones:verify.com.", "bad", `{
+		"a":{"ttl":300, "records":[{"ip":"1.2.3.4"}, {"ip":"::1"}]},
+		"caa":{"ttl":300, "records":[{"tag":"issue wild", "value":"godaddy.com", "flag":0}]},
+		"tlsa":{"ttl":300, "records":[{"usage":0, "selector":0, "matching_type":1, "certificate":"not hex"}]}
+	}`)
+	config := defaultConfig
+	h := NewHandlerWithBackend(&config, backend)
+
+	results, err := h.VerifyLocation("verify.com", "@")
+	if err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+	if len(results) != 2 {
+		fmt.Println("expected 2 records, got", len(results))
+		t.Fail()
+	}
+	for _, result := range results {
+		if result.Err != nil {
+			fmt.Println("valid record", result.RR, "failed :", result.Err)
+			t.Fail()
+		}
+	}
+
+	results, err = h.VerifyLocation("verify.com.", "bad")
+	if err != nil {
+		fmt.Println(err)
+		t.FailNow()
+	}
+	failed := make(map[uint16]int)
+	for _, result := range results {
+		if result.Err != nil {
+			failed[result.RR.Header().Rrtype]++
+		}
+	}
+	expected := map[uint16]int{dns.TypeA: 1, dns.TypeCAA: 1, dns.TypeTLSA: 1}
+	for rrtype, count := range expected {
+		if failed[rrtype] != count {
+			fmt.Println(dns.TypeToString[rrtype], "failures :", failed[rrtype], "expected", count)
+			t.Fail()
+		}
+	}
+	if len(results) != 4 {
+		fmt.Println("expected 4 records, got", len(results))
+		t.Fail()
+	}
+
+	if _, err := h.VerifyLocation("verify.com.", "missing"); err == nil {
+		fmt.Println("missing location should fail")
+		t.Fail()
+	}
+	if _, err := h.VerifyLocation("unknown.com.", "@"); err == nil {
+		fmt.Println("unknown zone should fail")
+		t.Fail()
+	}
+}
@@ -0,0 +1,31 @@
+package handler
+
+import (
+	"runtime"
+
+	"github.com/miekg/dns"
+)
+
+// Version and Commit identify the running build, set at build time with
+// -ldflags "-X arvancloud/redins/handler.Version=... -X arvancloud/redins/handler.Commit=..."
+var (
+	Version = "dev"
+	Commit  = "unknown"
+)
+
+type VersionInfoConfig struct {
+	Enable bool   `json:"enable"`
+	Name   string `json:"name"`
+}
+
+// VersionInfo returns a TXT record describing running build
+func (h *DnsRequestHandler) VersionInfo(context *RequestContext) []dns.RR {
+	r := new(dns.TXT)
+	r.Hdr = dns.RR_Header{Name: context.RawName(), Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0}
+	r.Txt = []string{
+		"version=" + Version,
+		"commit=" + Commit,
+		"go=" + runtime.Version(),
+	}
+	return []dns.RR{r}
+}
@@ -1,12 +1,14 @@
 package handler
 
 import (
+	"arvancloud/redins/test"
 	"fmt"
 	"log"
 	"net"
 	"testing"
 
 	"github.com/hawell/logger"
+	"github.com/miekg/dns"
 )
 
 func TestWeight(t *testing.T) {
@@ -120,3 +122,244 @@ func TestWeight(t *testing.T) {
 		}
 	}
 }
+
+func TestWeightedMulti(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	rrset := IP_RRSet{
+		FilterConfig: IpFilterConfig{
+			Count:     "multi",
+			Order:     "weighted",
+			GeoFilter: "",
+		},
+		Ttl: 300,
+		Data: []IP_RR{
+			{Ip: net.ParseIP("1.2.3.4"), Weight: 0},
+			{Ip: net.ParseIP("2.3.4.5"), Weight: 5},
+			{Ip: net.ParseIP("3.4.5.6"), Weight: 7},
+			{Ip: net.ParseIP("4.5.6.7"), Weight: 0},
+		},
+	}
+	mask := make([]int, len(rrset.Data))
+
+	// weight 0 ips are never returned
+	for i := 0; i < 1000; i++ {
+		x := OrderIps(&rrset, mask)
+		if len(x) != 2 {
+			fmt.Println("weight 0 ips should be dropped from multi answer : ", x)
+			t.FailNow()
+		}
+		for _, ip := range x {
+			if ip.Equal(rrset.Data[0].Ip) || ip.Equal(rrset.Data[3].Ip) {
+				fmt.Println("weight 0 ip returned : ", x)
+				t.FailNow()
+			}
+		}
+	}
+	for _, x := range mask {
+		if x != IpMaskWhite {
+			fmt.Println("caller's mask changed : ", mask)
+			t.Fail()
+		}
+	}
+
+	// all zero, every ip is returned
+	for i := range rrset.Data {
+		rrset.Data[i].Weight = 0
+	}
+	if x := OrderIps(&rrset, mask); len(x) != 4 {
+		fmt.Println("all ips should be returned when all weights are 0 : ", x)
+		t.Fail()
+	}
+}
+
+func TestStickyOrder(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	h := NewHandlerWithBackend(&defaultConfig, NewMemoryBackend())
+
+	rrset := IP_RRSet{
+		FilterConfig: IpFilterConfig{
+			Count:     "single",
+			Order:     "sticky",
+			GeoFilter: "",
+		},
+		Ttl: 300,
+		Data: []IP_RR{
+			{Ip: net.ParseIP("1.2.3.4")},
+			{Ip: net.ParseIP("2.3.4.5")},
+			{Ip: net.ParseIP("3.4.5.6")},
+			{Ip: net.ParseIP("4.5.6.7")},
+		},
+	}
+
+	// same client always gets the same ip
+	client := net.ParseIP("10.1.2.3")
+	first := h.Filter("www.sticky.com.", dns.TypeA, client, &rrset)
+	for i := 0; i < 100; i++ {
+		if x := h.Filter("www.sticky.com.", dns.TypeA, client, &rrset); len(x) != 1 || !x[0].Equal(first[0]) {
+			fmt.Println("sticky answer changed : ", first, x)
+			t.Fail()
+			break
+		}
+	}
+
+	// many clients spread over all ips
+	n := make(map[string]int)
+	assigned := make(map[string]string)
+	for i := 0; i < 4000; i++ {
+		c := net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+		x := h.Filter("www.sticky.com.", dns.TypeA, c, &rrset)
+		n[x[0].String()]++
+		assigned[c.String()] = x[0].String()
+	}
+	for _, rr := range rrset.Data {
+		if n[rr.Ip.String()] < 500 {
+			fmt.Println("clients not spread : ", n)
+			t.Fail()
+			break
+		}
+	}
+
+	// removing an ip from candidates only moves its own clients
+	mask := []int{IpMaskWhite, IpMaskGrey, IpMaskWhite, IpMaskWhite}
+	for c, ip := range assigned {
+		index := stickyIndex(net.ParseIP(c), &rrset, mask)
+		if ip != "2.3.4.5" && rrset.Data[index].Ip.String() != ip {
+			fmt.Println("client moved although its ip is still available : ", c, ip, rrset.Data[index].Ip)
+			t.Fail()
+			break
+		}
+		if index == 1 {
+			fmt.Println("removed ip selected")
+			t.Fail()
+			break
+		}
+	}
+
+	// multi count starts from sticky ip
+	rrset.FilterConfig.Count = "multi"
+	if x := h.Filter("www.sticky.com.", dns.TypeA, client, &rrset); len(x) != 4 || !x[0].Equal(first[0]) {
+		fmt.Println("unexpected multi sticky answer : ", x)
+		t.Fail()
+	}
+}
+
+func TestAAAASelection(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := NewMemoryBackend()
+	_ = backend.SAdd("redins:zones", "aaaa.com.")
+	_ = backend.HSet("redins:zones:aaaa.com.", "weighted", `{"aaaa":{"ttl":300, "filter":{"count":"single","order":"weighted","geo_filter":"none"}, "records":[{"ip":"2001:db8::1", "weight":1},{"ip":"2001:db8::2", "weight":10}]}}`)
+	_ = backend.HSet("redins:zones:aaaa.com.", "rr", `{"aaaa":{"ttl":300, "filter":{"count":"multi","order":"rr","geo_filter":"none"}, "records":[{"ip":"2001:db8::1"},{"ip":"2001:db8::2"},{"ip":"2001:db8::3"}]}}`)
+	config := defaultConfig
+	config.MaxTypeAnswers = map[string]int{"aaaa": 2}
+	h := NewHandlerWithBackend(&config, backend)
+
+	query := func(qname string) []dns.RR {
+		tc := test.Case{Qname: qname, Qtype: dns.TypeAAAA}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, tc.Msg()))
+		return w.Msg.Answer
+	}
+
+	// weighted shuffle
+	n := make(map[string]int)
+	for i := 0; i < 2000; i++ {
+		answer := query("weighted.aaaa.com.")
+		if len(answer) != 1 {
+			fmt.Println("single weighted aaaa should have one answer : ", answer)
+			t.FailNow()
+		}
+		n[answer[0].(*dns.AAAA).AAAA.String()]++
+	}
+	if n["2001:db8::1"] == 0 || n["2001:db8::1"] > n["2001:db8::2"] {
+		fmt.Println("aaaa weights not applied : ", n)
+		t.Fail()
+	}
+
+	// round robin and max answers per type
+	first := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		answer := query("rr.aaaa.com.")
+		if len(answer) != 2 {
+			fmt.Println("aaaa answers should be limited to 2 : ", answer)
+			t.FailNow()
+		}
+		first[answer[0].(*dns.AAAA).AAAA.String()]++
+	}
+	if len(first) != 3 {
+		fmt.Println("aaaa round robin should rotate all ips : ", first)
+		t.Fail()
+	}
+}
+
+func TestWeightedTruncation(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	records := ""
+	for i := 1; i <= 60; i++ {
+		if i > 1 {
+			records += ","
+		}
+		records += fmt.Sprintf(`{"ip":"10.0.0.%d", "weight":%d}`, i, i)
+	}
+	backend := NewMemoryBackend()
+	_ = backend.SAdd("redins:zones", "trim.com.")
+	_ = backend.HSet("redins:zones:trim.com.", "www", `{"a":{"ttl":300, "filter":{"count":"multi","order":"weighted","geo_filter":"none"}, "records":[`+records+`]}}`)
+	h := NewHandlerWithBackend(&defaultConfig, backend)
+
+	for i := 0; i < 20; i++ {
+		tc := test.Case{Qname: "www.trim.com.", Qtype: dns.TypeA}
+		r := tc.Msg()
+		r.SetEdns0(512, false)
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, r))
+		resp := w.Msg
+		if !resp.Truncated || len(resp.Answer) < 2 || len(resp.Answer) >= 60 {
+			fmt.Println("answer should be truncated to client's buffer : ", len(resp.Answer), resp.Truncated)
+			t.FailNow()
+		}
+		// first ip is the weighted pick, rest should be the highest weights in decreasing order
+		pick := int(resp.Answer[0].(*dns.A).A.To4()[3])
+		weight := 60
+		for _, rr := range resp.Answer[1:] {
+			if weight == pick {
+				weight--
+			}
+			if int(rr.(*dns.A).A.To4()[3]) != weight {
+				fmt.Println("lower weight ip kept before higher weight ones : ", resp.Answer)
+				t.FailNow()
+			}
+			weight--
+		}
+	}
+}
+
+func TestZoneIpOrder(t *testing.T) {
+	logger.Default = logger.NewLogger(&logger.LogConfig{}, nil)
+	backend := NewMemoryBackend()
+	_ = backend.SAdd("redins:zones", "order.com.")
+	_ = backend.Set("redins:zones:order.com.:config", `{"ip_order":"weighted"}`)
+	_ = backend.HSet("redins:zones:order.com.", "www", `{"a":{"ttl":300, "records":[{"ip":"1.2.3.4", "weight":0},{"ip":"2.3.4.5", "weight":1}]}}`)
+	_ = backend.HSet("redins:zones:order.com.", "fixed", `{"a":{"ttl":300, "filter":{"count":"multi","order":"none"}, "records":[{"ip":"1.2.3.4", "weight":0},{"ip":"2.3.4.5", "weight":1}]}}`)
+	h := NewHandlerWithBackend(&defaultConfig, backend)
+
+	query := func(qname string) string {
+		tc := test.Case{Qname: qname, Qtype: dns.TypeA}
+		w := test.NewRecorder(&test.ResponseWriter{})
+		h.HandleRequest(NewRequestContext(w, tc.Msg()))
+		if len(w.Msg.Answer) == 0 {
+			return ""
+		}
+		return w.Msg.Answer[0].(*dns.A).A.String()
+	}
+	for i := 0; i < 100; i++ {
+		if ip := query("www.order.com."); ip != "2.3.4.5" {
+			fmt.Println("zone ip_order should apply to rrsets without order : ", ip)
+			t.Fail()
+			break
+		}
+		if ip := query("fixed.order.com."); ip != "1.2.3.4" {
+			fmt.Println("rrset order should override zone ip_order : ", ip)
+			t.Fail()
+			break
+		}
+	}
+}
@@ -5,24 +5,55 @@ import (
 	jsoniter "github.com/json-iterator/go"
 	"github.com/miekg/dns"
 	"strings"
-	"time"
+	"sync"
+	"sync/atomic"
 )
 
 type Zone struct {
 	Name         string
 	Config       ZoneConfig
 	Locations    map[string]struct{}
+	probe        func(label string) bool
+	deepWildcard bool
+	logCount     uint64 // requests counted by sampleLog, accessed atomically
 	ZSK          *ZoneKey
 	KSK          *ZoneKey
+	// ExtraZSKs are zsks in DNSKEY set not used for signing, during a zsk rollover
+	ExtraZSKs    []*dns.DNSKEY
 	DnsKeySig    dns.RR
 	CacheTimeout int64
+	// delegation checks of findDelegation, kept until zone is reloaded
+	delegations       sync.Map // location -> bool
+	cachedDelegations int32
+	// names with no location of their own but locations below them, e.g. "b" for "a.b"
+	emptyNonTerminals map[string]struct{}
 }
 
 type ZoneConfig struct {
-	DomainId        string     `json:"domain_id,omitempty"`
-	SOA             *SOA_RRSet `json:"soa,omitempty"`
-	DnsSec          bool       `json:"dnssec,omitempty"`
-	CnameFlattening bool       `json:"cname_flattening,omitempty"`
+	DomainId         string       `json:"domain_id,omitempty"`
+	SOA              *SOA_RRSet   `json:"soa,omitempty"`
+	DnsSec           bool         `json:"dnssec,omitempty"`
+	CnameFlattening  bool         `json:"cname_flattening,omitempty"`
+	BlockCountries   []string     `json:"block_countries,omitempty"`
+	DefaultTtl       uint32       `json:"default_ttl,omitempty"`
+	ResponseDelay    int          `json:"response_delay,omitempty"`
+	Nsec3            *Nsec3Params `json:"nsec3,omitempty"`
+	SoaMbox          string       `json:"soa_mbox,omitempty"`
+	DisableGeoIp     bool         `json:"disable_geoip,omitempty"`
+	DisableHealth    bool         `json:"disable_healthcheck,omitempty"`
+	ZskRollover      *ZskRollover `json:"zsk_rollover,omitempty"`
+	LogSampling      uint64       `json:"log_sampling,omitempty"`
+	NxDomainRcode    string       `json:"nxdomain_rcode,omitempty"`
+	NoDataRcode      string       `json:"nodata_rcode,omitempty"`
+	ParseErrorRcode  string       `json:"parse_error_rcode,omitempty"`
+	WildcardTemplate bool         `json:"wildcard_template,omitempty"`
+	IpOrder          string       `json:"ip_order,omitempty"` // default order of a and aaaa rrsets without one, rrset order wins
+}
+
+// Nsec3Params enables nsec3 denial of existence with given hash iterations and hex encoded salt
+type Nsec3Params struct {
+	Iterations uint16 `json:"iterations"`
+	Salt       string `json:"salt"`
 }
 
 func NewZone(name string, locations []string, config string) *Zone {
@@ -32,20 +63,20 @@ func NewZone(name string, locations []string, config string) *Zone {
 	for _, val := range locations {
 		z.Locations[val] = struct{}{}
 	}
+	z.emptyNonTerminals = make(map[string]struct{})
+	for val := range z.Locations {
+		for i := strings.Index(val, "."); i != -1; i = strings.Index(val, ".") {
+			val = val[i+1:]
+			if _, ok := z.Locations[val]; !ok {
+				z.emptyNonTerminals[val] = struct{}{}
+			}
+		}
+	}
 
 	z.Config = ZoneConfig{
 		DnsSec:          false,
 		CnameFlattening: false,
-		SOA: &SOA_RRSet{
-			Ns:      "ns1." + z.Name,
-			MinTtl:  300,
-			Refresh: 86400,
-			Retry:   7200,
-			Expire:  3600,
-			MBox:    "hostmaster." + z.Name,
-			Serial:  uint32(time.Now().Unix()),
-			Ttl:     300,
-		},
+		SOA:             &SOA_RRSet{},
 	}
 	if len(config) > 0 {
 		err := jsoniter.Unmarshal([]byte(config), &z.Config)
@@ -53,7 +84,13 @@ func NewZone(name string, locations []string, config string) *Zone {
 			logger.Default.Errorf("cannot parse zone config : %s", err)
 		}
 	}
-	z.Config.SOA.Ns = dns.Fqdn(z.Config.SOA.Ns)
+	if z.Config.SOA == nil {
+		z.Config.SOA = &SOA_RRSet{}
+	}
+	if z.Config.SoaMbox != "" {
+		z.Config.SOA.MBox = emailToMbox(z.Config.SoaMbox)
+	}
+	z.Config.SOA.setDefaults(z.Name)
 	z.Config.SOA.Data = &dns.SOA{
 		Hdr:     dns.RR_Header{Name: z.Name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: z.Config.SOA.Ttl, Rdlength: 0},
 		Ns:      z.Config.SOA.Ns,
@@ -67,10 +104,48 @@ func NewZone(name string, locations []string, config string) *Zone {
 	return z
 }
 
+// emailToMbox converts an email address to soa mailbox name, dots in local part are escaped
+func emailToMbox(email string) string {
+	i := strings.LastIndex(email, "@")
+	if i == -1 {
+		return dns.Fqdn(email)
+	}
+	return dns.Fqdn(strings.ReplaceAll(email[:i], ".", "\\.") + "." + email[i+1:])
+}
+
+// setDefaults fills missing or zero soa fields so emitted soa is always valid
+func (soa *SOA_RRSet) setDefaults(zone string) {
+	if soa.Ns == "" {
+		soa.Ns = "ns1." + zone
+	}
+	if soa.MBox == "" {
+		soa.MBox = "hostmaster." + zone
+	}
+	soa.Ns = dns.Fqdn(soa.Ns)
+	soa.MBox = dns.Fqdn(soa.MBox)
+	if soa.Ttl == 0 {
+		soa.Ttl = 300
+	}
+	if soa.Refresh == 0 {
+		soa.Refresh = 86400
+	}
+	if soa.Retry == 0 {
+		soa.Retry = 7200
+	}
+	if soa.Expire == 0 {
+		soa.Expire = 3600
+	}
+	if soa.MinTtl == 0 {
+		soa.MinTtl = 300
+	}
+}
+
 const (
 	ExactMatch = iota
 	WildCardMatch
 	NoMatch
+	// EmptyNonTerminalMatch is an existing name without records, with locations below it
+	EmptyNonTerminalMatch
 )
 
 func (z *Zone) FindLocation(query string) (string, int) {
@@ -87,11 +162,26 @@ func (z *Zone) FindLocation(query string) (string, int) {
 
 	query = strings.TrimSuffix(query, "."+z.Name)
 
-	if _, ok = z.Locations[query]; ok {
+	if z.keyExists(query) {
 		return query, ExactMatch
 	}
 
 	closestEncloser, sourceOfSynthesis, ok = splitQuery(query)
+	if z.deepWildcard {
+		// non-standard: most specific wildcard matches regardless of existing closer names
+		for ok {
+			if z.keyExists(sourceOfSynthesis) {
+				return sourceOfSynthesis, WildCardMatch
+			}
+			closestEncloser, sourceOfSynthesis, ok = splitQuery(closestEncloser)
+		}
+		return "", NoMatch
+	}
+	// names existing only because of names below them are not covered by wildcards (rfc4592)
+	if z.isEmptyNonTerminal(query) {
+		return query, EmptyNonTerminalMatch
+	}
+
 	for ok {
 		ceExists := z.keyMatches(closestEncloser) || z.keyExists(closestEncloser)
 		ssExists := z.keyExists(sourceOfSynthesis)
@@ -109,17 +199,41 @@ func (z *Zone) FindLocation(query string) (string, int) {
 }
 
 func (z *Zone) keyExists(key string) bool {
+	if z.probe != nil {
+		return z.probe(key)
+	}
 	_, ok := z.Locations[key]
 	return ok
 }
 
+// maxCachedDelegations bounds delegation checks cached per zone, qnames are chosen by clients
+const maxCachedDelegations = 10000
+
+// isDelegation reports whether location is a delegation point, check is only run once per location
+func (z *Zone) isDelegation(location string, check func() bool) bool {
+	if cut, ok := z.delegations.Load(location); ok {
+		return cut.(bool)
+	}
+	cut := check()
+	if atomic.LoadInt32(&z.cachedDelegations) < maxCachedDelegations {
+		atomic.AddInt32(&z.cachedDelegations, 1)
+		z.delegations.Store(location, cut)
+	}
+	return cut
+}
+
 func (z *Zone) keyMatches(key string) bool {
-	for value := range z.Locations {
-		if strings.HasSuffix(value, key) {
-			return true
-		}
+	// zone apex always exists, in probe mode empty non-terminals are not known
+	return key == "" || z.isEmptyNonTerminal(key)
+}
+
+func (z *Zone) isEmptyNonTerminal(key string) bool {
+	if z.probe != nil {
+		// empty non-terminals cannot be found without loading all keys
+		return false
 	}
-	return false
+	_, ok := z.emptyNonTerminals[key]
+	return ok
 }
 
 func splitQuery(query string) (string, string, bool) {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"errors"
 	"flag"
 	"fmt"
@@ -14,6 +15,7 @@ import (
 	"log/syslog"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"strconv"
@@ -25,23 +27,34 @@ import (
 	"github.com/hawell/logger"
 	"github.com/hawell/uperdis"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	_ "net/http/pprof"
 )
 
 var (
-	s          []dns.Server
+	s          []*handler.Server
 	h          *handler.DnsRequestHandler
 	l          *handler.RateLimiter
+	d          *handler.DropMonitor
 	configFile string
 )
 
 func handleRequest(w dns.ResponseWriter, r *dns.Msg) {
+	if d.RejectInvalid(w, r) {
+		return
+	}
 	context := handler.NewRequestContext(w, r)
 	// logger.Default.Debugf("handle request: [%d] %s %s", r.Id, context.RawName(), context.Type())
 
 	if l.CanHandle(context.IP()) {
 		h.HandleRequest(context)
 	} else {
+		if l.Denied(context.IP()) {
+			d.Drop(handler.DropDenied, context.IP(), r)
+		} else {
+			d.Drop(handler.DropRateLimit, context.IP(), r)
+		}
+		context.ErrorText = "rate limit exceeded"
 		context.Response(dns.RcodeRefused)
 	}
 }
@@ -51,15 +64,18 @@ type RedinsConfig struct {
 	ErrorLog  logger.LogConfig                `json:"error_log"`
 	Handler   handler.DnsRequestHandlerConfig `json:"handler"`
 	RateLimit handler.RateLimiterConfig       `json:"ratelimit"`
+	DropLog   handler.DropLogConfig           `json:"drop_log"`
 }
 
 var redinsDefaultConfig = &RedinsConfig{
 	Server: []handler.ServerConfig{
 		{
-			Ip:       "127.0.0.1",
-			Port:     1053,
-			Protocol: "udp",
-			Count:    1,
+			Ip:             "127.0.0.1",
+			Port:           1053,
+			Protocol:       "udp",
+			Count:          1,
+			IdleTimeout:    8000,
+			MaxConnections: 0,
 			Tls: handler.TlsConfig{
 				Enable:   false,
 				CertPath: "",
@@ -78,9 +94,10 @@ var redinsDefaultConfig = &RedinsConfig{
 			},
 		},
 		GeoIp: handler.GeoIpConfig{
-			Enable:    false,
-			CountryDB: "geoCity.mmdb",
-			ASNDB:     "geoIsp.mmdb",
+			Enable:          false,
+			CountryDB:       "geoCity.mmdb",
+			ASNDB:           "geoIsp.mmdb",
+			RefreshInterval: 0,
 		},
 		HealthCheck: handler.HealthcheckConfig{
 			Enable:             false,
@@ -88,6 +105,17 @@ var redinsDefaultConfig = &RedinsConfig{
 			MaxPendingRequests: 100,
 			UpdateInterval:     600,
 			CheckInterval:      600,
+			StatusTtl:          0,
+			MissingStatus:      "neutral",
+			AllDownAction:      "serve",
+			SinkholeA:          "",
+			SinkholeAAAA:       "",
+			Mode:               "probe",
+			Import: handler.HealthImportConfig{
+				Url:      "",
+				Interval: 600,
+				Timeout:  1000,
+			},
 			RedisStatusServer: uperdis.RedisConfig{
 				Address:  "127.0.0.1:6379",
 				Net:      "tcp",
@@ -132,10 +160,57 @@ var redinsDefaultConfig = &RedinsConfig{
 				},
 			},
 		},
+		Blocklist: handler.BlocklistConfig{
+			Enable:       false,
+			File:         "",
+			Action:       "nxdomain",
+			SinkholeA:    "",
+			SinkholeAAAA: "",
+			Ttl:          300,
+			Reload:       600,
+		},
 		MaxTtl:            3600,
 		CacheTimeout:      60,
 		ZoneReload:        600,
 		LogSourceLocation: false,
+		LogZones:          []string{},
+		PreloadZones:      false,
+		PreloadWorkers:    10,
+		StableOrder:       false,
+		MaxCnameChain:     8,
+		UdpPartialAnswers: false,
+		MaxZoneLocations:  0,
+		LocationLookup:    "full",
+		MultiWildcard:     false,
+		ResponseDelay:     0,
+		BackendMetrics:    true,
+		MaxAnswers:        0,
+		MaxTypeAnswers:    map[string]int{},
+		SpecialNames:      false,
+		AnyUdpTruncate:    false,
+		UdpZoneByteRate:   0,
+		QueryTags:         map[string][]string{},
+		MaxTxtRecords:     0,
+		MaxTxtSize:        0,
+		TxtLimitAction:    "warn",
+		DuplicateRecords:  "merge",
+		MetaLabel:         "",
+		ParseErrorRcode:   "servfail",
+		NxDomainRcode:     "nxdomain",
+		NoDataRcode:       "noerror",
+		EdnsOptions:       []uint16{},
+		EchoEdnsOptions:   false,
+		HealthManagedTtl:  0,
+		ZskRolloverCheck:  0,
+		Rewrite:           map[string]string{},
+		NsHints:           map[string][]string{},
+		AddressHints:      false,
+		NeverEmpty:        true,
+		NotReadyAction:    "servfail",
+		SoaSerialPublic:   0,
+		SerialFormat:      "unix",
+		SoaSerial:         "",
+		Backend:           "redis",
 		Redis: uperdis.RedisConfig{
 			Address:  "127.0.0.1:6379",
 			Net:      "tcp",
@@ -153,6 +228,18 @@ var redinsDefaultConfig = &RedinsConfig{
 				WaitForConnection:    false,
 			},
 		},
+		Memory: handler.MemoryBackendConfig{
+			ZonesFile: "",
+		},
+		Debug: handler.DebugConfig{
+			Enable:      false,
+			CountryName: "country.redins.",
+		},
+		VersionInfo: handler.VersionInfoConfig{
+			Enable: false,
+			Name:   "version.redins.",
+		},
+		AdminToken: "",
 		Log: logger.LogConfig{
 			Enable:     true,
 			Target:     "file",
@@ -213,6 +300,9 @@ var redinsDefaultConfig = &RedinsConfig{
 		BlackList: []string{},
 		WhiteList: []string{},
 	},
+	DropLog: handler.DropLogConfig{
+		SampleRate: 0,
+	},
 }
 
 func LoadConfig(path string) (*RedinsConfig, error) {
@@ -231,6 +321,10 @@ func LoadConfig(path string) (*RedinsConfig, error) {
 		log.Printf("[INFO] loading default config")
 		return config, err
 	}
+	if err := config.Handler.ApplySoaSerial(); err != nil {
+		log.Printf("[ERROR] %s", err)
+		return config, err
+	}
 	return config, nil
 }
 
@@ -246,9 +340,14 @@ func Start() {
 
 	logger.Default.Info("starting handler...")
 	h = handler.NewHandler(&cfg.Handler)
+	if err := handler.CheckSerialFormat(cfg.Handler.SerialFormat, h.Backend); err != nil {
+		logger.Default.Error(err)
+		os.Exit(1)
+	}
 	logger.Default.Info("handler started")
 
 	l = handler.NewRateLimiter(&cfg.RateLimit)
+	d = handler.NewDropMonitor(&cfg.DropLog)
 
 	dns.HandleFunc(".", handleRequest)
 
@@ -507,7 +606,16 @@ func Verify(configFile string) {
 		}
 		printResult(msg, err)
 	}
-	checkRedis(&config.Handler.Redis)
+	for _, conflict := range config.Handler.ProbeConflicts() {
+		printWarning("checking location lookup", conflict)
+	}
+	if config.Handler.Backend == "memory" {
+		fmt.Println("checking memory backend...")
+		_, err := handler.NewMemoryBackendFromConfig(&config.Handler.Memory)
+		printResult(fmt.Sprintf("checking zones file : %s", config.Handler.Memory.ZonesFile), err)
+	} else {
+		checkRedis(&config.Handler.Redis)
+	}
 	if config.Handler.GeoIp.Enable {
 		fmt.Println("checking geoip...")
 		var countryRecord struct {
@@ -523,14 +631,18 @@ func Verify(configFile string) {
 			AutonomousSystemNumber uint `maxminddb:"autonomous_system_number"`
 		}
 		records := []interface{}{countryRecord, asnRecord}
+		checksums := []string{config.Handler.GeoIp.CountryDBSha256, config.Handler.GeoIp.ASNDBSha256}
 		for i, dbFile := range []string{config.Handler.GeoIp.CountryDB, config.Handler.GeoIp.ASNDB} {
-			msg = fmt.Sprintf("checking file stat : %s", dbFile)
-			_, err = os.Stat(dbFile)
-			printResult(msg, err)
+			err = nil
+			if !strings.HasPrefix(dbFile, "http://") && !strings.HasPrefix(dbFile, "https://") {
+				msg = fmt.Sprintf("checking file stat : %s", dbFile)
+				_, err = os.Stat(dbFile)
+				printResult(msg, err)
+			}
 			if err == nil {
 				msg = fmt.Sprintf("checking db : %s", dbFile)
 				var db *maxminddb.Reader
-				db, err = maxminddb.Open(dbFile)
+				db, err = handler.OpenGeoIpDB(dbFile, checksums[i])
 				printResult(msg, err)
 				if err == nil {
 					msg = fmt.Sprintf("checking db query results")
@@ -548,11 +660,146 @@ func Verify(configFile string) {
 	}
 }
 
+// VerifyLocation builds records of a location and reports those not producing valid dns records
+func VerifyLocation(args []string) {
+	ok := aurora.Bold(aurora.Green("[ OK ]"))
+	fail := aurora.Bold(aurora.Red("[FAIL]"))
+
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	configPtr := flags.String("c", "config.json", "path to config file")
+	zonePtr := flags.String("zone", "", "zone name")
+	locationPtr := flags.String("location", "@", "location label")
+	_ = flags.Parse(args)
+
+	cfg, _ := LoadConfig(*configPtr)
+	logger.Default = logger.NewLogger(&cfg.ErrorLog, nil)
+	cfg.Handler.HealthCheck.Enable = false
+	cfg.Handler.PreloadZones = false
+	vh := handler.NewHandler(&cfg.Handler)
+
+	results, err := vh.VerifyLocation(*zonePtr, *locationPtr)
+	if err != nil {
+		fmt.Printf("%-60s%s : %s\n", fmt.Sprintf("loading %s.%s", *locationPtr, *zonePtr), fail, err)
+		os.Exit(1)
+	}
+	failed := false
+	for _, result := range results {
+		if result.Err == nil {
+			fmt.Printf("%-60s%s\n", result.RR.String(), ok)
+		} else {
+			fmt.Printf("%-60s%s : %s\n", result.RR.String(), fail, result.Err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// Diff compares live zone records against a reference zone file, exits with 1 if they differ and 2 on errors
+func Diff(args []string) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	configPtr := flags.String("c", "config.json", "path to config file")
+	zonePtr := flags.String("zone", "", "zone name")
+	againstPtr := flags.String("against", "", "reference zone file")
+	_ = flags.Parse(args)
+
+	cfg, _ := LoadConfig(*configPtr)
+	logger.Default = logger.NewLogger(&cfg.ErrorLog, nil)
+	cfg.Handler.HealthCheck.Enable = false
+	cfg.Handler.PreloadZones = false
+	dh := handler.NewHandler(&cfg.Handler)
+
+	live, err := dh.ExportZone(*zonePtr)
+	if err != nil {
+		fmt.Printf("cannot export zone %s : %s\n", *zonePtr, err)
+		os.Exit(2)
+	}
+	file, err := os.Open(*againstPtr)
+	if err != nil {
+		fmt.Printf("cannot open zone file %s : %s\n", *againstPtr, err)
+		os.Exit(2)
+	}
+	reference, err := handler.ParseZoneFile(file, *zonePtr, *againstPtr)
+	_ = file.Close()
+	if err != nil {
+		fmt.Printf("cannot parse zone file %s : %s\n", *againstPtr, err)
+		os.Exit(2)
+	}
+
+	diffs := handler.DiffZone(live, reference)
+	for _, diff := range diffs {
+		switch diff.Change {
+		case handler.DiffAdded:
+			fmt.Println(aurora.Green("+ " + diff.RR.String()))
+		case handler.DiffRemoved:
+			fmt.Println(aurora.Red("- " + diff.Reference.String()))
+		case handler.DiffChanged:
+			fmt.Println(aurora.Yellow("~ " + diff.Reference.String() + " => " + diff.RR.String()))
+		}
+	}
+	if len(diffs) != 0 {
+		os.Exit(1)
+	}
+}
+
+// Tail prints live queries streamed from a running server
+func Tail(args []string) {
+	flags := flag.NewFlagSet("tail", flag.ExitOnError)
+	addressPtr := flags.String("address", "localhost:6060", "api address of running server")
+	qnamePtr := flags.String("qname", "", "only show queries for this name and its subdomains")
+	clientPtr := flags.String("client", "", "only show queries from this client ip or subnet")
+	tokenPtr := flags.String("token", "", "admin token of running server")
+	_ = flags.Parse(args)
+
+	query := url.Values{}
+	if *qnamePtr != "" {
+		query.Set("qname", *qnamePtr)
+	}
+	if *clientPtr != "" {
+		query.Set("client", *clientPtr)
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://"+*addressPtr+"/queries?"+query.Encode(), nil)
+	if err != nil {
+		fmt.Println("invalid address : ", err)
+		os.Exit(1)
+	}
+	req.Header.Set("Authorization", "Bearer "+*tokenPtr)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Println("cannot connect to server : ", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		fmt.Printf("server returned %s : %s", resp.Status, body)
+		os.Exit(1)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		fmt.Println(scanner.Text())
+	}
+}
+
 func main() {
 	configPtr := flag.String("c", "config.json", "path to config file")
 	verifyPtr := flag.Bool("t", false, "verify configuration")
 	generateConfigPtr := flag.String("g", "template-config.json", "generate template config file")
 
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		VerifyLocation(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		Diff(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "tail" {
+		Tail(os.Args[2:])
+		return
+	}
+
 	flag.Parse()
 	flagset := make(map[string]bool)
 	flag.Visit(func(f *flag.Flag) { flagset[f.Name] = true })
@@ -577,6 +824,16 @@ func main() {
 
 	Start()
 
+	http.HandleFunc("/queries", func(w http.ResponseWriter, r *http.Request) {
+		h.ServeQueryStream(w, r)
+	})
+	http.HandleFunc("/cache/flush", func(w http.ResponseWriter, r *http.Request) {
+		h.ServeCacheFlush(w, r)
+	})
+	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		h.ServeReady(w, r)
+	})
+	http.Handle("/metrics", promhttp.Handler())
 	// TODO: this should be part of a general api
 	go func() {
 		log.Println(http.ListenAndServe("localhost:6060", nil))
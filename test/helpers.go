@@ -105,6 +105,27 @@ func CAA(rr string) *dns.CAA { r, _ := dns.NewRR(rr); return r.(*dns.CAA) }
 // TLSA returns a TLSA record from rr. It panics on errors.
 func TLSA(rr string) *dns.TLSA { r, _ := dns.NewRR(rr); return r.(*dns.TLSA) }
 
+// NID returns a NID record from rr. It panics on errors.
+func NID(rr string) *dns.NID { r, _ := dns.NewRR(rr); return r.(*dns.NID) }
+
+// L32 returns a L32 record from rr. It panics on errors.
+func L32(rr string) *dns.L32 { r, _ := dns.NewRR(rr); return r.(*dns.L32) }
+
+// L64 returns a L64 record from rr. It panics on errors.
+func L64(rr string) *dns.L64 { r, _ := dns.NewRR(rr); return r.(*dns.L64) }
+
+// LP returns a LP record from rr. It panics on errors.
+func LP(rr string) *dns.LP { r, _ := dns.NewRR(rr); return r.(*dns.LP) }
+
+// URI returns a URI record from rr. It panics on errors.
+func URI(rr string) *dns.URI { r, _ := dns.NewRR(rr); return r.(*dns.URI) }
+
+// OPENPGPKEY returns an OPENPGPKEY record from rr. It panics on errors.
+func OPENPGPKEY(rr string) *dns.OPENPGPKEY { r, _ := dns.NewRR(rr); return r.(*dns.OPENPGPKEY) }
+
+// SMIMEA returns a SMIMEA record from rr. It panics on errors.
+func SMIMEA(rr string) *dns.SMIMEA { r, _ := dns.NewRR(rr); return r.(*dns.SMIMEA) }
+
 // OPT returns an OPT record with UDP buffer size set to bufsize and the DO bit set to do.
 func OPT(bufsize int, do bool) *dns.OPT {
 	o := new(dns.OPT)
@@ -218,6 +239,13 @@ func Section(tc Case, sec sect, rr []dns.RR) error {
 			if x.Ns != tt.Ns {
 				return fmt.Errorf("SOA nameserver should be %q, but is %q", tt.Ns, x.Ns)
 			}
+			if x.Mbox != tt.Mbox {
+				return fmt.Errorf("SOA mbox should be %q, but is %q", tt.Mbox, x.Mbox)
+			}
+			if x.Refresh != tt.Refresh || x.Retry != tt.Retry || x.Expire != tt.Expire || x.Minttl != tt.Minttl {
+				return fmt.Errorf("SOA timers should be %d %d %d %d, but are %d %d %d %d",
+					tt.Refresh, tt.Retry, tt.Expire, tt.Minttl, x.Refresh, x.Retry, x.Expire, x.Minttl)
+			}
 		case *dns.PTR:
 			tt := section[i].(*dns.PTR)
 			if x.Ptr != tt.Ptr {
@@ -234,7 +262,7 @@ func Section(tc Case, sec sect, rr []dns.RR) error {
 				return fmt.Errorf("MX Mx should be %q, but is %q", tt.Mx, x.Mx)
 			}
 			if x.Preference != tt.Preference {
-				return fmt.Errorf("MX Preference should be %q, but is %q", tt.Preference, x.Preference)
+				return fmt.Errorf("MX Preference should be %d, but is %d", tt.Preference, x.Preference)
 			}
 		case *dns.NS:
 			tt := section[i].(*dns.NS)
@@ -274,6 +302,63 @@ func Section(tc Case, sec sect, rr []dns.RR) error {
 			if x.Certificate != tt.Certificate {
 				return fmt.Errorf("TLSA Certificate should be %s, but is %s", tt.Certificate, x.Certificate)
 			}
+		case *dns.NID:
+			tt := section[i].(*dns.NID)
+			if x.Preference != tt.Preference {
+				return fmt.Errorf("NID Preference should be %d, but is %d", tt.Preference, x.Preference)
+			}
+			if x.NodeID != tt.NodeID {
+				return fmt.Errorf("NID NodeID should be %x, but is %x", tt.NodeID, x.NodeID)
+			}
+		case *dns.L32:
+			tt := section[i].(*dns.L32)
+			if x.Preference != tt.Preference {
+				return fmt.Errorf("L32 Preference should be %d, but is %d", tt.Preference, x.Preference)
+			}
+			if !x.Locator32.Equal(tt.Locator32) {
+				return fmt.Errorf("L32 Locator32 should be %s, but is %s", tt.Locator32, x.Locator32)
+			}
+		case *dns.L64:
+			tt := section[i].(*dns.L64)
+			if x.Preference != tt.Preference {
+				return fmt.Errorf("L64 Preference should be %d, but is %d", tt.Preference, x.Preference)
+			}
+			if x.Locator64 != tt.Locator64 {
+				return fmt.Errorf("L64 Locator64 should be %x, but is %x", tt.Locator64, x.Locator64)
+			}
+		case *dns.LP:
+			tt := section[i].(*dns.LP)
+			if x.Preference != tt.Preference {
+				return fmt.Errorf("LP Preference should be %d, but is %d", tt.Preference, x.Preference)
+			}
+			if x.Fqdn != tt.Fqdn {
+				return fmt.Errorf("LP Fqdn should be %s, but is %s", tt.Fqdn, x.Fqdn)
+			}
+		case *dns.URI:
+			tt := section[i].(*dns.URI)
+			if x.Priority != tt.Priority {
+				return fmt.Errorf("URI Priority should be %d, but is %d", tt.Priority, x.Priority)
+			}
+			if x.Weight != tt.Weight {
+				return fmt.Errorf("URI Weight should be %d, but is %d", tt.Weight, x.Weight)
+			}
+			if x.Target != tt.Target {
+				return fmt.Errorf("URI Target should be %q, but is %q", tt.Target, x.Target)
+			}
+		case *dns.OPENPGPKEY:
+			tt := section[i].(*dns.OPENPGPKEY)
+			if x.PublicKey != tt.PublicKey {
+				return fmt.Errorf("OPENPGPKEY PublicKey should be %s, but is %s", tt.PublicKey, x.PublicKey)
+			}
+		case *dns.SMIMEA:
+			tt := section[i].(*dns.SMIMEA)
+			if x.Usage != tt.Usage || x.Selector != tt.Selector || x.MatchingType != tt.MatchingType {
+				return fmt.Errorf("SMIMEA should be %d %d %d, but is %d %d %d",
+					tt.Usage, tt.Selector, tt.MatchingType, x.Usage, x.Selector, x.MatchingType)
+			}
+			if x.Certificate != tt.Certificate {
+				return fmt.Errorf("SMIMEA Certificate should be %s, but is %s", tt.Certificate, x.Certificate)
+			}
 		}
 	}
 	return nil